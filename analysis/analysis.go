@@ -0,0 +1,147 @@
+// Package analysis checks traced modules for problems that are not errors, like an input of a pipe that is never
+// used. It works like golang.org/x/tools/go/analysis: an Analyzer checks for one kind of problem, and is run on a
+// module with a Pass that describes the module and collects the problems it reports.
+//
+// The analyzers run by `hoser check` are the ones registered with Register, so a team can add its own rules:
+//
+//	var NoPrint = &analysis.Analyzer{
+//		Name: "no-print",
+//		Doc:  "no-print reports calls of Print, which should use a logger instead.",
+//		Run: func(pass *analysis.Pass) error {
+//			for _, pipe := range pass.Pipes() {
+//				for _, block := range pipe.BodyDAG.Blocks {
+//					if stub, ok := block.(*ast.StubBlock); ok && stub.Decl.BlockName() == "Print" {
+//						pass.Reportf(block.CreatedBy(), "use the logger rather than Print")
+//					}
+//				}
+//			}
+//			return nil
+//		},
+//	}
+//
+//	func init() { analysis.Register(NoPrint) }
+package analysis
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// Analyzer checks a traced module for one kind of problem.
+type Analyzer struct {
+	// Name identifies the analyzer on the command line and is the Code of the problems it reports unless they have
+	// their own, e.g. "unused-port".
+	Name string
+	// Doc describes what the analyzer reports. The first sentence is a summary shown in the usage of hoser check.
+	Doc string
+	// Flags configure the analyzer, they are given to hoser check prefixed with the name of the analyzer, e.g.
+	// -fan-out.max=8.
+	Flags flag.FlagSet
+	// Run checks the module of pass and reports the problems it finds with pass.Report. An error stops every
+	// analyzer from running and means that the module could not be checked, not that it has problems.
+	Run func(pass *Pass) error
+}
+
+func (a *Analyzer) String() string { return a.Name }
+
+// Pass is a module that has been traced without errors, which an analyzer is run on.
+type Pass struct {
+	Analyzer *Analyzer   // the analyzer being run
+	File     *token.File // file the module was parsed from
+
+	// Module is the module being checked. Every pipe has been traced, so its BodyDAG is set and the types of its
+	// ports are known.
+	Module *ast.Module
+	// Modules is every module loaded while tracing Module, including the modules it imports.
+	Modules *ast.ModuleSet
+	// Refs maps each identifier of Module to what it refers to, see tracer.Refs.
+	Refs map[*ast.Ident]ast.Node
+	// Implemented reports whether the stub called name in module has an implementation that can be run. It is nil
+	// if the implementations are not known.
+	Implemented func(module, name string) bool
+
+	report func(*token.Error)
+}
+
+// Report reports a problem. Its Code is set to the name of the analyzer if it has none.
+func (p *Pass) Report(err *token.Error) {
+	if err.Code == "" {
+		err.Code = p.Analyzer.Name
+	}
+	p.report(err)
+}
+
+// Reportf reports a warning at node and returns it so related positions and fixes can be added to it.
+func (p *Pass) Reportf(node ast.Node, format string, args ...interface{}) *token.Error {
+	err := &token.Error{Pos: p.File.Position(node.Pos()), Msg: fmt.Errorf(format, args...), Severity: token.SeverityWarning}
+	p.Report(err)
+	return err
+}
+
+// Pipes returns every traced pipe of the module in the order they are declared, followed by the pipe literals in
+// their bodies. The implicit main pipe of a script is included.
+func (p *Pass) Pipes() []*ast.PipeDecl {
+	var pipes []*ast.PipeDecl
+	for _, decl := range p.Module.DefinedBlocks {
+		if pipe, ok := decl.(*ast.PipeDecl); ok && pipe.BodyDAG != nil {
+			pipes = append(pipes, pipe)
+		}
+	}
+	for i := 0; i < len(pipes); i++ {
+		for _, block := range pipes[i].BodyDAG.Blocks {
+			if ref, ok := block.(*ast.PipeRefBlock); ok {
+				if lit, ok := ref.CreatedBy().(*ast.PipeLit); ok && lit.Decl.BodyDAG != nil {
+					pipes = append(pipes, lit.Decl)
+				}
+			}
+		}
+	}
+	return pipes
+}
+
+// Run runs each analyzer on the module of pass and returns the problems they report, sorted by position.
+func Run(pass *Pass, analyzers ...*Analyzer) (token.ErrorList, error) {
+	var problems token.ErrorList
+	for _, a := range analyzers {
+		p := *pass
+		p.Analyzer = a
+		p.report = func(err *token.Error) { problems = append(problems, err) }
+		if err := a.Run(&p); err != nil {
+			return nil, fmt.Errorf("%v: %v", a.Name, err)
+		}
+	}
+	problems.Sort()
+	return problems, nil
+}
+
+var (
+	registry  = make(map[string]*Analyzer)
+	validName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+)
+
+// Register makes an analyzer available to hoser check. It panics if the name of the analyzer is not made of lower
+// case words separated by dashes or is already registered.
+func Register(a *Analyzer) {
+	if !validName.MatchString(a.Name) {
+		panic(fmt.Sprintf("analysis: invalid analyzer name %q", a.Name))
+	}
+	if _, ok := registry[a.Name]; ok {
+		panic(fmt.Sprintf("analysis: analyzer %v registered twice", a.Name))
+	}
+	registry[a.Name] = a
+}
+
+// Registered returns every registered analyzer, sorted by name.
+func Registered() []*Analyzer {
+	var analyzers []*Analyzer
+	for _, a := range registry {
+		analyzers = append(analyzers, a)
+	}
+	sort.Slice(analyzers, func(i, j int) bool { return analyzers[i].Name < analyzers[j].Name })
+	return analyzers
+}
@@ -0,0 +1,90 @@
+package analysis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantPanic bool
+	}{
+		{"test-analyzer", false},
+		{"test-analyzer", true},
+		{"Test", true},
+		{"test-", true},
+		{"test analyzer", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.wantPanic {
+					t.Errorf("Register() panic = %v, want panic %v", r, tt.wantPanic)
+				}
+			}()
+			Register(&Analyzer{Name: tt.name, Run: func(*Pass) error { return nil }})
+		})
+	}
+
+	var names []string
+	for _, a := range Registered() {
+		names = append(names, a.Name)
+	}
+	if len(names) != 1 || names[0] != "test-analyzer" {
+		t.Errorf("Registered() = %v, want [test-analyzer]", names)
+	}
+}
+
+func TestRun(t *testing.T) {
+	src := `module "a"
+pipe F(a: int) (b: int) { b = a }
+pipe main() {}
+`
+	file := token.NewFile("", len(src))
+	module, err := tracer.NewTracer().TraceModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each pipe is reported by both analyzers, which must be sorted together by position
+	pipes := &Analyzer{Name: "pipes", Run: func(pass *Pass) error {
+		for _, pipe := range pass.Pipes() {
+			pass.Reportf(pipe.Name, "pipe %v", pipe.BlockName())
+		}
+		return nil
+	}}
+	ports := &Analyzer{Name: "ports", Run: func(pass *Pass) error {
+		for _, pipe := range pass.Pipes() {
+			for _, field := range pipe.Inputs.Fields {
+				pass.Report(&token.Error{Pos: pass.File.Position(field.Key.Pos()), Msg: errPort, Code: "port"})
+			}
+		}
+		return nil
+	}}
+
+	problems, err := Run(&Pass{File: &file, Module: module}, ports, pipes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2:6: pipe F", "2:8: input", "3:6: pipe main"}
+	wantCodes := []string{"pipes", "port", "pipes"}
+	if len(problems) != len(want) {
+		t.Fatalf("Run() = %v, want %q", problems, want)
+	}
+	for i, p := range problems {
+		if p.Error() != want[i] || p.Code != wantCodes[i] {
+			t.Errorf("problem %d = %q with code %q, want %q with code %q", i, p.Error(), p.Code, want[i], wantCodes[i])
+		}
+	}
+
+	failing := &Analyzer{Name: "failing", Run: func(*Pass) error { return errPort }}
+	if _, err := Run(&Pass{File: &file, Module: module}, pipes, failing); err == nil || err.Error() != "failing: input" {
+		t.Errorf("Run() err = %v, want failing: input", err)
+	}
+}
+
+var errPort = errors.New("input")
@@ -0,0 +1,230 @@
+// Package passes has the analyzers run by hoser check, which are registered with package analysis when it is
+// imported.
+package passes
+
+import (
+	"fmt"
+
+	"github.com/masp/hoser/analysis"
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+func init() {
+	FanOut.Flags.IntVar(&fanOutMax, "max", 4, "report values sent to more than `n` blocks")
+	for _, a := range All {
+		analysis.Register(a)
+	}
+}
+
+// All is every analyzer of this package that hoser check runs. UnimplementedStub is left out, since hoser check does
+// not know which stubs are implemented.
+var All = []*analysis.Analyzer{UnusedPort, FanOut, LiteralPipe}
+
+// UnusedPort reports the inputs of pipes that are never used.
+var UnusedPort = &analysis.Analyzer{
+	Name: "unused-port",
+	Doc: `unused-port reports inputs of pipes that are never used.
+
+Every caller has to connect an input even if the pipe ignores its values, so an unused input is likely a mistake or
+left over from an earlier version of the pipe.`,
+	Run: runUnusedPort,
+}
+
+func runUnusedPort(pass *analysis.Pass) error {
+	for _, pipe := range pass.Pipes() {
+		if pipe.Implicit {
+			continue // the ports of the main pipe of a script are the ones its statements use
+		}
+		used := make(map[ast.PortIdx]bool)
+		for _, edge := range pipe.BodyDAG.Edges {
+			if edge.Src.Block == ast.RootBlock {
+				used[edge.Src.Port] = true
+			}
+		}
+		for port, field := range pipe.Inputs.Fields {
+			if !used[ast.PortIdx(port)] {
+				pass.Reportf(field.Key, "input %v of %v is never used", field.Key.V, describePipe(pipe))
+			}
+		}
+	}
+	return nil
+}
+
+var fanOutMax int
+
+// FanOut reports values that are sent to suspiciously many blocks, or to merge more than once.
+var FanOut = &analysis.Analyzer{
+	Name: "fan-out",
+	Doc: `fan-out reports values that are sent to many blocks or merged with themselves.
+
+A value sent to several blocks is broadcast to each of them, and every block buffers the values it has not received
+yet. If one of many blocks is slow, the values pile up in the buffers of the others. A value given to merge more than
+once is sent that many times, which is rarely intended.`,
+	Run: runFanOut,
+}
+
+func runFanOut(pass *analysis.Pass) error {
+	for _, pipe := range pass.Pipes() {
+		graph := pipe.BodyDAG
+		consumers := make(map[ast.Loc][]ast.Loc)
+		var sources []ast.Loc // in the order of their first edge
+		for _, edge := range graph.Edges {
+			if _, ok := consumers[edge.Src]; !ok {
+				sources = append(sources, edge.Src)
+			}
+			consumers[edge.Src] = append(consumers[edge.Src], edge.Dst)
+		}
+
+		for _, src := range sources {
+			dsts := consumers[src]
+			merged := make(map[ast.BlockIdx]int) // number of inputs of each merge the value is given to
+			for _, dst := range dsts {
+				if dst.Block == ast.RootBlock {
+					continue
+				}
+				if b, ok := graph.Blocks[dst.Block].(*ast.BuiltinBlock); ok && b.Op == ast.MergeBuiltin {
+					if merged[dst.Block] == 1 {
+						reportSelfMerge(pass, graph.Blocks[dst.Block], dst.Port, describeSrc(pipe, src))
+					}
+					merged[dst.Block]++
+				}
+			}
+			if len(dsts) > fanOutMax {
+				pass.Reportf(srcNode(pipe, src), "%v is sent to %d blocks, which each buffer the values they have not received yet", describeSrc(pipe, src), len(dsts))
+			}
+		}
+	}
+	return nil
+}
+
+// reportSelfMerge reports a value given to merge again at input dup, with a fix removing the argument of dup.
+func reportSelfMerge(pass *analysis.Pass, merge ast.Block, dup ast.PortIdx, desc string) {
+	err := pass.Reportf(merge.CreatedBy(), "%v is merged with itself, so each of its values is sent more than once", desc)
+	call, ok := merge.CreatedBy().(*ast.CallExpr)
+	if !ok || len(call.Args) != len(merge.InPorts()) || dup == 0 {
+		return
+	}
+	// the end of other expressions is not always where they end in the source
+	prev, ok1 := call.Args[dup-1].(*ast.Ident)
+	arg, ok2 := call.Args[dup].(*ast.Ident)
+	if !ok1 || !ok2 {
+		return
+	}
+	// delete the argument with the comma before it, e.g. ", x" in merge(x, x)
+	err.Fixes = append(err.Fixes, token.Fix{
+		Msg:   fmt.Sprintf("remove argument %d of merge", dup+1),
+		Edits: []token.TextEdit{{Pos: pass.File.Position(prev.End()), End: pass.File.Position(arg.End())}},
+	})
+}
+
+// srcNode is the node values leave from at src, which is the declaration of the port for inputs of the pipe.
+func srcNode(pipe *ast.PipeDecl, src ast.Loc) ast.Node {
+	if src.Block == ast.RootBlock {
+		return pipe.Inputs.Fields[src.Port].Key
+	}
+	return pipe.BodyDAG.Blocks[src.Block].CreatedBy()
+}
+
+func describeSrc(pipe *ast.PipeDecl, src ast.Loc) string {
+	if src.Block == ast.RootBlock {
+		return "input " + pipe.Inputs.Fields[src.Port].Key.V
+	}
+	switch b := pipe.BodyDAG.Blocks[src.Block].(type) {
+	case *ast.StubBlock:
+		return describeOutput(b.Decl, src.Port)
+	case *ast.PipeBlock:
+		return describeOutput(b.Decl, src.Port)
+	case *ast.BuiltinBlock:
+		return "the value of " + string(b.Op)
+	default:
+		return "the value"
+	}
+}
+
+func describeOutput(decl ast.BlockDecl, port ast.PortIdx) string {
+	outputs := decl.BlockOutputs().Fields
+	if int(port) >= len(outputs) {
+		return "the value of " + decl.BlockName()
+	}
+	return fmt.Sprintf("output %v of %v", outputs[port].Key.V, decl.BlockName())
+}
+
+func describePipe(pipe *ast.PipeDecl) string {
+	if pipe.Name.V == "pipe" {
+		return "pipe literal" // pipe is a keyword, so no declared pipe has the name
+	}
+	return pipe.BlockName()
+}
+
+// UnimplementedStub reports stubs that cannot be run. It is not registered, a program embedding hoser runs it with
+// the implementations registered with its runtime:
+//
+//	pass.Implemented = func(module, name string) bool { return rt.Lookup(module, name) != nil }
+//	problems, err := analysis.Run(pass, passes.UnimplementedStub)
+var UnimplementedStub = &analysis.Analyzer{
+	Name: "unimplemented-stub",
+	Doc: `unimplemented-stub reports stubs that have no registered implementation.
+
+A stub is implemented outside of hoser, e.g. by a Go function registered with the runtime. A program calling a stub
+without an implementation fails once the stub is started. Nothing is reported if the implementations are not known.`,
+	Run: runUnimplementedStub,
+}
+
+func runUnimplementedStub(pass *analysis.Pass) error {
+	if pass.Implemented == nil {
+		return nil
+	}
+	for _, decl := range pass.Module.DefinedBlocks {
+		stub, ok := decl.(*ast.StubDecl)
+		if ok && !pass.Implemented(pass.Module.Name.Value, stub.BlockName()) {
+			pass.Reportf(stub.Name, "stub %v has no registered implementation", stub.BlockName())
+		}
+	}
+	return nil
+}
+
+// LiteralPipe reports pipes whose outputs are constant.
+var LiteralPipe = &analysis.Analyzer{
+	Name: "literal-pipe",
+	Doc: `literal-pipe reports pipes that only send literals.
+
+A pipe whose body is made only of literals and built-ins applied to literals always sends the same values. Each call
+of it still creates a block, where the values could be written directly or given as default values of ports. The
+main pipe is not reported, since a program may print a constant.`,
+	Run: runLiteralPipe,
+}
+
+func runLiteralPipe(pass *analysis.Pass) error {
+	for _, decl := range pass.Module.DefinedBlocks {
+		pipe, ok := decl.(*ast.PipeDecl)
+		if !ok || pipe.BodyDAG == nil || pipe.BlockName() == "main" || len(pipe.Outputs.Fields) == 0 {
+			continue
+		}
+		if constant(pipe.BodyDAG) {
+			pass.Reportf(pipe.Name, "pipe %v only sends literals", pipe.BlockName())
+		}
+	}
+	return nil
+}
+
+// constant reports whether graph has blocks that are all literals, pipe values or built-ins, and no value comes from
+// an input of the pipe, so every built-in is applied to literals.
+func constant(graph *ast.Graph) bool {
+	if len(graph.Blocks) == 0 {
+		return false
+	}
+	for _, edge := range graph.Edges {
+		if edge.Src.Block == ast.RootBlock {
+			return false
+		}
+	}
+	for _, block := range graph.Blocks {
+		switch block.(type) {
+		case *ast.LiteralBlock, *ast.PipeRefBlock, *ast.BuiltinBlock:
+		default:
+			return false
+		}
+	}
+	return true
+}
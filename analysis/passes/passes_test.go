@@ -0,0 +1,159 @@
+package passes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/masp/hoser/analysis"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+func TestAnalyzers(t *testing.T) {
+	tests := []struct {
+		name         string
+		analyzer     *analysis.Analyzer
+		src          string
+		implemented  []string // stubs with an implementation, nil if they are not known
+		wantProblems []string
+		wantFixes    []string // source after applying the first fix of each problem
+	}{
+		{
+			"Unused port",
+			UnusedPort,
+			`module "a"
+pipe F(a: int, b: int) (c: int) { c = a }
+pipe main() {
+	F(1, 2)
+	p = pipe(x: int) (y: int) { y = 1 }
+	p(1)
+}
+`,
+			nil,
+			[]string{"2:16: input b of F is never used", "5:11: input x of pipe literal is never used"},
+			nil,
+		},
+		{
+			"Unused port of script",
+			UnusedPort,
+			`#!/usr/bin/env hoser
+stdout = "hello"
+`,
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"Merged with itself",
+			FanOut,
+			`module "a"
+pipe F(a: int) (b: int) { b = merge(a, a) }
+pipe main() {}
+`,
+			nil,
+			[]string{"2:31: input a is merged with itself, so each of its values is sent more than once"},
+			[]string{`module "a"
+pipe F(a: int) (b: int) { b = merge(a) }
+pipe main() {}
+`},
+		},
+		{
+			"Sent to many blocks",
+			FanOut,
+			`module "a"
+stub S(a: int) (b: int)
+pipe F(a: int) (b: int) { b = merge(S(a), S(a), S(a), S(a), S(a)) }
+pipe G(a: int) (b: int) { b = merge(S(a), S(a), S(a), S(a)) }
+pipe main() {}
+`,
+			nil,
+			[]string{"3:8: input a is sent to 5 blocks, which each buffer the values they have not received yet"},
+			nil,
+		},
+		{
+			"Unimplemented stub",
+			UnimplementedStub,
+			`module "a"
+stub S(a: int) (b: int)
+stub T(a: int) (b: int)
+pipe main() {}
+`,
+			[]string{"a.S"},
+			[]string{"3:6: stub T has no registered implementation"},
+			nil,
+		},
+		{
+			"Unknown implementations",
+			UnimplementedStub,
+			`module "a"
+stub S(a: int) (b: int)
+pipe main() {}
+`,
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"Literal pipe",
+			LiteralPipe,
+			`module "a"
+pipe Two() (n: int) { n = 1 + 1 }
+pipe Inc(a: int) (n: int) { n = a + 1 }
+pipe main() (stdout: string) { stdout = "hello" }
+`,
+			nil,
+			[]string{"2:6: pipe Two only sends literals"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := tracer.NewTracer()
+			module, err := tr.TraceModule(&file, []byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pass := &analysis.Pass{File: &file, Module: module, Modules: tr.ModuleSet(), Refs: tr.Refs()}
+			if tt.implemented != nil {
+				pass.Implemented = func(module, name string) bool {
+					for _, stub := range tt.implemented {
+						if stub == module+"."+name {
+							return true
+						}
+					}
+					return false
+				}
+			}
+			problems, err := analysis.Run(pass, tt.analyzer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotProblems, gotFixes []string
+			for _, p := range problems {
+				gotProblems = append(gotProblems, p.Error())
+				if p.Code != tt.analyzer.Name {
+					t.Errorf("Code = %q, want %q", p.Code, tt.analyzer.Name)
+				}
+				if len(p.Fixes) > 0 {
+					gotFixes = append(gotFixes, applyFix(tt.src, p.Fixes[0]))
+				}
+			}
+			if !reflect.DeepEqual(gotProblems, tt.wantProblems) {
+				t.Errorf("problems = %q, want %q", gotProblems, tt.wantProblems)
+			}
+			if !reflect.DeepEqual(gotFixes, tt.wantFixes) {
+				t.Errorf("fixed = %q, want %q", gotFixes, tt.wantFixes)
+			}
+		})
+	}
+}
+
+func applyFix(src string, fix token.Fix) string {
+	for i := len(fix.Edits) - 1; i >= 0; i-- {
+		edit := fix.Edits[i]
+		src = src[:edit.Pos.Offset-1] + edit.NewText + src[edit.End.Offset-1:] // offsets are Pos values
+	}
+	return src
+}
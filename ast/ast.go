@@ -1,6 +1,9 @@
 package ast
 
 import (
+	"path"
+	"strings"
+
 	"github.com/masp/hoser/token"
 )
 
@@ -50,6 +53,7 @@ type BlockDecl interface {
 	BlockName() string
 	BlockInputs() *FieldList
 	BlockOutputs() *FieldList
+	IsPure() bool
 }
 
 // Module represents all the contents of a single file, including all defined blocks and all referenced blocks.
@@ -58,6 +62,11 @@ type Module struct {
 	Name          *LiteralExpr  // name of module identifier as a string literal
 	Imports       []*ImportDecl // list of imported modules
 	DefinedBlocks []BlockDecl
+	Comments      []*CommentGroup // every comment in the file, in the order they appear
+
+	// Script is set if the module was parsed from a script, a file starting with #!. The header of a script is
+	// optional, and statements outside of any pipe form the body of an implicit main pipe.
+	Script bool
 }
 
 func (m *Module) Pos() token.Pos {
@@ -72,6 +81,8 @@ func (m *Module) End() token.Pos {
 	}
 }
 
+// Lookup returns the pipe or stub called name, or nil if there is none. If name is declared more than once (which the
+// tracer reports as an error) the first declaration is returned.
 func (m *Module) Lookup(name string) BlockDecl {
 	for _, decl := range m.DefinedBlocks {
 		if decl.BlockName() == name {
@@ -81,6 +92,16 @@ func (m *Module) Lookup(name string) BlockDecl {
 	return nil
 }
 
+// Import returns the import of module with qualifier, or nil if there is none.
+func (m *Module) Import(qualifier string) *ImportDecl {
+	for _, imp := range m.Imports {
+		if imp.Qualifier() == qualifier {
+			return imp
+		}
+	}
+	return nil
+}
+
 type ImportDecl struct {
 	Keyword    token.Pos
 	ModuleName *LiteralExpr // import "ModuleName"
@@ -94,7 +115,15 @@ func (b *ImportDecl) End() token.Pos {
 	return b.ModuleName.End()
 }
 
+// Qualifier is the name used to reference blocks of an imported module, which is the last element of its
+// full name, e.g. grep in `import "text/grep"` and `grep.Filter()`.
+func (b *ImportDecl) Qualifier() string {
+	return path.Base(b.ModuleName.Value)
+}
+
 type StubDecl struct {
+	Doc     *CommentGroup // comments on the lines right above the declaration, nil if there are none
+	Pure    token.Pos     // position of the pure keyword, NoPos if the block is not pure
 	Name    *Ident
 	Inputs  FieldList
 	Outputs FieldList
@@ -105,7 +134,10 @@ func (b *StubDecl) Pos() token.Pos {
 }
 
 func (b *StubDecl) End() token.Pos {
-	return b.Outputs.End()
+	if b.Outputs.Closer.IsValid() {
+		return b.Outputs.End()
+	}
+	return b.Inputs.End()
 }
 
 type PipeDecl struct {
@@ -114,6 +146,10 @@ type PipeDecl struct {
 	Body      []Stmt
 	EndRBrack token.Pos
 
+	// Implicit is set for the main pipe of a script made of its top-level statements. Its name, braces and ports
+	// have no positions.
+	Implicit bool
+
 	BodyDAG *Graph // nil by default, added in by tracer
 }
 
@@ -122,6 +158,9 @@ func (b *PipeDecl) Pos() token.Pos {
 }
 
 func (b *PipeDecl) End() token.Pos {
+	if b.Implicit && len(b.Body) > 0 {
+		return b.Body[len(b.Body)-1].End()
+	}
 	return b.EndRBrack
 }
 
@@ -132,6 +171,11 @@ func (b *StubDecl) BlockName() string        { return b.Name.V }
 func (b *StubDecl) BlockInputs() *FieldList  { return &b.Inputs }
 func (b *StubDecl) BlockOutputs() *FieldList { return &b.Outputs }
 
+// IsPure reports whether the block is declared pure, e.g. `pure stub Upper(s: string) (u: string)`. A pure block
+// always sends the same values for the same values on its inputs and has no other effect, so identical calls of it
+// can share one block.
+func (b *StubDecl) IsPure() bool { return b.Pure.IsValid() }
+
 func (m *Module) declNode()     {}
 func (m *ImportDecl) declNode() {}
 func (m *PipeDecl) declNode()   {}
@@ -144,9 +188,17 @@ func (m *StubDecl) declNode()   {}
 // Field is a key-value combination like 'key: value' that shows up in pipe definitions and pattern
 // matching.
 type Field struct {
+	Doc   *CommentGroup // comments above a port or after it on the same line, nil if there are none
 	Key   *Ident
 	Colon token.Pos
-	Value Expr
+	Value Expr // nil for a port declared without a type, e.g. x in `pipe Double(x) (y: int)`
+
+	// Default is the value of an input that is not given an argument, e.g. 10 in `limit: int = 10`. It is nil if
+	// the port has no default value.
+	Assign  token.Pos // position of =, NoPos if there is no Default
+	Default *LiteralExpr
+
+	Inferred EdgeType // type of a port without a Value, filled in by the tracer
 }
 
 func (f *Field) Pos() token.Pos {
@@ -154,9 +206,23 @@ func (f *Field) Pos() token.Pos {
 }
 
 func (f *Field) End() token.Pos {
+	if f.Default != nil {
+		return f.Default.End()
+	}
+	if f.Value == nil {
+		return f.Key.End()
+	}
 	return f.Value.End()
 }
 
+// Type is the type of the port or record field, either declared by Value or inferred by the tracer.
+func (f *Field) Type() EdgeType {
+	if f.Value == nil {
+		return f.Inferred
+	}
+	return TypeOf(f.Value)
+}
+
 type FieldList struct {
 	Opener token.Pos // Opening { or NoPos if none
 	Fields []*Field
@@ -177,7 +243,7 @@ func (f *FieldList) Pos() token.Pos {
 
 func (f *FieldList) End() token.Pos {
 	if f.Closer.IsValid() {
-		return f.Opener
+		return f.Closer
 	} else {
 		if f.Len() > 0 {
 			return f.Fields[len(f.Fields)-1].Pos()
@@ -263,6 +329,58 @@ func (lit *LiteralExpr) End() token.Pos {
 	}
 }
 
+// InterpExpr is a string literal with expressions embedded in it, e.g. "out/${name}.txt". Parts alternates between
+// string *LiteralExprs (possibly empty) and the embedded expressions, always starting and ending with a string.
+type InterpExpr struct {
+	Quote  token.Pos // position of opening "
+	Parts  []Expr
+	Closer token.Pos // position of closing "
+}
+
+func (x *InterpExpr) Pos() token.Pos { return x.Quote }
+func (x *InterpExpr) End() token.Pos { return x.Closer + 1 }
+
+// PipeType is the signature of a pipe used as the type of a port, e.g. `f: pipe(x: int) (y: int)`.
+// Ports with a PipeType receive a pipe as a value that can be called like any other block.
+type PipeType struct {
+	Keyword token.Pos // position of pipe keyword
+	Inputs  FieldList
+	Outputs FieldList
+}
+
+func (p *PipeType) Pos() token.Pos {
+	return p.Keyword
+}
+
+func (p *PipeType) End() token.Pos {
+	if p.Outputs.Closer.IsValid() {
+		return p.Outputs.End()
+	}
+	return p.Inputs.End()
+}
+
+// PipeLit is an anonymous pipe defined in expression position, e.g. `pipe(x: int) (y: int) { y = x }`.
+// Decl is named after the pipe keyword so the literal can be traced and expanded like any other pipe.
+type PipeLit struct {
+	Decl *PipeDecl
+}
+
+func (p *PipeLit) Pos() token.Pos {
+	return p.Decl.Pos()
+}
+
+func (p *PipeLit) End() token.Pos {
+	return p.Decl.End()
+}
+
+// TupleExpr is a comma separated list of patterns on the left side of an assignment, e.g. `a, b = Split(x)`.
+type TupleExpr struct {
+	Elts []Expr
+}
+
+func (t *TupleExpr) Pos() token.Pos { return t.Elts[0].Pos() }
+func (t *TupleExpr) End() token.Pos { return t.Elts[len(t.Elts)-1].End() }
+
 // AssignExpr is an expression separated by an =
 type AssignExpr struct {
 	Lhs   Expr
@@ -280,6 +398,61 @@ func (*CallExpr) exprNode()    {}
 func (*LiteralExpr) exprNode() {}
 func (*ParenExpr) exprNode()   {}
 func (*AssignExpr) exprNode()  {}
+func (*PipeType) exprNode()    {}
+func (*PipeLit) exprNode()     {}
+func (*TupleExpr) exprNode()   {}
+func (*InterpExpr) exprNode()  {}
+
+// Span is the source range of a node that is no longer available, e.g. what created a block of a graph loaded
+// from a file rather than traced from source.
+type Span struct {
+	From, To token.Pos
+}
+
+func (s *Span) Pos() token.Pos { return s.From }
+func (s *Span) End() token.Pos { return s.To }
+
+// ----------------------------------------------------------------------------
+// Comments
+//
+
+// Comment is a single # comment, which continues to the end of the line.
+type Comment struct {
+	Hash token.Pos // position of #
+	Text string    // including the #
+}
+
+func (c *Comment) Pos() token.Pos { return c.Hash }
+func (c *Comment) End() token.Pos { return c.Hash + token.Pos(len(c.Text)) }
+
+// CommentGroup is a sequence of comments on consecutive lines with no other tokens between them.
+type CommentGroup struct {
+	List []*Comment
+}
+
+func (g *CommentGroup) Pos() token.Pos { return g.List[0].Pos() }
+func (g *CommentGroup) End() token.Pos { return g.List[len(g.List)-1].End() }
+
+// Text returns the text of the comments without the # and the space after it, one line for each comment. Leading
+// and trailing empty lines are removed.
+func (g *CommentGroup) Text() string {
+	if g == nil {
+		return ""
+	}
+	var lines []string
+	for _, c := range g.List {
+		line := strings.TrimPrefix(c.Text, "#")
+		line = strings.TrimPrefix(line, " ")
+		lines = append(lines, strings.TrimRight(line, " \t\r"))
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
 
 // ----------------------------------------------------------------------------
 // Statements
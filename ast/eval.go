@@ -0,0 +1,96 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/masp/hoser/token"
+)
+
+// Pure reports whether the built-in computes exactly one value from each set of values on its inputs without any
+// other effect, so it can be evaluated ahead of time when its inputs are constant. merge is not pure since it sends
+// every value it receives, and field is not since there are no record constants.
+func (op Builtin) Pure() bool {
+	switch op {
+	case FormatBuiltin, IntBuiltin, FloatBuiltin, StringBuiltin:
+		return true
+	default:
+		return false
+	}
+}
+
+// Eval computes the value of a pure built-in from one value on each of its inputs. It is used by the runtime for
+// every set of values it receives and by the optimizer for constant inputs.
+func (b *BuiltinBlock) Eval(args []interface{}) (interface{}, error) {
+	switch b.Op {
+	case FormatBuiltin:
+		var sb strings.Builder
+		sb.WriteString(b.Params[0])
+		for i, arg := range args {
+			fmt.Fprint(&sb, arg)
+			sb.WriteString(b.Params[i+1])
+		}
+		return sb.String(), nil
+	case IntBuiltin, FloatBuiltin, StringBuiltin:
+		return convert(args[0], b.Op)
+	default:
+		return nil, fmt.Errorf("%v cannot be evaluated", b.Op)
+	}
+}
+
+// convert converts a scalar value to the type of a conversion built-in. Floats are truncated when converted to
+// ints, and strings must hold a valid number to be converted to one.
+func convert(v interface{}, op Builtin) (interface{}, error) {
+	switch op {
+	case StringBuiltin:
+		return fmt.Sprint(v), nil
+	case FloatBuiltin:
+		switch x := v.(type) {
+		case int64:
+			return float64(x), nil
+		case float64:
+			return x, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to float", x)
+			}
+			return f, nil
+		}
+	case IntBuiltin:
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case float64:
+			return int64(x), nil
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to int", x)
+			}
+			return i, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T to %v", v, op)
+}
+
+// ValueLiteral creates the literal for a scalar value computed ahead of time, starting at pos. ok is false if v is
+// not a scalar.
+func ValueLiteral(v interface{}, pos token.Pos) (lit *LiteralExpr, ok bool) {
+	lit = &LiteralExpr{Start: pos, ParsedVal: v}
+	switch x := v.(type) {
+	case int64:
+		lit.Type, lit.Value = token.Integer, strconv.FormatInt(x, 10)
+	case float64:
+		lit.Type, lit.Value = token.Float, strconv.FormatFloat(x, 'f', -1, 64)
+		if !strings.ContainsAny(lit.Value, ".IN") { // keep 2.0 a float when printed, unless it is Inf or NaN
+			lit.Value += ".0"
+		}
+	case string:
+		lit.Type, lit.Value = token.String, x
+	default:
+		return nil, false
+	}
+	return lit, true
+}
@@ -1,6 +1,10 @@
 package ast
 
 import (
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/masp/hoser/token"
 )
 
@@ -23,21 +27,80 @@ const RootBlock BlockIdx = -1
 // are labeled 0-N. Each block contains information about all its inputs and outputs, which are referenced by their indices. A graph component
 // is created for each block defined in the module and referenced externally by the tracer.
 //
+// A Loc may be the source of many edges (fan-out), in which case every value that leaves the Loc is broadcast to every
+// consumer and each consumer sees the whole stream. A Loc may only be the destination of one edge, multiple producers
+// are combined explicitly with the merge() built-in.
+//
 // Only numeric indices are used rather than names to keep the representation concise and avoid circular references.
 // The downside is that the program graph is difficult to modify in place (all indices change if anything is added or removed). Since most programs are
 // smaller, though, it is not too expensive to recalculate the whole graph each time.
 type Graph struct {
+	Root   Block   // the block this graph describes, referenced by RootBlock
 	Blocks []Block // the sequence of blocks. the NodeIdx is used to lookup in the slice
 	Edges  []Edge  // edges connecting two nodes
 }
 
+// NewGraph creates an empty graph describing the body of decl.
+func NewGraph(decl *PipeDecl) Graph {
+	return Graph{
+		Root: &PipeBlock{
+			Decl:      decl,
+			inPorts:   portsFromFields(decl.Inputs),
+			outPorts:  portsFromFields(decl.Outputs),
+			createdBy: decl,
+		},
+	}
+}
+
+// Block returns the block at idx, where RootBlock is the block the graph describes.
+func (g *Graph) Block(idx BlockIdx) Block {
+	if idx == RootBlock {
+		return g.Root
+	}
+	return g.Blocks[idx]
+}
+
+// SrcType is the type of values that leave loc. For the root block, values leave through its inputs.
+func (g *Graph) SrcType(loc Loc) EdgeType {
+	if loc.Block == RootBlock {
+		return g.Root.InPorts()[loc.Port]
+	}
+	return g.Blocks[loc.Block].OutPorts()[loc.Port]
+}
+
+// DstType is the type of values that arrive at loc. For the root block, values arrive at its outputs.
+func (g *Graph) DstType(loc Loc) EdgeType {
+	if loc.Block == RootBlock {
+		return g.Root.OutPorts()[loc.Port]
+	}
+	return g.Blocks[loc.Block].InPorts()[loc.Port]
+}
+
 func portsFromFields(fields FieldList) (ports []EdgeType) {
 	for _, field := range fields.Fields {
-		ports = append(ports, EdgeType(field.Value.(*Ident).V))
+		ports = append(ports, field.Type())
 	}
 	return
 }
 
+// TypeOf converts a type expression like `int`, `{x: int}` or `pipe(x: int) (y: int)` into the EdgeType it describes.
+func TypeOf(typ Expr) EdgeType {
+	switch t := typ.(type) {
+	case *Ident:
+		return EdgeType(t.V)
+	case *PipeType:
+		return PipeEdgeType(portsFromFields(t.Inputs), portsFromFields(t.Outputs))
+	case *FieldList:
+		fields := make(map[string]EdgeType)
+		for _, field := range t.Fields {
+			fields[field.Key.V] = TypeOf(field.Value)
+		}
+		return RecordEdgeType(fields)
+	default:
+		return InvalidEdge
+	}
+}
+
 func (g *Graph) AddNamedBlock(decl BlockDecl, createdBy Node) BlockIdx {
 	var newBlock Block
 	switch b := decl.(type) {
@@ -61,7 +124,64 @@ func (g *Graph) AddNamedBlock(decl BlockDecl, createdBy Node) BlockIdx {
 }
 
 func (g *Graph) AddLiteralBlock(lit *LiteralExpr) BlockIdx {
-	g.Blocks = append(g.Blocks, &LiteralBlock{lit})
+	g.Blocks = append(g.Blocks, &LiteralBlock{Lit: lit})
+	return BlockIdx(len(g.Blocks) - 1)
+}
+
+// AddLiteralBlockFrom adds a literal computed from createdBy, e.g. a literal folded by an optimizer.
+func (g *Graph) AddLiteralBlockFrom(lit *LiteralExpr, createdBy Node) BlockIdx {
+	g.Blocks = append(g.Blocks, &LiteralBlock{Lit: lit, createdBy: createdBy})
+	return BlockIdx(len(g.Blocks) - 1)
+}
+
+// ReplaceWithLiteral replaces the block at idx with a literal created by createdBy, and removes the edges to the
+// inputs of the block. The edges from its outputs are kept, so the block must have a single output of the same type
+// as the literal.
+func (g *Graph) ReplaceWithLiteral(idx BlockIdx, lit *LiteralExpr, createdBy Node) {
+	g.Blocks[idx] = &LiteralBlock{Lit: lit, createdBy: createdBy}
+	edges := g.Edges[:0]
+	for _, edge := range g.Edges {
+		if edge.Dst.Block != idx {
+			edges = append(edges, edge)
+		}
+	}
+	g.Edges = edges
+}
+
+// AddPipeRefBlock adds a block that outputs decl as a value so it can be passed to pipe typed ports.
+func (g *Graph) AddPipeRefBlock(decl BlockDecl, createdBy Node) BlockIdx {
+	g.Blocks = append(g.Blocks, &PipeRefBlock{
+		Decl:      decl,
+		createdBy: createdBy,
+	})
+	return BlockIdx(len(g.Blocks) - 1)
+}
+
+// AddApplyBlock adds a block that calls whatever pipe of type typ arrives on its first input.
+func (g *Graph) AddApplyBlock(typ *PipeType, createdBy Node) BlockIdx {
+	g.Blocks = append(g.Blocks, &ApplyBlock{
+		Type:      typ,
+		inPorts:   append([]EdgeType{TypeOf(typ)}, portsFromFields(typ.Inputs)...),
+		outPorts:  portsFromFields(typ.Outputs),
+		createdBy: createdBy,
+	})
+	return BlockIdx(len(g.Blocks) - 1)
+}
+
+// AddBuiltinBlock adds a block implemented by the runtime with the given port types.
+func (g *Graph) AddBuiltinBlock(op Builtin, inPorts []EdgeType, outPorts []EdgeType, createdBy Node) BlockIdx {
+	return g.AddBuiltinBlockWithParams(op, nil, inPorts, outPorts, createdBy)
+}
+
+// AddBuiltinBlockWithParams is like AddBuiltinBlock for built-ins that are configured by params known while tracing.
+func (g *Graph) AddBuiltinBlockWithParams(op Builtin, params []string, inPorts []EdgeType, outPorts []EdgeType, createdBy Node) BlockIdx {
+	g.Blocks = append(g.Blocks, &BuiltinBlock{
+		Op:        op,
+		Params:    params,
+		inPorts:   inPorts,
+		outPorts:  outPorts,
+		createdBy: createdBy,
+	})
 	return BlockIdx(len(g.Blocks) - 1)
 }
 
@@ -69,6 +189,89 @@ func (g *Graph) Connect(src Loc, dst Loc, typ EdgeType) {
 	g.Edges = append(g.Edges, Edge{Type: typ, Src: src, Dst: dst})
 }
 
+// RemoveBlocks removes every block for which keep returns false and the edges connected to them. The remaining
+// blocks keep their order but are renumbered, so indices into the graph held before the call are invalid after.
+func (g *Graph) RemoveBlocks(keep func(idx BlockIdx) bool) {
+	newIdx := make([]BlockIdx, len(g.Blocks))
+	blocks := g.Blocks[:0]
+	for i, block := range g.Blocks {
+		if keep(BlockIdx(i)) {
+			newIdx[i] = BlockIdx(len(blocks))
+			blocks = append(blocks, block)
+		} else {
+			newIdx[i] = -2 // removed, not to be confused with RootBlock
+		}
+	}
+	for i := len(blocks); i < len(g.Blocks); i++ {
+		g.Blocks[i] = nil
+	}
+	g.Blocks = blocks
+
+	renumber := func(loc *Loc) bool {
+		if loc.Block == RootBlock {
+			return true
+		}
+		loc.Block = newIdx[loc.Block]
+		return loc.Block >= 0
+	}
+	edges := g.Edges[:0]
+	for _, edge := range g.Edges {
+		if renumber(&edge.Src) && renumber(&edge.Dst) {
+			edges = append(edges, edge)
+		}
+	}
+	g.Edges = edges
+}
+
+// SubstTypes replaces every type variable in the ports and edges of the graph with the type f returns for it.
+func (g *Graph) SubstTypes(f func(v EdgeType) EdgeType) {
+	subst := func(ports []EdgeType) {
+		for i := range ports {
+			ports[i] = ports[i].Subst(f)
+		}
+	}
+	for _, block := range append([]Block{g.Root}, g.Blocks...) {
+		// literals and pipe values compute their ports from the AST, which is updated by the tracer
+		switch b := block.(type) {
+		case *PipeBlock:
+			subst(b.inPorts)
+			subst(b.outPorts)
+		case *StubBlock:
+			subst(b.inPorts)
+			subst(b.outPorts)
+		case *ApplyBlock:
+			subst(b.inPorts)
+			subst(b.outPorts)
+		case *BuiltinBlock:
+			subst(b.inPorts)
+			subst(b.outPorts)
+		}
+	}
+	for i := range g.Edges {
+		g.Edges[i].Type = g.Edges[i].Type.Subst(f)
+	}
+}
+
+// Consumers returns every Loc that receives the values leaving src.
+func (g *Graph) Consumers(src Loc) (dsts []Loc) {
+	for _, edge := range g.Edges {
+		if edge.Src == src {
+			dsts = append(dsts, edge.Dst)
+		}
+	}
+	return
+}
+
+// Producer returns the Loc that sends values to dst, ok is false if dst is not connected.
+func (g *Graph) Producer(dst Loc) (src Loc, ok bool) {
+	for _, edge := range g.Edges {
+		if edge.Dst == dst {
+			return edge.Src, true
+		}
+	}
+	return Loc{}, false
+}
+
 type Block interface {
 	// CreatedBy is the AST node that corresponds to this Block being created (connects the graph to the AST)
 	CreatedBy() Node
@@ -94,7 +297,8 @@ type PipeBlock struct {
 // LiteralBlock is a block with a single output port that evaluates constantly to the literal expression
 // This block is atomic.
 type LiteralBlock struct {
-	Lit *LiteralExpr
+	Lit       *LiteralExpr
+	createdBy Node // nil if the literal is in the source, or the expression it was computed from, e.g. int("5")
 }
 
 // StubBlock refers to a block that is stubbed and is defined by an external process or Go code
@@ -106,6 +310,81 @@ type StubBlock struct {
 	outPorts  []EdgeType
 }
 
+// PipeRefBlock is a block with a single output port that evaluates constantly to a pipe (or stub) so it can be
+// passed to a pipe typed port, e.g. Double and the pipe literal are both PipeRefBlocks below:
+// 	Map(in, Double)
+// 	Map(in, pipe(x: int) (y: int) { y = Double(x) })
+// This block is atomic.
+type PipeRefBlock struct {
+	createdBy Node
+	Decl      BlockDecl
+}
+
+// ApplyBlock calls the pipe that arrives on its first input port with the remaining input ports as arguments.
+// It is created when a pipe typed port is called, e.g. f(x) in:
+// 	pipe Map(x: int, f: pipe(x: int) (y: int)) (y: int) { y = f(x) }
+//
+// The pipe is only known at runtime, so the block is instantiated by the runtime when the pipe arrives.
+type ApplyBlock struct {
+	createdBy Node
+	Type      *PipeType
+	inPorts   []EdgeType
+	outPorts  []EdgeType
+}
+
+// Builtin names a block that is implemented by the runtime.
+type Builtin string
+
+const (
+	// MergeBuiltin interleaves the values of all its inputs into its single output in the order they arrive,
+	// e.g. merge(a, b).
+	MergeBuiltin Builtin = "merge"
+	// FieldBuiltin outputs the field Params[0] of each record on its input. It is created by destructuring a
+	// record, e.g. `{pos: {x: px}} = Ball()`, and cannot be called by name.
+	FieldBuiltin Builtin = "field"
+	// FormatBuiltin joins the string Params with the values of its inputs in between to create a string, e.g.
+	// "out/${name}.txt" has Params ["out/", ".txt"] and one input. It cannot be called by name.
+	FormatBuiltin Builtin = "format"
+
+	// IntBuiltin, FloatBuiltin and StringBuiltin convert each value on their input to their type, e.g. int(x).
+	// Conversions that may lose information (float to int, string to a number) must be called explicitly, the
+	// others are inserted by the tracer wherever a type is connected to a type it widens to.
+	IntBuiltin    Builtin = "int"
+	FloatBuiltin  Builtin = "float"
+	StringBuiltin Builtin = "string"
+)
+
+// ConvertBuiltin returns the built-in that converts values to typ, ok is false if typ is not a scalar type.
+func ConvertBuiltin(typ EdgeType) (op Builtin, ok bool) {
+	switch typ {
+	case IntEdge, FloatEdge, StringEdge:
+		return Builtin(typ), true
+	default:
+		return "", false
+	}
+}
+
+// LookupBuiltin returns the built-in block called name, ok is false if there is none.
+func LookupBuiltin(name string) (op Builtin, ok bool) {
+	switch Builtin(name) {
+	case MergeBuiltin, IntBuiltin, FloatBuiltin, StringBuiltin:
+		return Builtin(name), true
+	default:
+		return "", false
+	}
+}
+
+// BuiltinBlock is a block implemented by the runtime itself, e.g. merge(a, b). Unlike stubs, built-ins are not
+// declared and their ports depend on how they are called.
+// This block is atomic.
+type BuiltinBlock struct {
+	createdBy Node
+	Op        Builtin
+	Params    []string // constant configuration of the built-in that is not an input, e.g. a field name
+	inPorts   []EdgeType
+	outPorts  []EdgeType
+}
+
 func (b PipeBlock) CreatedBy() Node      { return b.createdBy }
 func (b PipeBlock) InPorts() []EdgeType  { return b.inPorts }
 func (b PipeBlock) OutPorts() []EdgeType { return b.outPorts }
@@ -114,16 +393,41 @@ func (b StubBlock) CreatedBy() Node      { return b.createdBy }
 func (b StubBlock) InPorts() []EdgeType  { return b.inPorts }
 func (b StubBlock) OutPorts() []EdgeType { return b.outPorts }
 
-func (b LiteralBlock) CreatedBy() Node     { return b.Lit }
+func (b PipeRefBlock) CreatedBy() Node     { return b.createdBy }
+func (b PipeRefBlock) InPorts() []EdgeType { return nil }
+func (b PipeRefBlock) OutPorts() []EdgeType {
+	return []EdgeType{PipeEdgeType(portsFromFields(*b.Decl.BlockInputs()), portsFromFields(*b.Decl.BlockOutputs()))}
+}
+
+func (b ApplyBlock) CreatedBy() Node      { return b.createdBy }
+func (b ApplyBlock) InPorts() []EdgeType  { return b.inPorts }
+func (b ApplyBlock) OutPorts() []EdgeType { return b.outPorts }
+
+func (b BuiltinBlock) CreatedBy() Node      { return b.createdBy }
+func (b BuiltinBlock) InPorts() []EdgeType  { return b.inPorts }
+func (b BuiltinBlock) OutPorts() []EdgeType { return b.outPorts }
+
+func (b LiteralBlock) CreatedBy() Node {
+	if b.createdBy != nil {
+		return b.createdBy
+	}
+	return b.Lit
+}
+
 func (b LiteralBlock) InPorts() []EdgeType { return nil }
 func (b LiteralBlock) OutPorts() []EdgeType {
-	switch b.Lit.Type {
+	return []EdgeType{LiteralType(b.Lit)}
+}
+
+// LiteralType is the type of the value of lit.
+func LiteralType(lit *LiteralExpr) EdgeType {
+	switch lit.Type {
 	case token.Integer:
-		return []EdgeType{IntEdge}
+		return IntEdge
 	case token.Float:
-		return []EdgeType{FloatEdge}
+		return FloatEdge
 	case token.String:
-		return []EdgeType{StringEdge}
+		return StringEdge
 	default:
 		panic("invalid edge type")
 	}
@@ -138,6 +442,214 @@ var (
 	FloatEdge   EdgeType = "float"
 )
 
+// PipeEdgeType is the type of a pipe passed as a value. Only the port types are part of the type, so
+// pipes with differently named ports can be passed to the same port, e.g. pipe(int) (int).
+func PipeEdgeType(inputs, outputs []EdgeType) EdgeType {
+	var sb strings.Builder
+	writeList := func(types []EdgeType) {
+		sb.WriteString("(")
+		for i, typ := range types {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(string(typ))
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString("pipe")
+	writeList(inputs)
+	sb.WriteString(" ")
+	writeList(outputs)
+	return EdgeType(sb.String())
+}
+
+// RecordEdgeType is the type of a record with the given fields, e.g. {x: int, y: int}. Fields are sorted by name so
+// records with the same fields have the same type no matter the order they are declared in.
+func RecordEdgeType(fields map[string]EdgeType) EdgeType {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(name)
+		sb.WriteString(": ")
+		sb.WriteString(string(fields[name]))
+	}
+	sb.WriteString("}")
+	return EdgeType(sb.String())
+}
+
+// IsScalar is true for the types that are single values: int, float and string.
+func (t EdgeType) IsScalar() bool {
+	switch t {
+	case IntEdge, FloatEdge, StringEdge:
+		return true
+	default:
+		return false
+	}
+}
+
+// Widens is true if every value of type t can be converted to type to without losing information, so the
+// conversion can be done implicitly. The types form a lattice where int widens to float, and every scalar widens to
+// string to be displayed:
+// 	int -> float -> string
+// A type always widens to itself.
+func (t EdgeType) Widens(to EdgeType) bool {
+	switch {
+	case t == to:
+		return true
+	case t == IntEdge && to == FloatEdge:
+		return true
+	case t.IsScalar() && to == StringEdge:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsRecord is true if values of this type are records with named fields.
+func (t EdgeType) IsRecord() bool {
+	return strings.HasPrefix(string(t), "{")
+}
+
+// Field returns the type of the field called name in a record type, ok is false if there is no such field.
+func (t EdgeType) Field(name string) (typ EdgeType, ok bool) {
+	if !t.IsRecord() {
+		return InvalidEdge, false
+	}
+	for _, field := range splitTopLevel(string(t[1 : len(t)-1])) {
+		if i := strings.Index(field, ": "); i >= 0 && field[:i] == name {
+			return EdgeType(field[i+2:]), true
+		}
+	}
+	return InvalidEdge, false
+}
+
+// splitTopLevel splits a comma separated list of types without splitting the types nested in them.
+func splitTopLevel(list string) (items []string) {
+	depth, start := 0, 0
+	for i, c := range list {
+		switch c {
+		case '{', '(':
+			depth++
+		case '}', ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(list[start:]); rest != "" {
+		items = append(items, rest)
+	}
+	return
+}
+
+// IsPipe is true if values of this type are pipes that can be called.
+func (t EdgeType) IsPipe() bool {
+	return strings.HasPrefix(string(t), "pipe(")
+}
+
+// PipePorts returns the types of the inputs and outputs of a pipe type.
+func (t EdgeType) PipePorts() (inputs, outputs []EdgeType) {
+	if !t.IsPipe() {
+		return nil, nil
+	}
+	rest := string(t[len("pipe"):])
+	split := matchingParen(rest)
+	for _, item := range splitTopLevel(rest[1:split]) {
+		inputs = append(inputs, EdgeType(item))
+	}
+	rest = strings.TrimSpace(rest[split+1:])
+	for _, item := range splitTopLevel(rest[1 : len(rest)-1]) {
+		outputs = append(outputs, EdgeType(item))
+	}
+	return
+}
+
+// RecordFields returns the type of every field of a record type by name.
+func (t EdgeType) RecordFields() map[string]EdgeType {
+	if !t.IsRecord() {
+		return nil
+	}
+	fields := make(map[string]EdgeType)
+	for _, field := range splitTopLevel(string(t[1 : len(t)-1])) {
+		if i := strings.Index(field, ": "); i >= 0 {
+			fields[field[:i]] = EdgeType(field[i+2:])
+		}
+	}
+	return fields
+}
+
+// matchingParen returns the index of the paren closing the one that list starts with.
+func matchingParen(list string) int {
+	depth := 0
+	for i, c := range list {
+		switch c {
+		case '{', '(':
+			depth++
+		case '}', ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(list) - 1
+}
+
+// TypeVar is a placeholder for the type of a port that was declared without one, e.g. ?1. Type variables only
+// exist while tracing and are replaced by the types inferred for them once tracing is done.
+func TypeVar(n int) EdgeType {
+	return EdgeType("?" + strconv.Itoa(n))
+}
+
+// IsVar is true if t is a type variable.
+func (t EdgeType) IsVar() bool {
+	return strings.HasPrefix(string(t), "?")
+}
+
+// HasVars is true if t is or contains a type variable, e.g. pipe(?1) (int).
+func (t EdgeType) HasVars() bool {
+	return strings.Contains(string(t), "?")
+}
+
+// Subst replaces every type variable in t with the type f returns for it.
+func (t EdgeType) Subst(f func(v EdgeType) EdgeType) EdgeType {
+	switch {
+	case !t.HasVars():
+		return t
+	case t.IsVar():
+		return f(t)
+	case t.IsPipe():
+		inputs, outputs := t.PipePorts()
+		for i := range inputs {
+			inputs[i] = inputs[i].Subst(f)
+		}
+		for i := range outputs {
+			outputs[i] = outputs[i].Subst(f)
+		}
+		return PipeEdgeType(inputs, outputs)
+	case t.IsRecord():
+		fields := t.RecordFields()
+		for name, typ := range fields {
+			fields[name] = typ.Subst(f)
+		}
+		return RecordEdgeType(fields)
+	default:
+		return t
+	}
+}
+
 // Edge connects a "Src" Loc to a "Dst" Loc using with a typed flow of values
 type Edge struct {
 	Type     EdgeType // Type is the type of value that flows across this edge
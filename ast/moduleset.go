@@ -1,6 +1,8 @@
 package ast
 
 import (
+	"path/filepath"
+
 	"github.com/masp/hoser/token"
 )
 
@@ -12,12 +14,17 @@ type ModuleSet struct {
 }
 
 type CachedModule struct {
-	File *token.File // file holding module
-	Mod  *Module     // nil if module is not loaded yet but was indexed
+	File   *token.File // file holding module
+	Mod    *Module     // only the module header if the module is not loaded yet but was indexed
+	Loaded bool        // true once the whole module has been parsed into Mod
+
+	// Duplicates are the other files declaring a module with the same name, which were indexed after File and are
+	// ignored. Mod of each is its module header.
+	Duplicates []*CachedModule
 }
 
 func (cm CachedModule) IsLoaded() bool {
-	return len(cm.Mod.DefinedBlocks) > 0
+	return cm.Loaded
 }
 
 func EmptyModuleSet() ModuleSet {
@@ -26,9 +33,19 @@ func EmptyModuleSet() ModuleSet {
 	}
 }
 
+// Lookup returns the module with the full name, or nil if no module with that name has been indexed.
+func (ms *ModuleSet) Lookup(fullName string) *CachedModule {
+	return ms.Modules[fullName]
+}
+
+// IndexFile adds the module declared by moduleHeader in file to the set. If another file already declares a module
+// with the same name, that module is kept and returned with file added to its Duplicates.
 func (ms *ModuleSet) IndexFile(file *token.File, moduleHeader *Module) *CachedModule {
 	fullName := moduleHeader.Name.Value
 	if cached, ok := ms.Modules[fullName]; ok {
+		if cached.File != nil && filepath.Clean(cached.File.Name) != filepath.Clean(file.Name) {
+			cached.Duplicates = append(cached.Duplicates, &CachedModule{File: file, Mod: moduleHeader})
+		}
 		return cached
 	}
 	ms.Modules[fullName] = &CachedModule{
@@ -41,5 +58,6 @@ func (ms *ModuleSet) IndexFile(file *token.File, moduleHeader *Module) *CachedMo
 func (ms *ModuleSet) LoadModule(module *Module) *CachedModule {
 	fullName := module.Name.Value
 	ms.Modules[fullName].Mod = module
+	ms.Modules[fullName].Loaded = true
 	return ms.Modules[fullName]
 }
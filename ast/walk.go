@@ -12,9 +12,18 @@ func Walk(node Node, v Visitor) {
 	switch n := node.(type) {
 	case *Module:
 		Walk(n.Name, v)
+		for _, imp := range n.Imports {
+			Walk(imp, v)
+		}
 		for _, block := range n.DefinedBlocks {
 			Walk(block, v)
 		}
+	case *ImportDecl:
+		Walk(n.ModuleName, v)
+	case *StubDecl:
+		Walk(n.Name, v)
+		Walk(&n.Inputs, v)
+		Walk(&n.Outputs, v)
 	case *PipeDecl:
 		Walk(n.Name, v)
 		Walk(&n.Inputs, v)
@@ -22,9 +31,24 @@ func Walk(node Node, v Visitor) {
 		for _, stmt := range n.Body {
 			Walk(stmt, v)
 		}
+	case *PipeType:
+		Walk(&n.Inputs, v)
+		Walk(&n.Outputs, v)
+	case *PipeLit:
+		// the name of a pipe literal is the keyword itself, so it is not walked
+		Walk(&n.Decl.Inputs, v)
+		Walk(&n.Decl.Outputs, v)
+		for _, stmt := range n.Decl.Body {
+			Walk(stmt, v)
+		}
 	case *Field:
 		Walk(n.Key, v)
-		Walk(n.Value, v)
+		if n.Value != nil {
+			Walk(n.Value, v)
+		}
+		if n.Default != nil {
+			Walk(n.Default, v)
+		}
 	case *FieldList:
 		for _, field := range n.Fields {
 			Walk(field, v)
@@ -34,6 +58,14 @@ func Walk(node Node, v Visitor) {
 		for _, arg := range n.Args {
 			Walk(arg, v)
 		}
+	case *InterpExpr:
+		for _, part := range n.Parts {
+			Walk(part, v)
+		}
+	case *TupleExpr:
+		for _, elt := range n.Elts {
+			Walk(elt, v)
+		}
 	case *ParenExpr:
 		Walk(n.X, v)
 	case *ExprStmt:
@@ -0,0 +1,139 @@
+// Package cache stores traced modules in a directory so they can be loaded by later runs of the tracer instead of
+// being parsed and traced again. It implements tracer.ModuleCache:
+//
+//	dir, err := cache.Open(filepath.Join(os.TempDir(), "hoser"))
+//	...
+//	tr := tracer.NewTracer(includePath...)
+//	tr.Cache = dir
+//
+// Every entry is a file named by its key, holding the module in the format of package serialize and the warnings it
+// was traced with. Entries are never changed once written, so several processes can share a directory. Entries that
+// cannot be read, e.g. because they were written by another version, are treated as missing.
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/serialize"
+	"github.com/masp/hoser/token"
+)
+
+// Dir is a cache of traced modules in a directory.
+type Dir struct {
+	path string
+}
+
+// entry is what is stored for a module.
+type entry struct {
+	Version  int // serialize.Version the module was written with
+	Module   serialize.Module
+	Warnings []warning
+}
+
+// warning is a token.Error whose message can be encoded.
+type warning struct {
+	Pos      token.Position
+	Msg      string
+	Severity token.Severity
+	Code     string
+	Related  []token.Related
+	Fixes    []token.Fix
+}
+
+// Open uses the directory at path as a cache, creating it if it does not exist.
+func Open(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to open cache: %w", err)
+	}
+	return &Dir{path: path}, nil
+}
+
+// file is where the entry with key is stored. Entries are split in directories by the start of their key so no
+// directory gets too large.
+func (d *Dir) file(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(d.path, key)
+	}
+	return filepath.Join(d.path, key[:2], key)
+}
+
+func (d *Dir) Contains(key string) bool {
+	_, err := os.Stat(d.file(key))
+	return err == nil
+}
+
+func (d *Dir) Load(key string, set *ast.ModuleSet) (*ast.Module, token.ErrorList, error) {
+	f, err := os.Open(d.file(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var e entry
+	if err := gob.NewDecoder(f).Decode(&e); err != nil {
+		return nil, nil, fmt.Errorf("invalid cache entry %v: %w", key, err)
+	}
+	if e.Version != serialize.Version {
+		return nil, nil, fmt.Errorf("cache entry %v has format version %d, expected %d", key, e.Version, serialize.Version)
+	}
+	mod, err := serialize.LoadModule(e.Module, set)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings token.ErrorList
+	for _, w := range e.Warnings {
+		warnings = append(warnings, &token.Error{
+			Pos:      w.Pos,
+			Msg:      errors.New(w.Msg),
+			Severity: w.Severity,
+			Code:     w.Code,
+			Related:  w.Related,
+			Fixes:    w.Fixes,
+		})
+	}
+	return mod, warnings, nil
+}
+
+func (d *Dir) Store(key string, set *ast.ModuleSet, name string, warnings token.ErrorList) error {
+	mod, err := serialize.EncodeModule(set, name)
+	if err != nil {
+		return err
+	}
+	e := entry{Version: serialize.Version, Module: mod}
+	for _, w := range warnings {
+		e.Warnings = append(e.Warnings, warning{
+			Pos:      w.Pos,
+			Msg:      w.Msg.Error(),
+			Severity: w.Severity,
+			Code:     w.Code,
+			Related:  w.Related,
+			Fixes:    w.Fixes,
+		})
+	}
+
+	// the entry is written to a temporary file first, so it is never seen half written
+	path := d.file(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(&e); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
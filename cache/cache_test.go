@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+const lib = `module "lib"
+stub Upper(s: string) (u: string)
+pipe Shout(s: string) (u: string) {
+	x = Upper(s)
+	u = Upper("${s}!")
+}
+`
+
+const main = `module "main"
+import "lib"
+stub Print(s: string)
+pipe main() { Print(lib.Shout("a")) }
+`
+
+func writeFile(t *testing.T, path string, src string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trace traces src as the main module and returns the tracer with the messages of its warnings.
+func trace(t *testing.T, dir *Dir, includeDir string, src string) (*tracer.Tracer, []string) {
+	t.Helper()
+	file := token.NewFile("main.hos", len(src))
+	tr := tracer.NewTracer(includeDir)
+	tr.Cache = dir
+	if _, err := tr.TraceModule(&file, []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, w := range tr.Warnings() {
+		warnings = append(warnings, w.Error())
+	}
+	return tr, warnings
+}
+
+// cached reports whether the module was loaded from the cache, in which case its blocks are created by spans of
+// source instead of the nodes of the parsed module.
+func cached(t *testing.T, tr *tracer.Tracer, name string) bool {
+	t.Helper()
+	mod := tr.ModuleSet().Lookup(name).Mod
+	for _, decl := range mod.DefinedBlocks {
+		if pipe, ok := decl.(*ast.PipeDecl); ok {
+			for _, block := range pipe.BodyDAG.Blocks {
+				if _, ok := block.(*ast.LiteralBlock); ok {
+					continue
+				}
+				_, isSpan := block.CreatedBy().(*ast.Span)
+				return isSpan
+			}
+		}
+	}
+	t.Fatalf("module %v has no blocks", name)
+	return false
+}
+
+func entries(t *testing.T, path string) (files []string) {
+	t.Helper()
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCache(t *testing.T) {
+	includeDir := t.TempDir()
+	writeFile(t, filepath.Join(includeDir, "lib.hos"), lib)
+	dir, err := Open(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, wantWarnings := trace(t, dir, includeDir, main)
+	if cached(t, tr, "main") || cached(t, tr, "lib") {
+		t.Fatalf("modules loaded from an empty cache")
+	}
+	if len(wantWarnings) == 0 {
+		t.Fatalf("expected warnings for lib")
+	}
+	if got := len(entries(t, dir.path)); got != 2 {
+		t.Fatalf("got %d entries, want 2", got)
+	}
+
+	// nothing changed, so both modules and their warnings are loaded from the cache
+	tr, warnings := trace(t, dir, includeDir, main)
+	if !cached(t, tr, "main") || !cached(t, tr, "lib") {
+		t.Errorf("modules were traced again without changes")
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("Warnings() = %q, want %q", warnings, wantWarnings)
+	}
+
+	// only main is traced again when it changes
+	edited := main + "pipe Other() { Print(lib.Shout(\"b\")) }\n"
+	tr, _ = trace(t, dir, includeDir, edited)
+	if cached(t, tr, "main") || !cached(t, tr, "lib") {
+		t.Errorf("got main cached %v, lib cached %v, want only lib cached", cached(t, tr, "main"), cached(t, tr, "lib"))
+	}
+	if mod := tr.ModuleSet().Lookup("main").Mod; mod.Lookup("Other") == nil {
+		t.Errorf("edited main was not traced")
+	}
+
+	// a change to lib changes the key of main too, since main imports it
+	writeFile(t, filepath.Join(includeDir, "lib.hos"), lib+"pipe Whisper(s: string) (u: string) { u = s }\n")
+	tr, _ = trace(t, dir, includeDir, main)
+	if cached(t, tr, "main") || cached(t, tr, "lib") {
+		t.Errorf("modules were loaded from the cache after an import changed")
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	includeDir := t.TempDir()
+	writeFile(t, filepath.Join(includeDir, "lib.hos"), `module "lib"
+pipe Id(x) (y) { y = x }
+`)
+	dir, err := Open(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the type of x is decided by main, so neither module can be stored
+	src := `module "main"
+import "lib"
+stub Print(s: string)
+pipe main() { Print(lib.Id("a")) }
+`
+	trace(t, dir, includeDir, src)
+	if got := entries(t, dir.path); len(got) != 0 {
+		t.Errorf("got entries %q for modules with untyped ports", got)
+	}
+}
+
+func TestCacheCorrupt(t *testing.T) {
+	includeDir := t.TempDir()
+	writeFile(t, filepath.Join(includeDir, "lib.hos"), lib)
+	dir, err := Open(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace(t, dir, includeDir, main)
+	for _, path := range entries(t, dir.path) {
+		writeFile(t, path, "not an entry")
+	}
+	tr, _ := trace(t, dir, includeDir, main)
+	if cached(t, tr, "main") || cached(t, tr, "lib") {
+		t.Errorf("modules were loaded from corrupt entries")
+	}
+
+	// the corrupt entries are replaced
+	tr, _ = trace(t, dir, includeDir, main)
+	if !cached(t, tr, "main") || !cached(t, tr, "lib") {
+		t.Errorf("modules were not loaded after the entries were replaced")
+	}
+}
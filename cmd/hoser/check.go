@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/masp/hoser/analysis"
+	_ "github.com/masp/hoser/analysis/passes" // registers the analyzers that come with hoser
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+// checkCmd traces programs and runs the registered analyzers on them, like go vet. Every analyzer is run unless some
+// are enabled by their flag, e.g. -unused-port, in which case only those are run. -name=false disables one.
+// Analyzer flags are given prefixed with the name of the analyzer, e.g. -fan-out.max=8.
+func checkCmd(env *env, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	var include includeDirs
+	flags.Var(&include, "I", "add `dir` to the include path")
+	analyzers := analysis.Registered()
+	enabled := make(map[*analysis.Analyzer]*triState)
+	for _, a := range analyzers {
+		enabled[a] = new(triState)
+		flags.Var(enabled[a], a.Name, summary(a.Doc))
+		prefix := a.Name
+		a.Flags.VisitAll(func(f *flag.Flag) {
+			flags.Var(f.Value, prefix+"."+f.Name, f.Usage)
+		})
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: hoser check [-I dir]... [-analyzer]... file.hos...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	// like go vet, naming any analyzer runs only the ones named
+	only := false
+	for _, a := range analyzers {
+		if *enabled[a] == setTrue {
+			only = true
+		}
+	}
+	var selected []*analysis.Analyzer
+	for _, a := range analyzers {
+		if (only && *enabled[a] == setTrue) || (!only && *enabled[a] != setFalse) {
+			selected = append(selected, a)
+		}
+	}
+
+	code := exitOK
+	for _, filename := range flags.Args() {
+		if c := check(env, filename, include, selected); c > code {
+			code = c
+		}
+	}
+	return code
+}
+
+// check traces the program in filename and runs the analyzers on its module. It returns exitFailed if any problems
+// are found, including warnings of the tracer.
+func check(env *env, filename string, include includeDirs, analyzers []*analysis.Analyzer) int {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitUsage
+	}
+	tr := tracer.NewTracer(includePath(filename, include)...)
+	file := token.NewFile(filename, len(src))
+	module, err := tr.TraceModule(&file, src)
+	warnings := tr.Warnings()
+	token.PrintError(env.stderr, warnings)
+	if err != nil {
+		token.PrintError(env.stderr, err)
+		return exitInvalid
+	}
+
+	problems, err := analysis.Run(&analysis.Pass{
+		File:    &file,
+		Module:  module,
+		Modules: tr.ModuleSet(),
+		Refs:    tr.Refs(),
+	}, analyzers...)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v: %v\n", filename, err)
+		return exitFailed
+	}
+	token.PrintError(env.stderr, problems)
+	if len(warnings) > 0 || len(problems) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// summary is the first line of the documentation of an analyzer.
+func summary(doc string) string {
+	if i := strings.Index(doc, "\n"); i >= 0 {
+		doc = doc[:i]
+	}
+	return strings.TrimSuffix(doc, ".")
+}
+
+// triState is a bool flag that remembers whether it was set, so -name=false is not the same as leaving it out.
+type triState int
+
+const (
+	unset triState = iota
+	setTrue
+	setFalse
+)
+
+func (ts *triState) IsBoolFlag() bool { return true }
+
+func (ts *triState) String() string {
+	switch *ts {
+	case setTrue:
+		return "true"
+	case setFalse:
+		return "false"
+	}
+	return ""
+}
+
+func (ts *triState) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if b {
+		*ts = setTrue
+	} else {
+		*ts = setFalse
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	files := map[string]string{
+		"clean.hos": `module "main"
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = stdin
+}
+`,
+		"lint.hos": `module "main"
+
+stub Print(v: string) ()
+
+pipe Echo(a: string, b: string) (out: string) {
+	out = merge(a, a)
+}
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = Echo(stdin, stdin)
+	Print(stdin)
+}
+`,
+		"invalid.hos": `module "main"
+
+pipe main() (stdout: string) {
+	stdout = missing
+}
+`,
+	}
+	tests := []struct {
+		name       string
+		args       []string // $DIR is replaced by the directory of the files
+		wantStderr string   // $DIR is the directory of the files
+		wantCode   int
+	}{
+		{
+			name:     "Clean",
+			args:     []string{"$DIR/clean.hos"},
+			wantCode: exitOK,
+		},
+		{
+			name: "Problems",
+			args: []string{"$DIR/clean.hos", "$DIR/lint.hos"},
+			wantStderr: `$DIR/lint.hos:5:22: warning[unused-port]: input b of Echo is never used
+$DIR/lint.hos:6:8: warning[fan-out]: input a is merged with itself, so each of its values is sent more than once
+	fix: remove argument 2 of merge
+		$DIR/lint.hos:6:15: delete to $DIR/lint.hos:6:18
+`,
+			wantCode: exitFailed,
+		},
+		{
+			name:       "Only",
+			args:       []string{"-unused-port", "$DIR/lint.hos"},
+			wantStderr: "$DIR/lint.hos:5:22: warning[unused-port]: input b of Echo is never used\n",
+			wantCode:   exitFailed,
+		},
+		{
+			name:     "Disabled",
+			args:     []string{"-unused-port=false", "-fan-out=false", "$DIR/lint.hos"},
+			wantCode: exitOK,
+		},
+		{
+			name: "Errors",
+			args: []string{"$DIR/invalid.hos"},
+			wantStderr: `$DIR/invalid.hos:3:14: warning[unassigned-output]: output stdout of main is never assigned
+$DIR/invalid.hos:4:11: error[unknown-name]: no symbol found with name missing
+`,
+			wantCode: exitInvalid,
+		},
+		{
+			name: "Unknown analyzer",
+			args: []string{"-unimplemented-stub", "$DIR/lint.hos"},
+			wantStderr: `flag provided but not defined: -unimplemented-stub
+usage: hoser check [-I dir]... [-analyzer]... file.hos...
+  -I dir
+    	add dir to the include path
+  -fan-out
+    	fan-out reports values that are sent to many blocks or merged with themselves
+  -fan-out.max n
+    	report values sent to more than n blocks (default 4)
+  -literal-pipe
+    	literal-pipe reports pipes that only send literals
+  -unused-port
+    	unused-port reports inputs of pipes that are never used
+`,
+			wantCode: exitUsage,
+		},
+		{
+			name:       "Missing file",
+			args:       []string{"$DIR/missing.hos"},
+			wantStderr: "hoser: open $DIR/missing.hos: no such file or directory\n",
+			wantCode:   exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runHoser(t, files, append([]string{"check"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if stdout != "" {
+				t.Errorf("stdout = %q, want nothing", stdout)
+			}
+			if stderr != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr, tt.wantStderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/masp/hoser/ast"
+)
+
+// progFlags are the command-line flags of a program, one for every input of the entry pipe that is a scalar and not
+// stdin, args or bound to a file with -in. Flags are documented by the doc comments of their ports and are required
+// unless the port has a default:
+//
+//	# Grep prints the lines of stdin that match pattern.
+//	pipe main(
+//		stdin: string,
+//		pattern: string, # regular expression to match
+//		limit: int = 10, # maximum number of lines
+//	) (stdout: string) {...}
+//
+// is run with `hoser run grep.hos -pattern 'a+' -limit 3`.
+type progFlags struct {
+	entry  *ast.PipeDecl
+	set    *flag.FlagSet
+	values map[string]*portValue // by port name
+}
+
+// newProgFlags creates the flags of entry, which are parsed from the arguments after the file name. Name is how the
+// program was named on the command line.
+func newProgFlags(entry *ast.PipeDecl, name string, bound portFiles) *progFlags {
+	f := &progFlags{
+		entry:  entry,
+		set:    flag.NewFlagSet(name, flag.ContinueOnError),
+		values: make(map[string]*portValue),
+	}
+	f.set.Usage = func() {} // printed by parse, to stdout for -h
+	for _, field := range entry.Inputs.Fields {
+		port := field.Key.V
+		if _, ok := bound[port]; ok || port == "stdin" || port == "args" || !field.Type().IsScalar() {
+			continue
+		}
+		value := &portValue{typ: field.Type()}
+		if field.Default != nil {
+			value.v = convertDefault(field.Default, value.typ)
+			value.set = true
+		}
+		f.values[port] = value
+		f.set.Var(value, port, field.Doc.Text())
+	}
+	return f
+}
+
+// convertDefault widens the value of a default to typ, which the tracer has checked it widens to.
+func convertDefault(lit *ast.LiteralExpr, typ ast.EdgeType) interface{} {
+	switch v := lit.ParsedVal.(type) {
+	case int64:
+		switch typ {
+		case ast.FloatEdge:
+			return float64(v)
+		case ast.StringEdge:
+			return strconv.FormatInt(v, 10)
+		}
+	case float64:
+		if typ == ast.StringEdge {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	}
+	return lit.ParsedVal
+}
+
+// parse parses the flags at the start of args and returns the rest. If ok is false, the program must not be run
+// and the command exits with code: the usage is printed to stdout if it is asked for with -h and to stderr if args
+// are invalid.
+func (f *progFlags) parse(args []string, env *env) (rest []string, ok bool, code int) {
+	f.set.SetOutput(env.stderr)
+	if err := f.set.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			f.usage(env.stdout)
+			return nil, false, exitOK
+		}
+		f.usage(env.stderr)
+		return nil, false, exitUsage
+	}
+
+	var missing []string
+	for _, field := range f.entry.Inputs.Fields {
+		if value, ok := f.values[field.Key.V]; ok && !value.set {
+			missing = append(missing, "-"+field.Key.V)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(env.stderr, "hoser: missing required flags %s\n", strings.Join(missing, ", "))
+		f.usage(env.stderr)
+		return nil, false, exitUsage
+	}
+	return f.set.Args(), true, exitOK
+}
+
+// value returns the value of the flag for the input called name, false if the input is not a flag.
+func (f *progFlags) value(name string) (interface{}, bool) {
+	value, ok := f.values[name]
+	if !ok {
+		return nil, false
+	}
+	return value.v, true
+}
+
+// usage prints how to run the program, generated from the entry pipe and the doc comments of the pipe and its ports.
+func (f *progFlags) usage(w io.Writer) {
+	line := "usage: hoser run " + f.set.Name()
+	if len(f.values) > 0 {
+		line += " [flags]"
+	}
+	if hasInput(f.entry, "args") {
+		line += " [args...]"
+	}
+	fmt.Fprintln(w, line)
+	if doc := f.entry.Doc.Text(); doc != "" {
+		fmt.Fprintf(w, "\n%s\n", doc)
+	}
+	if len(f.values) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nflags:\n")
+	for _, field := range f.entry.Inputs.Fields {
+		value, ok := f.values[field.Key.V]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "  -%s %v\n", field.Key.V, value.typ)
+		var usage []string
+		if doc := field.Doc.Text(); doc != "" {
+			usage = strings.Split(doc, "\n")
+		}
+		switch {
+		case field.Default != nil && value.typ == ast.StringEdge:
+			usage = append(usage, fmt.Sprintf("(default %q)", value))
+		case field.Default != nil:
+			usage = append(usage, fmt.Sprintf("(default %v)", value))
+		default:
+			usage = append(usage, "(required)")
+		}
+		for _, line := range usage {
+			fmt.Fprintf(w, "    \t%s\n", line)
+		}
+	}
+}
+
+// portValue is the value of a flag, converted to the type of its port.
+type portValue struct {
+	typ ast.EdgeType
+	v   interface{} // int64, float64 or string
+	set bool        // given on the command line or by a default
+}
+
+func (p *portValue) String() string {
+	if p == nil || p.v == nil {
+		return ""
+	}
+	return fmt.Sprint(p.v)
+}
+
+func (p *portValue) Set(s string) error {
+	v, err := parseValue(p.typ, s)
+	if err != nil {
+		return err
+	}
+	p.v, p.set = v, true
+	return nil
+}
+
+// parseValue converts s to a value of the scalar type typ.
+func parseValue(typ ast.EdgeType, s string) (interface{}, error) {
+	var (
+		v   interface{} = s
+		err error
+	)
+	switch typ {
+	case ast.IntEdge:
+		v, err = strconv.ParseInt(s, 10, 64)
+	case ast.FloatEdge:
+		v, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expected %v, got %q", typ, s)
+	}
+	return v, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/masp/hoser/format"
+	"github.com/masp/hoser/token"
+)
+
+// fmtCmd formats source files in the canonical style of package format. Directories are formatted recursively, and
+// standard input is formatted to standard output if no files are given. Like gofmt, the formatted source is printed
+// unless one of -w, -d or -l is given.
+func fmtCmd(env *env, args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	var opts fmtOptions
+	flags.BoolVar(&opts.write, "w", false, "write the result to the file instead of standard output")
+	flags.BoolVar(&opts.diff, "d", false, "print a diff of the changes instead of the formatted source")
+	flags.BoolVar(&opts.list, "l", false, "list the files whose formatting differs")
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: hoser fmt [-w] [-d] [-l] [path...]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if flags.NArg() == 0 {
+		if opts.write {
+			fmt.Fprintf(env.stderr, "hoser: cannot use -w with standard input\n")
+			return exitUsage
+		}
+		src, err := io.ReadAll(env.stdin)
+		if err != nil {
+			fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+			return exitFailed
+		}
+		return opts.format(env, "<stdin>", src)
+	}
+
+	code := exitOK
+	for _, root := range flags.Args() {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || (path != root && filepath.Ext(path) != ".hos") {
+				return nil // files named on the command line are formatted whatever their extension, e.g. scripts
+			}
+			src, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if c := opts.format(env, path, src); c > code {
+				code = c
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+			if code < exitUsage {
+				code = exitUsage
+			}
+		}
+	}
+	return code
+}
+
+type fmtOptions struct {
+	write, diff, list bool
+}
+
+// format formats the source of the file called name and reports it as asked for by the options.
+func (o fmtOptions) format(env *env, name string, src []byte) int {
+	file := token.NewFile(name, len(src))
+	res, err := format.Source(&file, src)
+	if err != nil {
+		token.PrintError(env.stderr, err)
+		return exitInvalid
+	}
+	if !o.write && !o.diff && !o.list {
+		env.stdout.Write(res)
+		return exitOK
+	}
+	if bytes.Equal(src, res) {
+		return exitOK
+	}
+
+	if o.list {
+		fmt.Fprintln(env.stdout, name)
+	}
+	if o.write {
+		info, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+			return exitFailed
+		}
+		if err := os.WriteFile(name, res, info.Mode().Perm()); err != nil {
+			fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+			return exitFailed
+		}
+	}
+	if o.diff {
+		env.stdout.Write(unifiedDiff(name+".orig", name, src, res))
+	}
+	return exitOK
+}
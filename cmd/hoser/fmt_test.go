@@ -0,0 +1,144 @@
+package main
+
+import "testing"
+
+const unformatted = `module "main"
+pipe main(stdin: string) (stdout: string) { stdout = stdin }
+`
+
+const formatted = `module "main"
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = stdin
+}
+`
+
+func TestFmt(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string // $DIR is replaced by the directory of the files
+		stdin      string
+		wantStdout string // $DIR is the directory of the files
+		wantStderr string
+		wantCode   int
+		wantFiles  map[string]string
+	}{
+		{
+			name:       "Stdin",
+			stdin:      unformatted,
+			wantStdout: formatted,
+			wantCode:   exitOK,
+		},
+		{
+			name:       "File",
+			args:       []string{"$DIR/main.hos"},
+			wantStdout: formatted,
+			wantCode:   exitOK,
+		},
+		{
+			name:       "List",
+			args:       []string{"-l", "$DIR"},
+			wantStdout: "$DIR/main.hos\n",
+			wantCode:   exitOK,
+			wantFiles:  map[string]string{"main.hos": unformatted},
+		},
+		{
+			name:      "Write",
+			args:      []string{"-w", "$DIR"},
+			wantCode:  exitOK,
+			wantFiles: map[string]string{"main.hos": formatted, "lib/lib.hos": formatted, "notes.txt": "notes\n"},
+		},
+		{
+			name: "Diff",
+			args: []string{"-d", "$DIR/main.hos"},
+			wantStdout: `--- $DIR/main.hos.orig
++++ $DIR/main.hos
+@@ -1,2 +1,5 @@
+ module "main"
+-pipe main(stdin: string) (stdout: string) { stdout = stdin }
++
++pipe main(stdin: string) (stdout: string) {
++	stdout = stdin
++}
+`,
+			wantCode: exitOK,
+		},
+		{
+			name:     "Formatted",
+			args:     []string{"-l", "-d", "$DIR/lib/lib.hos"},
+			wantCode: exitOK,
+		},
+		{
+			name:       "Errors",
+			args:       []string{"$DIR/invalid.txt"},
+			wantStderr: "$DIR/invalid.txt:3:1: error: expected token ), got EOF\n",
+			wantCode:   exitInvalid,
+		},
+		{
+			name:       "Write stdin",
+			args:       []string{"-w"},
+			wantStderr: "hoser: cannot use -w with standard input\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Missing file",
+			args:       []string{"$DIR/missing.hos"},
+			wantStderr: "hoser: lstat $DIR/missing.hos: no such file or directory\n",
+			wantCode:   exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{
+				"-":           tt.stdin,
+				"main.hos":    unformatted,
+				"lib/lib.hos": formatted,
+				"notes.txt":   "notes\n",
+				"invalid.txt": "module \"main\"\npipe main(\n",
+			}
+			code, stdout, stderr := runHoser(t, files, append([]string{"fmt"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.wantStdout)
+			}
+			if stderr != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr, tt.wantStderr)
+			}
+			for name, want := range tt.wantFiles {
+				if got := files[name]; got != want {
+					t.Errorf("%v = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13"
+	want := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+\ No newline at end of file
+`
+	if got := string(unifiedDiff("a", "b", []byte(a), []byte(b))); got != want {
+		t.Errorf("unifiedDiff() =\n%s\nwant:\n%s", got, want)
+	}
+	if got := unifiedDiff("a", "b", []byte(a), []byte(a)); len(got) != 0 {
+		t.Errorf("unifiedDiff() of equal files = %q, want nothing", got)
+	}
+}
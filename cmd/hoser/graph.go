@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/masp/hoser/draw"
+	"github.com/masp/hoser/runtime"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+// graphCmd traces a program and prints the graphs of its pipes, or only the graph of one pipe if it is named after
+// the file, e.g. `hoser graph lib.hos:Filter`. Graphs are printed in the DOT language of Graphviz unless another
+// format of package draw is given with -format.
+func graphCmd(env *env, args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	var include includeDirs
+	flags.Var(&include, "I", "add `dir` to the include path")
+	var opts draw.Options
+	flags.BoolVar(&opts.Expand, "expand", false, "draw the pipes called by each pipe as clusters of their own blocks")
+	flags.Func("format", "print graphs as `dot`, mermaid or html", func(name string) (err error) {
+		opts.Format, err = draw.ParseFormat(name)
+		return err
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: hoser graph [-I dir]... [-expand] [-format dot|mermaid|html] file.hos[:pipe]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	filename, entryName := splitEntry(flags.Arg(0))
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitUsage
+	}
+	tr := tracer.NewTracer(includePath(filename, include)...)
+	file := token.NewFile(filename, len(src))
+	module, err := tr.TraceModule(&file, src)
+	token.PrintError(env.stderr, tr.Warnings())
+	if err != nil {
+		token.PrintError(env.stderr, err)
+		return exitInvalid
+	}
+	opts.Source = draw.ModuleSource(tr.ModuleSet(), os.ReadFile)
+
+	if filename == flags.Arg(0) {
+		err = draw.Module(env.stdout, module, opts)
+	} else {
+		entry, entryErr := runtime.Entry(module, entryName)
+		if entryErr != nil {
+			fmt.Fprintf(env.stderr, "hoser: %v: %v\n", filename, entryErr)
+			return exitUsage
+		}
+		err = draw.Pipe(env.stdout, entry, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v: %v\n", filename, err)
+		return exitFailed
+	}
+	return exitOK
+}
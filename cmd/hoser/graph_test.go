@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	files := map[string]string{
+		"main.hos": `module "main"
+
+pipe Echo(s: string) (out: string) {
+	out = s
+}
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = Echo(stdin)
+}
+`,
+		"invalid.hos": `module "main"
+
+pipe main() (stdout: string) {
+	stdout = missing
+}
+`,
+	}
+	tests := []struct {
+		name         string
+		args         []string // $DIR is replaced by the directory of the files
+		wantStdout   string   // prefix of the output
+		wantContains string   // anywhere in the output
+		wantStderr   string   // $DIR is the directory of the files
+		wantCode     int
+	}{
+		{
+			name:       "Module",
+			args:       []string{"$DIR/main.hos"},
+			wantStdout: "digraph \"main\" {\n\tnode [shape=plain];\n\tsubgraph \"cluster_Echo\" {\n",
+			wantCode:   exitOK,
+		},
+		{
+			name:       "Pipe",
+			args:       []string{"$DIR/main.hos:Echo"},
+			wantStdout: "digraph \"Echo\" {\n\tnode [shape=plain];\n\t\"Echo.in\" ",
+			wantCode:   exitOK,
+		},
+		{
+			name:         "Expand",
+			args:         []string{"-expand", "$DIR/main.hos:main"},
+			wantStdout:   "digraph \"main\" {\n\tnode [shape=plain];\n\t\"main.in\" ",
+			wantContains: "subgraph \"cluster_main.",
+			wantCode:     exitOK,
+		},
+		{
+			name:       "Mermaid",
+			args:       []string{"-format", "mermaid", "$DIR/main.hos:Echo"},
+			wantStdout: "flowchart TB\n\tn0([\"s\"])\n\tn1([\"out\"])\n\tn0 -->|\"s → out: string\"| n1\n",
+			wantCode:   exitOK,
+		},
+		{
+			name:       "HTML",
+			args:       []string{"-format=html", "$DIR/main.hos"},
+			wantStdout: "<!DOCTYPE html>\n",
+			wantCode:   exitOK,
+		},
+		{
+			name:       "Unknown format",
+			args:       []string{"-format", "svg", "$DIR/main.hos"},
+			wantStderr: "invalid value \"svg\" for flag -format: unknown format \"svg\", expected one of dot, mermaid, html\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Missing pipe",
+			args:       []string{"$DIR/main.hos:Missing"},
+			wantStderr: "hoser: $DIR/main.hos: no pipe named Missing in module\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name: "Errors",
+			args: []string{"$DIR/invalid.hos"},
+			wantStderr: `$DIR/invalid.hos:3:14: warning[unassigned-output]: output stdout of main is never assigned
+$DIR/invalid.hos:4:11: error[unknown-name]: no symbol found with name missing
+`,
+			wantCode: exitInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, got := runHoser(t, files, append([]string{"graph"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !strings.HasPrefix(stdout, tt.wantStdout) {
+				t.Errorf("stdout = %q, want prefix %q", stdout, tt.wantStdout)
+			}
+			if !strings.Contains(stdout, tt.wantContains) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout, tt.wantContains)
+			}
+			if tt.wantCode == exitUsage && strings.HasPrefix(got, tt.wantStderr+"usage:") {
+				got = tt.wantStderr // the usage printed after an invalid flag is not compared
+			}
+			if got != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", got, tt.wantStderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/masp/hoser/lsp"
+)
+
+// lspCmd runs a language server for editors, which reads requests from stdin and writes responses to stdout until
+// the editor exits. The modules imported by a document are found like those of a program run from its file.
+func lspCmd(env *env, args []string) int {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	var include includeDirs
+	flags.Var(&include, "I", "add `dir` to the include path")
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: hoser lsp [-I dir]...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	s := &lsp.Server{IncludePath: func(filename string) []string { return includePath(filename, include) }}
+	if err := s.Serve(env.stdin, env.stdout); err != nil {
+		fmt.Fprintf(env.stderr, "hoser: lsp: %v\n", err)
+		return exitFailed
+	}
+	return exitOK
+}
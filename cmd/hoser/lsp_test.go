@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLSP(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		messages   []string // bodies of the messages sent to the server
+		wantStdout string   // part of the output
+		wantStderr string   // prefix of the errors
+		wantCode   int
+	}{
+		{
+			name: "Session",
+			messages: []string{
+				`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+				`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`,
+				`{"jsonrpc":"2.0","method":"exit"}`,
+			},
+			wantStdout: `"hoverProvider":true`,
+			wantCode:   exitOK,
+		},
+		{
+			name: "No shutdown",
+			messages: []string{
+				`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+			},
+			wantStderr: "hoser: lsp: exit without shutdown\n",
+			wantCode:   exitFailed,
+		},
+		{
+			name:       "Arguments",
+			args:       []string{"main.hos"},
+			wantStderr: "usage: hoser lsp [-I dir]...\n",
+			wantCode:   exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdin strings.Builder
+			for _, msg := range tt.messages {
+				fmt.Fprintf(&stdin, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+			}
+			var stdout, stderr bytes.Buffer
+			code := hoser(append([]string{"lsp"}, tt.args...), &env{stdin: strings.NewReader(stdin.String()), stdout: &stdout, stderr: &stderr})
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout.String(), tt.wantStdout)
+			}
+			if !strings.HasPrefix(stderr.String(), tt.wantStderr) || (tt.wantStderr == "" && stderr.Len() > 0) {
+				t.Errorf("stderr = %q, want prefix %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
@@ -1,16 +1,175 @@
+// Command hoser runs hoser programs.
+//
+// Usage:
+//
+//	hoser <command> [arguments]
+//
+// The commands are:
+//
+//	run    trace and run a program
+//	fmt    format source files
+//	check  report likely mistakes in programs
+//	graph  print the graphs of pipes
+//	lsp    run a language server for editors
+//
+// A program is run from its main pipe, or from any other pipe named after the file, e.g. `hoser run lib.hos:Filter`.
+// The inputs of the pipe are its command-line flags, documented by the comments above or after each port. Run
+// `hoser run file.hos -h` to print them. Inputs and outputs can also be bound to files with -in port=file and
+// -out port=file.
+//
+// Modules imported by a program are found in the directory of the program, the directories given with -I and the
+// directories listed in HOSER_PATH. Traced modules are cached in HOSER_CACHE, or a directory in the user's cache
+// directory if it is not set. HOSER_CACHE=off disables the cache.
+//
+// Scripts are files starting with #!/usr/bin/env hoser, which can be run directly or with `hoser file.hos`. A script
+// may leave out its module header, and statements outside of any pipe are its main pipe:
+//
+//	#!/usr/bin/env hoser
+//	stdout = "> ${stdin}"
+//
+// `hoser fmt` reprints source files in one canonical style, keeping their comments. Like gofmt, it prints the
+// formatted source, or with -w rewrites the files, with -d prints a diff of the changes and with -l lists the files
+// whose formatting differs. Directories are formatted recursively, and standard input if no files are given.
+//
+// `hoser check` traces programs and runs the analyzers of package analysis on them, which report likely mistakes
+// like inputs that are never used. Like go vet, -name runs only the named analyzers and -name=false leaves one out.
+// Other packages can add analyzers with analysis.Register.
+//
+// `hoser graph` prints the graph of every pipe of a program, or of one pipe with file.hos:pipe, with -expand drawing
+// the pipes each pipe calls as clusters of their own blocks. Graphs are printed in the DOT language of Graphviz, or
+// with -format mermaid as a Mermaid flowchart, or with -format html as a page that draws them itself and shows the
+// source of each block when it is clicked:
+//
+//	hoser graph file.hos | dot -Tsvg > file.svg
+//	hoser graph -format html file.hos > file.html
+//
+// `hoser lsp` is a Language Server Protocol server that editors start and talk to over its standard input and
+// output. It shows the errors and warnings of a file as it is edited, describes pipes and ports on hover, goes to the
+// definitions of names across modules, completes block names and named arguments, lists the pipes and stubs of a file
+// and formats it like hoser fmt. Imported modules are found like those of `hoser run`, with -I adding directories.
+//
+// hoser exits with 0 if the command succeeded, 1 if the program failed while running or check found problems, 2 if
+// the command line is invalid and 3 if the program has errors and was not run.
 package main
 
 import (
 	"fmt"
-	"log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/masp/hoser/lexer"
+	"github.com/masp/hoser/cache"
+	"github.com/masp/hoser/tracer"
 )
 
+// Exit codes of the hoser command.
+const (
+	exitOK      = 0
+	exitFailed  = 1 // the program failed while running, or check found problems
+	exitUsage   = 2 // the command line is invalid
+	exitInvalid = 3 // the program has errors and was not run
+)
+
+// env is what a command reads from and writes to, which is the process's standard streams outside of tests.
+type env struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+type command struct {
+	name  string
+	args  string // arguments shown in the usage
+	short string
+	run   func(env *env, args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "[-I dir]... file.hos[:pipe] [flags] [args...]", "trace and run a program", runCmd},
+		{"fmt", "[-w] [-d] [-l] [path...]", "format source files", fmtCmd},
+		{"check", "[-I dir]... [-analyzer]... file.hos...", "report likely mistakes in programs", checkCmd},
+		{"graph", "[-I dir]... [-expand] [-format dot|mermaid|html] file.hos[:pipe]", "print the graphs of pipes", graphCmd},
+		{"lsp", "[-I dir]...", "run a language server for editors", lspCmd},
+	}
+}
+
 func main() {
-	tokens, err := lexer.ScanAll("I have a new toy\n	it is called a lexer and it is great")
-	fmt.Printf("%v\n", tokens)
+	os.Exit(hoser(os.Args[1:], &env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}))
+}
+
+func hoser(args []string, env *env) int {
+	if len(args) == 0 {
+		usage(env.stderr)
+		return exitUsage
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(env, args[1:])
+		}
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		usage(env.stdout)
+		return exitOK
+	}
+	if info, err := os.Stat(args[0]); err == nil && info.Mode().IsRegular() {
+		// a script started by its #! line, e.g. #!/usr/bin/env hoser
+		return runCmd(env, args)
+	}
+	fmt.Fprintf(env.stderr, "hoser: unknown command %q\n", args[0])
+	usage(env.stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: hoser <command> [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t%-6s %s\n", cmd.name, cmd.short)
+	}
+}
+
+// includeDirs is the value of a flag that can be given more than once, e.g. -I lib -I vendor.
+type includeDirs []string
+
+func (d *includeDirs) String() string { return strings.Join(*d, string(filepath.ListSeparator)) }
+
+func (d *includeDirs) Set(dir string) error {
+	*d = append(*d, dir)
+	return nil
+}
+
+// includePath is where the modules imported by the program in filename are found. Every directory is searched with
+// its subdirectories, which the tracer only does if the program imports a module, so running a program without
+// imports from a large directory like $HOME reads no other file.
+func includePath(filename string, dirs includeDirs) []string {
+	path := append([]string{filepath.Dir(filename)}, dirs...)
+	for _, dir := range filepath.SplitList(os.Getenv("HOSER_PATH")) {
+		if dir != "" {
+			path = append(path, dir)
+		}
+	}
+	return path
+}
+
+// openCache opens the cache of traced modules, or returns nil if it is disabled or cannot be opened. The cache only
+// makes tracing faster, so a missing cache is not an error.
+func openCache() tracer.ModuleCache {
+	dir := os.Getenv("HOSER_CACHE")
+	if dir == "off" {
+		return nil
+	}
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(userCache, "hoser")
+	}
+	c, err := cache.Open(dir)
 	if err != nil {
-		log.Fatalf("failed to scan: %v", err)
+		return nil
 	}
+	return c
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runHoser writes files to a temporary directory and runs hoser with args, in which $DIR is replaced by the
+// directory. The file named "-" is not written but given as standard input. The directory is replaced by $DIR in the
+// output and files is updated with the contents of the directory after hoser exits, so the files hoser writes can be
+// checked.
+func runHoser(t *testing.T, files map[string]string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if name == "-" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dirArgs []string
+	for _, arg := range args {
+		dirArgs = append(dirArgs, strings.ReplaceAll(arg, "$DIR", dir))
+	}
+	var outBuf, errBuf bytes.Buffer
+	code = hoser(dirArgs, &env{stdin: strings.NewReader(files["-"]), stdout: &outBuf, stderr: &errBuf})
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		files[filepath.ToSlash(name)] = string(src)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, strings.ReplaceAll(outBuf.String(), dir, "$DIR"), strings.ReplaceAll(errBuf.String(), dir, "$DIR")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/runtime"
+	"github.com/masp/hoser/token"
+)
+
+// runCmd traces a program and runs its entry pipe, which is main unless another pipe is named after the file name,
+// e.g. `hoser run lib.hos:Filter`. The ports of the entry pipe are bound to the process:
+//
+//	-in port=file   the input receives each line of file, converted to the type of the port
+//	-out port=file  each value sent to the output is written on its own line of file
+//	stdin: string   receives each line of standard input, without the newline
+//	args: string    receives each argument after the file name and flags
+//	stdout, stderr  print each value they receive on its own line
+//
+// The file - is standard input or output. Every other input must be an int, float or string, and is given by a
+// flag of the same name after the file name, see progFlags. Values sent to any other output are discarded if the
+// entry pipe is main, and printed to standard output otherwise so that library pipes can be run without a wrapper.
+func runCmd(env *env, args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	var include includeDirs
+	flags.Var(&include, "I", "add `dir` to the include path")
+	inFiles, outFiles := portFiles{}, portFiles{}
+	flags.Var(inFiles, "in", "read an input from the lines of a file, given as `port=file`")
+	flags.Var(outFiles, "out", "write an output to the lines of a file, given as `port=file`")
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: hoser run [-I dir]... [-in port=file]... [-out port=file]... file.hos[:pipe] [flags] [args...]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	filename, entryName := splitEntry(flags.Arg(0))
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitUsage
+	}
+	rt := runtime.New()
+	rt.IncludePath = includePath(filename, include)
+	rt.Cache = openCache()
+
+	file := token.NewFile(filename, len(src))
+	module, warnings, err := rt.LoadFile(&file, src)
+	token.PrintError(env.stderr, warnings)
+	if err != nil {
+		token.PrintError(env.stderr, err)
+		return exitInvalid
+	}
+	entry, err := runtime.Entry(module, entryName)
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v: %v\n", filename, err)
+		if entryName == "main" {
+			return exitInvalid
+		}
+		return exitUsage
+	}
+	if err := checkPortFiles(entry, inFiles, outFiles); err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitUsage
+	}
+
+	progFlags := newProgFlags(entry, flags.Arg(0), inFiles)
+	progArgs, ok, code := progFlags.parse(flags.Args()[1:], env)
+	if !ok {
+		return code
+	}
+	if len(progArgs) > 0 && !hasInput(entry, "args") {
+		fmt.Fprintf(env.stderr, "hoser: %v takes no arguments, got %d\n", entry.BlockName(), len(progArgs))
+		return exitUsage
+	}
+
+	ports := &entryPorts{}
+	if err := ports.open(inFiles, outFiles, env); err != nil {
+		ports.close()
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitUsage
+	}
+	if err := ports.bind(entry, env, progFlags, progArgs); err != nil {
+		ports.close()
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitInvalid
+	}
+	err = rt.Start(entry, ports.in, ports.out)
+	ports.wait()
+	if err == nil {
+		err = ports.err
+	}
+	if err != nil {
+		fmt.Fprintf(env.stderr, "hoser: %v\n", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// splitEntry splits the name of the entry pipe from an argument like lib.hos:Filter. The entry pipe is main if
+// the argument does not end in a pipe name.
+func splitEntry(arg string) (filename, entry string) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 || !isIdent(arg[i+1:]) {
+		return arg, "main"
+	}
+	return arg[:i], arg[i+1:]
+}
+
+func isIdent(s string) bool {
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// portFiles is the value of -in or -out, which bind ports to files and can be given more than once, e.g.
+// -in lines=input.txt -in words=-.
+type portFiles map[string]string
+
+func (f portFiles) String() string {
+	var bound []string
+	for port, file := range f {
+		bound = append(bound, port+"="+file)
+	}
+	sort.Strings(bound)
+	return strings.Join(bound, " ")
+}
+
+func (f portFiles) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("expected port=file")
+	}
+	port, file := s[:i], s[i+1:]
+	if _, ok := f[port]; ok {
+		return fmt.Errorf("port %v is bound twice", port)
+	}
+	f[port] = file
+	return nil
+}
+
+// checkPortFiles checks that every port bound to a file is a port of entry.
+func checkPortFiles(entry *ast.PipeDecl, in, out portFiles) error {
+	for _, bound := range []struct {
+		files portFiles
+		ports *ast.FieldList
+		desc  string
+	}{
+		{in, &entry.Inputs, "input"},
+		{out, &entry.Outputs, "output"},
+	} {
+		var names []string
+		for name := range bound.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !hasField(bound.ports, name) {
+				return fmt.Errorf("%v has no %v named %v", entry.BlockName(), bound.desc, name)
+			}
+		}
+	}
+	return nil
+}
+
+// entryPorts are the streams the entry pipe is started with, connected to the process.
+type entryPorts struct {
+	in  []*runtime.Stream
+	out []*runtime.Output
+
+	readers map[string]*portReader // inputs bound to files by port name
+	writers map[string]io.Writer   // outputs bound to files by port name
+	files   []*os.File             // outputs opened by open, closed once every value is written
+
+	writing sync.WaitGroup // until every value sent to a bound output is written
+	mu      sync.Mutex     // guards err and writes
+	err     error          // first error reading or writing a port
+}
+
+// portReader is a file an input is read from, named for errors.
+type portReader struct {
+	name string
+	r    io.Reader
+	f    *os.File // opened by open and closed once it is read, nil for stdin
+}
+
+// open opens the files bound to ports with -in and -out.
+func (p *entryPorts) open(in, out portFiles, env *env) error {
+	p.readers = make(map[string]*portReader)
+	for port, name := range in {
+		if name == "-" {
+			p.readers[port] = &portReader{name: "stdin", r: env.stdin}
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		p.readers[port] = &portReader{name: name, r: f, f: f}
+	}
+
+	p.writers = make(map[string]io.Writer)
+	for port, name := range out {
+		if name == "-" {
+			p.writers[port] = env.stdout
+			continue
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		p.files = append(p.files, f)
+		p.writers[port] = f
+	}
+	return nil
+}
+
+// bind connects each port of entry to a file, the process or a flag.
+func (p *entryPorts) bind(entry *ast.PipeDecl, env *env, flags *progFlags, args []string) error {
+	for _, field := range entry.Inputs.Fields {
+		name := field.Key.V
+		typ := field.Type()
+		switch {
+		case p.readers[name] != nil:
+			if !typ.IsScalar() {
+				return fmt.Errorf("cannot read input %v: %v of %v from a file, expected int, float or string", name, typ, entry.BlockName())
+			}
+			p.in = append(p.in, p.readLines(p.readers[name], typ))
+		case name == "stdin" && typ == ast.StringEdge:
+			p.in = append(p.in, p.readLines(&portReader{name: "stdin", r: env.stdin}, typ))
+		case name == "args" && typ == ast.StringEdge:
+			values := make([]interface{}, len(args))
+			for i, arg := range args {
+				values[i] = arg
+			}
+			p.in = append(p.in, runtime.ClosedStream(values...))
+		default:
+			value, ok := flags.value(name)
+			if !ok {
+				return fmt.Errorf("cannot bind input %v: %v of %v, expected stdin: string, args: string or a flag of type int, float or string", name, typ, entry.BlockName())
+			}
+			p.in = append(p.in, runtime.ConstStream(value))
+		}
+	}
+
+	for _, field := range entry.Outputs.Fields {
+		out := &runtime.Output{}
+		name := field.Key.V
+		switch {
+		case p.writers[name] != nil:
+			p.write(out, p.writers[name])
+		case name == "stdout":
+			p.write(out, env.stdout)
+		case name == "stderr":
+			p.write(out, env.stderr)
+		case entry.BlockName() != "main":
+			p.write(out, env.stdout)
+		}
+		p.out = append(p.out, out)
+	}
+	return nil
+}
+
+// wait waits until every value sent to the outputs is written and closes the files.
+func (p *entryPorts) wait() {
+	p.writing.Wait()
+	p.close()
+}
+
+func (p *entryPorts) close() {
+	for _, f := range p.files {
+		if err := f.Close(); err != nil {
+			p.fail(err)
+		}
+	}
+	p.files = nil
+}
+
+// fail records the first error reading or writing a port. The pipe keeps running with the values read so far.
+func (p *entryPorts) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func hasInput(entry *ast.PipeDecl, name string) bool {
+	return hasField(&entry.Inputs, name)
+}
+
+func hasField(fields *ast.FieldList, name string) bool {
+	for _, field := range fields.Fields {
+		if field.Key.V == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readLines sends every line of r converted to typ to the returned stream, which is closed at the end of r or at
+// the first line that cannot be converted. Lines are read as fast as r gives them, so the lines the program has not
+// handled yet are kept in memory, see runtime.Stream.
+func (p *entryPorts) readLines(r *portReader, typ ast.EdgeType) *runtime.Stream {
+	stream := runtime.NewStream()
+	go func() {
+		defer stream.Close()
+		if r.f != nil {
+			defer r.f.Close()
+		}
+		scanner := bufio.NewScanner(r.r)
+		for line := 1; scanner.Scan(); line++ {
+			v, err := parseValue(typ, scanner.Text())
+			if err != nil {
+				p.fail(fmt.Errorf("%v:%d: %v", r.name, line, err))
+				return
+			}
+			stream.Send(v)
+		}
+		if err := scanner.Err(); err != nil {
+			p.fail(fmt.Errorf("%v: %v", r.name, err))
+		}
+	}()
+	return stream
+}
+
+// write prints every value sent to out on its own line of w.
+func (p *entryPorts) write(out *runtime.Output, w io.Writer) {
+	stream := out.Connect()
+	p.writing.Add(1)
+	go func() {
+		defer p.writing.Done()
+		for {
+			v, ok := stream.Recv()
+			if !ok {
+				return
+			}
+			p.mu.Lock() // outputs may share a writer
+			fmt.Fprintln(w, formatValue(v))
+			p.mu.Unlock()
+		}
+	}()
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case *runtime.Pipe:
+		return "pipe " + v.Decl.BlockName()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const grep = `module "main"
+
+# main prints its flags
+# and then its args.
+pipe main(
+	# regular expression
+	# to match
+	pattern: string,
+	limit: int = 10, # maximum number of lines
+	ratio: float = 1,
+	args: string,
+) (stdout: string, stderr: string) {
+	stdout = "${pattern} ${limit} ${ratio}"
+	stderr = args
+}
+`
+
+const grepUsage = `usage: hoser run $DIR/main.hos [flags] [args...]
+
+main prints its flags
+and then its args.
+
+flags:
+  -pattern string
+    	regular expression
+    	to match
+    	(required)
+  -limit int
+    	maximum number of lines
+    	(default 10)
+  -ratio float
+    	(default 1)
+`
+
+func TestRun(t *testing.T) {
+	t.Setenv("HOSER_CACHE", "off")
+	t.Setenv("HOSER_PATH", "")
+	tests := []struct {
+		name       string
+		files      map[string]string // main.hos is run
+		args       []string
+		stdin      string
+		wantStdout string // $DIR is the directory of main.hos
+		wantStderr string
+		wantCode   int
+	}{
+		{
+			name: "Stdin to stdout",
+			files: map[string]string{"main.hos": `module "main"
+pipe main(stdin: string) (stdout: string) { stdout = "> ${stdin}" }
+`},
+			stdin:      "a\nb\n",
+			wantStdout: "> a\n> b\n",
+			wantCode:   exitOK,
+		},
+		{
+			name: "Args and stderr",
+			files: map[string]string{"main.hos": `module "main"
+pipe main(args: string) (stdout: string, stderr: int) {
+	stdout = args
+	stderr = 1
+}
+`},
+			args:       []string{"x", "y"},
+			wantStdout: "x\ny\n",
+			wantStderr: "1\n",
+			wantCode:   exitOK,
+		},
+		{
+			name: "Import next to main",
+			files: map[string]string{
+				"main.hos": `module "main"
+import "greet"
+pipe main() (stdout: string) { stdout = greet.Hello("world") }
+`,
+				"greet.hos": `module "greet"
+pipe Hello(name: string) (s: string) { s = "hello ${name}" }
+`,
+			},
+			wantStdout: "hello world\n",
+			wantCode:   exitOK,
+		},
+		{
+			name: "Errors",
+			files: map[string]string{"main.hos": `module "main"
+stub B(a: int)
+pipe main() {
+	x = 1
+	B(y)
+}
+`},
+			wantStderr: `$DIR/main.hos:4:2: warning[unused-symbol]: x is assigned but never used
+	fix: discard the value with _
+		$DIR/main.hos:4:2: replace to $DIR/main.hos:4:3 with "_"
+$DIR/main.hos:5:4: error[unknown-name]: no symbol found with name y
+`,
+			wantCode: exitInvalid,
+		},
+		{
+			name: "Missing main",
+			files: map[string]string{"main.hos": `module "main"
+pipe Other() {}
+`},
+			wantStderr: "hoser: $DIR/main.hos: missing 'main' pipe in module\n",
+			wantCode:   exitInvalid,
+		},
+		{
+			name: "Unbound input",
+			files: map[string]string{"main.hos": `module "main"
+pipe main(f: pipe(x: int)) {}
+`},
+			wantStderr: "hoser: cannot bind input f: pipe(int) () of main, expected stdin: string, args: string or a flag of type int, float or string\n",
+			wantCode:   exitInvalid,
+		},
+		{
+			name:       "Flags",
+			files:      map[string]string{"main.hos": grep},
+			args:       []string{"-pattern", "a", "-ratio", "0.5", "x"},
+			wantStdout: "a 10 0.5\n",
+			wantStderr: "x\n",
+			wantCode:   exitOK,
+		},
+		{
+			name: "Flag with stdin",
+			files: map[string]string{"main.hos": `module "main"
+pipe main(stdin: string, pattern: string) (stdout: string) { stdout = "${pattern}:${stdin}" }
+`},
+			args:       []string{"-pattern", "p"},
+			stdin:      "a\nb\n",
+			wantStdout: "p:a\np:b\n",
+			wantCode:   exitOK,
+		},
+		{
+			name:       "Flag with default",
+			files:      map[string]string{"main.hos": grep},
+			args:       []string{"-limit=3", "-pattern", ""},
+			wantStdout: " 3 1\n",
+			wantCode:   exitOK,
+		},
+		{
+			name:       "Invalid flag value",
+			files:      map[string]string{"main.hos": grep},
+			args:       []string{"-pattern", "a", "-limit", "ten"},
+			wantStderr: "invalid value \"ten\" for flag -limit: expected int, got \"ten\"\n" + grepUsage,
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Missing flag",
+			files:      map[string]string{"main.hos": grep},
+			wantStderr: "hoser: missing required flags -pattern\n" + grepUsage,
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Help",
+			files:      map[string]string{"main.hos": grep},
+			args:       []string{"-h"},
+			wantStdout: grepUsage,
+			wantCode:   exitOK,
+		},
+		{
+			name: "Unexpected args",
+			files: map[string]string{"main.hos": `module "main"
+pipe main() {}
+`},
+			args:       []string{"x"},
+			wantStderr: "hoser: main takes no arguments, got 1\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name: "Runtime failure",
+			files: map[string]string{"main.hos": `module "main"
+stub Missing()
+pipe main() { Missing() }
+`},
+			wantStderr: "hoser: no proc registered for stub main.Missing\n",
+			wantCode:   exitFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.files["-"] = tt.stdin
+			code, stdout, stderr := runHoser(t, tt.files, append([]string{"run", "$DIR/main.hos"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.wantStdout)
+			}
+			if stderr != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr, tt.wantStderr)
+			}
+		})
+	}
+}
+
+const double = `module "main"
+pipe Double(x: int) (y: int, s: string) {
+	y = x
+	s = "x=${x}"
+}
+stub Print(s: string)
+`
+
+func TestRunEntry(t *testing.T) {
+	t.Setenv("HOSER_CACHE", "off")
+	t.Setenv("HOSER_PATH", "")
+	tests := []struct {
+		name       string
+		runFlags   []string // before the file name, $DIR is replaced by the directory of main.hos
+		entry      string   // after main.hos
+		args       []string
+		stdin      string
+		wantStdout string
+		wantStderr string
+		wantCode   int
+		wantFiles  map[string]string
+	}{
+		{
+			name:       "Input from file",
+			runFlags:   []string{"-in", "x=$DIR/in.txt", "-out", "s=$DIR/s.txt"},
+			entry:      ":Double",
+			wantStdout: "7\n",
+			wantCode:   exitOK,
+			wantFiles:  map[string]string{"s.txt": "x=7\n"},
+		},
+		{
+			name:       "Input from stdin",
+			runFlags:   []string{"-in", "x=-", "-out", "y=$DIR/y.txt"},
+			entry:      ":Double",
+			stdin:      "1\n2\n",
+			wantStdout: "x=1\nx=2\n",
+			wantCode:   exitOK,
+			wantFiles:  map[string]string{"y.txt": "1\n2\n"},
+		},
+		{
+			name:       "Input from flag",
+			runFlags:   []string{"-out", "y=$DIR/y.txt"},
+			entry:      ":Double",
+			args:       []string{"-x", "3"},
+			wantStdout: "x=3\n",
+			wantCode:   exitOK,
+			wantFiles:  map[string]string{"y.txt": "3\n"},
+		},
+		{
+			name:       "Invalid line",
+			runFlags:   []string{"-in", "x=-", "-out", "y=$DIR/y.txt"},
+			entry:      ":Double",
+			stdin:      "1\none\n",
+			wantStdout: "x=1\n",
+			wantStderr: "hoser: stdin:2: expected int, got \"one\"\n",
+			wantCode:   exitFailed,
+		},
+		{
+			name:       "Unknown port",
+			runFlags:   []string{"-in", "z=-"},
+			entry:      ":Double",
+			wantStderr: "hoser: Double has no input named z\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Missing input file",
+			runFlags:   []string{"-in", "x=$DIR/missing.txt"},
+			entry:      ":Double",
+			wantStderr: "hoser: open $DIR/missing.txt: no such file or directory\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Missing entry",
+			entry:      ":Triple",
+			wantStderr: "hoser: $DIR/main.hos: no pipe named Triple in module\n",
+			wantCode:   exitUsage,
+		},
+		{
+			name:       "Stub entry",
+			entry:      ":Print",
+			wantStderr: "hoser: $DIR/main.hos: Print is a stub, expected a pipe\n",
+			wantCode:   exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"-": tt.stdin, "main.hos": double, "in.txt": "7\n"}
+			args := append([]string{"run"}, tt.runFlags...)
+			args = append(args, "$DIR/main.hos"+tt.entry)
+			args = append(args, tt.args...)
+			code, stdout, stderr := runHoser(t, files, args...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.wantStdout)
+			}
+			if stderr != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr, tt.wantStderr)
+			}
+			for name, want := range tt.wantFiles {
+				if got := files[name]; got != want {
+					t.Errorf("%v = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	t.Setenv("HOSER_CACHE", "off")
+	t.Setenv("HOSER_PATH", "")
+	files := map[string]string{
+		"-": "a\nb\n",
+		"script": `#!/usr/bin/env hoser
+import "greet"
+stdout = greet.Hello(stdin)
+stderr = args
+`,
+		"greet.hos": `module "greet"
+pipe Hello(name: string) (s: string) { s = "hello ${name}" }
+`,
+	}
+	code, stdout, stderr := runHoser(t, files, "$DIR/script", "x")
+	if code != exitOK {
+		t.Errorf("exit code = %d, want %d, stderr:\n%s", code, exitOK, stderr)
+	}
+	if got, want := stdout, "hello a\nhello b\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if got, want := stderr, "x\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"No command", nil, exitUsage},
+		{"Unknown command", []string{"build"}, exitUsage},
+		{"Run without file", []string{"run"}, exitUsage},
+		{"Run missing file", []string{"run", "missing.hos"}, exitUsage},
+		{"Help", []string{"help"}, exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := hoser(tt.args, &env{stdin: strings.NewReader(""), stdout: &out, stderr: &out}); code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d, output:\n%s", code, tt.wantCode, out.String())
+			}
+		})
+	}
+}
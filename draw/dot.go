@@ -0,0 +1,82 @@
+package draw
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+func writeDOT(buf *bytes.Buffer, name string, d *diagram) {
+	fmt.Fprintf(buf, "digraph %s {\n", dotID(name))
+	buf.WriteString("\tnode [shape=plain];\n")
+	writeCluster(buf, d.root, 1)
+	for _, e := range d.edges {
+		fmt.Fprintf(buf, "\t%s:%s:s -> %s:%s:n [label=%s];\n",
+			dotID(e.src.node.id), dotPort(e.src), dotID(e.dst.node.id), dotPort(e.dst), dotID(string(e.typ)))
+	}
+	buf.WriteString("}\n")
+}
+
+// writeCluster writes the nodes of c and its clusters as subgraphs, indented by depth tabs.
+func writeCluster(buf *bytes.Buffer, c *cluster, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, n := range c.nodes {
+		fmt.Fprintf(buf, "%s%s [label=<%s>];\n", indent, dotID(n.id), nodeTable(n))
+	}
+	for _, sub := range c.clusters {
+		// Graphviz only draws a box around subgraphs whose name starts with cluster
+		fmt.Fprintf(buf, "%ssubgraph %s {\n", indent, dotID("cluster_"+sub.id))
+		fmt.Fprintf(buf, "%s\tlabel=%s;\n", indent, dotID(sub.label))
+		writeCluster(buf, sub, depth+1)
+		fmt.Fprintf(buf, "%s}\n", indent)
+	}
+}
+
+// nodeTable is an HTML-like label with a row for each of the inputs, the title and the outputs of a node. Every row
+// spans the same number of columns, so each input spans as many columns as there are outputs and the other way round.
+func nodeTable(n *node) string {
+	inSpan, outSpan := max(len(n.outputs), 1), max(len(n.inputs), 1)
+	cols := inSpan * max(len(n.inputs), 1)
+
+	var sb strings.Builder
+	sb.WriteString(`<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4">`)
+	writePorts := func(ports []portInfo, prefix string, span int) {
+		if len(ports) == 0 {
+			return
+		}
+		sb.WriteString("<TR>")
+		for i, p := range ports {
+			fmt.Fprintf(&sb, `<TD PORT="%s%d" COLSPAN="%d">%s</TD>`, prefix, i, span, html.EscapeString(p.label()))
+		}
+		sb.WriteString("</TR>")
+	}
+	writePorts(n.inputs, "i", inSpan)
+	if n.label != "" {
+		fmt.Fprintf(&sb, `<TR><TD COLSPAN="%d"><B>%s</B></TD></TR>`, cols, html.EscapeString(n.label))
+	}
+	writePorts(n.outputs, "o", outSpan)
+	sb.WriteString("</TABLE>")
+	return sb.String()
+}
+
+// dotPort is the name of the cell of p in the table of its node.
+func dotPort(p port) string {
+	if p.out {
+		return "o" + strconv.Itoa(p.idx)
+	}
+	return "i" + strconv.Itoa(p.idx)
+}
+
+// dotID quotes s so it can be used as an ID in DOT.
+func dotID(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
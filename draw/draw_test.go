@@ -0,0 +1,233 @@
+package draw
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+const src = `module "main"
+
+stub Upper(s: string) (upper: string)
+
+pipe Shout(s: string) (out: string) {
+	out = Upper(s)
+}
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = merge(Shout(stdin), "done")
+}
+`
+
+func trace(t *testing.T, src string) *ast.Module {
+	t.Helper()
+	file := token.NewFile("", len(src))
+	module, err := tracer.NewTracer().TraceModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return module
+}
+
+func TestPipe(t *testing.T) {
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{DOT, `digraph "main" {
+	node [shape=plain];
+	"main.in" [label=<<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4"><TR><TD PORT="o0" COLSPAN="1">stdin</TD></TR></TABLE>>];
+	"main.out" [label=<<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4"><TR><TD PORT="i0" COLSPAN="1">stdout</TD></TR></TABLE>>];
+	"main.0" [label=<<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4"><TR><TD PORT="i0" COLSPAN="1">s</TD></TR><TR><TD COLSPAN="1"><B>Shout</B></TD></TR><TR><TD PORT="o0" COLSPAN="1">out</TD></TR></TABLE>>];
+	"main.1" [label=<<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4"><TR><TD COLSPAN="1"><B>&#34;done&#34;</B></TD></TR><TR><TD PORT="o0" COLSPAN="1">string</TD></TR></TABLE>>];
+	"main.2" [label=<<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4"><TR><TD PORT="i0" COLSPAN="1">string</TD><TD PORT="i1" COLSPAN="1">string</TD></TR><TR><TD COLSPAN="2"><B>merge</B></TD></TR><TR><TD PORT="o0" COLSPAN="2">string</TD></TR></TABLE>>];
+	"main.in":o0:s -> "main.0":i0:n [label="string"];
+	"main.0":o0:s -> "main.2":i0:n [label="string"];
+	"main.1":o0:s -> "main.2":i1:n [label="string"];
+	"main.2":o0:s -> "main.out":i0:n [label="string"];
+}
+`},
+		{Mermaid, `flowchart TB
+	n0(["stdin"])
+	n1(["stdout"])
+	n2["Shout"]
+	n3["#quot;done#quot;"]
+	n4["merge"]
+	n0 -->|"stdin → s: string"| n2
+	n2 -->|"out: string"| n4
+	n3 -->|"string"| n4
+	n4 -->|"stdout: string"| n1
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			module := trace(t, src)
+			var buf bytes.Buffer
+			if err := Pipe(&buf, module.Lookup("main").(*ast.PipeDecl), Options{Format: tt.format}); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Pipe() =\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestModule(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		wantLine []string // lines of the output, which are not all the lines
+	}{
+		{
+			"Clusters",
+			Options{},
+			[]string{
+				"\tsubgraph \"cluster_Shout\" {",
+				"\tsubgraph \"cluster_main\" {",
+				"\t\t\"main.0\" [label=<<TABLE BORDER=\"0\" CELLBORDER=\"1\" CELLSPACING=\"0\" CELLPADDING=\"4\"><TR><TD PORT=\"i0\" COLSPAN=\"1\">s</TD></TR><TR><TD COLSPAN=\"1\"><B>Shout</B></TD></TR><TR><TD PORT=\"o0\" COLSPAN=\"1\">out</TD></TR></TABLE>>];",
+				"\t\"Shout.in\":o0:s -> \"Shout.0\":i0:n [label=\"string\"];",
+				"\t\"main.in\":o0:s -> \"main.0\":i0:n [label=\"string\"];",
+			},
+		},
+		{
+			"Mermaid",
+			Options{Format: Mermaid, Expand: true},
+			[]string{
+				"\tsubgraph c0 [\"Shout\"]",
+				"\t\tsubgraph c2 [\"Shout\"]",
+				"\t\t\tn7([\"s\"])",
+				"\tn3 -->|\"stdin → s: string\"| n7",
+			},
+		},
+		{
+			"Expand",
+			Options{Expand: true},
+			[]string{
+				"\t\tsubgraph \"cluster_main.0\" {",
+				"\t\t\tlabel=\"Shout\";",
+				"\t\"main.in\":o0:s -> \"main.0.in\":o0:n [label=\"string\"];",
+				"\t\"main.0.in\":o0:s -> \"main.0.0\":i0:n [label=\"string\"];",
+				"\t\"main.0.out\":i0:s -> \"main.2\":i0:n [label=\"string\"];",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			module := trace(t, src)
+			var buf bytes.Buffer
+			if err := Module(&buf, module, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			lines := make(map[string]bool)
+			for _, line := range strings.Split(buf.String(), "\n") {
+				lines[line] = true
+			}
+			for _, want := range tt.wantLine {
+				if !lines[want] {
+					t.Errorf("Module() has no line %q, got:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	src := `module "main"
+stub Upper(s: string) (upper: string)
+pipe main() {}
+`
+	file := token.NewFile("", len(src))
+	module, err := parser.ParseModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Pipe(&bytes.Buffer{}, module.Lookup("main").(*ast.PipeDecl), Options{}); !errors.Is(err, ErrNotTraced) {
+		t.Errorf("Pipe() err = %v, want %v", err, ErrNotTraced)
+	}
+	if err := Module(&bytes.Buffer{}, module, Options{}); !errors.Is(err, ErrNoPipes) {
+		t.Errorf("Module() err = %v, want %v", err, ErrNoPipes)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "main.hos")
+	if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := token.NewFile(filename, len(src))
+	tr := tracer.NewTracer()
+	module, err := tr.TraceModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	opts := Options{Format: HTML, Expand: true, Source: ModuleSource(tr.ModuleSet(), os.ReadFile)}
+	if err := Module(&buf, module, opts); err != nil {
+		t.Fatal(err)
+	}
+	page := strings.ReplaceAll(buf.String(), dir, "$DIR")
+	for _, want := range []string{
+		"<title>main</title>",
+		"<h2>Shout</h2>",
+		"<h2>main</h2>",
+		`<rect class="cluster"`,
+		`<g><title>upper: string</title>`,
+		`{"pos":"$DIR/main.hos:10:1","text":"\tstdout = merge(Shout(stdin), \"done\")"}`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page has no %q, got:\n%s", want, page)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	module := trace(t, src)
+	d := &diagram{root: &cluster{}}
+	d.addGraph(d.root, "main", module.Lookup("main").(*ast.PipeDecl), Options{Expand: true}, map[*ast.PipeDecl]bool{})
+	l := newLayout(d, d.root)
+
+	// every edge goes down, and boxes in the same layer do not overlap
+	for _, e := range d.edges {
+		_, y1, _, y2 := l.edgeEnds(e)
+		if y2 <= y1 {
+			t.Errorf("edge from %v to %v goes up from %v to %v", e.src.node.id, e.dst.node.id, y1, y2)
+		}
+	}
+	for a, ra := range l.nodes {
+		for b, rb := range l.nodes {
+			if a != b && ra.x < rb.x+rb.w && rb.x < ra.x+ra.w && ra.y < rb.y+rb.h && rb.y < ra.y+ra.h {
+				t.Errorf("%v at %v overlaps %v at %v", a.id, ra, b.id, rb)
+			}
+		}
+	}
+	// the nodes of the expanded pipe are inside its frame
+	for n, r := range l.nodes {
+		for c, frame := range l.clusters {
+			if l.nodeParent[n] == c && (r.x < frame.x || r.y < frame.y || r.x+r.w > frame.x+frame.w || r.y+r.h > frame.y+frame.h) {
+				t.Errorf("%v at %v is outside of its cluster at %v", n.id, r, frame)
+			}
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{DOT, Mermaid, HTML} {
+		if got, err := ParseFormat(f.String()); err != nil || got != f {
+			t.Errorf("ParseFormat(%q) = %v, %v, want %v", f.String(), got, err, f)
+		}
+	}
+	if _, err := ParseFormat("svg"); err == nil {
+		t.Errorf("ParseFormat(svg) succeeded, want an error")
+	}
+}
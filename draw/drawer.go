@@ -1,54 +1,361 @@
+// Package draw renders the graphs of traced pipes so they can be reviewed. Graphs are written as Graphviz DOT, as
+// Mermaid flowcharts or as an HTML page that needs neither:
+//
+//	hoser graph file.hos | dot -Tsvg > file.svg
+//
+// Every block is drawn as a box with its input ports on top and its output ports at the bottom, and each edge goes
+// from an output port to an input port labelled with the type of its values. The inputs and outputs of the pipe
+// itself are drawn as two more boxes. Ports are named after the ports of the block they belong to, and after their
+// type if they have no name, like the inputs of merge.
 package draw
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
 
-	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
 )
 
-// drawer will take in a module in hoser and convert it into a dot format file that can be rendered
-// using GraphViz software.
-
 var (
-	ErrNoRootBlocks = errors.New("No root blocks found (blocks with no inputs or outputs")
+	ErrNotTraced = errors.New("pipe has not been traced")
+	ErrNoPipes   = errors.New("module has no traced pipes")
+)
+
+// Format is a language that graphs are written in.
+type Format int
+
+const (
+	DOT     Format = iota // the DOT language of Graphviz
+	Mermaid               // a Mermaid flowchart, which has no ports so edges are labelled with the ports they connect
+	HTML                  // a page drawing the graphs as SVG with a layout of its own, showing the source of clicked blocks
 )
 
-func Module(m *parser.Module) (string, error) {
-	var sb strings.Builder
-	sb.WriteString("digraph G {")
-	roots := m.RootBlocks()
-	if len(roots) == 0 {
-		return "", ErrNoRootBlocks
-	}
-
-	for _, root := range roots {
-		if err := rootBlock(root, &sb); err != nil {
-			return "", err
-		}
-	}
-	sb.WriteString("}")
-	return sb.String(), nil
-}
-
-func rootBlock(root *parser.Block, sb *strings.Builder) error {
-	sb.WriteString(fmt.Sprintf("subgraph %s {", root.Name))
-
-	sb.WriteString(fmt.Sprintf(`%s [label=<
-	<TABLE BORDER="0" CELLBORDER="1" CELLSPACING="0" CELLPADDING="4">
-	  <TR>
-		<TD ROWSPAN="3">hello<BR/>world</TD>
-		<TD COLSPAN="3">b</TD>
-		<TD ROWSPAN="3">g</TD>
-		<TD ROWSPAN="3">h</TD>
-	  </TR>
-	  <TR>
-		<TD>c</TD><TD PORT="here">d</TD><TD>e</TD>
-	  </TR>
-	  <TR>
-		<TD COLSPAN="3">f</TD>
-	  </TR>
-	</TABLE>>];`, ))
-	sb.WriteString("}")
+var formatNames = [...]string{DOT: "dot", Mermaid: "mermaid", HTML: "html"}
+
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+	return formatNames[f]
+}
+
+// ParseFormat returns the format called name, e.g. mermaid.
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if n == name {
+			return Format(f), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format %q, expected one of %v", name, strings.Join(formatNames[:], ", "))
+}
+
+// Options configure how graphs are drawn.
+type Options struct {
+	Format Format
+	// Expand draws each pipe called in a graph as a cluster of the blocks of its own graph, recursively, rather than as
+	// a single block.
+	Expand bool
+	// Source returns the source that node was created from, which is in the module declaring pipe. It is used by
+	// the HTML format to show the source of each block and may be nil, see ModuleSource.
+	Source func(pipe *ast.PipeDecl, node ast.Node) (Snippet, bool)
+}
+
+// Snippet is the source a block was created from.
+type Snippet struct {
+	Pos  token.Position // start of the first line
+	Text string         // every line the block was created from
+}
+
+// ModuleSource returns an Options.Source that finds the source of the pipes declared by the loaded modules of set
+// in the files of the modules, which are read with readFile.
+func ModuleSource(set *ast.ModuleSet, readFile func(filename string) ([]byte, error)) func(pipe *ast.PipeDecl, node ast.Node) (Snippet, bool) {
+	files := make(map[*ast.PipeDecl]*token.File)
+	for _, cached := range set.Modules {
+		if !cached.IsLoaded() || cached.Mod == nil || cached.File == nil {
+			continue
+		}
+		for _, decl := range cached.Mod.DefinedBlocks {
+			if pipe, ok := decl.(*ast.PipeDecl); ok {
+				files[pipe] = cached.File
+			}
+		}
+	}
+	sources := make(map[string][]byte)
+	return func(pipe *ast.PipeDecl, node ast.Node) (Snippet, bool) {
+		file, ok := files[pipe]
+		if !ok || node == nil || !node.Pos().IsValid() {
+			return Snippet{}, false
+		}
+		src, ok := sources[file.Name]
+		if !ok {
+			var err error
+			if src, err = readFile(file.Name); err != nil {
+				return Snippet{}, false
+			}
+			sources[file.Name] = src
+		}
+		start, end := int(node.Pos())-1, int(node.End())-1
+		if start >= len(src) {
+			return Snippet{}, false
+		}
+		if end < start || end > len(src) {
+			end = start
+		}
+		// widen to whole lines so the block is shown in context
+		start = bytes.LastIndexByte(src[:start], '\n') + 1
+		if i := bytes.IndexByte(src[end:], '\n'); i >= 0 {
+			end += i
+		} else {
+			end = len(src)
+		}
+		return Snippet{Pos: file.Position(file.Pos(start)), Text: string(src[start:end])}, true
+	}
+}
+
+// Pipe writes the graph of a traced pipe to w.
+func Pipe(w io.Writer, pipe *ast.PipeDecl, opts Options) error {
+	if pipe.BodyDAG == nil {
+		return fmt.Errorf("%v: %w", pipe.BlockName(), ErrNotTraced)
+	}
+	d := &diagram{root: &cluster{}}
+	d.addGraph(d.root, pipe.BlockName(), pipe, opts, map[*ast.PipeDecl]bool{})
+	return d.write(w, pipe.BlockName(), opts)
+}
+
+// Module writes the graph of every traced pipe of module to w, each in a cluster labelled with the name of the pipe.
+func Module(w io.Writer, module *ast.Module, opts Options) error {
+	d := &diagram{root: &cluster{}}
+	for _, decl := range module.DefinedBlocks {
+		pipe, ok := decl.(*ast.PipeDecl)
+		if !ok || pipe.BodyDAG == nil {
+			continue
+		}
+		c := &cluster{id: pipe.BlockName(), label: pipe.BlockName()}
+		d.root.clusters = append(d.root.clusters, c)
+		d.addGraph(c, pipe.BlockName(), pipe, opts, map[*ast.PipeDecl]bool{})
+	}
+	if len(d.root.clusters) == 0 {
+		return ErrNoPipes
+	}
+	return d.write(w, module.Name.Value, opts)
+}
+
+func (d *diagram) write(w io.Writer, title string, opts Options) error {
+	var buf bytes.Buffer
+	switch opts.Format {
+	case DOT:
+		writeDOT(&buf, title, d)
+	case Mermaid:
+		writeMermaid(&buf, d)
+	case HTML:
+		if err := writeHTML(&buf, title, d, opts); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %v", opts.Format)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// diagram is a graph made of boxes with ports, independent of the format it is drawn in.
+type diagram struct {
+	root  *cluster // the nodes that are not in any cluster
+	edges []edge
+}
+
+// cluster groups the nodes drawn for a pipe.
+type cluster struct {
+	id       string
+	label    string
+	nodes    []*node
+	clusters []*cluster
+}
+
+type node struct {
+	id              string
+	label           string // empty for the inputs and outputs of a pipe, which are a single row of ports
+	inputs, outputs []portInfo
+	block           ast.Block     // nil for the inputs and outputs of a pipe
+	pipe            *ast.PipeDecl // pipe whose graph the node is in
+}
+
+type portInfo struct {
+	name string // empty if the port has no name
+	typ  ast.EdgeType
+}
+
+// label is the name of the port, or its type if it has none.
+func (p portInfo) label() string {
+	switch {
+	case p.name != "":
+		return p.name
+	case p.typ == ast.InvalidEdge:
+		return "?"
+	default:
+		return string(p.typ)
+	}
+}
+
+type edge struct {
+	src, dst port
+	typ      ast.EdgeType
+}
+
+// port is a port of a node, in its row of inputs or of outputs. Edges go from outputs to inputs, except at the
+// inputs and outputs of an expanded pipe, whose ports are passed through by edges on both sides.
+type port struct {
+	node *node
+	idx  int
+	out  bool // the port is in the row of outputs
+}
+
+func (p port) info() portInfo {
+	if p.out {
+		return p.node.outputs[p.idx]
+	}
+	return p.node.inputs[p.idx]
+}
+
+// ends are the nodes that the edges to the inputs and from the outputs of a block are connected to, which are the
+// nodes of the inputs and outputs of its graph if the block is an expanded pipe.
+type ends struct {
+	in, out  *node
+	expanded bool
+}
+
+// addGraph adds the blocks of the graph of pipe to c, with ids starting with prefix. Expanded pipes are skipped if
+// they are already being expanded, so a recursive pipe is drawn as a block. It returns the nodes of the inputs and
+// outputs of the pipe, nil if it has none.
+func (d *diagram) addGraph(c *cluster, prefix string, pipe *ast.PipeDecl, opts Options, expanding map[*ast.PipeDecl]bool) ends {
+	expanding[pipe] = true
+	defer delete(expanding, pipe)
+
+	graph := pipe.BodyDAG
+	var root ends
+	if len(graph.Root.InPorts()) > 0 {
+		root.in = &node{id: prefix + ".in", outputs: ports(graph.Root.InPorts(), fieldNames(pipe.Inputs)), pipe: pipe}
+		c.nodes = append(c.nodes, root.in)
+	}
+	if len(graph.Root.OutPorts()) > 0 {
+		root.out = &node{id: prefix + ".out", inputs: ports(graph.Root.OutPorts(), fieldNames(pipe.Outputs)), pipe: pipe}
+		c.nodes = append(c.nodes, root.out)
+	}
+
+	blocks := make([]ends, len(graph.Blocks))
+	for i, block := range graph.Blocks {
+		id := prefix + "." + strconv.Itoa(i)
+		if b, ok := block.(*ast.PipeBlock); ok && opts.Expand && b.Decl.BodyDAG != nil && !expanding[b.Decl] {
+			sub := &cluster{id: id, label: blockLabel(block)}
+			c.clusters = append(c.clusters, sub)
+			blocks[i] = d.addGraph(sub, id, b.Decl, opts, expanding)
+			blocks[i].expanded = true
+			continue
+		}
+		in, out := portNames(block)
+		n := &node{
+			id:      id,
+			label:   blockLabel(block),
+			inputs:  ports(block.InPorts(), in),
+			outputs: ports(block.OutPorts(), out),
+			block:   block,
+			pipe:    pipe,
+		}
+		c.nodes = append(c.nodes, n)
+		blocks[i] = ends{in: n, out: n}
+	}
+
+	for _, e := range graph.Edges {
+		src := port{node: root.in, idx: int(e.Src.Port), out: true}
+		if e.Src.Block != ast.RootBlock {
+			b := blocks[e.Src.Block]
+			src = port{node: b.out, idx: int(e.Src.Port), out: !b.expanded}
+		}
+		dst := port{node: root.out, idx: int(e.Dst.Port)}
+		if e.Dst.Block != ast.RootBlock {
+			b := blocks[e.Dst.Block]
+			dst = port{node: b.in, idx: int(e.Dst.Port), out: b.expanded}
+		}
+		d.edges = append(d.edges, edge{src: src, dst: dst, typ: e.Type})
+	}
+	return root
+}
+
+// blockLabel is the title of the box of a block.
+func blockLabel(block ast.Block) string {
+	switch b := block.(type) {
+	case *ast.PipeBlock:
+		return calleeName(b, b.Decl)
+	case *ast.StubBlock:
+		return calleeName(b, b.Decl)
+	case *ast.ApplyBlock:
+		if call, ok := b.CreatedBy().(*ast.CallExpr); ok {
+			return call.Name.V
+		}
+		return "apply"
+	case *ast.BuiltinBlock:
+		switch b.Op {
+		case ast.FieldBuiltin:
+			return "field " + strings.Join(b.Params, ".")
+		case ast.FormatBuiltin:
+			return "format " + strconv.Quote(strings.Join(b.Params, "${}"))
+		}
+		return string(b.Op)
+	case *ast.LiteralBlock:
+		if b.Lit.Type == token.String {
+			return strconv.Quote(b.Lit.Value)
+		}
+		return b.Lit.Value
+	case *ast.PipeRefBlock:
+		if _, ok := b.CreatedBy().(*ast.PipeLit); ok {
+			return "pipe literal"
+		}
+		return "pipe " + b.Decl.BlockName()
+	}
+	return "?"
+}
+
+// calleeName is the name a pipe or stub is called by, including its module if it is imported.
+func calleeName(block ast.Block, decl ast.BlockDecl) string {
+	if call, ok := block.CreatedBy().(*ast.CallExpr); ok && call.Name.Module != "" {
+		return call.Name.Module + "." + decl.BlockName()
+	}
+	return decl.BlockName()
+}
+
+// portNames returns the names of the ports of block, which are fewer than its ports if some have no name.
+func portNames(block ast.Block) (in, out []string) {
+	switch b := block.(type) {
+	case *ast.PipeBlock:
+		return fieldNames(b.Decl.Inputs), fieldNames(b.Decl.Outputs)
+	case *ast.StubBlock:
+		return fieldNames(b.Decl.Inputs), fieldNames(b.Decl.Outputs)
+	case *ast.ApplyBlock:
+		return append([]string{"pipe"}, fieldNames(b.Type.Inputs)...), fieldNames(b.Type.Outputs)
+	}
+	return nil, nil
+}
+
+func fieldNames(fields ast.FieldList) (names []string) {
+	for _, field := range fields.Fields {
+		names = append(names, field.Key.V)
+	}
+	return
+}
+
+// ports pairs the types of ports with their names, which are fewer than the ports if some have no name.
+func ports(types []ast.EdgeType, names []string) []portInfo {
+	ports := make([]portInfo, len(types))
+	for i, typ := range types {
+		ports[i].typ = typ
+		if i < len(names) {
+			ports[i].name = names[i]
+		}
+	}
+	return ports
 }
@@ -0,0 +1,230 @@
+package draw
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// figure is a graph drawn as one SVG image of the page.
+type figure struct {
+	Title  string // empty if the page has a single graph
+	Width  string
+	Height string
+	SVG    template.HTML
+}
+
+type snippetJSON struct {
+	Pos  string `json:"pos"`
+	Text string `json:"text"`
+}
+
+// htmlPage is a page with no dependencies. Clicking a block shows the source it was created from, which is kept in a
+// list indexed by the data-snippet attribute of each block.
+var htmlPage = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { display: flex; margin: 0; font: 14px sans-serif; }
+main { flex: 1; overflow: auto; padding: 16px; }
+aside { width: 40%; max-width: 560px; padding: 16px; border-left: 1px solid #ccc; overflow: auto; }
+pre { background: #f6f6f6; padding: 8px; }
+svg text { font: 12px monospace; dominant-baseline: central; text-anchor: middle; }
+.box { fill: white; stroke: #333; }
+.port { fill: #eef3fb; stroke: #333; }
+.pipe-ports .box, .pipe-ports .port { fill: #f3f3f3; }
+.title { font-weight: bold; }
+.block { cursor: pointer; }
+.block.selected .box { stroke: #d33; stroke-width: 2; }
+.cluster { fill: none; stroke: #999; stroke-dasharray: 4 2; }
+svg text.cluster-label { text-anchor: start; fill: #666; }
+.edge { fill: none; stroke: #555; marker-end: url(#arrow); }
+svg text.edge-label { font-size: 10px; fill: #555; text-anchor: start; }
+</style>
+</head>
+<body>
+<svg width="0" height="0" style="position: absolute"><defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#555"/></marker></defs></svg>
+<main>
+<h1>{{.Title}}</h1>
+{{range .Figures}}<section>
+{{if .Title}}<h2>{{.Title}}</h2>
+{{end}}<svg width="{{.Width}}" height="{{.Height}}">
+{{.SVG}}</svg>
+</section>
+{{end}}</main>
+<aside>
+<p id="source-pos">Click a block to show its source.</p>
+<pre id="source-text"></pre>
+</aside>
+<script>
+const snippets = {{.Snippets}};
+for (const block of document.querySelectorAll(".block")) {
+	block.addEventListener("click", () => {
+		for (const selected of document.querySelectorAll(".selected")) {
+			selected.classList.remove("selected");
+		}
+		block.classList.add("selected");
+		const snippet = snippets[block.dataset.snippet];
+		document.getElementById("source-pos").textContent = snippet ? snippet.pos : "This block has no source.";
+		document.getElementById("source-text").textContent = snippet ? snippet.text : "";
+	});
+}
+</script>
+</body>
+</html>
+`))
+
+// htmlWriter draws the figures of a page and collects the source of their blocks.
+type htmlWriter struct {
+	d        *diagram
+	opts     Options
+	snippets []snippetJSON
+	indices  map[snippetJSON]int // index of each snippet, since blocks created by the same line share it
+}
+
+func writeHTML(buf *bytes.Buffer, title string, d *diagram, opts Options) error {
+	w := &htmlWriter{d: d, opts: opts, snippets: []snippetJSON{}, indices: make(map[snippetJSON]int)}
+	var figures []figure
+	if len(d.root.nodes) == 0 {
+		for _, c := range d.root.clusters {
+			figures = append(figures, w.figure(c.label, c))
+		}
+	} else {
+		figures = append(figures, w.figure("", d.root))
+	}
+	return htmlPage.Execute(buf, struct {
+		Title    string
+		Figures  []figure
+		Snippets []snippetJSON
+	}{title, figures, w.snippets})
+}
+
+// figure lays out the contents of c and draws them with the edges between them.
+func (w *htmlWriter) figure(title string, c *cluster) figure {
+	const margin = 4.0 // room for the strokes at the edges of the image
+	l := newLayout(w.d, c)
+	var svg strings.Builder
+	fmt.Fprintf(&svg, "<g transform=\"translate(%s %s)\">\n", num(margin), num(margin))
+	w.frames(&svg, l, c)
+	w.nodes(&svg, l, c)
+	for _, e := range w.d.edges {
+		if _, ok := l.nodes[e.src.node]; !ok {
+			continue
+		}
+		if _, ok := l.nodes[e.dst.node]; !ok {
+			continue
+		}
+		x1, y1, x2, y2 := l.edgeEnds(e)
+		bend := math.Max(math.Abs(y2-y1)/2, layerGap/2)
+		fmt.Fprintf(&svg, "<path class=\"edge\" d=\"M %s %s C %s %s, %s %s, %s %s\"/>\n",
+			num(x1), num(y1), num(x1), num(y1+bend), num(x2), num(y2-bend), num(x2), num(y2))
+		typ := string(e.typ)
+		if typ == "" {
+			typ = "?"
+		}
+		fmt.Fprintf(&svg, "<text class=\"edge-label\" x=\"%s\" y=\"%s\">%s</text>\n",
+			num(x1+4), num(y1+layerGap/4), html.EscapeString(typ))
+	}
+	svg.WriteString("</g>\n")
+
+	width, height := l.size(c)
+	return figure{
+		Title:  title,
+		Width:  num(width + 2*margin),
+		Height: num(height + 2*margin),
+		SVG:    template.HTML(svg.String()),
+	}
+}
+
+// frames draws the frames of the clusters in c, outer clusters first so the inner ones are drawn on top of them.
+func (w *htmlWriter) frames(svg *strings.Builder, l *layout, c *cluster) {
+	for _, sub := range c.clusters {
+		frame := l.clusters[sub]
+		fmt.Fprintf(svg, "<rect class=\"cluster\" x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\"/>\n",
+			num(frame.x), num(frame.y), num(frame.w), num(frame.h))
+		fmt.Fprintf(svg, "<text class=\"cluster-label\" x=\"%s\" y=\"%s\">%s</text>\n",
+			num(frame.x+clusterPad), num(frame.y+clusterPad/2+clusterLabel/2), html.EscapeString(sub.label))
+		w.frames(svg, l, sub)
+	}
+}
+
+// nodes draws the boxes of c and of the clusters in it, in the order they were added to the diagram.
+func (w *htmlWriter) nodes(svg *strings.Builder, l *layout, c *cluster) {
+	for _, n := range c.nodes {
+		w.node(svg, n, l.nodes[n])
+	}
+	for _, sub := range c.clusters {
+		w.nodes(svg, l, sub)
+	}
+}
+
+// node draws a box with a row for each of the inputs, the title and the outputs of n.
+func (w *htmlWriter) node(svg *strings.Builder, n *node, r rect) {
+	class := "block"
+	if n.block == nil {
+		class += " pipe-ports"
+	}
+	fmt.Fprintf(svg, "<g class=\"%s\" data-snippet=\"%d\">\n", class, w.snippet(n))
+	fmt.Fprintf(svg, "<rect class=\"box\" x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\"/>\n", num(r.x), num(r.y), num(r.w), num(r.h))
+	y := r.y
+	row := func(ports []portInfo) {
+		if len(ports) == 0 {
+			return
+		}
+		cell := r.w / float64(len(ports))
+		for i, p := range ports {
+			x := r.x + float64(i)*cell
+			typ := string(p.typ)
+			if p.name != "" {
+				typ = p.name + ": " + typ
+			}
+			fmt.Fprintf(svg, "<g><title>%s</title><rect class=\"port\" x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\"/>",
+				html.EscapeString(typ), num(x), num(y), num(cell), num(rowHeight))
+			fmt.Fprintf(svg, "<text x=\"%s\" y=\"%s\">%s</text></g>\n", num(x+cell/2), num(y+rowHeight/2), html.EscapeString(p.label()))
+		}
+		y += rowHeight
+	}
+	row(n.inputs)
+	if n.label != "" {
+		fmt.Fprintf(svg, "<text class=\"title\" x=\"%s\" y=\"%s\">%s</text>\n", num(r.x+r.w/2), num(y+rowHeight/2), html.EscapeString(n.label))
+		y += rowHeight
+	}
+	row(n.outputs)
+	svg.WriteString("</g>\n")
+}
+
+// snippet adds the source of n to the page and returns its index, or -1 if it has none. The inputs and outputs of a
+// pipe show its declaration.
+func (w *htmlWriter) snippet(n *node) int {
+	if w.opts.Source == nil {
+		return -1
+	}
+	var s Snippet
+	var ok bool
+	if n.block != nil {
+		s, ok = w.opts.Source(n.pipe, n.block.CreatedBy())
+	} else if !n.pipe.Implicit {
+		s, ok = w.opts.Source(n.pipe, n.pipe.Name)
+	}
+	if !ok {
+		return -1
+	}
+	snippet := snippetJSON{Pos: s.Pos.String(), Text: s.Text}
+	if i, ok := w.indices[snippet]; ok {
+		return i
+	}
+	w.indices[snippet] = len(w.snippets)
+	w.snippets = append(w.snippets, snippet)
+	return len(w.snippets) - 1
+}
+
+// num formats a coordinate with at most one decimal.
+func num(v float64) string {
+	return strconv.FormatFloat(math.Round(v*10)/10, 'f', -1, 64)
+}
@@ -0,0 +1,283 @@
+package draw
+
+import "sort"
+
+// Sizes of the layout in pixels. Text is drawn in a 12px monospace font so its width can be known without a browser.
+const (
+	charWidth    = 7.3  // width of a character of the font, a little wider than it is for bold text
+	rowHeight    = 22.0 // height of a row of ports or the title of a box
+	cellPadding  = 8.0  // space on each side of the text of a port or title
+	minCellWidth = 24.0
+	nodeGap      = 24.0 // horizontal space between boxes
+	layerGap     = 48.0 // vertical space between layers, which has the labels of the edges
+	clusterPad   = 12.0 // space between the frame of a cluster and its contents
+	clusterLabel = 20.0 // height of the label at the top of a cluster
+	sweeps       = 4    // number of times layers are reordered to reduce crossings
+)
+
+type rect struct {
+	x, y, w, h float64
+}
+
+// layout places the nodes and clusters of a diagram in layers, like Graphviz dot but much simpler: every box is put
+// one layer below the boxes that send values to it, then the boxes of each layer are ordered by the average position
+// of the boxes they are connected to, so that edges cross less. A cluster is laid out on its own first and then
+// placed in the layers of the cluster around it as a single box.
+type layout struct {
+	d        *diagram
+	nodes    map[*node]rect    // absolute positions of nodes
+	clusters map[*cluster]rect // absolute frames of clusters
+
+	nodeParent    map[*node]*cluster
+	clusterParent map[*cluster]*cluster
+	rel           map[interface{}]rect // positions relative to the contents of the cluster around them
+}
+
+// item is a node or cluster placed in the layers of a cluster.
+type item struct {
+	key          interface{} // *node or *cluster
+	w, h         float64
+	layer, order int
+	preds, succs []*item
+}
+
+// newLayout places c and everything in it with the top left corner of its contents at (0, 0).
+func newLayout(d *diagram, c *cluster) *layout {
+	l := &layout{
+		d:             d,
+		nodes:         make(map[*node]rect),
+		clusters:      make(map[*cluster]rect),
+		nodeParent:    make(map[*node]*cluster),
+		clusterParent: make(map[*cluster]*cluster),
+		rel:           make(map[interface{}]rect),
+	}
+	l.index(c)
+	l.arrange(c)
+	l.place(c, 0, 0)
+	return l
+}
+
+func (l *layout) index(c *cluster) {
+	for _, n := range c.nodes {
+		l.nodeParent[n] = c
+	}
+	for _, sub := range c.clusters {
+		l.clusterParent[sub] = c
+		l.index(sub)
+	}
+}
+
+// size is the width and height of the contents of the cluster laid out last.
+func (l *layout) size(c *cluster) (w, h float64) {
+	r := l.rel[c]
+	return r.w, r.h
+}
+
+// nodeSize is the size of the box of a node. The ports of a row are all as wide as the widest of them.
+func nodeSize(n *node) (w, h float64) {
+	rows := 0
+	if n.label != "" {
+		w, rows = textWidth(n.label), 1
+	}
+	for _, ports := range [][]portInfo{n.inputs, n.outputs} {
+		if len(ports) == 0 {
+			continue
+		}
+		rows++
+		cell := minCellWidth
+		for _, p := range ports {
+			if pw := textWidth(p.label()); pw > cell {
+				cell = pw
+			}
+		}
+		if row := cell * float64(len(ports)); row > w {
+			w = row
+		}
+	}
+	return w, float64(rows) * rowHeight
+}
+
+func textWidth(s string) float64 {
+	return float64(len([]rune(s)))*charWidth + 2*cellPadding
+}
+
+// itemIn returns the item of c that n is in, which is n itself or the cluster in c that has n somewhere inside.
+func (l *layout) itemIn(n *node, c *cluster, items map[interface{}]*item) *item {
+	if l.nodeParent[n] == c {
+		return items[n]
+	}
+	for sub := l.nodeParent[n]; sub != nil; sub = l.clusterParent[sub] {
+		if l.clusterParent[sub] == c {
+			return items[sub]
+		}
+	}
+	return nil
+}
+
+// arrange lays out the contents of c relative to its top left corner, after laying out its clusters.
+func (l *layout) arrange(c *cluster) {
+	var items []*item
+	byKey := make(map[interface{}]*item)
+	for _, n := range c.nodes {
+		w, h := nodeSize(n)
+		items = append(items, &item{key: n, w: w, h: h})
+	}
+	for _, sub := range c.clusters {
+		l.arrange(sub)
+		w, h := l.size(sub)
+		items = append(items, &item{key: sub, w: w + 2*clusterPad, h: h + 2*clusterPad + clusterLabel})
+	}
+	for _, it := range items {
+		byKey[it.key] = it
+	}
+	for _, e := range l.d.edges {
+		src, dst := l.itemIn(e.src.node, c, byKey), l.itemIn(e.dst.node, c, byKey)
+		if src != nil && dst != nil && src != dst {
+			src.succs = append(src.succs, dst)
+			dst.preds = append(dst.preds, src)
+		}
+	}
+
+	layers := assignLayers(items)
+	orderLayers(layers)
+
+	width := 0.0
+	for _, layer := range layers {
+		if w := layerWidth(layer); w > width {
+			width = w
+		}
+	}
+	y := 0.0
+	for _, layer := range layers {
+		x, height := (width-layerWidth(layer))/2, 0.0
+		for _, it := range layer {
+			l.rel[it.key] = rect{x, y, it.w, it.h}
+			x += it.w + nodeGap
+			if it.h > height {
+				height = it.h
+			}
+		}
+		y += height + layerGap
+	}
+	if len(layers) > 0 {
+		y -= layerGap
+	}
+	l.rel[c] = rect{w: width, h: y}
+}
+
+// assignLayers puts every item one layer below the lowest item sending values to it, with the outputs of a pipe in
+// the last layer, and returns the items of each layer in the order they were given.
+func assignLayers(items []*item) [][]*item {
+	indegree := make(map[*item]int)
+	for _, it := range items {
+		indegree[it] = len(it.preds)
+	}
+	var queue []*item
+	for _, it := range items {
+		if indegree[it] == 0 {
+			queue = append(queue, it)
+		}
+	}
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		for _, succ := range it.succs {
+			if it.layer+1 > succ.layer {
+				succ.layer = it.layer + 1
+			}
+			if indegree[succ]--; indegree[succ] == 0 {
+				queue = append(queue, succ)
+			}
+		}
+	}
+	// graphs have no cycles, but items left in one keep the layer they reached
+
+	last := 0
+	for _, it := range items {
+		if it.layer > last {
+			last = it.layer
+		}
+	}
+	for _, it := range items {
+		if n, ok := it.key.(*node); ok && n.block == nil && len(n.inputs) > 0 {
+			it.layer = last
+		}
+	}
+	layers := make([][]*item, last+1)
+	for _, it := range items {
+		it.order = len(layers[it.layer])
+		layers[it.layer] = append(layers[it.layer], it)
+	}
+	return layers
+}
+
+// orderLayers reorders the items of each layer by the average order of the items they are connected to, sweeping
+// down the layers by their predecessors and back up by their successors.
+func orderLayers(layers [][]*item) {
+	sortBy := func(layer []*item, neighbors func(*item) []*item) {
+		center := make(map[*item]float64)
+		for _, it := range layer {
+			center[it] = float64(it.order)
+			if ns := neighbors(it); len(ns) > 0 {
+				sum := 0.0
+				for _, n := range ns {
+					sum += float64(n.order)
+				}
+				center[it] = sum / float64(len(ns))
+			}
+		}
+		sort.SliceStable(layer, func(i, j int) bool { return center[layer[i]] < center[layer[j]] })
+		for i, it := range layer {
+			it.order = i
+		}
+	}
+	for i := 0; i < sweeps; i++ {
+		for _, layer := range layers[1:] {
+			sortBy(layer, func(it *item) []*item { return it.preds })
+		}
+		for j := len(layers) - 2; j >= 0; j-- {
+			sortBy(layers[j], func(it *item) []*item { return it.succs })
+		}
+	}
+}
+
+func layerWidth(layer []*item) float64 {
+	w := 0.0
+	for _, it := range layer {
+		w += it.w
+	}
+	if len(layer) > 1 {
+		w += float64(len(layer)-1) * nodeGap
+	}
+	return w
+}
+
+// place sets the absolute positions of the contents of c, whose top left corner is at (x, y).
+func (l *layout) place(c *cluster, x, y float64) {
+	for _, n := range c.nodes {
+		r := l.rel[n]
+		l.nodes[n] = rect{x + r.x, y + r.y, r.w, r.h}
+	}
+	for _, sub := range c.clusters {
+		r := l.rel[sub]
+		frame := rect{x + r.x, y + r.y, r.w, r.h}
+		l.clusters[sub] = frame
+		l.place(sub, frame.x+clusterPad, frame.y+clusterPad+clusterLabel)
+	}
+}
+
+// portX is the middle of port p.
+func (l *layout) portX(p port) float64 {
+	r, row := l.nodes[p.node], p.node.inputs
+	if p.out {
+		row = p.node.outputs
+	}
+	return r.x + (float64(p.idx)+0.5)*r.w/float64(len(row))
+}
+
+// edgeEnds are the points an edge leaves from, at the bottom of its source, and arrives at, at the top of its
+// destination.
+func (l *layout) edgeEnds(e edge) (x1, y1, x2, y2 float64) {
+	src, dst := l.nodes[e.src.node], l.nodes[e.dst.node]
+	return l.portX(e.src), src.y + src.h, l.portX(e.dst), dst.y
+}
@@ -0,0 +1,72 @@
+package draw
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// mermaidText escapes the characters that Mermaid interprets in quoted text as entity codes.
+var mermaidText = strings.NewReplacer(`#`, `#35;`, `"`, `#quot;`, `<`, `#lt;`, `>`, `#gt;`)
+
+// mermaidWriter numbers nodes and clusters, since Mermaid only allows some characters in their ids.
+type mermaidWriter struct {
+	buf      *bytes.Buffer
+	ids      map[*node]string
+	clusters int
+}
+
+func writeMermaid(buf *bytes.Buffer, d *diagram) {
+	w := &mermaidWriter{buf: buf, ids: make(map[*node]string)}
+	buf.WriteString("flowchart TB\n")
+	w.cluster(d.root, 1)
+	for _, e := range d.edges {
+		fmt.Fprintf(buf, "\t%s -->|\"%s\"| %s\n", w.ids[e.src.node], mermaidText.Replace(mermaidLabel(e)), w.ids[e.dst.node])
+	}
+}
+
+func (w *mermaidWriter) cluster(c *cluster, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, n := range c.nodes {
+		id := fmt.Sprintf("n%d", len(w.ids))
+		w.ids[n] = id
+		label := mermaidText.Replace(n.label)
+		if n.block == nil {
+			// the inputs and outputs of a pipe are named after their ports and rounded to set them apart from blocks
+			var names []string
+			for _, p := range append(n.inputs, n.outputs...) {
+				names = append(names, p.label())
+			}
+			label = mermaidText.Replace(strings.Join(names, ", "))
+			fmt.Fprintf(w.buf, "%s%s([\"%s\"])\n", indent, id, label)
+		} else {
+			fmt.Fprintf(w.buf, "%s%s[\"%s\"]\n", indent, id, label)
+		}
+	}
+	for _, sub := range c.clusters {
+		fmt.Fprintf(w.buf, "%ssubgraph c%d [\"%s\"]\n", indent, w.clusters, mermaidText.Replace(sub.label))
+		w.clusters++
+		w.cluster(sub, depth+1)
+		fmt.Fprintf(w.buf, "%send\n", indent)
+	}
+}
+
+// mermaidLabel describes the ports an edge connects and its type, e.g. `stdin → s: string`. Ports without a name are
+// left out.
+func mermaidLabel(e edge) string {
+	var names []string
+	if name := e.src.info().name; name != "" {
+		names = append(names, name)
+	}
+	if name := e.dst.info().name; name != "" {
+		names = append(names, name)
+	}
+	typ := string(e.typ)
+	if typ == "" {
+		typ = "?"
+	}
+	if len(names) == 0 {
+		return typ
+	}
+	return strings.Join(names, " → ") + ": " + typ
+}
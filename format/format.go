@@ -0,0 +1,81 @@
+// Package format prints hoser source in its canonical style:
+//
+//	module "main"
+//
+//	import "text"
+//
+//	# Grep prints the lines of stdin that match pattern.
+//	pipe main(
+//		stdin:   string,
+//		pattern: string,   # regular expression to match
+//		limit:   int = 10, # maximum number of lines
+//	) (stdout: string) {
+//		stdout = text.Grep(stdin, pattern, limit)
+//	}
+//
+// Every statement is on its own line, indented with tabs. Ports stay on one line unless they were written one per
+// line or have comments, in which case every port is on its own line with a trailing comma and their types and
+// comments are aligned. Blank lines between declarations and statements are kept, but never more than one, and
+// declarations of different kinds and pipes with bodies are always separated by one. Comments are kept where they
+// are. Formatting is idempotent: formatted source is formatted to itself.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/token"
+)
+
+// Source parses the module in src and returns it formatted. If the module has errors, they are returned instead.
+func Source(file *token.File, src []byte) ([]byte, error) {
+	module, err := parser.ParseModule(file, src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := Module(&buf, file, module); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Module prints module parsed from file to w, including its comments.
+func Module(w io.Writer, file *token.File, module *ast.Module) error {
+	p := newPrinter(file, module.Comments)
+	p.module(module)
+	return p.writeTo(w)
+}
+
+// Node prints a single node of a module parsed from file to w, without comments. Node can be a module, a declaration,
+// a statement, an expression or a comment.
+func Node(w io.Writer, file *token.File, node ast.Node) error {
+	p := newPrinter(file, nil)
+	switch n := node.(type) {
+	case *ast.Module:
+		p.module(n)
+	case *ast.ImportDecl:
+		p.importDecl(n)
+	case ast.BlockDecl:
+		p.decl(n)
+	case ast.Stmt:
+		p.stmt(n)
+	case ast.Expr:
+		p.expr(n)
+	case *ast.Comment:
+		p.print(n.Text)
+	case *ast.CommentGroup:
+		for i, c := range n.List {
+			if i > 0 {
+				p.newline(false)
+			}
+			p.print(c.Text)
+		}
+	default:
+		return fmt.Errorf("format: cannot print %T", node)
+	}
+	return p.writeTo(w)
+}
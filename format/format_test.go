@@ -0,0 +1,326 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/token"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "Declarations",
+			src:  `module "test"; import "a"; pipe main() () { B(1) }; stub B(x: int)`,
+			want: `module "test"
+
+import "a"
+
+pipe main() {
+	B(1)
+}
+
+stub B(x: int)
+`,
+		},
+		{
+			name: "Spacing",
+			src: `module  "test"
+pure   stub A( x:int,y : string )(z:int)
+pipe main(){a,{b:_}=c( 1,x : 2.50 )
+d = ( e )}
+`,
+			want: `module "test"
+
+pure stub A(x: int, y: string) (z: int)
+
+pipe main() {
+	a, {b: _} = c(1, x: 2.50)
+	d = (e)
+}
+`,
+		},
+		{
+			name: "Blank lines",
+			src: `module "test"
+import "a"
+
+import "b"
+stub A()
+stub B()
+
+
+stub C()
+pipe main() {
+
+	A()
+
+
+	B()
+
+}
+`,
+			want: `module "test"
+
+import "a"
+
+import "b"
+
+stub A()
+stub B()
+
+stub C()
+
+pipe main() {
+	A()
+
+	B()
+}
+`,
+		},
+		{
+			name: "Comments",
+			src: `#!/usr/bin/env hoser
+module "test" # header
+# A does nothing.
+stub A() # after A
+
+pipe main() { # opened
+	# before A
+	A() # after
+	# at the end
+} # closed
+# at the end of the file
+`,
+			want: `#!/usr/bin/env hoser
+module "test" # header
+
+# A does nothing.
+stub A() # after A
+
+pipe main() { # opened
+	# before A
+	A() # after
+	# at the end
+} # closed
+# at the end of the file
+`,
+		},
+		{
+			name: "Aligned ports",
+			src: `module "main"
+# main prints its flags.
+pipe main(
+	# regular expression
+	pattern: string,
+	limit: int = 10, # maximum number of lines
+	ratio: float=1,   # ratio
+
+
+	args: string, x,
+	n: int, # count
+) (stdout: string) {}
+`,
+			want: `module "main"
+
+# main prints its flags.
+pipe main(
+	# regular expression
+	pattern: string,
+	limit:   int = 10,  # maximum number of lines
+	ratio:   float = 1, # ratio
+
+	args: string,
+	x,
+	n:    int, # count
+) (stdout: string) {}
+`,
+		},
+		{
+			name: "Comments in ports",
+			src: `module "main"
+stub A(x: int, # x
+	y: int) ( # outputs
+	# none
+)
+`,
+			want: `module "main"
+
+stub A(
+	x: int, # x
+	y: int,
+) ( # outputs
+	# none
+)
+`,
+		},
+		{
+			name: "Comments in calls",
+			src: `module "main"
+pipe main() {
+	b = Call(a,   # first
+		a)
+	c, d = G(a)
+	e = Call( # lead
+		a, a, # both
+
+		G(x: a))
+	Map(1, pipe(x) (y) {
+		y = x # in the literal
+	})
+}
+`,
+			want: `module "main"
+
+pipe main() {
+	b = Call(
+		a, # first
+		a,
+	)
+	c, d = G(a)
+	e = Call( # lead
+		a,
+		a, # both
+
+		G(x: a),
+	)
+	Map(1, pipe(x) (y) {
+		y = x # in the literal
+	})
+}
+`,
+		},
+		{
+			name: "Strings",
+			src: `module "main"
+pipe main() {
+	a = "quote \" backslash \\ tab \t newline \n question \?"
+	b = "${ x }/${y}.txt \"${z}\""
+	c = "\${x} costs \$${y}"
+}
+`,
+			want: `module "main"
+
+pipe main() {
+	a = "quote \" backslash \\ tab \t newline \n question ?"
+	b = "${x}/${y}.txt \"${z}\""
+	c = "\${x} costs $${y}"
+}
+`,
+		},
+		{
+			name: "Pipes as values",
+			src: `module "main"
+stub Map(in: int, f: pipe(x: int)  (y: int)) (out: int)
+stub Each(f: pipe(x: int))
+pipe main() {
+	Map(1, pipe(x) (y) {y = x})
+	Map(2, pipe(x) (y) {
+	a = x; y = a })
+	Each(pipe(x) () { })
+}
+`,
+			want: `module "main"
+
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+stub Each(f: pipe(x: int))
+
+pipe main() {
+	Map(1, pipe(x) (y) { y = x })
+	Map(2, pipe(x) (y) {
+		a = x
+		y = a
+	})
+	Each(pipe(x) {})
+}
+`,
+		},
+		{
+			name: "Script",
+			src: `#!/usr/bin/env hoser
+import "text"
+
+stdout = text.Upper(stdin)
+pipe Twice(x) (y) { y = x }
+stderr = Twice(args)
+`,
+			want: `#!/usr/bin/env hoser
+import "text"
+
+stdout = text.Upper(stdin)
+
+pipe Twice(x) (y) {
+	y = x
+}
+
+stderr = Twice(args)
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := format(t, tt.src)
+			if got != tt.want {
+				t.Errorf("Source() =\n%s\nwant:\n%s", got, tt.want)
+			}
+			if again := format(t, got); again != got {
+				t.Errorf("Source() is not idempotent, formatted again =\n%s", again)
+			}
+		})
+	}
+}
+
+func format(t *testing.T, src string) string {
+	t.Helper()
+	file := token.NewFile("<test>", len(src))
+	got, err := Source(&file, []byte(src))
+	if err != nil {
+		t.Fatalf("Source() error = %v", err)
+	}
+	return string(got)
+}
+
+func TestSourceErrors(t *testing.T) {
+	src := `module "main"
+pipe main( {}
+`
+	file := token.NewFile("<test>", len(src))
+	if _, err := Source(&file, []byte(src)); err == nil {
+		t.Errorf("Source() error = nil, want the parse error")
+	}
+}
+
+func TestNode(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`a`, `a`},
+		{`mod.Run( x:1 )`, `mod.Run(x: 1)`},
+		{`{pos: {x: px,y: _}}`, `{pos: {x: px, y: _}}`},
+		{`pipe(x: int)(y: int)`, `pipe(x: int) (y: int)`},
+		{`"a\tb"`, `"a\tb"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			src := tt.src + ";"
+			file := token.NewFile("<test>", len(src))
+			expr, err := parser.ParseExpression(&file, []byte(src))
+			if err != nil {
+				t.Fatalf("ParseExpression() error = %v", err)
+			}
+			var buf bytes.Buffer
+			if err := Node(&buf, &file, expr); err != nil {
+				t.Fatalf("Node() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Node() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,599 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+const (
+	// Markers of the columns aligned in ports on their own lines, replaced by spaces once the ports are printed.
+	// Neither can be part of a string since they are escaped.
+	typeColumn    = '\v' // before the type of a port
+	commentColumn = '\f' // before the comment after a port
+
+	endOfFile = token.Pos(math.MaxInt32)
+)
+
+// printer prints nodes to out in the canonical style. The layout only depends on the nodes and the lines they are on
+// in file, so printing formatted source gives the same source.
+type printer struct {
+	file     *token.File
+	comments []*ast.CommentGroup // comments not printed yet, in the order they appear
+	out      bytes.Buffer
+	err      error
+
+	indent   int  // number of tabs at the start of a line
+	bol      bool // at the beginning of a line before the indentation
+	last     int  // line of the last node or comment printed
+	aligning bool // printing ports on their own lines, whose comments are aligned
+}
+
+func newPrinter(file *token.File, comments []*ast.CommentGroup) *printer {
+	return &printer{file: file, comments: append([]*ast.CommentGroup(nil), comments...)}
+}
+
+func (p *printer) writeTo(w io.Writer) error {
+	if p.err != nil {
+		return p.err
+	}
+	_, err := w.Write(p.out.Bytes())
+	return err
+}
+
+func (p *printer) print(s string) {
+	if p.bol {
+		p.out.WriteString(strings.Repeat("\t", p.indent))
+		p.bol = false
+	}
+	p.out.WriteString(s)
+}
+
+func (p *printer) newline(blank bool) {
+	p.out.WriteByte('\n')
+	if blank {
+		p.out.WriteByte('\n')
+	}
+	p.bol = true
+}
+
+func (p *printer) lineOf(pos token.Pos) int {
+	if !pos.IsValid() || int(pos) > p.file.Size {
+		return 0
+	}
+	return p.file.Line(pos)
+}
+
+// ----------------------------------------------------------------------------
+// Lines and comments
+//
+
+// startLine prints the comments before pos on their own lines, then starts the line of the node at pos. Each line
+// is separated from the one before by a blank line if there is at least one between them in the source or sep is
+// set, unless first is set because the node or its comments start a block.
+func (p *printer) startLine(pos token.Pos, first, sep bool) {
+	first, sep = p.flushComments(pos, first, sep)
+	p.lineBreak(p.lineOf(pos), first, sep)
+}
+
+// flushComments prints the comments before pos on their own lines and returns first and sep for the line after them.
+func (p *printer) flushComments(pos token.Pos, first, sep bool) (bool, bool) {
+	for len(p.comments) > 0 && p.comments[0].Pos() < pos {
+		g := p.comments[0]
+		p.comments = p.comments[1:]
+		for _, c := range g.List {
+			p.lineBreak(p.lineOf(c.Pos()), first, sep)
+			p.print(commentText(c))
+			first, sep = false, false
+		}
+	}
+	return first, sep
+}
+
+func (p *printer) lineBreak(line int, first, sep bool) {
+	if p.out.Len() > 0 {
+		p.newline(!first && (sep || line > p.last+1))
+	}
+	if line > p.last {
+		p.last = line // a comment moved out of a node printed on fewer lines is before the end of the node
+	}
+}
+
+// trailingComment prints the comment after the node ending on line, if there is one.
+func (p *printer) trailingComment(line int) {
+	p.trailingCommentBefore(line, endOfFile)
+}
+
+// trailingCommentBefore prints the comment at the end of line if it comes before pos, e.g. the comment after { but
+// not the one after } for `pipe main() { B() } # comment`.
+func (p *printer) trailingCommentBefore(line int, pos token.Pos) {
+	p.last = line
+	for i, g := range p.comments {
+		if g.Pos() >= pos || p.lineOf(g.Pos()) > line {
+			return
+		}
+		if p.lineOf(g.Pos()) < line {
+			continue // inside a node printed on fewer lines, printed before the next one
+		}
+		sep := " "
+		if p.aligning {
+			sep = string(commentColumn)
+		}
+		p.print(sep + commentText(g.List[0]))
+		if len(g.List) > 1 {
+			p.comments[i] = &ast.CommentGroup{List: g.List[1:]}
+		} else {
+			p.comments = append(p.comments[:i:i], p.comments[i+1:]...)
+		}
+		return
+	}
+}
+
+// hasComments reports whether there are comments left between from and to.
+func (p *printer) hasComments(from, to token.Pos) bool {
+	for _, g := range p.comments {
+		if g.Pos() > from && g.Pos() < to {
+			return true
+		}
+	}
+	return false
+}
+
+func commentText(c *ast.Comment) string {
+	return strings.TrimRight(c.Text, " \t\r")
+}
+
+// ----------------------------------------------------------------------------
+// Declarations
+//
+
+func (p *printer) module(m *ast.Module) {
+	var items []ast.Node // imports, declarations and the top-level statements of a script
+	for _, imp := range m.Imports {
+		items = append(items, imp)
+	}
+	for _, decl := range m.DefinedBlocks {
+		if pipe, ok := decl.(*ast.PipeDecl); ok && pipe.Implicit {
+			for _, stmt := range pipe.Body {
+				items = append(items, stmt)
+			}
+			continue
+		}
+		items = append(items, decl)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return startOf(items[i]) < startOf(items[j]) })
+
+	sep := false
+	if m.ModulePos.IsValid() {
+		p.startLine(m.ModulePos, false, false)
+		p.print("module ")
+		p.expr(m.Name)
+		p.trailingComment(p.lineOf(m.Name.Pos()))
+		sep = true
+	}
+	var prev ast.Node
+	for _, item := range items {
+		p.startLine(startOf(item), false, sep || separate(prev, item))
+		switch item := item.(type) {
+		case *ast.ImportDecl:
+			p.importDecl(item)
+			p.trailingComment(p.lineOf(item.ModuleName.Pos()))
+		case ast.BlockDecl:
+			p.decl(item)
+		case ast.Stmt:
+			p.stmt(item)
+			p.trailingComment(p.lineOf(lastPos(item)))
+		}
+		prev, sep = item, false
+	}
+	p.flushComments(endOfFile, false, false)
+	if p.out.Len() > 0 {
+		p.newline(false)
+	}
+}
+
+// separate reports whether a blank line is always printed between the top-level items prev and next, which is the
+// case if they are different kinds of items or one is a pipe.
+func separate(prev, next ast.Node) bool {
+	if prev == nil {
+		return false
+	}
+	kind := func(n ast.Node) string {
+		switch n := n.(type) {
+		case *ast.ImportDecl:
+			return "import"
+		case *ast.StubDecl:
+			return "stub"
+		case *ast.PipeDecl:
+			return "pipe"
+		default:
+			return fmt.Sprintf("%T", n)
+		}
+	}
+	return kind(prev) != kind(next) || kind(prev) == "pipe"
+}
+
+// startOf is the position of the first token of a top-level item, which is the pure keyword of a pure declaration.
+func startOf(node ast.Node) token.Pos {
+	switch n := node.(type) {
+	case *ast.StubDecl:
+		if n.IsPure() {
+			return n.Pure
+		}
+	case *ast.PipeDecl:
+		if n.IsPure() {
+			return n.Pure
+		}
+	}
+	return node.Pos()
+}
+
+func (p *printer) importDecl(imp *ast.ImportDecl) {
+	p.print("import ")
+	p.expr(imp.ModuleName)
+}
+
+func (p *printer) decl(decl ast.BlockDecl) {
+	switch d := decl.(type) {
+	case *ast.StubDecl:
+		p.signature("stub", d)
+		p.trailingComment(p.lineOf(d.End()))
+	case *ast.PipeDecl:
+		p.signature("pipe", &d.StubDecl)
+		p.print(" ")
+		p.body(d, false)
+		p.trailingComment(p.lineOf(d.EndRBrack))
+	default:
+		p.fail(decl)
+	}
+}
+
+func (p *printer) signature(keyword string, stub *ast.StubDecl) {
+	if stub.IsPure() {
+		p.print("pure ")
+	}
+	p.print(keyword + " " + stub.Name.FullName())
+	p.ports(&stub.Inputs)
+	if p.hasPorts(&stub.Outputs) {
+		p.print(" ")
+		p.ports(&stub.Outputs)
+	}
+}
+
+// hasPorts reports whether a list of outputs is printed, which is left out if it is empty, e.g. `pipe main() () {}`
+// is printed as `pipe main() {}`.
+func (p *printer) hasPorts(ports *ast.FieldList) bool {
+	return len(ports.Fields) > 0 || p.hasComments(ports.Opener, ports.Closer)
+}
+
+// ports prints a list of ports in parentheses, either all on one line or each on its own line.
+func (p *printer) ports(ports *ast.FieldList) {
+	multiline := len(ports.Fields) > 0 && p.lineOf(ports.Opener) != p.lineOf(ports.Fields[0].Pos())
+	if !multiline && !p.hasComments(ports.Opener, ports.Closer) {
+		p.print("(")
+		p.fields(ports.Fields)
+		p.print(")")
+		return
+	}
+
+	p.print("(")
+	first := ports.Closer
+	if len(ports.Fields) > 0 {
+		first = ports.Fields[0].Pos()
+	}
+	p.trailingCommentBefore(p.lineOf(ports.Opener), first)
+	start := p.out.Len()
+	aligning := p.aligning
+	p.aligning = true
+	p.indent++
+	for i, field := range ports.Fields {
+		p.startLine(field.Pos(), i == 0, false)
+		p.print(field.Key.FullName())
+		if field.Value != nil {
+			p.print(":" + string(typeColumn))
+			p.expr(field.Value)
+		}
+		p.fieldDefault(field)
+		p.print(",")
+		end, next := p.lineOf(lastPos(field)), ports.Closer
+		if i+1 < len(ports.Fields) {
+			next = ports.Fields[i+1].Pos()
+		}
+		if p.lineOf(next) == end {
+			p.last = end // the comment at the end of the line is after the last port on it
+			continue
+		}
+		p.trailingCommentBefore(end, next)
+	}
+	p.flushComments(ports.Closer, len(ports.Fields) == 0, false)
+	p.indent--
+	p.aligning = aligning
+	p.lineBreak(p.lineOf(ports.Closer), true, false)
+	p.print(")")
+	align(&p.out, start)
+}
+
+// align replaces the column markers printed after start with spaces so that the types and comments of consecutive
+// ports line up. Blank lines start a new group of aligned ports.
+func align(out *bytes.Buffer, start int) {
+	lines := strings.Split(string(out.Bytes()[start:]), "\n")
+	for i := 0; i < len(lines); {
+		j := i
+		for j < len(lines) && lines[j] != "" {
+			j++
+		}
+		alignColumn(lines[i:j], typeColumn)
+		alignColumn(lines[i:j], commentColumn)
+		i = j + 1
+	}
+	out.Truncate(start)
+	out.WriteString(strings.Join(lines, "\n"))
+}
+
+func alignColumn(lines []string, marker rune) {
+	width := 0
+	for _, line := range lines {
+		if i := strings.IndexRune(line, marker); i >= 0 && utf8.RuneCountInString(line[:i]) > width {
+			width = utf8.RuneCountInString(line[:i])
+		}
+	}
+	for k, line := range lines {
+		if i := strings.IndexRune(line, marker); i >= 0 {
+			pad := strings.Repeat(" ", width-utf8.RuneCountInString(line[:i])+1)
+			lines[k] = line[:i] + pad + line[i+1:]
+		}
+	}
+}
+
+// body prints the statements of a pipe in braces, each on its own line. A pipe literal with a single statement
+// stays on one line if it was written on one line, e.g. `pipe(x) (y) { y = x }`.
+func (p *printer) body(pipe *ast.PipeDecl, literal bool) {
+	comments := p.hasComments(pipe.BegLBrack, pipe.EndRBrack)
+	switch {
+	case len(pipe.Body) == 0 && !comments:
+		p.print("{}")
+		return
+	case literal && len(pipe.Body) == 1 && !comments && p.lineOf(pipe.BegLBrack) == p.lineOf(pipe.EndRBrack):
+		p.print("{ ")
+		p.stmt(pipe.Body[0])
+		p.print(" }")
+		return
+	}
+
+	p.print("{")
+	first := pipe.EndRBrack
+	if len(pipe.Body) > 0 {
+		first = pipe.Body[0].Pos()
+	}
+	p.trailingCommentBefore(p.lineOf(pipe.BegLBrack), first)
+	p.indent++
+	for i, stmt := range pipe.Body {
+		p.startLine(stmt.Pos(), i == 0, false)
+		p.stmt(stmt)
+		p.trailingCommentBefore(p.lineOf(lastPos(stmt)), pipe.EndRBrack)
+	}
+	p.flushComments(pipe.EndRBrack, len(pipe.Body) == 0, false)
+	p.indent--
+	p.lineBreak(p.lineOf(pipe.EndRBrack), true, false)
+	p.print("}")
+}
+
+// ----------------------------------------------------------------------------
+// Statements and expressions
+//
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	if s, ok := stmt.(*ast.ExprStmt); ok {
+		p.expr(s.X)
+		return
+	}
+	p.fail(stmt)
+}
+
+func (p *printer) expr(x ast.Expr) {
+	switch x := x.(type) {
+	case *ast.Ident:
+		p.print(x.FullName())
+	case *ast.LiteralExpr:
+		if x.Type == token.String {
+			p.print(`"` + escaper.Replace(x.Value) + `"`)
+		} else {
+			p.print(x.Value)
+		}
+	case *ast.InterpExpr:
+		p.print(`"`)
+		for i, part := range x.Parts {
+			if lit, ok := part.(*ast.LiteralExpr); ok && i%2 == 0 {
+				p.print(escaper.Replace(lit.Value))
+				continue
+			}
+			p.print("${")
+			p.expr(part)
+			p.print("}")
+		}
+		p.print(`"`)
+	case *ast.CallExpr:
+		p.call(x)
+	case *ast.Field:
+		p.field(x)
+	case *ast.FieldList:
+		p.print("{")
+		p.fields(x.Fields)
+		p.print("}")
+	case *ast.ParenExpr:
+		p.print("(")
+		p.expr(x.X)
+		p.print(")")
+	case *ast.AssignExpr:
+		p.expr(x.Lhs)
+		p.print(" = ")
+		p.expr(x.Rhs)
+	case *ast.TupleExpr:
+		for i, elt := range x.Elts {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.expr(elt)
+		}
+	case *ast.PipeType:
+		p.print("pipe")
+		p.ports(&x.Inputs)
+		if p.hasPorts(&x.Outputs) {
+			p.print(" ")
+			p.ports(&x.Outputs)
+		}
+	case *ast.PipeLit:
+		p.print("pipe")
+		p.ports(&x.Decl.Inputs)
+		if p.hasPorts(&x.Decl.Outputs) {
+			p.print(" ")
+			p.ports(&x.Decl.Outputs)
+		}
+		p.print(" ")
+		p.body(x.Decl, true)
+	default:
+		p.fail(x)
+	}
+}
+
+// call prints a call with its arguments on one line, or each argument on its own line like ports if they were
+// written on several lines or there are comments between them.
+func (p *printer) call(call *ast.CallExpr) {
+	p.print(call.Name.FullName() + "(")
+	if !p.multilineArgs(call) {
+		for i, arg := range call.Args {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.expr(arg)
+		}
+		p.print(")")
+		return
+	}
+
+	p.trailingCommentBefore(p.lineOf(call.Lparen), call.Args[0].Pos())
+	aligning := p.aligning
+	p.aligning = false
+	p.indent++
+	for i, arg := range call.Args {
+		p.startLine(arg.Pos(), i == 0, false)
+		p.expr(arg)
+		p.print(",")
+		end, next := p.lineOf(lastPos(arg)), call.Rparen
+		if i+1 < len(call.Args) {
+			next = call.Args[i+1].Pos()
+		}
+		if p.lineOf(next) == end {
+			p.last = end // the comment at the end of the line is after the last argument on it
+			continue
+		}
+		p.trailingCommentBefore(end, next)
+	}
+	p.flushComments(call.Rparen, false, false)
+	p.indent--
+	p.aligning = aligning
+	p.lineBreak(p.lineOf(call.Rparen), true, false)
+	p.print(")")
+}
+
+// multilineArgs reports whether an argument of call starts on a later line than the token before it or there are
+// comments between the arguments. Comments in the arguments themselves, e.g. in the body of a pipe literal, are
+// printed by the argument.
+func (p *printer) multilineArgs(call *ast.CallExpr) bool {
+	prev := call.Lparen
+	for _, arg := range call.Args {
+		if p.lineOf(arg.Pos()) != p.lineOf(prev) || p.hasComments(prev, arg.Pos()) {
+			return true
+		}
+		prev = lastPos(arg)
+	}
+	return len(call.Args) > 0 && p.hasComments(prev, call.Rparen)
+}
+
+func (p *printer) fields(fields []*ast.Field) {
+	for i, field := range fields {
+		if i > 0 {
+			p.print(", ")
+		}
+		p.field(field)
+	}
+}
+
+func (p *printer) field(field *ast.Field) {
+	p.print(field.Key.FullName())
+	if field.Value != nil {
+		p.print(": ")
+		p.expr(field.Value)
+	}
+	p.fieldDefault(field)
+}
+
+func (p *printer) fieldDefault(field *ast.Field) {
+	if field.Default != nil {
+		p.print(" = ")
+		p.expr(field.Default)
+	}
+}
+
+func (p *printer) fail(node ast.Node) {
+	if p.err == nil {
+		p.err = fmt.Errorf("format: cannot print %T", node)
+	}
+}
+
+// escaper escapes the value of a string so it is scanned as the same value.
+var escaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\a", `\a`,
+	"\b", `\b`,
+	"\f", `\f`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\v", `\v`,
+	"${", `\${`,
+)
+
+// lastPos returns a position on the last line of node, which is not always the line of End, e.g. the end of an
+// assignment is the start of its right side.
+func lastPos(node ast.Node) token.Pos {
+	switch n := node.(type) {
+	case *ast.ExprStmt:
+		return lastPos(n.X)
+	case *ast.AssignExpr:
+		return lastPos(n.Rhs)
+	case *ast.ParenExpr:
+		return lastPos(n.X)
+	case *ast.TupleExpr:
+		return lastPos(n.Elts[len(n.Elts)-1])
+	case *ast.Field:
+		if n.Default != nil {
+			return n.Default.Pos()
+		}
+		if n.Value != nil {
+			return lastPos(n.Value)
+		}
+	case *ast.FieldList:
+		return n.Closer
+	case *ast.CallExpr:
+		return n.Rparen
+	case *ast.InterpExpr:
+		return n.Closer
+	case *ast.PipeType:
+		if n.Outputs.Closer.IsValid() {
+			return n.Outputs.Closer
+		}
+		return n.Inputs.Closer
+	case *ast.PipeLit:
+		return n.Decl.EndRBrack
+	}
+	return node.Pos()
+}
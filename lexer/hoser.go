@@ -840,7 +840,7 @@ func (s *Scanner) lexString(quote byte) (pos token.Pos, tok token.Token, lit str
 				u = yych
 				if u == quote {
 					tok = token.String
-					pos = token.Pos(s.token)
+					pos = s.file.Pos(s.token)
 					lit = string(buf.Bytes())
 					return
 				}
@@ -864,6 +864,9 @@ func (s *Scanner) lexString(quote byte) (pos token.Pos, tok token.Token, lit str
 							goto yy88
 						}
 					} else {
+						if yych == '$' {
+							goto yy112
+						}
 						if yych == '\'' {
 							goto yy92
 						}
@@ -983,6 +986,12 @@ func (s *Scanner) lexString(quote byte) (pos token.Pos, tok token.Token, lit str
 				buf.WriteByte('\v')
 				continue
 			}
+		yy112:
+			s.cursor += 1
+			{
+				buf.WriteByte('$')
+				continue
+			}
 		}
 
 	}
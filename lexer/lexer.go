@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/masp/hoser/token"
@@ -59,6 +60,22 @@ func NewScanner(file *token.File, text []byte) *Scanner {
 	}
 }
 
+// At returns a new scanner over the same text that starts scanning at offset. It is used to scan the
+// expressions embedded in strings, e.g. "${name}".
+func (s *Scanner) At(offset int) *Scanner {
+	return &Scanner{
+		file:   s.file,
+		text:   s.text,
+		cursor: offset,
+		token:  offset,
+	}
+}
+
+// Text is the full text being scanned.
+func (s *Scanner) Text() []byte {
+	return s.text
+}
+
 func (s *Scanner) Next() (pos token.Pos, tok token.Token, lit string) {
 	if s.prevToken == token.Eof {
 		return token.Pos(len(s.text)), token.Eof, ""
@@ -93,3 +110,40 @@ func (s *Scanner) insertSemi() bool {
 func (s *Scanner) literal() string          { return string(s.text[s.token:s.cursor]) }
 func (s *Scanner) pos() token.Pos           { return s.file.Pos(s.cursor) }
 func (s *Scanner) position() token.Position { return s.file.Position(s.pos()) }
+
+// Unescape replaces the escape sequences in the raw contents of a string (without quotes) the same way they are
+// replaced when scanning a string.
+func Unescape(raw []byte) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' {
+			buf.WriteByte(raw[i])
+			continue
+		}
+		i++
+		if i >= len(raw) {
+			return "", ErrInvalidString
+		}
+		switch raw[i] {
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'v':
+			buf.WriteByte('\v')
+		case '\\', '\'', '"', '?', '$':
+			buf.WriteByte(raw[i])
+		default:
+			return "", ErrInvalidString
+		}
+	}
+	return buf.String(), nil
+}
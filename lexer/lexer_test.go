@@ -122,6 +122,13 @@ func TestTokensPos(t *testing.T) {
 				{token.Pos(5), token.Ident, "c"},
 			},
 		},
+		{
+			`"a\${b}" c`,
+			[]result{
+				{token.Pos(1), token.String, "a${b}"},
+				{token.Pos(10), token.Ident, "c"},
+			},
+		},
 		{
 			"12.5  5\n7",
 			[]result{
@@ -147,6 +154,31 @@ func TestTokensPos(t *testing.T) {
 	}
 }
 
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{`a\tb`, "a\tb", false},
+		{`\"quoted\"`, `"quoted"`, false},
+		{`cost: \${price}`, "cost: ${price}", false},
+		{`\{`, "", true},
+		{`end\`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := Unescape([]byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unescape() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Unescape() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestTokensPositions(t *testing.T) {
 	tests := []struct {
 		src  string
@@ -0,0 +1,228 @@
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/query"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+// document is a file opened by the client, with its current text and what was found when it was last traced.
+type document struct {
+	uri      string
+	filename string
+	version  int
+	text     *text
+
+	// module is the traced module of the current text, nil if the text does not parse. Index finds its identifiers.
+	module *ast.Module
+	index  *query.Index
+
+	// parsed and modules are the module and the module set of the last text that parsed, for completion
+	parsed  *ast.Module
+	modules *ast.ModuleSet
+
+	// includes are the modules of the include path, found the first time the document imports one
+	includes *tracer.Index
+}
+
+// update replaces the text of doc, traces it and publishes its errors.
+func (s *Server) update(doc *document, src []byte) {
+	doc.text = newText(src)
+	doc.module, doc.index = nil, nil
+
+	// the text is parsed before it is traced to keep the module of the last text that parsed for completion
+	file := token.NewFile(doc.filename, len(src))
+	var errs token.ErrorList
+	if parsed, err := parser.ParseModule(&file, src); err != nil {
+		errs = errorList(err)
+	} else {
+		errs = s.trace(doc, &file, parsed, src)
+	}
+	errs.Sort()
+
+	diags := []Diagnostic{}
+	for _, e := range errs {
+		diags = append(diags, s.diagnostic(doc, e))
+	}
+	s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: doc.uri, Version: doc.version, Diagnostics: diags})
+}
+
+// trace traces the module parsed from the text of doc and returns its errors and warnings. A panic of the tracer is
+// returned as an error, so that it is shown to the user and the server goes on with the next change.
+func (s *Server) trace(doc *document, file *token.File, parsed *ast.Module, src []byte) (errs token.ErrorList) {
+	defer func() {
+		if r := recover(); r != nil {
+			doc.module, doc.index = nil, nil
+			errs = token.ErrorList{{Msg: fmt.Errorf("internal error while tracing: %v", r)}}
+		}
+	}()
+
+	tr := tracer.NewTracer(s.includePath(doc.filename)...)
+	if len(parsed.Imports) > 0 && doc.includes == nil {
+		doc.includes = tracer.NewIndex(tr.IncludePath...)
+	}
+	tr.Index = doc.includes
+	module, err := tr.TraceParsed(file, parsed, src)
+	doc.module, doc.index = module, query.New(tr.ModuleSet(), tr.Refs())
+	doc.parsed, doc.modules = module, tr.ModuleSet()
+	return append(errorList(err), tr.Warnings()...)
+}
+
+// errorList is the list of errors in err, which is usually already a token.ErrorList.
+func errorList(err error) token.ErrorList {
+	if err == nil {
+		return nil
+	}
+	var list token.ErrorList
+	if errors.As(err, &list) {
+		return list
+	}
+	var e *token.Error
+	if errors.As(err, &e) {
+		return token.ErrorList{e}
+	}
+	return token.ErrorList{{Msg: err}}
+}
+
+// diagnostic converts an error found in doc to a diagnostic. Errors in the modules doc imports are shown at the top of
+// doc with their position in the message, since every diagnostic published for a document is in it.
+func (s *Server) diagnostic(doc *document, e *token.Error) Diagnostic {
+	d := Diagnostic{Code: e.Code, Source: "hoser", Message: e.Msg.Error()}
+	switch e.Severity {
+	case token.SeverityError:
+		d.Severity = severityError
+	case token.SeverityWarning:
+		d.Severity = severityWarning
+	default:
+		d.Severity = severityInformation
+	}
+	if e.Pos.Filename == doc.filename && e.Pos.IsValid() {
+		start := doc.text.tokenOffset(e.Pos)
+		d.Range = Range{doc.text.position(start), doc.text.position(doc.text.wordEnd(start))}
+	} else if e.Pos.Filename != "" {
+		d.Message = fmt.Sprintf("%v: %s", e.Pos, d.Message)
+	}
+	for _, rel := range e.Related {
+		loc := s.location(rel.Pos, rel.Pos)
+		d.RelatedInformation = append(d.RelatedInformation, DiagnosticRelatedInformation{Location: loc, Message: rel.Msg})
+	}
+	return d
+}
+
+// location is the range from start to end in the file they are in, which is read if it is not open.
+func (s *Server) location(start, end token.Position) Location {
+	t := s.textOf(start.Filename)
+	return Location{
+		URI:   fileURI(start.Filename),
+		Range: Range{t.position(t.tokenOffset(start)), t.position(t.tokenOffset(end))},
+	}
+}
+
+// textOf is the text of an open document called filename, or else the file as it is saved.
+func (s *Server) textOf(filename string) *text {
+	for _, doc := range s.docs {
+		if doc.filename == filename {
+			return doc.text
+		}
+	}
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return newText(nil)
+	}
+	return newText(src)
+}
+
+// text is the source of a file with the offsets its lines start at, to convert byte offsets to the positions of the
+// protocol, which count characters in UTF-16 code units.
+type text struct {
+	src   []byte
+	lines []int
+}
+
+func newText(src []byte) *text {
+	t := &text{src: src, lines: []int{0}}
+	for i, c := range src {
+		if c == '\n' {
+			t.lines = append(t.lines, i+1)
+		}
+	}
+	return t
+}
+
+// offset is the byte offset of p, which is moved to the end of its line or of the text if it is past it.
+func (t *text) offset(p Position) int {
+	if p.Line < 0 {
+		return 0
+	}
+	if p.Line >= len(t.lines) {
+		return len(t.src)
+	}
+	offset, units := t.lines[p.Line], 0
+	for offset < len(t.src) && t.src[offset] != '\n' && units < p.Character {
+		r, size := utf8.DecodeRune(t.src[offset:])
+		units += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+// position is the position of a byte offset.
+func (t *text) position(offset int) Position {
+	if offset > len(t.src) {
+		offset = len(t.src)
+	}
+	line := sort.SearchInts(t.lines, offset+1) - 1
+	units := len(utf16.Encode([]rune(string(t.src[t.lines[line]:offset]))))
+	return Position{Line: line, Character: units}
+}
+
+// tokenOffset is the byte offset of a position reported by the parser or tracer, whose line and column start at 1.
+// Positions past the end of the text, e.g. in a file that has changed since, are moved to its end.
+func (t *text) tokenOffset(pos token.Position) int {
+	if !pos.IsValid() {
+		return 0
+	}
+	if pos.Line > len(t.lines) {
+		return len(t.src)
+	}
+	offset := t.lines[pos.Line-1]
+	if pos.Column > 0 {
+		offset += pos.Column - 1
+	}
+	if offset > len(t.src) {
+		return len(t.src)
+	}
+	return offset
+}
+
+// wordEnd is the end of the identifier or number at offset, or the offset after the character at offset if there is
+// none, so that a diagnostic is never empty.
+func (t *text) wordEnd(offset int) int {
+	end := offset
+	for end < len(t.src) && isIdentByte(t.src[end]) {
+		end++
+	}
+	if end == offset && end < len(t.src) && t.src[end] != '\n' {
+		_, size := utf8.DecodeRune(t.src[end:])
+		end += size
+	}
+	return end
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// tokenPos is the byte offset of a position of the AST.
+func tokenPos(pos token.Pos) int {
+	return int(pos) - 1
+}
@@ -0,0 +1,419 @@
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/format"
+	"github.com/masp/hoser/token"
+)
+
+// builtinDoc documents the built-ins that can be called by name.
+var builtinDoc = map[ast.Builtin]string{
+	ast.MergeBuiltin:  "Merge interleaves the values of all its inputs into its single output in the order they arrive.",
+	ast.IntBuiltin:    "Int converts each value on its input to an int.",
+	ast.FloatBuiltin:  "Float converts each value on its input to a float.",
+	ast.StringBuiltin: "String converts each value on its input to a string.",
+}
+
+var builtins = []ast.Builtin{ast.MergeBuiltin, ast.IntBuiltin, ast.FloatBuiltin, ast.StringBuiltin}
+
+// hover describes the identifier at offset: the signature and doc comment of a pipe or stub, the type and doc comment
+// of a port, or the module of an import.
+func (s *Server) hover(doc *document, offset int) *Hover {
+	if doc.index == nil {
+		return nil
+	}
+	ident := doc.index.IdentAt(doc.filename, offset)
+	if ident == nil {
+		return nil
+	}
+	start, end := ident.Pos(), ident.End()
+	if !ident.Local() {
+		start = ident.ModulePos
+	}
+
+	var code, text string
+	sym, ok := doc.index.Definition(doc.filename, offset)
+	switch {
+	case !ok:
+		op, builtin := ast.LookupBuiltin(ident.V)
+		if !builtin || !ident.Local() {
+			return nil
+		}
+		code, text = "built-in "+ident.V, builtinDoc[op]
+	case sym.Qualifier:
+		code = fmt.Sprintf("import %q", sym.Decl.(*ast.ImportDecl).ModuleName.Value)
+		end = ident.ModulePos + token.Pos(len(ident.Module))
+	default:
+		code, text = describe(sym.Decl, doc.modules)
+	}
+
+	value := "```hoser\n" + code + "\n```"
+	if text != "" {
+		value += "\n\n" + text
+	}
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: value},
+		Range:    Range{doc.text.position(tokenPos(start)), doc.text.position(tokenPos(end))},
+	}
+}
+
+// describe returns how a declaration is shown in a hover, as code and the text after it.
+func describe(decl ast.Node, modules *ast.ModuleSet) (code, text string) {
+	switch d := decl.(type) {
+	case *ast.PipeDecl:
+		return signature("pipe", &d.StubDecl), d.Doc.Text()
+	case *ast.StubDecl:
+		return signature("stub", d), d.Doc.Text()
+	case *ast.Field:
+		text = d.Doc.Text()
+		if owner, input := portOwner(modules, d); owner != nil {
+			kind := "Output"
+			if input {
+				kind = "Input"
+			}
+			text = strings.TrimSpace(fmt.Sprintf("%s of %s.\n\n%s", kind, owner.BlockName(), text))
+		}
+		return portString(d), text
+	case *ast.Ident:
+		return d.V, ""
+	}
+	return "", ""
+}
+
+// portOwner finds the pipe or stub that declares a port and whether the port is one of its inputs.
+func portOwner(modules *ast.ModuleSet, field *ast.Field) (owner ast.BlockDecl, input bool) {
+	for _, cached := range modules.Modules {
+		if cached.Mod == nil {
+			continue
+		}
+		for _, decl := range cached.Mod.DefinedBlocks {
+			for _, f := range decl.BlockInputs().Fields {
+				if f == field {
+					return decl, true
+				}
+			}
+			for _, f := range decl.BlockOutputs().Fields {
+				if f == field {
+					return decl, false
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// signature prints the declaration of a pipe or stub without its body, e.g. `pipe Grep(stdin: string, limit: int =
+// 10) (stdout: string)`.
+func signature(keyword string, stub *ast.StubDecl) string {
+	var sb strings.Builder
+	if stub.IsPure() {
+		sb.WriteString("pure ")
+	}
+	sb.WriteString(keyword + " " + stub.Name.V)
+	ports := func(fields []*ast.Field) {
+		sb.WriteString("(")
+		for i, field := range fields {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(portString(field))
+		}
+		sb.WriteString(")")
+	}
+	ports(stub.Inputs.Fields)
+	if len(stub.Outputs.Fields) > 0 {
+		sb.WriteString(" ")
+		ports(stub.Outputs.Fields)
+	}
+	return sb.String()
+}
+
+// portString prints a port with its type and default, e.g. `limit: int = 10`. The type of a port declared without one
+// is the type inferred by the tracer, if the port has been traced.
+func portString(field *ast.Field) string {
+	s := field.Key.V
+	if typ := field.Type(); typ != "" {
+		s += ": " + string(typ)
+	}
+	if lit := field.Default; lit != nil {
+		if lit.Type == token.String {
+			s += " = " + strconv.Quote(lit.Value)
+		} else {
+			s += " = " + lit.Value
+		}
+	}
+	return s
+}
+
+// definition finds where the identifier at offset is declared, which may be in another module.
+func (s *Server) definition(doc *document, offset int) *Location {
+	if doc.index == nil {
+		return nil
+	}
+	sym, ok := doc.index.Definition(doc.filename, offset)
+	if !ok {
+		return nil
+	}
+	loc := s.location(sym.Def.Start, sym.Def.End)
+	return &loc
+}
+
+// completion suggests the names that can be written at offset: the blocks of a module after its qualifier, or else
+// the blocks, built-ins and imported modules that can be called and, at the start of an argument, the inputs of the
+// block being called. Names are taken from the last text that parsed and only those starting with the word before
+// offset are suggested.
+func (s *Server) completion(doc *document, offset int) []CompletionItem {
+	items := []CompletionItem{}
+	if doc.parsed == nil {
+		return items
+	}
+	src := doc.text.src[:offset]
+	start := offset
+	for start > 0 && isIdentByte(src[start-1]) {
+		start--
+	}
+	prefix := string(src[start:])
+
+	if start > 0 && src[start-1] == '.' {
+		qstart := start - 1
+		for qstart > 0 && isIdentByte(src[qstart-1]) {
+			qstart--
+		}
+		if imported := doc.imported(string(src[qstart : start-1])); imported != nil {
+			items = blockItems(items, imported, prefix)
+		}
+		return items
+	}
+
+	if call := enclosingCall(src[:start]); call != "" {
+		if decl := doc.lookup(call); decl != nil {
+			for _, field := range decl.BlockInputs().Fields {
+				if strings.HasPrefix(field.Key.V, prefix) {
+					items = append(items, CompletionItem{
+						Label:         field.Key.V,
+						Kind:          completionField,
+						Detail:        portString(field),
+						Documentation: markdown(field.Doc.Text()),
+						InsertText:    field.Key.V + ": ",
+					})
+				}
+			}
+		}
+	}
+	items = blockItems(items, doc.parsed, prefix)
+	for _, op := range builtins {
+		if strings.HasPrefix(string(op), prefix) {
+			items = append(items, CompletionItem{
+				Label:         string(op),
+				Kind:          completionFunction,
+				Detail:        "built-in " + string(op),
+				Documentation: markdown(builtinDoc[op]),
+			})
+		}
+	}
+	for _, imp := range doc.parsed.Imports {
+		if strings.HasPrefix(imp.Qualifier(), prefix) {
+			items = append(items, CompletionItem{
+				Label:  imp.Qualifier(),
+				Kind:   completionModule,
+				Detail: fmt.Sprintf("import %q", imp.ModuleName.Value),
+			})
+		}
+	}
+	return items
+}
+
+// blockItems appends the pipes and stubs of module whose names start with prefix to items.
+func blockItems(items []CompletionItem, module *ast.Module, prefix string) []CompletionItem {
+	for _, decl := range module.DefinedBlocks {
+		var code string
+		switch d := decl.(type) {
+		case *ast.PipeDecl:
+			if d.Implicit {
+				continue
+			}
+			code = signature("pipe", &d.StubDecl)
+		case *ast.StubDecl:
+			code = signature("stub", d)
+		}
+		if !strings.HasPrefix(decl.BlockName(), prefix) {
+			continue
+		}
+		var docText string
+		if doc := declDoc(decl); doc != nil {
+			docText = doc.Text()
+		}
+		items = append(items, CompletionItem{
+			Label:         decl.BlockName(),
+			Kind:          completionFunction,
+			Detail:        code,
+			Documentation: markdown(docText),
+		})
+	}
+	return items
+}
+
+func declDoc(decl ast.BlockDecl) *ast.CommentGroup {
+	switch d := decl.(type) {
+	case *ast.PipeDecl:
+		return d.Doc
+	case *ast.StubDecl:
+		return d.Doc
+	}
+	return nil
+}
+
+func markdown(text string) *MarkupContent {
+	if text == "" {
+		return nil
+	}
+	return &MarkupContent{Kind: "markdown", Value: text}
+}
+
+// enclosingCall returns the name of the block called by the parentheses that src ends in, e.g. grep.Filter for
+// `grep.Filter(stdin, `, if src ends at the start of an argument. Parentheses in strings and comments are not told
+// apart from the others, which at worst suggests the wrong inputs.
+func enclosingCall(src []byte) string {
+	last := len(src) - 1
+	for last >= 0 && (src[last] == ' ' || src[last] == '\t' || src[last] == '\n' || src[last] == '\r') {
+		last--
+	}
+	if last < 0 || (src[last] != '(' && src[last] != ',') {
+		return ""
+	}
+
+	depth := 0
+	for i := last; i >= 0; i-- {
+		switch src[i] {
+		case ')', '}':
+			depth++
+		case '{':
+			if depth == 0 {
+				return "" // the start of a record or a pipe body, not a call
+			}
+			depth--
+		case '(':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			end := i
+			start := end
+			for start > 0 && (isIdentByte(src[start-1]) || src[start-1] == '.') {
+				start--
+			}
+			return string(src[start:end])
+		}
+	}
+	return ""
+}
+
+// imported is the module imported with qualifier by the last text of doc that parsed, nil if there is none or it was
+// not loaded.
+func (doc *document) imported(qualifier string) *ast.Module {
+	imp := doc.parsed.Import(qualifier)
+	if imp == nil {
+		return nil
+	}
+	cached := doc.modules.Lookup(imp.ModuleName.Value)
+	if cached == nil || !cached.IsLoaded() {
+		return nil
+	}
+	return cached.Mod
+}
+
+// lookup finds the block called name, which may be qualified by a module, in the last text of doc that parsed.
+func (doc *document) lookup(name string) ast.BlockDecl {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		imported := doc.imported(name[:i])
+		if imported == nil {
+			return nil
+		}
+		return imported.Lookup(name[i+1:])
+	}
+	return doc.parsed.Lookup(name)
+}
+
+// symbols lists the pipes and stubs of doc with their ports.
+func (s *Server) symbols(doc *document) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	if doc.module == nil {
+		return symbols
+	}
+	for _, decl := range doc.module.DefinedBlocks {
+		var (
+			stub    *ast.StubDecl
+			keyword string
+			kind    int
+		)
+		switch d := decl.(type) {
+		case *ast.PipeDecl:
+			if d.Implicit {
+				continue
+			}
+			stub, keyword, kind = &d.StubDecl, "pipe", symbolFunction
+		case *ast.StubDecl:
+			stub, keyword, kind = d, "stub", symbolInterface
+		default:
+			continue
+		}
+
+		name := doc.text.span(tokenPos(stub.Name.Pos()), tokenPos(stub.Name.End()))
+		start := doc.text.keywordStart(tokenPos(stub.Name.Pos()), keyword)
+		if stub.IsPure() {
+			start = tokenPos(stub.Pure)
+		}
+		sym := DocumentSymbol{
+			Name:           stub.Name.V,
+			Detail:         signature(keyword, stub),
+			Kind:           kind,
+			Range:          doc.text.span(start, tokenPos(decl.End())+1), // End is the closing ) or }
+			SelectionRange: name,
+		}
+		for _, field := range append(append([]*ast.Field{}, stub.Inputs.Fields...), stub.Outputs.Fields...) {
+			key := doc.text.span(tokenPos(field.Key.Pos()), tokenPos(field.Key.End()))
+			sym.Children = append(sym.Children, DocumentSymbol{
+				Name:           field.Key.V,
+				Detail:         portString(field),
+				Kind:           symbolField,
+				Range:          key,
+				SelectionRange: key,
+			})
+		}
+		symbols = append(symbols, sym)
+	}
+	return symbols
+}
+
+// span is the range between two byte offsets.
+func (t *text) span(start, end int) Range {
+	return Range{t.position(start), t.position(end)}
+}
+
+// keywordStart is the offset of keyword if it is the word before offset, or else offset.
+func (t *text) keywordStart(offset int, keyword string) int {
+	i := offset
+	for i > 0 && (t.src[i-1] == ' ' || t.src[i-1] == '\t') {
+		i--
+	}
+	if i >= len(keyword) && string(t.src[i-len(keyword):i]) == keyword {
+		return i - len(keyword)
+	}
+	return offset
+}
+
+// formatting formats doc as hoser fmt does, with one edit replacing the whole text. Nothing is changed if doc is
+// already formatted or does not parse.
+func (s *Server) formatting(doc *document) []TextEdit {
+	file := token.NewFile(doc.filename, len(doc.text.src))
+	formatted, err := format.Source(&file, doc.text.src)
+	if err != nil || bytes.Equal(formatted, doc.text.src) {
+		return []TextEdit{}
+	}
+	return []TextEdit{{Range: doc.text.span(0, len(doc.text.src)), NewText: string(formatted)}}
+}
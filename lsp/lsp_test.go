@@ -0,0 +1,549 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const mainSrc = `module "main"
+
+import "text"
+
+# Echo sends s back.
+pipe Echo(
+	s: string, # the value
+	n: int = 2,
+) (out: string) {
+	out = s
+}
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = text.Upper(Echo(stdin))
+}
+`
+
+const textSrc = `module "text"
+
+# Upper converts s to upper case.
+stub Upper(s: string) (upper: string)
+`
+
+// client writes the messages of a session to the server in advance.
+type client struct {
+	in  bytes.Buffer
+	ids int
+}
+
+func (c *client) request(method string, params interface{}) int {
+	c.ids++
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "id": c.ids, "method": method, "params": params})
+	return c.ids
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (c *client) send(msg interface{}) {
+	data, _ := json.Marshal(msg)
+	c.in.WriteString("Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n")
+	c.in.Write(data)
+}
+
+// open writes files to a new directory and starts a session with its main.hos open.
+func open(t *testing.T, files map[string]string) (c *client, dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	c = &client{}
+	c.request("initialize", map[string]interface{}{})
+	c.notify("initialized", map[string]interface{}{})
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "main.hos" {
+			c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{
+				URI: fileURI(filename), LanguageID: "hoser", Version: 1, Text: src,
+			}})
+		}
+	}
+	return c, dir
+}
+
+// serve runs the session of c to its end and returns the responses by ID and the notifications.
+func serve(t *testing.T, c *client) (responses map[int]message, notes []message, err error) {
+	t.Helper()
+	var out bytes.Buffer
+	err = (&Server{}).Serve(&c.in, &out)
+	responses = make(map[int]message)
+	r := bufio.NewReader(&out)
+	for {
+		body, rerr := readMessage(r)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == nil {
+			notes = append(notes, msg)
+			continue
+		}
+		var id int
+		if err := json.Unmarshal(*msg.ID, &id); err != nil {
+			t.Fatal(err)
+		}
+		responses[id] = msg
+	}
+	return
+}
+
+// at is the position in src of the | in marker, which is found in src with the | removed.
+func at(t *testing.T, src, marker string) Position {
+	t.Helper()
+	i := strings.Index(src, strings.ReplaceAll(marker, "|", ""))
+	if i < 0 {
+		t.Fatalf("%q is not in the source", marker)
+	}
+	return newText([]byte(src)).position(i + strings.Index(marker, "|"))
+}
+
+// equalJSON reports whether two JSON values are the same, ignoring formatting and the order of object keys.
+func equalJSON(t *testing.T, got []byte, want string) bool {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func TestRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		at     string // cursor in main.hos, for requests with a position
+		want   string // $DIR is the directory of the files
+	}{
+		{
+			name:   "Hover pipe",
+			method: "textDocument/hover",
+			at:     "Ec|ho(stdin)",
+			want: `{"contents": {"kind": "markdown", "value": "` + "```hoser\\npipe Echo(s: string, n: int = 2) (out: string)\\n```" + `\n\nEcho sends s back."},
+				"range": {"start": {"line": 13, "character": 21}, "end": {"line": 13, "character": 25}}}`,
+		},
+		{
+			name:   "Hover port",
+			method: "textDocument/hover",
+			at:     "out = |s",
+			want: `{"contents": {"kind": "markdown", "value": "` + "```hoser\\ns: string\\n```" + `\n\nInput of Echo.\n\nthe value"},
+				"range": {"start": {"line": 9, "character": 7}, "end": {"line": 9, "character": 8}}}`,
+		},
+		{
+			name:   "Hover qualifier",
+			method: "textDocument/hover",
+			at:     "te|xt.Upper",
+			want: `{"contents": {"kind": "markdown", "value": "` + "```hoser\\nimport \\\"text\\\"\\n```" + `"},
+				"range": {"start": {"line": 13, "character": 10}, "end": {"line": 13, "character": 14}}}`,
+		},
+		{
+			name:   "Hover nothing",
+			method: "textDocument/hover",
+			at:     "stdout =| text",
+			want:   `null`,
+		},
+		{
+			name:   "Definition in module",
+			method: "textDocument/definition",
+			at:     "Ec|ho(stdin)",
+			want:   `{"uri": "file://$DIR/main.hos", "range": {"start": {"line": 5, "character": 5}, "end": {"line": 5, "character": 9}}}`,
+		},
+		{
+			name:   "Definition in import",
+			method: "textDocument/definition",
+			at:     "text.Up|per",
+			want:   `{"uri": "file://$DIR/text.hos", "range": {"start": {"line": 3, "character": 5}, "end": {"line": 3, "character": 10}}}`,
+		},
+		{
+			name:   "Formatted",
+			method: "textDocument/formatting",
+			want:   `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := open(t, map[string]string{"main.hos": mainSrc, "text.hos": textSrc})
+			uri := fileURI(filepath.Join(dir, "main.hos"))
+			var id int
+			if tt.at != "" {
+				id = c.request(tt.method, TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: at(t, mainSrc, tt.at)})
+			} else {
+				id = c.request(tt.method, DocumentFormattingParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+			}
+			c.request("shutdown", nil)
+			c.notify("exit", nil)
+			responses, _, err := serve(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, ok := responses[id]
+			if !ok || resp.Error != nil {
+				t.Fatalf("%s failed: %v", tt.method, resp.Error)
+			}
+			result := json.RawMessage("null") // a null result is decoded as no result
+			if resp.Result != nil {
+				result = *resp.Result
+			}
+			want := strings.ReplaceAll(tt.want, "$DIR", filepath.ToSlash(dir))
+			if !equalJSON(t, result, want) {
+				t.Errorf("%s =\n%s\nwant:\n%s", tt.method, result, want)
+			}
+		})
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	tests := []struct {
+		name   string
+		change string // replaces the body of main before completing at the end of it, if set
+		at     string // cursor in main.hos if change is not set
+		want   []string
+	}{
+		{
+			name: "Arguments",
+			at:   "Echo(|stdin)",
+			want: []string{"s", "n", "Echo", "main", "merge", "int", "float", "string", "text"},
+		},
+		{
+			name: "Prefix",
+			at:   "stdout = text.Upper(E|cho",
+			want: []string{"Echo"},
+		},
+		{
+			name: "Qualified",
+			at:   "text.|Upper",
+			want: []string{"Upper"},
+		},
+		{
+			name:   "Typing qualified",
+			change: "stdout = text.",
+			want:   []string{"Upper"},
+		},
+		{
+			name:   "Typing argument",
+			change: "stdout = Echo(stdin, n",
+			want:   []string{"n"},
+		},
+		{
+			name:   "Typing in record",
+			change: "stdout = Echo({s",
+			want:   []string{"string"}, // a key of the record, not an input of Echo
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := open(t, map[string]string{"main.hos": mainSrc, "text.hos": textSrc})
+			uri := fileURI(filepath.Join(dir, "main.hos"))
+			src, marker := mainSrc, tt.at
+			if tt.change != "" {
+				src = strings.Replace(mainSrc, "stdout = text.Upper(Echo(stdin))", tt.change, 1)
+				marker = tt.change + "|"
+				c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+					TextDocument:   VersionedTextDocumentIdentifier{URI: uri, Version: 2},
+					ContentChanges: []TextDocumentContentChangeEvent{{Text: src}},
+				})
+			}
+			id := c.request("textDocument/completion", TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: at(t, src, marker)})
+			c.request("shutdown", nil)
+			c.notify("exit", nil)
+			responses, _, err := serve(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var items []CompletionItem
+			if err := json.Unmarshal(*responses[id].Result, &items); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, item := range items {
+				got = append(got, item.Label)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("completion = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // diagnostics published when the document is opened
+	}{
+		{
+			name: "Clean",
+			src:  mainSrc,
+			want: `[]`,
+		},
+		{
+			name: "Trace",
+			src: `module "main"
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = missing
+}
+`,
+			want: `[{"range": {"start": {"line": 2, "character": 26}, "end": {"line": 2, "character": 32}}, "severity": 2,
+				"code": "unassigned-output", "source": "hoser", "message": "output stdout of main is never assigned"},
+				{"range": {"start": {"line": 3, "character": 10}, "end": {"line": 3, "character": 17}}, "severity": 1,
+				"code": "unknown-name", "source": "hoser", "message": "no symbol found with name missing"}]`,
+		},
+		{
+			name: "Warning",
+			src: `module "main"
+
+pipe main(stdin: string) (stdout: string) {}
+`,
+			want: `[{"range": {"start": {"line": 2, "character": 26}, "end": {"line": 2, "character": 32}}, "severity": 2,
+				"code": "unassigned-output", "source": "hoser", "message": "output stdout of main is never assigned"}]`,
+		},
+		{
+			name: "Syntax",
+			src: `module "main"
+
+pipe main(stdin: string) (stdout: string) {
+	stdout = Echo(
+}
+`,
+			want: `[{"range": {"start": {"line": 4, "character": 0}, "end": {"line": 4, "character": 1}}, "severity": 1,
+				"source": "hoser", "message": "expected expression got }"},
+				{"range": {"start": {"line": 5, "character": 0}, "end": {"line": 5, "character": 0}}, "severity": 1,
+				"source": "hoser", "message": "expected token }, got EOF"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := open(t, map[string]string{"main.hos": tt.src, "text.hos": textSrc})
+			uri := fileURI(filepath.Join(dir, "main.hos"))
+			c.notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+			c.request("shutdown", nil)
+			c.notify("exit", nil)
+			_, notes, err := serve(t, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(notes) != 2 {
+				t.Fatalf("got %d notifications, want 2 for opening and closing", len(notes))
+			}
+			var opened, closed PublishDiagnosticsParams
+			if err := json.Unmarshal(notes[0].Params, &opened); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(notes[1].Params, &closed); err != nil {
+				t.Fatal(err)
+			}
+			if opened.URI != uri || opened.Version != 1 {
+				t.Errorf("diagnostics are for %s version %d, want %s version 1", opened.URI, opened.Version, uri)
+			}
+			got, _ := json.Marshal(opened.Diagnostics)
+			if !equalJSON(t, got, tt.want) {
+				t.Errorf("diagnostics =\n%s\nwant:\n%s", got, tt.want)
+			}
+			if len(closed.Diagnostics) != 0 {
+				t.Errorf("closing the document published %v, want no diagnostics", closed.Diagnostics)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "text.hos"), []byte(textSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "main.hos")
+	var out bytes.Buffer
+	crash := false
+	s := &Server{w: &out, docs: make(map[string]*document), IncludePath: func(filename string) []string {
+		if crash {
+			panic("include path")
+		}
+		return []string{filepath.Dir(filename)}
+	}}
+	doc := &document{uri: fileURI(filename), filename: filename}
+
+	// the include path is searched once and the modules found are used for every change
+	s.update(doc, []byte(mainSrc))
+	includes := doc.includes
+	s.update(doc, []byte(strings.Replace(mainSrc, "Echo(stdin)", "stdin", 1)))
+	if includes == nil || doc.includes != includes {
+		t.Errorf("include path was indexed again for a change")
+	}
+	if doc.module == nil {
+		t.Fatalf("changed document was not traced")
+	}
+
+	// a panic while tracing is published and leaves the server running
+	crash = true
+	s.update(doc, []byte(mainSrc))
+	if doc.module != nil || doc.index != nil {
+		t.Errorf("document that failed to trace has a module")
+	}
+	var diags []PublishDiagnosticsParams
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg message
+		var params PublishDiagnosticsParams
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			t.Fatal(err)
+		}
+		diags = append(diags, params)
+	}
+	if len(diags) != 3 {
+		t.Fatalf("got %d notifications, want 3 for the changes", len(diags))
+	}
+	got, _ := json.Marshal(diags[2].Diagnostics)
+	want := `[{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 0, "character": 0}}, "severity": 1,
+		"source": "hoser", "message": "internal error while tracing: include path"}]`
+	if !equalJSON(t, got, want) {
+		t.Errorf("diagnostics =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	c, dir := open(t, map[string]string{"main.hos": mainSrc, "text.hos": textSrc})
+	id := c.request("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: fileURI(filepath.Join(dir, "main.hos"))}})
+	c.request("shutdown", nil)
+	c.notify("exit", nil)
+	responses, _, err := serve(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var symbols []DocumentSymbol
+	if err := json.Unmarshal(*responses[id].Result, &symbols); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sym := range symbols {
+		got = append(got, sym.Detail)
+		for _, port := range sym.Children {
+			got = append(got, "\t"+port.Detail)
+		}
+	}
+	want := []string{
+		"pipe Echo(s: string, n: int = 2) (out: string)",
+		"\ts: string",
+		"\tn: int = 2",
+		"\tout: string",
+		"pipe main(stdin: string) (stdout: string)",
+		"\tstdin: string",
+		"\tstdout: string",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("symbols = %q, want %q", got, want)
+	}
+	if r := symbols[0].Range; r.Start != (Position{5, 0}) || r.End != (Position{10, 1}) {
+		t.Errorf("range of Echo = %v, want from the pipe keyword to the closing brace", r)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	src := "module \"main\"\npipe main(stdin: string) (stdout: string) { stdout = stdin }\n"
+	c, dir := open(t, map[string]string{"main.hos": src})
+	id := c.request("textDocument/formatting", DocumentFormattingParams{TextDocument: TextDocumentIdentifier{URI: fileURI(filepath.Join(dir, "main.hos"))}})
+	c.request("shutdown", nil)
+	c.notify("exit", nil)
+	responses, _, err := serve(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 2, "character": 0}},
+		"newText": "module \"main\"\n\npipe main(stdin: string) (stdout: string) {\n\tstdout = stdin\n}\n"}]`
+	if !equalJSON(t, *responses[id].Result, want) {
+		t.Errorf("formatting =\n%s\nwant:\n%s", *responses[id].Result, want)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	c := &client{}
+	early := c.request("textDocument/hover", TextDocumentPositionParams{})
+	c.request("initialize", map[string]interface{}{})
+	unknown := c.request("workspace/symbol", map[string]interface{}{})
+	closed := c.request("textDocument/hover", TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: "file:///closed.hos"}})
+	c.in.WriteString("Content-Length: 5\r\n\r\n{bad}")
+	c.notify("exit", nil)
+	responses, notes, err := serve(t, c)
+	if !errors.Is(err, ErrNoShutdown) {
+		t.Errorf("Serve() err = %v, want %v", err, ErrNoShutdown)
+	}
+
+	for id, code := range map[int]int{early: codeServerNotInitialized, unknown: codeMethodNotFound, closed: codeInvalidParams} {
+		if resp := responses[id]; resp.Error == nil || resp.Error.Code != code {
+			t.Errorf("response %d has error %v, want code %d", id, resp.Error, code)
+		}
+	}
+	// the response to a message that is not JSON has a null ID, so it is read as a notification
+	if len(notes) != 1 || notes[0].Error == nil || notes[0].Error.Code != codeParseError {
+		t.Errorf("got notifications %v, want one parse error", notes)
+	}
+}
+
+func TestText(t *testing.T) {
+	src := "a→b\n𝄞x\n"
+	tests := []struct {
+		offset int
+		pos    Position
+	}{
+		{0, Position{0, 0}},
+		{1, Position{0, 1}},
+		{4, Position{0, 2}}, // → is 3 bytes and 1 UTF-16 unit
+		{6, Position{1, 0}},
+		{10, Position{1, 2}}, // 𝄞 is 4 bytes and 2 UTF-16 units
+		{12, Position{2, 0}},
+	}
+	text := newText([]byte(src))
+	for _, tt := range tests {
+		if got := text.position(tt.offset); got != tt.pos {
+			t.Errorf("position(%d) = %v, want %v", tt.offset, got, tt.pos)
+		}
+		if got := text.offset(tt.pos); got != tt.offset {
+			t.Errorf("offset(%v) = %d, want %d", tt.pos, got, tt.offset)
+		}
+	}
+	if got := text.offset(Position{0, 100}); got != 5 {
+		t.Errorf("offset past the end of a line = %d, want the end of the line at 5", got)
+	}
+}
@@ -0,0 +1,294 @@
+// Package lsp is a Language Server Protocol server for hoser source files, which lets editors show the errors of a
+// program while it is typed and answer hover, go-to-definition, completion, document symbol and formatting requests.
+//
+// The server speaks JSON-RPC over a pair of streams, usually standard input and output:
+//
+//	s := &lsp.Server{IncludePath: func(filename string) []string { return []string{filepath.Dir(filename)} }}
+//	err := s.Serve(os.Stdin, os.Stdout)
+//
+// Documents are sent whole every time they change. They are traced with their imported modules, which are read from
+// the include path, and their errors and the warnings of the tracer are published as diagnostics. The include path is
+// searched for modules once for each open document, so modules added to it are found when the document is reopened.
+// Requests about a document are answered from its last trace, except for completion, which uses the last version of
+// the document that parsed so that names can be completed in the middle of a statement.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNoShutdown is returned by Serve if the client exits or closes the connection without asking the server to shut
+// down first.
+var ErrNoShutdown = errors.New("exit without shutdown")
+
+// Server answers the requests of one client. The zero value is ready to use.
+type Server struct {
+	// IncludePath returns the directories searched for the modules imported by the file called filename. If it is
+	// nil, only the directory of the file is searched.
+	IncludePath func(filename string) []string
+
+	w           io.Writer
+	docs        map[string]*document // open documents by URI
+	initialized bool
+	shutdown    bool
+}
+
+// Serve reads requests from r and writes responses and notifications to w until the client exits. It returns nil if
+// the client shut the server down before exiting.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	s.docs = make(map[string]*document)
+	in := bufio.NewReader(r)
+	for {
+		body, err := readMessage(in)
+		if err == io.EOF {
+			if s.shutdown {
+				return nil
+			}
+			return ErrNoShutdown
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			null := json.RawMessage("null")
+			s.respond(&null, nil, &responseError{Code: codeParseError, Message: err.Error()})
+			continue
+		}
+		if msg.ID == nil {
+			if msg.Method == "exit" {
+				if s.shutdown {
+					return nil
+				}
+				return ErrNoShutdown
+			}
+			s.notified(msg.Method, msg.Params)
+			continue
+		}
+		result, err := s.call(msg.Method, msg.Params)
+		var rerr *responseError
+		if err != nil && !errors.As(err, &rerr) {
+			rerr = &responseError{Code: codeInternalError, Message: err.Error()}
+		}
+		s.respond(msg.ID, result, rerr)
+	}
+}
+
+// call answers a request with its result or an error.
+func (s *Server) call(method string, params json.RawMessage) (interface{}, error) {
+	if !s.initialized && method != "initialize" {
+		return nil, &responseError{Code: codeServerNotInitialized, Message: "server is not initialized"}
+	}
+	if s.shutdown {
+		return nil, &responseError{Code: codeInvalidRequest, Message: "server is shut down"}
+	}
+
+	switch method {
+	case "initialize":
+		s.initialized = true
+		return InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:           syncFull,
+				HoverProvider:              true,
+				DefinitionProvider:         true,
+				CompletionProvider:         CompletionOptions{TriggerCharacters: []string{".", "(", ","}},
+				DocumentSymbolProvider:     true,
+				DocumentFormattingProvider: true,
+			},
+			ServerInfo: ServerInfo{Name: "hoser"},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/hover":
+		var p TextDocumentPositionParams
+		doc, offset, err := s.position(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		return s.hover(doc, offset), nil
+	case "textDocument/definition":
+		var p TextDocumentPositionParams
+		doc, offset, err := s.position(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		return s.definition(doc, offset), nil
+	case "textDocument/completion":
+		var p TextDocumentPositionParams
+		doc, offset, err := s.position(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		return s.completion(doc, offset), nil
+	case "textDocument/documentSymbol":
+		var p DocumentSymbolParams
+		doc, err := s.document(params, &p, &p.TextDocument)
+		if err != nil {
+			return nil, err
+		}
+		return s.symbols(doc), nil
+	case "textDocument/formatting":
+		var p DocumentFormattingParams
+		doc, err := s.document(params, &p, &p.TextDocument)
+		if err != nil {
+			return nil, err
+		}
+		return s.formatting(doc), nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method %s is not supported", method)}
+}
+
+// notified handles a notification, which has no response. Notifications the server does not know are ignored, as
+// the protocol requires.
+func (s *Server) notified(method string, params json.RawMessage) {
+	if !s.initialized {
+		return
+	}
+	switch method {
+	case "textDocument/didOpen":
+		var p DidOpenTextDocumentParams
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		filename, err := uriFilename(p.TextDocument.URI)
+		if err != nil {
+			return
+		}
+		doc := &document{uri: p.TextDocument.URI, filename: filename, version: p.TextDocument.Version}
+		s.docs[doc.uri] = doc
+		s.update(doc, []byte(p.TextDocument.Text))
+	case "textDocument/didChange":
+		var p DidChangeTextDocumentParams
+		if json.Unmarshal(params, &p) != nil || len(p.ContentChanges) == 0 {
+			return
+		}
+		doc, ok := s.docs[p.TextDocument.URI]
+		if !ok {
+			return
+		}
+		doc.version = p.TextDocument.Version
+		s.update(doc, []byte(p.ContentChanges[len(p.ContentChanges)-1].Text))
+	case "textDocument/didClose":
+		var p DidCloseTextDocumentParams
+		if json.Unmarshal(params, &p) != nil {
+			return
+		}
+		if _, ok := s.docs[p.TextDocument.URI]; ok {
+			delete(s.docs, p.TextDocument.URI)
+			s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []Diagnostic{}})
+		}
+	}
+}
+
+// document decodes params into p and returns the open document named by id, which is part of p.
+func (s *Server) document(params json.RawMessage, p interface{}, id *TextDocumentIdentifier) (*document, error) {
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	doc, ok := s.docs[id.URI]
+	if !ok {
+		return nil, &responseError{Code: codeInvalidParams, Message: fmt.Sprintf("document %s is not open", id.URI)}
+	}
+	return doc, nil
+}
+
+// position decodes params into p and returns the document and byte offset it points at.
+func (s *Server) position(params json.RawMessage, p *TextDocumentPositionParams) (*document, int, error) {
+	doc, err := s.document(params, p, &p.TextDocument)
+	if err != nil {
+		return nil, 0, err
+	}
+	return doc, doc.text.offset(p.Position), nil
+}
+
+func (s *Server) respond(id *json.RawMessage, result interface{}, rerr *responseError) {
+	msg := message{JSONRPC: "2.0", ID: id, Error: rerr}
+	if rerr == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			msg.Error = &responseError{Code: codeInternalError, Message: err.Error()}
+		} else {
+			raw := json.RawMessage(data)
+			msg.Result = &raw
+		}
+	}
+	s.write(msg)
+}
+
+// notify sends a notification to the client.
+func (s *Server) notify(method string, params interface{}) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	s.write(message{JSONRPC: "2.0", Method: method, Params: data})
+}
+
+func (s *Server) write(msg message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	// the client has gone away if writing fails, which Serve finds out when it reads the next message
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+// readMessage reads the body of the next message, which is preceded by a header with its length like HTTP.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF && len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("invalid message header: %v", err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading message: %v", err)
+	}
+	return body, nil
+}
+
+func (s *Server) includePath(filename string) []string {
+	if s.IncludePath == nil {
+		return []string{filepath.Dir(filename)}
+	}
+	return s.IncludePath(filename)
+}
+
+// uriFilename is the name of the file of a file:// URI.
+func uriFilename(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI %s, expected a file:// URI", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// fileURI is the file:// URI of filename.
+func fileURI(filename string) string {
+	path := filepath.ToSlash(filename)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // a Windows path like C:/dir
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
@@ -0,0 +1,191 @@
+// Package optimize rewrites the graphs created by the tracer into equivalent graphs that do less work when run.
+package optimize
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/masp/hoser/ast"
+)
+
+// Pass rewrites a single traced graph in place.
+type Pass func(graph *ast.Graph)
+
+// Module runs each pass in order on the body of every pipe in mod, including the bodies of pipe literals.
+func Module(mod *ast.Module, passes ...Pass) {
+	for _, decl := range mod.DefinedBlocks {
+		if pipe, ok := decl.(*ast.PipeDecl); ok && pipe.BodyDAG != nil {
+			Graph(pipe.BodyDAG, passes...)
+		}
+	}
+}
+
+// Graph runs each pass in order on graph and on the bodies of the pipe literals inside it.
+func Graph(graph *ast.Graph, passes ...Pass) {
+	for _, block := range graph.Blocks {
+		if ref, ok := block.(*ast.PipeRefBlock); ok {
+			if _, isLit := ref.CreatedBy().(*ast.PipeLit); isLit {
+				Graph(ref.Decl.(*ast.PipeDecl).BodyDAG, passes...)
+			}
+		}
+	}
+	for _, pass := range passes {
+		pass(graph)
+	}
+}
+
+// Fold evaluates pure built-ins whose inputs all come from literals and replaces them with the literal they compute,
+// e.g. int("5") becomes 5. The literal keeps the expression it was computed from as its CreatedBy. Folding repeats
+// until nothing changes, so chains of built-ins fold into one literal. Built-ins that fail to evaluate are kept so
+// the error is reported when the program is run. The literals that were inputs of a folded block are left for Prune.
+func Fold(graph *ast.Graph) {
+	for folded := true; folded; {
+		folded = false
+		for idx, block := range graph.Blocks {
+			builtin, ok := block.(*ast.BuiltinBlock)
+			if !ok || !builtin.Op.Pure() {
+				continue
+			}
+			args, ok := literalArgs(graph, ast.BlockIdx(idx), len(builtin.InPorts()))
+			if !ok {
+				continue
+			}
+			v, err := builtin.Eval(args)
+			if err != nil {
+				continue
+			}
+			if lit, ok := ast.ValueLiteral(v, builtin.CreatedBy().Pos()); ok {
+				graph.ReplaceWithLiteral(ast.BlockIdx(idx), lit, builtin.CreatedBy())
+				folded = true
+			}
+		}
+	}
+}
+
+// literalArgs returns the values of the literals connected to the n inputs of block idx, ok is false if any input is
+// not connected to a literal.
+func literalArgs(graph *ast.Graph, idx ast.BlockIdx, n int) (args []interface{}, ok bool) {
+	for port := 0; port < n; port++ {
+		src, ok := graph.Producer(ast.Loc{Block: idx, Port: ast.PortIdx(port)})
+		if !ok || src.Block == ast.RootBlock {
+			return nil, false
+		}
+		lit, ok := graph.Block(src.Block).(*ast.LiteralBlock)
+		if !ok {
+			return nil, false
+		}
+		args = append(args, lit.Lit.ParsedVal)
+	}
+	return args, true
+}
+
+// Dedup merges pure blocks that compute the same values into one block whose outputs fan out to the consumers of all
+// of them. Two blocks are the same if they are the same literal, pipe value or pure built-in, or call the same pure
+// stub or pipe, and their inputs come from the same producers. Merging blocks can make their consumers the same, so
+// merging repeats until nothing changes.
+func Dedup(graph *ast.Graph) {
+	for {
+		first := make(map[string]ast.BlockIdx)
+		replace := make(map[ast.BlockIdx]ast.BlockIdx)
+		for i, block := range graph.Blocks {
+			idx := ast.BlockIdx(i)
+			key, ok := pureKey(graph, idx, block)
+			if !ok {
+				continue
+			}
+			if other, ok := first[key]; ok {
+				replace[idx] = other
+			} else {
+				first[key] = idx
+			}
+		}
+		if len(replace) == 0 {
+			return
+		}
+
+		for i := range graph.Edges {
+			if other, ok := replace[graph.Edges[i].Src.Block]; ok {
+				graph.Edges[i].Src.Block = other
+			}
+		}
+		graph.RemoveBlocks(func(idx ast.BlockIdx) bool {
+			_, dup := replace[idx]
+			return !dup
+		})
+	}
+}
+
+// pureKey identifies what a pure block computes, ok is false if the block is not pure.
+func pureKey(graph *ast.Graph, idx ast.BlockIdx, block ast.Block) (key string, ok bool) {
+	var sb strings.Builder
+	switch b := block.(type) {
+	case *ast.LiteralBlock:
+		fmt.Fprintf(&sb, "literal %v %q", b.Lit.Type, b.Lit.Value)
+	case *ast.PipeRefBlock:
+		fmt.Fprintf(&sb, "ref %p", b.Decl)
+	case *ast.BuiltinBlock:
+		if !b.Op.Pure() {
+			return "", false
+		}
+		fmt.Fprintf(&sb, "builtin %v %q", b.Op, b.Params)
+	case *ast.StubBlock:
+		if !b.Decl.IsPure() {
+			return "", false
+		}
+		fmt.Fprintf(&sb, "stub %p", b.Decl)
+	case *ast.PipeBlock:
+		if !b.Decl.IsPure() {
+			return "", false
+		}
+		fmt.Fprintf(&sb, "pipe %p", b.Decl)
+	default:
+		return "", false
+	}
+	for port := range block.InPorts() {
+		src, ok := graph.Producer(ast.Loc{Block: idx, Port: ast.PortIdx(port)})
+		if !ok {
+			return "", false // an error reported by the tracer
+		}
+		fmt.Fprintf(&sb, " %d.%d", src.Block, src.Port)
+	}
+	return sb.String(), true
+}
+
+// Prune removes blocks that can never affect the result of running the graph. A block is live if it may have side
+// effects (stubs, and pipes since they may call stubs) or if one of its outputs reaches a live block or an output of
+// the graph. Every other block only computes values that are dropped, e.g. the literal in `x = 10` if x is never used.
+func Prune(graph *ast.Graph) {
+	live := make([]bool, len(graph.Blocks))
+	var work []ast.BlockIdx
+	markLive := func(idx ast.BlockIdx) {
+		if idx != ast.RootBlock && !live[idx] {
+			live[idx] = true
+			work = append(work, idx)
+		}
+	}
+
+	for i, block := range graph.Blocks {
+		switch block.(type) {
+		case *ast.StubBlock, *ast.PipeBlock, *ast.ApplyBlock:
+			markLive(ast.BlockIdx(i))
+		}
+	}
+	for _, edge := range graph.Edges {
+		if edge.Dst.Block == ast.RootBlock {
+			markLive(edge.Src.Block)
+		}
+	}
+
+	// every producer of a live block is live
+	for len(work) > 0 {
+		idx := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, edge := range graph.Edges {
+			if edge.Dst.Block == idx {
+				markLive(edge.Src.Block)
+			}
+		}
+	}
+
+	graph.RemoveBlocks(func(idx ast.BlockIdx) bool { return live[idx] })
+}
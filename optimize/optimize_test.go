@@ -0,0 +1,368 @@
+package optimize
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+func encodeBlock(block ast.Block) string {
+	switch b := block.(type) {
+	case *ast.PipeBlock:
+		return b.Decl.BlockName()
+	case *ast.StubBlock:
+		return b.Decl.BlockName() + "*"
+	case *ast.LiteralBlock:
+		return b.Lit.Value
+	case *ast.PipeRefBlock:
+		return "&" + b.Decl.BlockName()
+	case *ast.BuiltinBlock:
+		return string(b.Op)
+	case *ast.ApplyBlock:
+		return b.CreatedBy().(*ast.CallExpr).Name.V + "()"
+	default:
+		panic(fmt.Errorf("invalid block type: %T", block))
+	}
+}
+
+func encodeGraph(graph *ast.Graph) (blocks []string, edges []string) {
+	for _, block := range graph.Blocks {
+		blocks = append(blocks, encodeBlock(block))
+	}
+	for _, edge := range graph.Edges {
+		edges = append(edges, fmt.Sprintf("%s[%d]->%s[%d]",
+			encodeBlock(graph.Block(edge.Src.Block)), edge.Src.Port,
+			encodeBlock(graph.Block(edge.Dst.Block)), edge.Dst.Port))
+	}
+	return
+}
+
+func trace(t *testing.T, src string) *ast.Module {
+	t.Helper()
+	file := token.NewFile("", len(src))
+	mod, err := tracer.NewTracer().TraceModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mod
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantEdges  []string
+	}{
+		{
+			"Unused literal",
+			`
+module "a"
+stub B(a: int)
+pipe main() {
+	x = 10
+	B(12)
+}
+`,
+			[]string{"12", "B*"},
+			[]string{"12[0]->B*[0]"},
+		},
+		{
+			"Unused chain",
+			`
+module "a"
+pipe main() {
+	x = merge(1, 2)
+	_ = "${x}"
+}
+`,
+			nil,
+			nil,
+		},
+		{
+			"Stub output unused",
+			`
+module "a"
+stub B(a: int) (b: int)
+pipe main() {
+	B(merge(1))
+}
+`,
+			[]string{"1", "merge", "B*"},
+			[]string{"1[0]->merge[0]", "merge[0]->B*[0]"},
+		},
+		{
+			"Output of pipe",
+			`
+module "a"
+stub B(a: int)
+pipe main() (out: string) {
+	_ = 1
+	out = "${2}"
+	B(3)
+}
+`,
+			[]string{"2", "format", "3", "B*"},
+			[]string{"2[0]->format[0]", "format[0]->main[0]", "3[0]->B*[0]"},
+		},
+		{
+			"Pipe literal body",
+			`
+module "a"
+stub Map(f: pipe(x: int) (y: int))
+pipe main() {
+	Map(pipe(x: int) (y: int) { z = 5; y = x })
+}
+`,
+			[]string{"&pipe", "Map*"},
+			[]string{"&pipe[0]->Map*[0]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mod := trace(t, tt.src)
+			Module(mod, Prune)
+
+			graph := mod.Lookup("main").(*ast.PipeDecl).BodyDAG
+			gotBlocks, gotEdges := encodeGraph(graph)
+			if !reflect.DeepEqual(gotBlocks, tt.wantBlocks) {
+				t.Errorf("Prune() blocks = %v, want %v", gotBlocks, tt.wantBlocks)
+			}
+			if !reflect.DeepEqual(gotEdges, tt.wantEdges) {
+				t.Errorf("Prune() edges = %v, want %v", gotEdges, tt.wantEdges)
+			}
+
+			for _, block := range graph.Blocks {
+				if ref, ok := block.(*ast.PipeRefBlock); ok {
+					lit := ref.Decl.(*ast.PipeDecl).BodyDAG
+					if blocks, _ := encodeGraph(lit); len(blocks) != 0 {
+						t.Errorf("Prune() pipe literal blocks = %v, want none", blocks)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantEdges  []string
+	}{
+		{
+			"Conversion",
+			`
+module "a"
+stub B(a: int)
+pipe main() {
+	B(int("5"))
+}
+`,
+			[]string{"5", "B*"},
+			[]string{"5[0]->B*[0]"},
+		},
+		{
+			"Chain",
+			`
+module "a"
+stub B(a: string)
+pipe main() {
+	B("n=${float(int(2.5))}")
+}
+`,
+			[]string{"n=2", "B*"},
+			[]string{"n=2[0]->B*[0]"},
+		},
+		{
+			"Implicit conversion",
+			`
+module "a"
+stub B(a: float)
+pipe main() {
+	B(2)
+}
+`,
+			[]string{"B*", "2.0"}, // the conversion is added when its output is connected
+			[]string{"2.0[0]->B*[0]"},
+		},
+		{
+			"Shared literal",
+			`
+module "a"
+stub B(a: int, b: string)
+pipe main() {
+	x = 3
+	B(x, "${x}")
+}
+`,
+			[]string{"3", "3", "B*"},
+			[]string{"3[0]->B*[0]", "3[0]->B*[1]"},
+		},
+		{
+			"Not constant",
+			`
+module "a"
+stub A() (a: int)
+stub B(a: string)
+pipe main() {
+	B("${A()}")
+}
+`,
+			[]string{"A*", "format", "B*"},
+			[]string{"A*[0]->format[0]", "format[0]->B*[0]"},
+		},
+		{
+			"Invalid conversion",
+			`
+module "a"
+stub B(a: int)
+pipe main() {
+	B(int("x"))
+}
+`,
+			[]string{"x", "int", "B*"},
+			[]string{"x[0]->int[0]", "int[0]->B*[0]"},
+		},
+		{
+			"Merge",
+			`
+module "a"
+stub B(a: int)
+pipe main() {
+	B(merge(1, 2))
+}
+`,
+			[]string{"1", "2", "merge", "B*"},
+			[]string{"1[0]->merge[0]", "2[0]->merge[1]", "merge[0]->B*[0]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mod := trace(t, tt.src)
+			Module(mod, Fold, Prune)
+
+			graph := mod.Lookup("main").(*ast.PipeDecl).BodyDAG
+			gotBlocks, gotEdges := encodeGraph(graph)
+			if !reflect.DeepEqual(gotBlocks, tt.wantBlocks) {
+				t.Errorf("Fold() blocks = %v, want %v", gotBlocks, tt.wantBlocks)
+			}
+			if !reflect.DeepEqual(gotEdges, tt.wantEdges) {
+				t.Errorf("Fold() edges = %v, want %v", gotEdges, tt.wantEdges)
+			}
+		})
+	}
+}
+
+func TestFoldCreatedBy(t *testing.T) {
+	mod := trace(t, `
+module "a"
+stub B(a: int)
+pipe main() {
+	B(int("5"))
+}
+`)
+	Module(mod, Fold, Prune)
+	graph := mod.Lookup("main").(*ast.PipeDecl).BodyDAG
+	call, ok := graph.Blocks[0].CreatedBy().(*ast.CallExpr)
+	if !ok || call.Name.V != "int" {
+		t.Fatalf("CreatedBy() = %#v, want the call to int", graph.Blocks[0].CreatedBy())
+	}
+	if lit := graph.Blocks[0].(*ast.LiteralBlock).Lit; lit.ParsedVal != int64(5) {
+		t.Errorf("folded value = %#v, want 5", lit.ParsedVal)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantEdges  []string
+	}{
+		{
+			"Literals",
+			`
+module "a"
+stub B(a: int, b: int, c: string)
+pipe main() {
+	B(1, 1, "1")
+}
+`,
+			[]string{"1", "1", "B*"},
+			[]string{"1[0]->B*[0]", "1[0]->B*[1]", "1[0]->B*[2]"},
+		},
+		{
+			"Pure stub calls",
+			`
+module "a"
+pure stub Upper(s: string) (u: string)
+stub B(a: string, b: string)
+pipe main() {
+	B(Upper("x"), Upper("x"))
+}
+`,
+			[]string{"x", "Upper*", "B*"},
+			[]string{"x[0]->Upper*[0]", "Upper*[0]->B*[0]", "Upper*[0]->B*[1]"},
+		},
+		{
+			"Different inputs",
+			`
+module "a"
+pure stub Upper(s: string) (u: string)
+stub B(a: string, b: string)
+pipe main() {
+	B(Upper("x"), Upper("y"))
+}
+`,
+			[]string{"x", "Upper*", "y", "Upper*", "B*"},
+			[]string{"x[0]->Upper*[0]", "y[0]->Upper*[0]", "Upper*[0]->B*[0]", "Upper*[0]->B*[1]"},
+		},
+		{
+			"Impure stub calls",
+			`
+module "a"
+stub Read(path: string) (text: string)
+stub B(a: string, b: string)
+pipe main() {
+	B(Read("x"), Read("x"))
+}
+`,
+			[]string{"x", "Read*", "Read*", "B*"},
+			[]string{"x[0]->Read*[0]", "x[0]->Read*[0]", "Read*[0]->B*[0]", "Read*[0]->B*[1]"},
+		},
+		{
+			"Pure pipes and built-ins",
+			`
+module "a"
+pure pipe Twice(s: string) (t: string) { t = "${s}${s}" }
+stub B(a: string, b: string)
+pipe main(x: int) {
+	B(Twice("${x}"), Twice("${x}"))
+}
+`,
+			[]string{"format", "Twice", "B*"},
+			[]string{"main[0]->format[0]", "format[0]->Twice[0]", "Twice[0]->B*[0]", "Twice[0]->B*[1]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mod := trace(t, tt.src)
+			Module(mod, Dedup)
+
+			graph := mod.Lookup("main").(*ast.PipeDecl).BodyDAG
+			gotBlocks, gotEdges := encodeGraph(graph)
+			if !reflect.DeepEqual(gotBlocks, tt.wantBlocks) {
+				t.Errorf("Dedup() blocks = %v, want %v", gotBlocks, tt.wantBlocks)
+			}
+			if !reflect.DeepEqual(gotEdges, tt.wantEdges) {
+				t.Errorf("Dedup() edges = %v, want %v", gotEdges, tt.wantEdges)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/masp/hoser/ast"
 	"github.com/masp/hoser/lexer"
@@ -17,6 +18,14 @@ type parser struct {
 	// if peek() is called, peeked will be the cached values so that
 	// calls to eat() will consume this rather than calling next() again.
 	peeked tokenInfo
+	script bool // the file starts with #!, see ast.Module.Script
+
+	// comments are skipped by next and grouped as they are read, to be attached to declarations once the module
+	// is parsed
+	comments []*ast.CommentGroup
+	trailing map[*ast.CommentGroup]bool // groups that start on the line of the token before them
+	group    *ast.CommentGroup          // group the next comment may be added to, nil after any other token
+	lastLine int                        // line of the last token that is not a comment or newline
 }
 
 type tokenInfo struct {
@@ -30,19 +39,24 @@ var (
 	ErrExpectedExpression = errors.New("expected expression")
 )
 
+// ParseModuleHeader only parses the module name and the imports that follow it, which is enough to know what a
+// module is called and what it depends on without parsing the whole file.
 func ParseModuleHeader(file *token.File, src []byte) (module *ast.Module, err error) {
 	scanner := lexer.NewScanner(file, src)
-	p := parser{file: file, scanner: scanner}
+	p := parser{file: file, scanner: scanner, script: isScript(src)}
 	defer p.handleErrors(&err)
 	module = p.parseModuleHeader()
 	return
 }
 
+// ParseModule parses a module and every declaration in it. A file starting with #! is parsed as a script, see
+// ast.Module.Script.
 func ParseModule(file *token.File, src []byte) (module *ast.Module, err error) {
 	scanner := lexer.NewScanner(file, src)
-	p := parser{file: file, scanner: scanner}
+	p := parser{file: file, scanner: scanner, script: isScript(src)}
 	defer p.handleErrors(&err)
 	module = p.parseModule()
+	p.attachComments(module)
 	return
 }
 
@@ -117,7 +131,17 @@ func (p *parser) expectedError(posOrTok interface{}, msg string) {
 }
 
 func (p *parser) next() {
-	p.peeked.pos, p.peeked.tok, p.peeked.lit = p.scanner.Next()
+	for {
+		p.peeked.pos, p.peeked.tok, p.peeked.lit = p.scanner.Next()
+		if p.peeked.tok != token.Comment {
+			break
+		}
+		p.addComment(p.peeked.pos, p.peeked.lit)
+	}
+	if p.peeked.tok != token.Eof && (p.peeked.tok != token.Semicolon || p.peeked.lit != "\n") {
+		p.group = nil
+		p.lastLine = p.file.Line(p.peeked.pos)
+	}
 }
 
 func (p *parser) peek() tokenInfo {
@@ -171,11 +195,24 @@ func precedence(kind token.Token) int {
 }
 
 func (p *parser) parseStmt() ast.Stmt {
-	return &ast.ExprStmt{X: p.parseExpression(token.Invalid)}
+	return p.parseStmtFrom(p.parsePrefix())
+}
+
+// parseStmtFrom parses the rest of a statement that starts with left.
+func (p *parser) parseStmtFrom(left ast.Expr) ast.Stmt {
+	x := p.parseExpressionFrom(left, token.Invalid)
+	if p.peek().tok == token.Comma {
+		x = p.parseTupleAssign(x)
+	}
+	return &ast.ExprStmt{X: x}
 }
 
 func (p *parser) parseExpression(parent token.Token) ast.Expr {
-	left := p.parsePrefix()
+	return p.parseExpressionFrom(p.parsePrefix(), parent)
+}
+
+// parseExpressionFrom parses the rest of an expression after its first operand left.
+func (p *parser) parseExpressionFrom(left ast.Expr, parent token.Token) ast.Expr {
 	for {
 		next := p.peek()
 		if precedence(parent) >= precedence(next.tok) || next.tok == token.Eof {
@@ -187,18 +224,32 @@ func (p *parser) parseExpression(parent token.Token) ast.Expr {
 }
 
 func (p *parser) parsePrefix() ast.Expr {
-	next := p.eat()
+	return p.parsePrefixFrom(p.eat())
+}
+
+// parsePrefixFrom parses an operand that starts with next, which has been eaten.
+func (p *parser) parsePrefixFrom(next tokenInfo) ast.Expr {
 
 	switch next.tok {
 	case token.LParen:
 		return p.parseLParen(next)
 	case token.Ident:
 		return p.parseIdentifier(next)
-	case token.String, token.Integer, token.Float:
+	case token.String:
+		if strings.Contains(next.lit, "${") {
+			// the ${ may also be escaped as \${, which makes a string without expressions
+			if interp := p.parseInterp(next); len(interp.Parts) > 1 {
+				return interp
+			}
+		}
+		return p.parseLiteral(next)
+	case token.Integer, token.Float:
 		return p.parseLiteral(next)
 	case token.LCurlyBrack:
 		fields := p.parseFieldList(next)
 		return &fields
+	case token.Pipe:
+		return p.parsePipeExpr(next)
 	default:
 		p.error(next.pos, fmt.Errorf("expected expression got %v", next.tok))
 		return nil
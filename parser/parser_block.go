@@ -19,33 +19,68 @@ var (
 )
 
 func (p *parser) parseStubBlock() (stub ast.StubDecl) {
+	return p.parseSignature(false)
+}
+
+func (p *parser) parsePipeBlock() (pipe ast.PipeDecl) {
+	// the types of the ports of a pipe are optional and inferred by the tracer if they are left out
+	pipe.StubDecl = p.parseSignature(true)
+	pipe.BegLBrack = p.eatOnly(token.LCurlyBrack).pos
+	pipe.Body = p.parseFnBody()
+	pipe.EndRBrack = p.eatOnly(token.RCurlyBrack).pos
+	return
+}
+
+// parseSignature parses the name, inputs and outputs of a stub or pipe. If untyped is true, ports may leave out
+// their types.
+func (p *parser) parseSignature(untyped bool) (stub ast.StubDecl) {
 	stub.Name = p.parseIdentifier(p.eatOnly(token.Ident))
-	stub.Inputs = p.parseArgs()
+	stub.Inputs = p.parsePorts(untyped)
 
 	// output is optional
 	// e.g. `main() () {}`` is equivalent to `main() {}`
 	next := p.peek()
 	if next.tok == token.LParen {
 		// parse output definition
-		stub.Outputs = p.parseArgs()
+		stub.Outputs = p.parsePorts(untyped)
 	}
 	return
 }
 
-func (p *parser) parsePipeBlock() (pipe ast.PipeDecl) {
-	pipe.StubDecl = p.parseStubBlock()
-	pipe.BegLBrack = p.eatOnly(token.LCurlyBrack).pos
-	pipe.Body = p.parseFnBody()
-	pipe.EndRBrack = p.eatOnly(token.RCurlyBrack).pos
-	return
+// parsePipeExpr parses a pipe in expression position. Without a body it is the type of a pipe typed port,
+// and with a body it is an anonymous pipe literal.
+// example:
+// pipe(x: int) (y: int) -> PipeType
+// pipe(x: int) (y: int) { y = x } -> PipeLit
+func (p *parser) parsePipeExpr(keyword tokenInfo) ast.Expr {
+	// ports are parsed as untyped since they may belong to a pipe literal, pipe types are checked by the tracer
+	typ := &ast.PipeType{Keyword: keyword.pos}
+	typ.Inputs = p.parsePorts(true)
+	if p.peek().tok == token.LParen {
+		typ.Outputs = p.parsePorts(true)
+	}
+	if p.peek().tok != token.LCurlyBrack {
+		return typ
+	}
+
+	lit := &ast.PipeLit{Decl: &ast.PipeDecl{}}
+	lit.Decl.Name = &ast.Ident{V: keyword.lit, NamePos: keyword.pos}
+	lit.Decl.Inputs = typ.Inputs
+	lit.Decl.Outputs = typ.Outputs
+	lit.Decl.BegLBrack = p.eatOnly(token.LCurlyBrack).pos
+	lit.Decl.Body = p.parseFnBody()
+	lit.Decl.EndRBrack = p.eatOnly(token.RCurlyBrack).pos
+	return lit
 }
 
-// parseArgs takes either the input or output arguments specification and converts it to a Map
+// parsePorts takes either the input or output arguments specification and converts it to a Map
 // example:
 // ([name: string, value: int]) -> Map{{Key: name, Val: string}, {Key: value, Val: int}}
-func (p *parser) parseArgs() ast.FieldList {
+// Ports without a type (`(name)`) are allowed if untyped is true. Ports may have default values, which are only
+// valid on the inputs of declared pipes and stubs and are checked by the tracer.
+func (p *parser) parsePorts(untyped bool) ast.FieldList {
 	opener := p.eatOnly(token.LParen)
-	return p.parseFieldList(opener)
+	return p.parseFields(opener, untyped, true)
 }
 
 func (p *parser) parseFnBody() []ast.Stmt {
@@ -76,6 +111,7 @@ func (p *parser) parseBlockCall(left ast.Expr, lparen tokenInfo) *ast.CallExpr {
 			next = p.peek()
 			if next.tok == token.Comma {
 				p.eatOnly(token.Comma)
+				next = p.peek() // the last argument may be followed by a comma
 			} else if next.tok != token.RParen {
 				p.expectedError(next, "comma or right paren ')'")
 				return result
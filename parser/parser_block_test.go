@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/masp/hoser/ast"
 	"github.com/masp/hoser/token"
 )
 
@@ -38,3 +41,223 @@ func TestParseModule(t *testing.T) {
 		})
 	}
 }
+
+func TestParseModuleHeader(t *testing.T) {
+	program := `module "main"; import "a"; import "b/c"
+pipe main() {}
+import "d"`
+	file := token.NewFile("<test>", len(program))
+	got, err := ParseModuleHeader(&file, []byte(program))
+	if err != nil {
+		t.Fatalf("ParseModuleHeader() error = %v", err)
+	}
+
+	var gotImports []string
+	for _, imp := range got.Imports {
+		gotImports = append(gotImports, imp.ModuleName.Value)
+	}
+	if want := []string{"a", "b/c"}; !reflect.DeepEqual(gotImports, want) {
+		t.Errorf("ParseModuleHeader() imports = %v, want %v", gotImports, want)
+	}
+	if len(got.DefinedBlocks) > 0 {
+		t.Errorf("ParseModuleHeader() parsed blocks %v", got.DefinedBlocks)
+	}
+}
+
+func TestParseUntypedPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		wantErr bool
+	}{
+		{"Untyped pipe ports", `module "main"; pipe A(x, y: int) (z) {}`, false},
+		{"Untyped stub port", `module "main"; stub A(x) (z: int)`, true},
+		{"Untyped record field", `module "main"; pipe A() { {x} = B() }`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("<test>", len(tt.program))
+			got, err := ParseModule(&file, []byte(tt.program))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseModule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			pipe := got.Lookup("A").(*ast.PipeDecl)
+			if pipe.Inputs.Fields[0].Value != nil || pipe.Inputs.Fields[1].Value == nil || pipe.Outputs.Fields[0].Value != nil {
+				t.Errorf("ParseModule() did not leave out only the missing types")
+			}
+		})
+	}
+}
+
+func TestParsePure(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		wantPure bool
+		wantErr  bool
+	}{
+		{"Pure stub", `module "main"; pure stub A(x: int) (y: int)`, true, false},
+		{"Pure pipe", `module "main"; pure pipe A(x) (y) { y = x }`, true, false},
+		{"Not pure", `module "main"; stub A(x: int) (y: int)`, false, false},
+		{"Pure as a name", `module "main"; pipe A(pure: int) (y) { y = pure }`, false, false},
+		{"Pure without a block", `module "main"; pure A()`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("<test>", len(tt.program))
+			got, err := ParseModule(&file, []byte(tt.program))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseModule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if decl := got.Lookup("A"); decl.IsPure() != tt.wantPure {
+				t.Errorf("IsPure() = %v, want %v", decl.IsPure(), tt.wantPure)
+			}
+		})
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	tests := []struct {
+		name        string
+		program     string
+		wantDefault string // of the last input of A
+		wantErr     bool
+	}{
+		{"Integer", `module "main"; stub A(s: string, n: int = 10)`, "10", false},
+		{"String", `module "main"; pipe A(s: string = "a b") {}`, "a b", false},
+		{"No default", `module "main"; stub A(n: int)`, "", false},
+		{"Untyped", `module "main"; pipe A(n = 10) {}`, "", true},
+		{"Not a literal", `module "main"; stub A(n: int = x)`, "", true},
+		{"Record field", `module "main"; pipe A() { {x: int = 1} = B() }`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("<test>", len(tt.program))
+			got, err := ParseModule(&file, []byte(tt.program))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseModule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			inputs := got.Lookup("A").BlockInputs()
+			last := inputs.Fields[len(inputs.Fields)-1]
+			gotDefault := ""
+			if last.Default != nil {
+				gotDefault = last.Default.Value
+			}
+			if gotDefault != tt.wantDefault {
+				t.Errorf("Default = %q, want %q", gotDefault, tt.wantDefault)
+			}
+		})
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	program := `# the main module
+module "main"
+
+# Grep prints the lines of stdin
+# that match pattern.
+pipe main(
+	# regular expression to match
+	pattern: string,
+	limit: int = 10, # maximum number of lines
+	stdin: string, ignored: int, # after the last port on the line
+) (stdout: string) {
+	stdout = stdin # not a doc
+}
+
+# separated by an empty line
+
+stub Other(a: int) # not a doc either
+`
+	file := token.NewFile("<test>", len(program))
+	got, err := ParseModule(&file, []byte(program))
+	if err != nil {
+		t.Fatalf("ParseModule() error = %v", err)
+	}
+	if len(got.Comments) != 8 {
+		t.Errorf("len(Comments) = %d, want 8", len(got.Comments))
+	}
+
+	main := got.Lookup("main").(*ast.PipeDecl)
+	tests := []struct {
+		name string
+		doc  *ast.CommentGroup
+		want string
+	}{
+		{"Pipe", main.Doc, "Grep prints the lines of stdin\nthat match pattern."},
+		{"Port above", main.Inputs.Fields[0].Doc, "regular expression to match"},
+		{"Port after", main.Inputs.Fields[1].Doc, "maximum number of lines"},
+		{"Port before another on its line", main.Inputs.Fields[2].Doc, ""},
+		{"Last port on its line", main.Inputs.Fields[3].Doc, "after the last port on the line"},
+		{"Undocumented port", main.Outputs.Fields[0].Doc, ""},
+		{"Separated stub", got.Lookup("Other").(*ast.StubDecl).Doc, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.doc.Text(); got != tt.want {
+				t.Errorf("Text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	tests := []struct {
+		name       string
+		program    string
+		wantModule string
+		wantMain   string // ports of the implicit main, "" if there is none
+		wantScript bool
+		wantErr    bool
+	}{
+		{"Without header", "#!/usr/bin/env hoser\nstdout = stdin\n", "main", "(stdin) (stdout)", true, false},
+		{"With header", "#!/usr/bin/env hoser\nmodule \"tool\"\nimport \"text\"\nstderr = text.Upper(args)\n", "tool", "(args) (stderr)", true, false},
+		{"Declarations", "#!/usr/bin/env hoser\nx = A(s: stdin)\npipe A(s: string) (t: string) { t = s }\nB(x)\nstub B(s: string)\n", "main", "(stdin) ()", true, false},
+		{"Pure as a name", "#!/usr/bin/env hoser\npure = 1\nB(pure)\nstub B(n: int)\n", "main", "() ()", true, false},
+		{"Nested named argument", "#!/usr/bin/env hoser\nstdout = Up(G(stderr: \"x\"))\nstub Up(s: string) (t: string)\nstub G(stderr: string) (t: string)\n", "main", "() (stdout)", true, false},
+		{"Pipe literal argument", "#!/usr/bin/env hoser\nstdout = Map(args, pipe(stdin: string) (out: string) { out = stdin })\nstub Map(in: string, f: pipe(stdin: string) (out: string)) (out: string)\n", "main", "(args) (stdout)", true, false},
+		{"No statements", "#!/usr/bin/env hoser\nstub B(n: int)\n", "main", "", true, false},
+		{"Main declared", "#!/usr/bin/env hoser\nB(1)\npipe main() {}\nstub B(n: int)\n", "", "", true, true},
+		{"Not a script", "module \"main\"\nstdout = stdin\n", "", "", false, true},
+		{"Not a script without header", "stdout = stdin\n", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("<test>", len(tt.program))
+			got, err := ParseModule(&file, []byte(tt.program))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseModule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Name.Value != tt.wantModule || got.Script != tt.wantScript {
+				t.Errorf("ParseModule() = module %q script %v, want %q script %v", got.Name.Value, got.Script, tt.wantModule, tt.wantScript)
+			}
+
+			gotMain := ""
+			if main, ok := got.Lookup("main").(*ast.PipeDecl); ok && main.Implicit {
+				var in, out []string
+				for _, field := range main.Inputs.Fields {
+					in = append(in, field.Key.V)
+				}
+				for _, field := range main.Outputs.Fields {
+					out = append(out, field.Key.V)
+				}
+				gotMain = "(" + strings.Join(in, ", ") + ") (" + strings.Join(out, ", ") + ")"
+			}
+			if gotMain != tt.wantMain {
+				t.Errorf("implicit main = %q, want %q", gotMain, tt.wantMain)
+			}
+		})
+	}
+}
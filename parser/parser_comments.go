@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// Comments start with # and end at the end of the line. They are not part of the syntax tree, but a group of
+// comments right above a declaration or a port documents it:
+//
+//	# Grep prints the lines of stdin that match pattern.
+//	pipe Grep(
+//		# regular expression to match
+//		pattern: string,
+//		limit: int = 10, # maximum number of lines to print
+//	) (stdout: string) {...}
+//
+// A port can also be documented by a comment after it on the same line.
+
+// addComment adds a comment to the group before it if they are on consecutive lines with nothing else between
+// them, or starts a new group. A comment after a token on the same line always starts its own group.
+func (p *parser) addComment(pos token.Pos, text string) {
+	if p.trailing == nil {
+		p.trailing = make(map[*ast.CommentGroup]bool)
+	}
+	c := &ast.Comment{Hash: pos, Text: text}
+	line := p.file.Line(pos)
+	trailing := line == p.lastLine
+	if g := p.group; g != nil && !trailing && !p.trailing[g] && p.file.Line(g.End())+1 == line {
+		g.List = append(g.List, c)
+		return
+	}
+	p.group = &ast.CommentGroup{List: []*ast.Comment{c}}
+	p.comments = append(p.comments, p.group)
+	if trailing {
+		p.trailing[p.group] = true
+	}
+}
+
+// attachComments adds every comment to module and sets the docs of its declarations and their ports.
+func (p *parser) attachComments(module *ast.Module) {
+	module.Comments = p.comments
+	var (
+		above = make(map[int]*ast.CommentGroup) // groups on their own lines by the line they end on
+		after = make(map[int]*ast.CommentGroup) // groups after a token by their line
+	)
+	for _, g := range p.comments {
+		if p.trailing[g] {
+			after[p.file.Line(g.Pos())] = g
+		} else {
+			above[p.file.Line(g.End())] = g
+		}
+	}
+
+	for _, decl := range module.DefinedBlocks {
+		var stub *ast.StubDecl
+		switch d := decl.(type) {
+		case *ast.StubDecl:
+			stub = d
+		case *ast.PipeDecl:
+			stub = &d.StubDecl
+		}
+		start := stub.Name.Pos()
+		if stub.Pure.IsValid() {
+			start = stub.Pure
+		}
+		stub.Doc = above[p.file.Line(start)-1]
+
+		for _, ports := range []*ast.FieldList{&stub.Inputs, &stub.Outputs} {
+			for i, field := range ports.Fields {
+				if g := above[p.file.Line(field.Pos())-1]; g != nil && g.Pos() > ports.Opener {
+					field.Doc = g
+					continue
+				}
+				line := p.file.Line(field.End())
+				if i+1 < len(ports.Fields) && p.file.Line(ports.Fields[i+1].Pos()) == line {
+					continue // the comment is after the last port on the line
+				}
+				if g := after[line]; g != nil && g.Pos() > field.End() {
+					field.Doc = g
+				}
+			}
+		}
+	}
+}
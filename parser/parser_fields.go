@@ -13,6 +13,8 @@ var (
 	ErrInvalidEntryKey   = errors.New("key of an entry must be an identifier")
 	ErrInvalidEntryValue = errors.New("value of an entry must be an identifier")
 	ErrExpectedEndOfMap  = errors.New("expected ] to end map")
+	ErrDefaultNotLiteral = errors.New("default value of a port must be a literal")
+	ErrDefaultUntyped    = errors.New("port with a default value must have a type")
 )
 
 func flip(tok token.Token) token.Token {
@@ -31,15 +33,31 @@ func flip(tok token.Token) token.Token {
 }
 
 func (p *parser) parseFieldList(opener tokenInfo) (result ast.FieldList) {
+	return p.parseFields(opener, false, false)
+}
+
+// parseFields parses a list of fields ending in the closer of opener. If untyped is true, a field can be a name
+// without a value, e.g. the ports of `pipe Double(x) (y: int)`. If defaults is true, a field can have a literal
+// default value, e.g. `limit: int = 10`.
+func (p *parser) parseFields(opener tokenInfo, untyped, defaults bool) (result ast.FieldList) {
 	result.Opener = opener.pos
 	closerTok := flip(opener.tok)
 
 	next := p.peek()
-	for next.tok != closerTok {
+	for next.tok != closerTok && next.tok != token.Eof {
 		p.eatAll(token.Comma)
+		if p.peek().tok == closerTok {
+			break // trailing comma, e.g. at the end of ports on their own lines
+		}
 		arg := p.parseExpression(token.Invalid)
 		if ent, ok := arg.(*ast.Field); ok {
 			result.Fields = append(result.Fields, ent)
+		} else if name, ok := arg.(*ast.Ident); ok && untyped {
+			result.Fields = append(result.Fields, &ast.Field{Key: name})
+		} else if assign, ok := arg.(*ast.AssignExpr); ok && defaults {
+			if field := p.parseDefault(assign); field != nil {
+				result.Fields = append(result.Fields, field)
+			}
 		} else {
 			p.expectedError(next.pos+1, "'key: value' pair")
 		}
@@ -59,3 +77,20 @@ func (p *parser) parseField(left ast.Expr, colon tokenInfo) *ast.Field {
 	}
 	return nil
 }
+
+// parseDefault converts `key: type = literal` to a field with a default value.
+func (p *parser) parseDefault(assign *ast.AssignExpr) *ast.Field {
+	field, ok := assign.Lhs.(*ast.Field)
+	if !ok {
+		p.error(assign.Pos(), ErrDefaultUntyped)
+		return nil
+	}
+	lit, ok := assign.Rhs.(*ast.LiteralExpr)
+	if !ok {
+		p.error(assign.Rhs.Pos(), ErrDefaultNotLiteral)
+		return nil
+	}
+	field.Assign = assign.EqPos
+	field.Default = lit
+	return field
+}
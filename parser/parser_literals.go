@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"fmt"
 	"strconv"
 
 	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/lexer"
 	"github.com/masp/hoser/token"
 )
 
@@ -37,3 +39,65 @@ func (p *parser) parseLiteral(tok tokenInfo) *ast.LiteralExpr {
 	}
 	return &ast.LiteralExpr{Start: tok.pos, Type: tok.tok, Value: tok.lit, ParsedVal: parsedVal}
 }
+
+// parseInterp splits a string with embedded expressions into its parts, e.g. "out/${name}.txt" is split into
+// "out/", name and ".txt". The string has already been scanned as a whole, so the embedded expressions are parsed
+// by scanning the source of the string again starting after each ${. A ${ escaped as \${ is part of the text.
+//
+// Expressions cannot contain strings themselves since the string would end at the first quote.
+func (p *parser) parseInterp(quote tokenInfo) *ast.InterpExpr {
+	text := p.scanner.Text()
+	interp := &ast.InterpExpr{Quote: quote.pos}
+	addSegment := func(start, end int) {
+		value, err := lexer.Unescape(text[start:end])
+		if err != nil {
+			p.error(p.file.Pos(start), err)
+		}
+		interp.Parts = append(interp.Parts, &ast.LiteralExpr{
+			Start:     p.file.Pos(start),
+			Type:      token.String,
+			Value:     value,
+			ParsedVal: value,
+		})
+	}
+
+	offset := p.file.Offset(quote.pos) + 1 // the first character after the opening quote
+	start := offset
+	for offset < len(text) && text[offset] != '"' {
+		switch {
+		case text[offset] == '\\':
+			offset += 2
+		case text[offset] == '$' && text[offset+1] == '{':
+			addSegment(start, offset)
+			if end := interpEnd(text, offset+2); text[end] == '"' {
+				p.error(p.file.Pos(end), fmt.Errorf("expected } before the string ends, strings cannot be used in ${...}"))
+				interp.Closer = p.file.Pos(end)
+				return interp
+			}
+			sub := parser{file: p.file, scanner: p.scanner.At(offset + 2)}
+			interp.Parts = append(interp.Parts, sub.parseExpression(token.Invalid))
+			closer := sub.eatOnly(token.RCurlyBrack)
+			if len(sub.errors) > 0 {
+				p.errors = append(p.errors, sub.errors...)
+				interp.Closer = closer.pos
+				return interp
+			}
+			offset = p.file.Offset(closer.pos) + 1 // the first character after the closing }
+			start = offset
+		default:
+			offset++
+		}
+	}
+	addSegment(start, offset)
+	interp.Closer = p.file.Pos(offset)
+	return interp
+}
+
+// interpEnd is the offset of the } that closes the expression starting at offset, or of the quote, newline or end of
+// text that comes first.
+func interpEnd(text []byte, offset int) int {
+	for offset < len(text)-1 && text[offset] != '}' && text[offset] != '"' && text[offset] != '\n' {
+		offset++
+	}
+	return offset
+}
@@ -6,26 +6,43 @@ import (
 )
 
 func (p *parser) parseModuleHeader() *ast.Module {
-	p.eatOnly(token.Module)
-	name := p.parseLiteral(p.eat())
-	if name.Type != token.String {
-		p.expectedError(name.Pos(), "module name as a quoted string")
+	var header *ast.Module
+	if p.script && p.peek().tok != token.Module {
+		header = scriptHeader()
+	} else {
+		module := p.eatOnly(token.Module)
+		name := p.parseLiteral(p.eat())
+		if name.Type != token.String {
+			p.expectedError(name.Pos(), "module name as a quoted string")
+		}
+		header = &ast.Module{
+			ModulePos: module.pos,
+			Name:      name,
+		}
 	}
+	header.Script = p.script
 
-	return &ast.Module{
-		Name: name,
+	// imports that come right after the module name are part of the header
+	for {
+		p.eatAll(token.Semicolon)
+		if p.peek().tok != token.Import {
+			return header
+		}
+		imp := p.parseImport(p.eat())
+		header.Imports = append(header.Imports, &imp)
 	}
 }
 
 func (p *parser) parseModule() (module *ast.Module) {
 	module = p.parseModuleHeader()
+	var script []ast.Stmt // top-level statements of a script
 	for {
 		p.eatAll(token.Semicolon)
 
 		keyword := p.eat()
 		switch keyword.tok {
 		case token.Import:
-			imp := p.parseImport()
+			imp := p.parseImport(keyword)
 			module.Imports = append(module.Imports, &imp)
 		case token.Pipe:
 			pipe := p.parsePipeBlock()
@@ -34,15 +51,30 @@ func (p *parser) parseModule() (module *ast.Module) {
 			stub := p.parseStubBlock()
 			module.DefinedBlocks = append(module.DefinedBlocks, &stub)
 		case token.Eof:
+			if len(script) > 0 {
+				p.addImplicitMain(module, script)
+			}
 			return
 		default:
+			if keyword.tok == token.Ident && keyword.lit == pureKeyword {
+				// pure is only a keyword before a declaration, so it can still be used as a name
+				if decl := p.parsePureDecl(keyword); decl != nil {
+					module.DefinedBlocks = append(module.DefinedBlocks, decl)
+					continue
+				}
+			}
+			if p.script {
+				script = append(script, p.parseStmtFrom(p.parsePrefixFrom(keyword)))
+				continue
+			}
 			p.expectedError(keyword, "import/pipe/stub")
 			return
 		}
 	}
 }
 
-func (p *parser) parseImport() (imp ast.ImportDecl) {
+func (p *parser) parseImport(keyword tokenInfo) (imp ast.ImportDecl) {
+	imp.Keyword = keyword.pos
 	importArg := p.eat()
 	imp.ModuleName = p.parseLiteral(importArg)
 	if imp.ModuleName.Type != token.String {
@@ -50,3 +82,23 @@ func (p *parser) parseImport() (imp ast.ImportDecl) {
 	}
 	return
 }
+
+const pureKeyword = "pure"
+
+// parsePureDecl parses the stub or pipe after the pure keyword, or returns nil if there is none.
+func (p *parser) parsePureDecl(pure tokenInfo) ast.BlockDecl {
+	switch p.peek().tok {
+	case token.Pipe:
+		p.eat()
+		pipe := p.parsePipeBlock()
+		pipe.Pure = pure.pos
+		return &pipe
+	case token.Stub:
+		p.eat()
+		stub := p.parseStubBlock()
+		stub.Pure = pure.pos
+		return &stub
+	default:
+		return nil
+	}
+}
@@ -15,3 +15,21 @@ func (p *parser) parseLParen(lparen tokenInfo) *ast.ParenExpr {
 	p.eatOnly(token.RParen)
 	return &ast.ParenExpr{X: expr}
 }
+
+// parseTupleAssign parses the rest of an assignment with several patterns on the left side, e.g. `a, b = Split(x)`
+// where first is the already parsed `a`.
+func (p *parser) parseTupleAssign(first ast.Expr) ast.Expr {
+	tuple := &ast.TupleExpr{Elts: []ast.Expr{first}}
+	for p.peek().tok == token.Comma {
+		p.eat()
+		// elements stop at the = so it is not parsed as part of the last element
+		tuple.Elts = append(tuple.Elts, p.parseExpression(token.Equals))
+	}
+
+	eq := p.peek()
+	if eq.tok != token.Equals {
+		p.expectedError(eq, "'=' after list of patterns")
+		return tuple
+	}
+	return p.parseEquals(tuple, p.eat())
+}
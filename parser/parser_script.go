@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// A script is a file that can be run directly, starting with a #! line:
+//
+//	#!/usr/bin/env hoser
+//	import "text"
+//	stdout = text.Upper(stdin)
+//
+// The module header of a script is optional and defaults to module "main". Statements outside of any pipe are the
+// body of an implicit main pipe, whose ports are the ones hoser run binds to the process that are used in the
+// statements: stdin and args are string inputs, stdout and stderr are string outputs.
+
+var ErrMainDeclared = errors.New("statements outside of a pipe are the body of main, which is already declared")
+
+// isScript reports whether src is a script, which starts with #!.
+func isScript(src []byte) bool {
+	return bytes.HasPrefix(src, []byte("#!"))
+}
+
+// scriptHeader is the header of a script without one.
+func scriptHeader() *ast.Module {
+	return &ast.Module{Name: &ast.LiteralExpr{Type: token.String, Value: "main", ParsedVal: "main"}}
+}
+
+var (
+	scriptInputs  = []string{"stdin", "args"}
+	scriptOutputs = []string{"stdout", "stderr"}
+)
+
+// addImplicitMain adds the main pipe of a script made of its top-level statements.
+func (p *parser) addImplicitMain(module *ast.Module, body []ast.Stmt) {
+	if module.Lookup("main") != nil {
+		p.error(body[0].Pos(), ErrMainDeclared)
+		return
+	}
+
+	used := make(map[string]bool)
+	var visit func(node ast.Node) bool
+	visit = func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.Ident:
+			if n.Local() {
+				used[n.V] = true
+			}
+		case *ast.CallExpr:
+			// named arguments are names of the inputs of the called block, not symbols
+			for _, arg := range n.Args {
+				if field, ok := arg.(*ast.Field); ok {
+					arg = field.Value
+				}
+				ast.Walk(arg, visit)
+			}
+			return false
+		case *ast.PipeLit:
+			return false // the body of a pipe literal only sees its own ports
+		}
+		return true
+	}
+	for _, stmt := range body {
+		ast.Walk(stmt, visit)
+	}
+
+	main := &ast.PipeDecl{Body: body, Implicit: true}
+	main.Name = &ast.Ident{V: "main"}
+	main.Inputs.Fields = scriptPorts(scriptInputs, used)
+	main.Outputs.Fields = scriptPorts(scriptOutputs, used)
+	module.DefinedBlocks = append(module.DefinedBlocks, main)
+}
+
+func scriptPorts(names []string, used map[string]bool) (ports []*ast.Field) {
+	for _, name := range names {
+		if used[name] {
+			ports = append(ports, &ast.Field{Key: &ast.Ident{V: name}, Value: &ast.Ident{V: string(ast.StringEdge)}})
+		}
+	}
+	return
+}
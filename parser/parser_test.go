@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/masp/hoser/ast"
@@ -15,6 +16,10 @@ func TestValid(t *testing.T) {
 	}{
 		{`module "test"; import "a"; pipe main() () {}`},
 		{`module "test"; pipe B1(a: b) {}; pipe B2() (v: d) {}`},
+		{`module "test"; pipe main() { a, {b: _} = c(); d, e, f = g() }`},
+		{`module "test"; stub Map(in: int, f: pipe(x: int) (y: int)) (out: int); pipe main() { Map(1, pipe(x: int) (y: int) { y = x }) }`},
+		{`module "test"; pipe Double(x, n: int) (y) { y = x }; pipe main() { Map(1, pipe(x) (y) { y = x }) }`},
+		{"module \"test\"; pipe main() { a = B(\n\t1,\n\tc: 2,\n) }"},
 	}
 	for _, tt := range tests {
 		t.Run(fmt.Sprintf("%q", tt.src), func(t *testing.T) {
@@ -36,6 +41,8 @@ func Test_LiteralExpr(t *testing.T) {
 		{"\"hello\";", token.String},
 		{"12;", token.Integer},
 		{"123.5;", token.Float},
+		{`"no $ {interpolation}";`, token.String},
+		{`"no \${interpolation}";`, token.String},
 	}
 
 	for _, tt := range tests {
@@ -179,6 +186,79 @@ func Test_parseExpression(t *testing.T) {
 			},
 			Rparen: 9,
 		}},
+		{"Interpolated string", args{`"a${b}c${d.e}";`}, &ast.InterpExpr{
+			Quote: 1,
+			Parts: []ast.Expr{
+				&ast.LiteralExpr{Start: 2, Type: token.String, Value: "a", ParsedVal: "a"},
+				&ast.Ident{V: "b", NamePos: 5},
+				&ast.LiteralExpr{Start: 7, Type: token.String, Value: "c", ParsedVal: "c"},
+				&ast.Ident{V: "e", NamePos: 12, Module: "d", ModulePos: 10},
+				&ast.LiteralExpr{Start: 14, Type: token.String, Value: "", ParsedVal: ""},
+			},
+			Closer: 14,
+		}},
+		{"Escaped interpolation", args{`"a\${b}${c}";`}, &ast.InterpExpr{
+			Quote: 1,
+			Parts: []ast.Expr{
+				&ast.LiteralExpr{Start: 2, Type: token.String, Value: "a${b}", ParsedVal: "a${b}"},
+				&ast.Ident{V: "c", NamePos: 10},
+				&ast.LiteralExpr{Start: 12, Type: token.String, Value: "", ParsedVal: ""},
+			},
+			Closer: 12,
+		}},
+		{"Pipe type", args{"pipe(x: a) (y: b);"}, &ast.PipeType{
+			Keyword: 1,
+			Inputs: ast.FieldList{
+				Opener: 5,
+				Fields: []*ast.Field{
+					{
+						Key:   &ast.Ident{V: "x", NamePos: 6},
+						Colon: 7,
+						Value: &ast.Ident{V: "a", NamePos: 9},
+					},
+				},
+				Closer: 10,
+			},
+			Outputs: ast.FieldList{
+				Opener: 12,
+				Fields: []*ast.Field{
+					{
+						Key:   &ast.Ident{V: "y", NamePos: 13},
+						Colon: 14,
+						Value: &ast.Ident{V: "b", NamePos: 16},
+					},
+				},
+				Closer: 17,
+			},
+		}},
+		{"Pipe literal", args{"pipe() (y: b) {y = c};"}, &ast.PipeLit{
+			Decl: &ast.PipeDecl{
+				StubDecl: ast.StubDecl{
+					Name:   &ast.Ident{V: "pipe", NamePos: 1},
+					Inputs: ast.FieldList{Opener: 5, Closer: 6},
+					Outputs: ast.FieldList{
+						Opener: 8,
+						Fields: []*ast.Field{
+							{
+								Key:   &ast.Ident{V: "y", NamePos: 9},
+								Colon: 10,
+								Value: &ast.Ident{V: "b", NamePos: 12},
+							},
+						},
+						Closer: 13,
+					},
+				},
+				BegLBrack: 15,
+				Body: []ast.Stmt{
+					&ast.ExprStmt{X: &ast.AssignExpr{
+						Lhs:   &ast.Ident{V: "y", NamePos: 16},
+						EqPos: 18,
+						Rhs:   &ast.Ident{V: "c", NamePos: 20},
+					}},
+				},
+				EndRBrack: 21,
+			},
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -207,3 +287,23 @@ func Test_parseExpression(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseInterpErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		wantErr string
+	}{
+		{"String in expression", `"a${"b"}";`, `<test>:1:5: expected } before the string ends, strings cannot be used in ${...}`},
+		{"Unclosed expression", `"a${b";`, `<test>:1:6: expected } before the string ends, strings cannot be used in ${...}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("<test>", len(tt.program))
+			_, err := ParseExpression(&file, []byte(tt.program))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("ParseExpression() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Package query answers questions about the identifiers of traced modules for tools like editors: what the
+// identifier under the cursor refers to and where else the same thing is used.
+//
+// Queries are made with a file name and a byte offset in that file, and their results are Locations that can be
+// shown to the user. Identifiers are resolved by the tracer, which records them in Tracer.Refs:
+//
+//	tr := tracer.NewTracer(includePath...)
+//	tr.TraceModule(&file, src)
+//	index := query.New(tr.ModuleSet(), tr.Refs())
+//	def, ok := index.Definition("main.hos", offset)
+package query
+
+import (
+	"sort"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// Index finds the identifiers of every loaded module in a ModuleSet by position.
+type Index struct {
+	refs  map[*ast.Ident]ast.Node
+	files map[string]*fileIndex    // by file name
+	nodes map[ast.Node]*token.File // file every declaration, port and identifier is in
+}
+
+type fileIndex struct {
+	file   *token.File
+	mod    *ast.Module
+	idents []*ast.Ident // in the order they appear in the file
+}
+
+// Location is the range of an identifier in a file.
+type Location struct {
+	Start, End token.Position
+}
+
+// Symbol is an identifier and what it refers to.
+type Symbol struct {
+	Ident *ast.Ident
+	// Decl is what Ident refers to: a *ast.PipeDecl or *ast.StubDecl, the *ast.Field of a port, the *ast.Ident where
+	// a symbol is assigned or, if Qualifier is set, the *ast.ImportDecl of the module.
+	Decl      ast.Node
+	Qualifier bool     // the position is on the module of a qualified name, e.g. grep in grep.Filter
+	Def       Location // name of Decl
+}
+
+// New indexes the loaded modules of set. Refs is what each identifier refers to, as returned by Tracer.Refs.
+func New(set *ast.ModuleSet, refs map[*ast.Ident]ast.Node) *Index {
+	ix := &Index{
+		refs:  refs,
+		files: make(map[string]*fileIndex),
+		nodes: make(map[ast.Node]*token.File),
+	}
+	for _, cached := range set.Modules {
+		if !cached.IsLoaded() || cached.Mod == nil || cached.File == nil {
+			continue
+		}
+		f := &fileIndex{file: cached.File, mod: cached.Mod}
+		ast.Walk(cached.Mod, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.Ident:
+				if !n.Pos().IsValid() {
+					return true // names of the implicit main of a script and its ports
+				}
+				f.idents = append(f.idents, n)
+				ix.nodes[n] = cached.File
+			case *ast.PipeDecl, *ast.StubDecl, *ast.Field, *ast.ImportDecl:
+				ix.nodes[n] = cached.File
+			}
+			return true
+		})
+		sort.SliceStable(f.idents, func(i, j int) bool { return identStart(f.idents[i]) < identStart(f.idents[j]) })
+		ix.files[cached.File.Name] = f
+	}
+	return ix
+}
+
+// identStart is where an identifier starts, including its module if it is qualified.
+func identStart(ident *ast.Ident) token.Pos {
+	if ident.Local() {
+		return ident.Pos()
+	}
+	return ident.ModulePos
+}
+
+// IdentAt returns the identifier at offset in the file, or nil if there is none. An offset just after an identifier
+// is also on it, like a cursor at the end of a word.
+func (ix *Index) IdentAt(filename string, offset int) *ast.Ident {
+	ident, _ := ix.identAt(filename, offset)
+	return ident
+}
+
+// identAt also reports whether offset is on the module of a qualified identifier.
+func (ix *Index) identAt(filename string, offset int) (found *ast.Ident, qualifier bool) {
+	f, ok := ix.files[filename]
+	if !ok || offset < 0 || offset > f.file.Size {
+		return nil, false
+	}
+	pos := f.file.Pos(offset)
+	for _, ident := range f.idents {
+		if !ident.Local() && ident.ModulePos <= pos && pos <= ident.ModulePos+token.Pos(len(ident.Module)) {
+			if pos < ident.ModulePos+token.Pos(len(ident.Module)) || found == nil {
+				found, qualifier = ident, true
+			}
+		}
+		if ident.Pos() <= pos && pos <= ident.End() {
+			if pos < ident.End() || found == nil {
+				found, qualifier = ident, false
+			}
+		}
+	}
+	return
+}
+
+// Definition returns what the identifier at offset in the file refers to. It is false if there is no identifier at
+// offset or the identifier could not be resolved, e.g. because it names a built-in or a port of the implicit main
+// pipe of a script.
+func (ix *Index) Definition(filename string, offset int) (Symbol, bool) {
+	ident, qualifier := ix.identAt(filename, offset)
+	if ident == nil {
+		return Symbol{}, false
+	}
+	if qualifier {
+		imp := ix.files[filename].mod.Import(ident.Module)
+		if imp == nil {
+			return Symbol{}, false
+		}
+		return Symbol{Ident: ident, Decl: imp, Qualifier: true, Def: ix.location(imp, imp.ModuleName.Pos(), imp.ModuleName.End())}, true
+	}
+
+	decl, ok := ix.refs[ident]
+	if !ok {
+		return Symbol{}, false
+	}
+	var name *ast.Ident
+	switch d := decl.(type) {
+	case *ast.PipeDecl:
+		name = d.Name
+	case *ast.StubDecl:
+		name = d.Name
+	case *ast.Field:
+		name = d.Key
+	case *ast.Ident:
+		name = d
+	default:
+		return Symbol{}, false
+	}
+	if !name.Pos().IsValid() {
+		return Symbol{}, false
+	}
+	return Symbol{Ident: ident, Decl: decl, Def: ix.location(decl, name.Pos(), name.End())}, true
+}
+
+// References returns every identifier that refers to the same thing as the identifier at offset in the file,
+// including its declaration, in the order of their files and positions. For the module of a qualified name, these
+// are the import and every name qualified by the module in the same file.
+func (ix *Index) References(filename string, offset int) (refs []Location) {
+	sym, ok := ix.Definition(filename, offset)
+	if !ok {
+		return nil
+	}
+
+	if sym.Qualifier {
+		refs = append(refs, sym.Def)
+		for _, ident := range ix.files[filename].idents {
+			if !ident.Local() && ident.Module == sym.Ident.Module {
+				refs = append(refs, ix.location(ident, ident.ModulePos, ident.ModulePos+token.Pos(len(ident.Module))))
+			}
+		}
+		return
+	}
+
+	var names []string
+	for name := range ix.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, ident := range ix.files[name].idents {
+			if ix.refs[ident] == sym.Decl {
+				refs = append(refs, ix.location(ident, ident.Pos(), ident.End()))
+			}
+		}
+	}
+	return
+}
+
+// location converts the range of node from start to end to positions in the file of node.
+func (ix *Index) location(node ast.Node, start, end token.Pos) Location {
+	file, ok := ix.nodes[node]
+	if !ok {
+		return Location{}
+	}
+	loc := Location{Start: file.Position(start), End: file.Position(end)}
+	if end > token.Pos(file.Size) {
+		loc.End = file.Position(token.Pos(file.Size))
+	}
+	return loc
+}
@@ -0,0 +1,184 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+const lib = `module "text/lib"
+stub Upper(s: string) (u: string)
+pipe Shout(s: string) (u: string) { u = Upper(s) }
+`
+
+const main = `module "main"
+import "text/lib"
+stub Print(s: string)
+stub Map(in: string, f: pipe(s: string) (u: string)) (out: string)
+pipe Twice(in: string) (out: string) {
+	x = lib.Shout(in)
+	out = lib.Upper(s: x)
+	Print(x)
+}
+pipe main() {
+	Print(Map(Twice("a"), lib.Shout))
+	Print(string(1))
+}
+`
+
+func index(t *testing.T) (*Index, string) {
+	t.Helper()
+	includeDir := t.TempDir()
+	libFile := filepath.Join(includeDir, "lib.hos")
+	if err := os.WriteFile(libFile, []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := token.NewFile("main.hos", len(main))
+	tr := tracer.NewTracer(includeDir)
+	if _, err := tr.TraceModule(&file, []byte(main)); err != nil {
+		t.Fatal(err)
+	}
+	return New(tr.ModuleSet(), tr.Refs()), libFile
+}
+
+func formatLoc(loc Location, libFile string) string {
+	name := loc.Start.Filename
+	if name == libFile {
+		name = "lib.hos"
+	}
+	return fmt.Sprintf("%s:%d:%d-%d", name, loc.Start.Line, loc.Start.Column, loc.End.Column)
+}
+
+// offset finds the nth (from 1) occurrence of marker in src, and is at the first | in marker.
+func offset(t *testing.T, src string, marker string, n int) int {
+	t.Helper()
+	at := strings.Index(marker, "|")
+	marker = strings.Replace(marker, "|", "", 1)
+	start := 0
+	for i := 0; i < n; i++ {
+		idx := strings.Index(src[start:], marker)
+		if idx < 0 {
+			t.Fatalf("marker %q not found %d times", marker, n)
+		}
+		start += idx + 1
+	}
+	return start - 1 + at
+}
+
+func TestDefinitionAndReferences(t *testing.T) {
+	ix, libFile := index(t)
+	tests := []struct {
+		name     string
+		marker   string
+		n        int
+		wantDef  string
+		wantRefs []string
+	}{
+		{
+			"Local symbol",
+			"Print(|x)", 1,
+			"main.hos:6:2-3",
+			[]string{"main.hos:6:2-3", "main.hos:7:21-22", "main.hos:8:8-9"},
+		},
+		{
+			"Input port",
+			"Shout(|in)", 1,
+			"main.hos:5:12-14",
+			[]string{"main.hos:5:12-14", "main.hos:6:16-18"},
+		},
+		{
+			"Output port",
+			"|out = ", 1,
+			"main.hos:5:25-28",
+			[]string{"main.hos:5:25-28", "main.hos:7:2-5"},
+		},
+		{
+			"Cursor at end of identifier",
+			"Print(x|)", 1,
+			"main.hos:6:2-3",
+			[]string{"main.hos:6:2-3", "main.hos:7:21-22", "main.hos:8:8-9"},
+		},
+		{
+			"Local pipe",
+			"Map(Tw|ice", 1,
+			"main.hos:5:6-11",
+			[]string{"main.hos:5:6-11", "main.hos:11:12-17"},
+		},
+		{
+			"Stub",
+			"Pri|nt(", 1,
+			"main.hos:3:6-11",
+			[]string{"main.hos:3:6-11", "main.hos:8:2-7", "main.hos:11:2-7", "main.hos:12:2-7"},
+		},
+		{
+			"Imported pipe",
+			"lib.Sh|out", 1,
+			"lib.hos:3:6-11",
+			[]string{"lib.hos:3:6-11", "main.hos:6:10-15", "main.hos:11:28-33"},
+		},
+		{
+			"Named argument",
+			"Upper(|s:", 1,
+			"lib.hos:2:12-13",
+			[]string{"lib.hos:2:12-13", "main.hos:7:18-19"},
+		},
+		{
+			"Module qualifier",
+			"l|ib.Shout", 2,
+			"main.hos:2:8-18",
+			[]string{"main.hos:2:8-18", "main.hos:6:6-9", "main.hos:7:8-11", "main.hos:11:24-27"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := offset(t, main, tt.marker, tt.n)
+			sym, ok := ix.Definition("main.hos", at)
+			if !ok {
+				t.Fatalf("Definition(%d) found nothing", at)
+			}
+			if got := formatLoc(sym.Def, libFile); got != tt.wantDef {
+				t.Errorf("Definition(%d) = %v, want %v", at, got, tt.wantDef)
+			}
+
+			var gotRefs []string
+			for _, ref := range ix.References("main.hos", at) {
+				gotRefs = append(gotRefs, formatLoc(ref, libFile))
+			}
+			if !reflect.DeepEqual(gotRefs, tt.wantRefs) {
+				t.Errorf("References(%d) = %q, want %q", at, gotRefs, tt.wantRefs)
+			}
+		})
+	}
+}
+
+func TestNoDefinition(t *testing.T) {
+	ix, _ := index(t)
+	tests := []struct {
+		name   string
+		marker string
+	}{
+		{"Built-in", "str|ing(1)"},
+		{"Literal", "Twice(\"|a\")"},
+		{"Keyword", "p|ipe main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := offset(t, main, tt.marker, 1)
+			if sym, ok := ix.Definition("main.hos", at); ok {
+				t.Errorf("Definition(%d) = %v, want nothing", at, sym.Def)
+			}
+			if refs := ix.References("main.hos", at); refs != nil {
+				t.Errorf("References(%d) = %v, want nothing", at, refs)
+			}
+		})
+	}
+	if ident := ix.IdentAt("other.hos", 0); ident != nil {
+		t.Errorf("IdentAt in unknown file = %v, want nil", ident)
+	}
+}
@@ -0,0 +1,257 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/masp/hoser/ast"
+)
+
+// start runs a single instance of decl until it finishes. All of out are closed when start returns.
+func (rt *State) start(decl ast.BlockDecl, in []*Stream, out []*Output) error {
+	defer closeAll(out)
+	switch d := decl.(type) {
+	case *ast.StubDecl:
+		module := rt.declModule[d]
+		proc := rt.Lookup(module, d.BlockName())
+		if proc == nil {
+			return fmt.Errorf("no proc registered for stub %v", fullName(module, d.BlockName()))
+		}
+		return proc(&Proc{In: in, Out: out, rt: rt})
+	case *ast.PipeDecl:
+		if d.BodyDAG == nil {
+			return fmt.Errorf("pipe %v has not been traced", d.BlockName())
+		}
+		return rt.runGraph(d.BodyDAG, in, out)
+	default:
+		panic(fmt.Errorf("invalid block declaration: %T", decl))
+	}
+}
+
+// runGraph starts every block in graph concurrently and waits until all of them have finished. Values sent to in
+// leave the root block's inputs, and values arriving at the root block's outputs are sent to out.
+//
+// Every edge gets its own Stream, so a port with several consumers broadcasts each value to all of them and each
+// consumer buffers the values it has not received yet.
+func (rt *State) runGraph(graph *ast.Graph, in []*Stream, out []*Output) error {
+	rootIn := newOutputs(len(in))
+	outputs := make([][]*Output, len(graph.Blocks))
+	inputs := make([][]*Stream, len(graph.Blocks))
+	for i, block := range graph.Blocks {
+		outputs[i] = newOutputs(len(block.OutPorts()))
+		inputs[i] = make([]*Stream, len(block.InPorts()))
+	}
+
+	constant := constants(graph, in)
+	for _, edge := range graph.Edges {
+		var src *Output
+		if edge.Src.Block == ast.RootBlock {
+			src = rootIn[edge.Src.Port]
+		} else {
+			src = outputs[edge.Src.Block][edge.Src.Port]
+		}
+
+		if edge.Dst.Block == ast.RootBlock {
+			src.forward(out[edge.Dst.Port])
+		} else {
+			stream := src.Connect()
+			stream.constant = constant(edge.Src)
+			inputs[edge.Dst.Block][edge.Dst.Port] = stream
+		}
+	}
+
+	for _, ports := range inputs {
+		for i := range ports {
+			if ports[i] == nil {
+				ports[i] = ClosedStream()
+			}
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	for port, stream := range in {
+		wg.Add(1)
+		go func(stream *Stream, to *Output) {
+			defer wg.Done()
+			defer to.Close()
+			for {
+				v, ok := stream.Recv()
+				if !ok {
+					return
+				}
+				to.Send(v)
+			}
+		}(stream, rootIn[port])
+	}
+	for i, block := range graph.Blocks {
+		wg.Add(1)
+		go func(block ast.Block, in []*Stream, out []*Output) {
+			defer wg.Done()
+			defer closeAll(out)
+			if err := rt.runBlock(block, in, out); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}(block, inputs[i], outputs[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (rt *State) runBlock(block ast.Block, in []*Stream, out []*Output) error {
+	switch b := block.(type) {
+	case *ast.LiteralBlock:
+		out[0].Send(b.Lit.ParsedVal)
+		return nil
+	case *ast.StubBlock:
+		return rt.start(b.Decl, in, out)
+	case *ast.PipeBlock:
+		return rt.start(b.Decl, in, out)
+	case *ast.PipeRefBlock:
+		out[0].Send(&Pipe{Decl: b.Decl, rt: rt})
+		return nil
+	case *ast.ApplyBlock:
+		// the pipe is instantiated once it arrives and is given the rest of the inputs
+		v, ok := in[0].Recv()
+		if !ok {
+			return nil
+		}
+		return v.(*Pipe).Start(in[1:], out)
+	case *ast.BuiltinBlock:
+		return rt.runBuiltin(b, in, out)
+	default:
+		panic(fmt.Errorf("invalid block type: %T", block))
+	}
+}
+
+func (rt *State) runBuiltin(block *ast.BuiltinBlock, in []*Stream, out []*Output) error {
+	switch block.Op {
+	case ast.MergeBuiltin:
+		var wg sync.WaitGroup
+		for _, stream := range in {
+			wg.Add(1)
+			go func(stream *Stream) {
+				defer wg.Done()
+				for {
+					v, ok := stream.Recv()
+					if !ok {
+						return
+					}
+					out[0].Send(v)
+				}
+			}(stream)
+		}
+		wg.Wait()
+		return nil
+	case ast.FieldBuiltin:
+		// records are maps from field name to value
+		for {
+			v, ok := in[0].Recv()
+			if !ok {
+				return nil
+			}
+			record, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("expected record with field %v, got %T", block.Params[0], v)
+			}
+			out[0].Send(record[block.Params[0]])
+		}
+	case ast.FormatBuiltin, ast.IntBuiltin, ast.FloatBuiltin, ast.StringBuiltin:
+		// one value is computed for every value received on all inputs, with constant inputs received only once
+		args := make([]interface{}, len(in))
+		allConstant := true
+		for i, stream := range in {
+			if !stream.Constant() {
+				allConstant = false
+				continue
+			}
+			v, ok := stream.Recv()
+			if !ok {
+				return nil
+			}
+			args[i] = v
+		}
+		for {
+			for i, stream := range in {
+				if stream.Constant() {
+					continue
+				}
+				v, ok := stream.Recv()
+				if !ok {
+					return nil
+				}
+				args[i] = v
+			}
+			v, err := block.Eval(args)
+			if err != nil {
+				return err
+			}
+			out[0].Send(v)
+			if allConstant {
+				return nil
+			}
+		}
+	default:
+		panic(fmt.Errorf("unknown builtin %v", block.Op))
+	}
+}
+
+// constants returns whether the values leaving a port of graph are constant: the outputs of literals, the inputs of
+// the graph that are given constant streams in, and interpolations and conversions of only constants.
+func constants(graph *ast.Graph, in []*Stream) func(from ast.Loc) bool {
+	sources := make(map[ast.Loc]ast.Loc)
+	for _, edge := range graph.Edges {
+		sources[edge.Dst] = edge.Src
+	}
+	known := make(map[ast.BlockIdx]bool)
+	var constant func(from ast.Loc) bool
+	constant = func(from ast.Loc) bool {
+		if from.Block == ast.RootBlock {
+			return in[from.Port].Constant()
+		}
+		if c, ok := known[from.Block]; ok {
+			return c
+		}
+		c := false
+		switch b := graph.Blocks[from.Block].(type) {
+		case *ast.LiteralBlock:
+			c = true
+		case *ast.BuiltinBlock:
+			switch b.Op {
+			case ast.FormatBuiltin, ast.IntBuiltin, ast.FloatBuiltin, ast.StringBuiltin:
+				c = true
+				for port := range b.InPorts() {
+					src, ok := sources[ast.Loc{Block: from.Block, Port: ast.PortIdx(port)}]
+					if !ok || !constant(src) {
+						c = false
+						break
+					}
+				}
+			}
+		}
+		known[from.Block] = c
+		return c
+	}
+	return constant
+}
+
+func newOutputs(n int) []*Output {
+	outputs := make([]*Output, n)
+	for i := range outputs {
+		outputs[i] = &Output{}
+	}
+	return outputs
+}
+
+func closeAll(outputs []*Output) {
+	for _, o := range outputs {
+		o.Close()
+	}
+}
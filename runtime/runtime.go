@@ -1,128 +1,235 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/masp/hoser/ast"
-	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/optimize"
+	"github.com/masp/hoser/serialize"
 	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
 )
 
-type NativeProc func(state *State)
+var (
+	ErrMissingMain = errors.New("missing 'main' pipe in module")
+)
+
+// NativeProc implements a stub in Go. It receives values from the inputs of the stub and sends values to its
+// outputs, both in the order they are declared. The outputs are closed by the runtime when it returns.
+type NativeProc func(proc *Proc) error
+
+// Proc is a running instance of a stub.
+type Proc struct {
+	In  []*Stream
+	Out []*Output
+	rt  *State
+}
 
+// Arg receives the next value sent to input idx, or nil if there is none.
+func (p *Proc) Arg(idx int) interface{} {
+	v, _ := p.In[idx].Recv()
+	return v
+}
+
+func (p *Proc) ArgInt(idx int) int64     { return p.Arg(idx).(int64) }
+func (p *Proc) ArgFloat(idx int) float64 { return p.Arg(idx).(float64) }
+func (p *Proc) ArgString(idx int) string { return p.Arg(idx).(string) }
+func (p *Proc) ArgPipe(idx int) *Pipe    { return p.Arg(idx).(*Pipe) }
+
+// State executes traced modules. Stubs are implemented by NativeProcs registered by their full name.
 type State struct {
 	NativeProcs map[string]NativeProc
-	Args        []interface{}
+	IncludePath []string           // directories searched for modules imported by programs
+	Cache       tracer.ModuleCache // traced modules kept between runs, nil to always trace every module
+
+	declModule map[ast.BlockDecl]string // module name each loaded block is declared in
 }
 
 func New() *State {
 	return &State{
 		NativeProcs: make(map[string]NativeProc),
-		Pipes:       make(map[string]ast.PipeDecl),
+		declModule:  make(map[ast.BlockDecl]string),
 	}
 }
 
-func (rt *State) Lookup(ident *ast.Ident) NativeProc {
-	if fn, ok := rt.NativeProcs[ident.FullName()]; ok {
+func (rt *State) Lookup(module string, name string) NativeProc {
+	if fn, ok := rt.NativeProcs[fullName(module, name)]; ok {
 		return fn
 	}
+	return nil
 }
 
 func (rt *State) RegisterProc(module string, name string, proc NativeProc) {
-	if module != "" {
-		rt.NativeProcs[module+"."+name] = proc
-	} else {
-		rt.NativeProcs[name] = proc
-	}
+	rt.NativeProcs[fullName(module, name)] = proc
 }
 
-func (rt *State) RegisterPipe(module string, name string, decl *ast.PipeDecl) {
+func fullName(module string, name string) string {
 	if module != "" {
-		rt.Pipes[module+"."+name] = decl
-	} else {
-		rt.Pipes[name] = decl
+		return module + "." + name
 	}
+	return name
 }
 
-func (rt *State) Push(arg interface{}) {
-	rt.Args = append(rt.Args, arg)
-}
-
-func (rt *State) ArgInt(idx int) int64     { return rt.Args[idx].(int64) }
-func (rt *State) ArgFloat(idx int) float64 { return rt.Args[idx].(float64) }
-func (rt *State) ArgString(idx int) string { return rt.Args[idx].(string) }
-
-func (rt *State) ClearArgs() {
-	rt.Args = rt.Args[0:]
+// Load makes the blocks of a traced module available to be run.
+func (rt *State) Load(module *ast.Module) {
+	for _, decl := range module.DefinedBlocks {
+		rt.declModule[decl] = module.Name.Value
+	}
 }
 
 func (rt *State) RunProgram(program []byte) error {
 	file := token.NewFile("", len(program))
-	module, err := parser.ParseModule(&file, program)
+	module, _, err := rt.LoadFile(&file, program)
 	if err != nil {
 		return err
 	}
+	return rt.Run(module)
+}
 
-	for _, block := range module.DefinedPipes {
-		rt.RegisterPipe("", block.Name.V, block)
+// LoadFile traces and optimizes the module in src and the modules it imports, and loads all of them to be run. The
+// warnings found while tracing are returned even if there are errors.
+func (rt *State) LoadFile(file *token.File, src []byte) (*ast.Module, token.ErrorList, error) {
+	set, module, warnings, err := rt.trace(file, src)
+	if err != nil {
+		return nil, warnings, err
+	}
+	for _, cached := range set.Modules {
+		if cached.IsLoaded() && cached.Mod != nil {
+			rt.Load(cached.Mod)
+		}
 	}
+	return module, warnings, nil
+}
 
+// Compile traces and optimizes program and the modules it imports so it can be saved and run later with RunCompiled.
+func (rt *State) Compile(program []byte) (*serialize.Program, error) {
+	file := token.NewFile("", len(program))
+	set, module, _, err := rt.trace(&file, program)
+	if err != nil {
+		return nil, err
+	}
+	return serialize.Encode(set, module.Name.Value)
+}
+
+// RunCompiled runs the main pipe of a program saved by Compile without parsing or tracing it again.
+func (rt *State) RunCompiled(program *serialize.Program) error {
+	set, module, err := program.Load()
+	if err != nil {
+		return err
+	}
+	for _, cached := range set.Modules {
+		rt.Load(cached.Mod)
+	}
 	return rt.Run(module)
 }
 
-func (rt *State) Run(module *ast.Module) error {
-	mainBlock := findMainBlock(module)
-	if mainBlock == nil {
-		return fmt.Errorf("missing 'main' pipe in module")
-	}
-
-	for _, stmt := range mainBlock.Body {
-		switch st := stmt.(type) {
-		case *ast.ExprStmt:
-			switch x := st.X.(type) {
-			case *ast.CallExpr:
-				if proc := rt.Lookup(x.Name); proc != nil {
-					for _, arg := range x.Args {
-						err := rt.evalArg(arg)
-						if err != nil {
-							return err
-						}
-					}
-					proc(rt)
-
-					// Clear args for next call
-					rt.ClearArgs()
-				} else {
-					return fmt.Errorf("no proc with name %v found", x.Name.FullName())
-				}
-			}
+// trace traces the module in src and optimizes every module it loads.
+func (rt *State) trace(file *token.File, src []byte) (*ast.ModuleSet, *ast.Module, token.ErrorList, error) {
+	tr := tracer.NewTracer(rt.IncludePath...)
+	tr.Cache = rt.Cache
+	module, err := tr.TraceModule(file, src)
+	if err != nil {
+		return nil, nil, tr.Warnings(), err
+	}
+	set := tr.ModuleSet()
+	for _, cached := range set.Modules {
+		if cached.IsLoaded() && cached.Mod != nil {
+			optimize.Module(cached.Mod, optimize.Fold, optimize.Dedup, optimize.Prune)
 		}
 	}
+	return set, module, tr.Warnings(), nil
+}
 
-	return nil
+// Run runs the main pipe of module with no values on its inputs and discards its outputs.
+func (rt *State) Run(module *ast.Module) error {
+	return rt.RunEntry(module, "main")
 }
 
-func (rt *State) evalArg(x ast.Expr) error {
-	switch v := x.(type) {
-	case *ast.LiteralExpr:
-		rt.Push(v.ParsedVal)
-		return nil
-	case *ast.Field:
-		err := rt.evalArg(v.Value)
-		if err != nil {
-			return err
-		}
-		return nil
+// RunEntry runs the pipe called name in module like Run, see Entry. Use Start to give it inputs.
+func (rt *State) RunEntry(module *ast.Module, name string) error {
+	rt.Load(module)
+	entry, err := Entry(module, name)
+	if err != nil {
+		return err
+	}
+
+	in := make([]*Stream, len(entry.Inputs.Fields))
+	for i := range in {
+		in[i] = ClosedStream()
+	}
+	out := make([]*Output, len(entry.Outputs.Fields))
+	for i := range out {
+		out[i] = &Output{}
+	}
+	return rt.start(entry, in, out)
+}
+
+// Main returns the main pipe of module, or ErrMissingMain if it has none.
+func Main(module *ast.Module) (*ast.PipeDecl, error) {
+	if pipe, ok := module.Lookup("main").(*ast.PipeDecl); ok {
+		return pipe, nil
+	}
+	return nil, ErrMissingMain
+}
+
+// Entry returns the pipe called name in module, which a program can be run from instead of main.
+func Entry(module *ast.Module, name string) (*ast.PipeDecl, error) {
+	if name == "main" {
+		return Main(module)
+	}
+	switch decl := module.Lookup(name).(type) {
+	case *ast.PipeDecl:
+		return decl, nil
+	case *ast.StubDecl:
+		return nil, fmt.Errorf("%v is a stub, expected a pipe", name)
 	default:
-		return fmt.Errorf("unsupported expression found in args")
+		return nil, fmt.Errorf("no pipe named %v in module", name)
 	}
 }
 
-func findMainBlock(module *ast.Module) *ast.PipeDecl {
-	for _, block := range module.DefinedPipes {
-		if block.Name.V == "main" {
-			return block
-		}
+// Start runs a loaded pipe or stub until all its outputs are closed, like Pipe.Start. Values sent to in are the
+// inputs of the block, and its outputs are sent to out.
+func (rt *State) Start(decl ast.BlockDecl, in []*Stream, out []*Output) error {
+	return rt.start(decl, in, out)
+}
+
+// Pipe is a pipe or stub passed as a value to a pipe typed port. A Pipe can be started any number of times.
+type Pipe struct {
+	Decl ast.BlockDecl
+	rt   *State
+}
+
+// Start runs a new instance of the pipe until all its outputs are closed. Values sent to in are the inputs of
+// the pipe, and its outputs are sent to out.
+func (p *Pipe) Start(in []*Stream, out []*Output) error {
+	return p.rt.start(p.Decl, in, out)
+}
+
+// Call runs a new instance of the pipe with a single value on each input and returns every value sent to each output.
+// It can be used by NativeProcs to apply a pipe to each element of a stream.
+func (p *Pipe) Call(args ...interface{}) ([][]interface{}, error) {
+	if len(args) != len(p.Decl.BlockInputs().Fields) {
+		return nil, fmt.Errorf("wrong number of args for call to %v, expected %d, got %d",
+			p.Decl.BlockName(), len(p.Decl.BlockInputs().Fields), len(args))
 	}
-	return nil
+	in := make([]*Stream, len(args))
+	for i, arg := range args {
+		in[i] = ClosedStream(arg)
+	}
+	out := make([]*Output, len(p.Decl.BlockOutputs().Fields))
+	results := make([]*Stream, len(out))
+	for i := range out {
+		out[i] = &Output{}
+		results[i] = out[i].Connect()
+	}
+	if err := p.Start(in, out); err != nil {
+		return nil, err
+	}
+
+	values := make([][]interface{}, len(results))
+	for i, result := range results {
+		values[i] = result.All()
+	}
+	return values, nil
 }
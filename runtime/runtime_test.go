@@ -1,8 +1,14 @@
 package runtime
 
 import (
+	"bytes"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+
+	"github.com/masp/hoser/serialize"
+	"github.com/masp/hoser/token"
 )
 
 const NotCalled = "NEVER_CALLED"
@@ -13,34 +19,310 @@ func TestState_Run(t *testing.T) {
 		program string
 		want    []interface{}
 	}{
-		{"never called", "module main; main() {}", []interface{}{NotCalled}},
-		{"zero args", "module main; main() { test.Pass() }", nil},
-		{"two args", `module main; main() { test.Pass(10, "hello") }`, []interface{}{int64(10), "hello"}},
-		{"named args", `module main; main() { test.Pass(a: 10, b: "hello") }`, []interface{}{int64(10), "hello"}},
+		{"never called", `module "test"; stub Pass(); pipe main() {}`, []interface{}{NotCalled}},
+		{"zero args", `module "test"; stub Pass(); pipe main() { Pass() }`, nil},
+		{"two args", `module "test"; stub Pass(a: int, b: string); pipe main() { Pass(10, "hello") }`, []interface{}{int64(10), "hello"}},
+		{"named args", `module "test"; stub Pass(a: int, b: string); pipe main() { Pass(b: "hello", a: 10) }`, []interface{}{int64(10), "hello"}},
 		{"subcall", `
-module main
-sub(v: int) { test.Pass(v) }
-main() { sub(10) }
+module "test"
+stub Pass(v: int)
+pipe sub(v: int) { Pass(v) }
+pipe main() { sub(10) }
+`, []interface{}{int64(10)}},
+		{"pipe output", `
+module "test"
+stub Pass(v: int)
+pipe sub() (v: int) { v = 10 }
+pipe main() { Pass(sub()) }
 `, []interface{}{int64(10)}},
+		{"interpolation", `
+module "test"
+stub Pass(v: string)
+pipe sub(name: string, n: int) { Pass("out/${name}-${n}.txt") }
+pipe main() { sub("a", 1) }
+`, []interface{}{"out/a-1.txt"}},
+		{"call pipe value", `
+module "test"
+stub Pass(v: int)
+pipe apply(v: int, f: pipe(x: int) (y: int)) (y: int) { y = f(v) }
+pipe main() { Pass(apply(10, pipe(x: int) (y: int) { y = x })) }
+`, []interface{}{int64(10)}},
+		{"implicit conversions", `
+module "test"
+stub Pass(f: float, s: string)
+pipe main() { Pass(1, 2.5) }
+`, []interface{}{float64(1), "2.5"}},
+		{"explicit conversions", `
+module "test"
+stub Pass(a: int, b: int, c: float, d: string)
+pipe main() { Pass(int(2.7), int("42"), float(" 1.5"), string(3)) }
+`, []interface{}{int64(2), int64(42), 1.5, "3"}},
 	}
 
+	for _, tt := range tests {
+		for _, compiled := range []bool{false, true} {
+			name := tt.name
+			if compiled {
+				name += " compiled"
+			}
+			t.Run(name, func(t *testing.T) {
+				rt := New()
+				got := []interface{}{NotCalled}
+				rt.RegisterProc("test", "Pass", func(proc *Proc) error {
+					got = nil
+					for i := range proc.In {
+						got = append(got, proc.Arg(i))
+					}
+					return nil
+				})
+
+				if err := run(rt, []byte(tt.program), compiled); err != nil {
+					t.Errorf("Run() error = %v", err)
+					return
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Run() called Pass() with %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// run runs program from source, or saves it in the binary form and runs it from there if compiled is set.
+func run(rt *State, program []byte, compiled bool) error {
+	if !compiled {
+		return rt.RunProgram(program)
+	}
+	prog, err := rt.Compile(program)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := prog.WriteBinary(&buf); err != nil {
+		return err
+	}
+	if prog, err = serialize.ReadBinary(&buf); err != nil {
+		return err
+	}
+	return rt.RunCompiled(prog)
+}
+
+func TestState_RunEntry(t *testing.T) {
+	const program = `module "test"
+stub Pass(v: int)
+pipe Filter() { Pass(10) }
+pipe main() {}
+`
+	tests := []struct {
+		name    string
+		entry   string
+		want    []interface{}
+		wantErr string
+	}{
+		{"Pipe", "Filter", []interface{}{int64(10)}, ""},
+		{"Main", "main", []interface{}{NotCalled}, ""},
+		{"Stub", "Pass", nil, "Pass is a stub, expected a pipe"},
+		{"Missing", "Other", nil, "no pipe named Other in module"},
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rt := New()
 			got := []interface{}{NotCalled}
-			rt.Register("test", "Pass", func(state *State) {
-				got = nil
-				got = append(got, state.Args...)
+			rt.RegisterProc("test", "Pass", func(proc *Proc) error {
+				got = []interface{}{proc.Arg(0)}
+				return nil
 			})
+			file := token.NewFile("", len(program))
+			module, _, err := rt.LoadFile(&file, []byte(program))
+			if err != nil {
+				t.Fatal(err)
+			}
 
-			if err := rt.RunProgram([]byte(tt.program)); err != nil {
-				t.Errorf("Run() error = %v", err)
+			err = rt.RunEntry(module, tt.entry)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("RunEntry() error = %v, want %v", err, tt.wantErr)
+				}
 				return
 			}
+			if err != nil {
+				t.Fatalf("RunEntry() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RunEntry() called Pass() with %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
 
+func TestState_Streams(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		want    map[string][]interface{}
+	}{
+		{"fan-out broadcasts", `
+module "test"
+stub Count() (n: int)
+stub Collect1(v: int)
+stub Collect2(v: int)
+pipe main() {
+	n = Count()
+	Collect1(n)
+	Collect2(n)
+}
+`, map[string][]interface{}{
+			"Collect1": {int64(0), int64(1), int64(2)},
+			"Collect2": {int64(0), int64(1), int64(2)},
+		}},
+		{"merge interleaves", `
+module "test"
+stub Count() (n: int)
+stub Collect1(v: int)
+pipe main() {
+	Collect1(merge(Count(), 10, Count()))
+}
+`, map[string][]interface{}{
+			"Collect1": {int64(0), int64(0), int64(1), int64(1), int64(2), int64(2), int64(10)},
+		}},
+		{"map with pipe", `
+module "test"
+stub Count() (n: int)
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+stub Collect1(v: int)
+pipe main() {
+	Collect1(Map(Count(), pipe(x: int) (y: int) { y = merge(x, x) }))
+}
+`, map[string][]interface{}{
+			"Collect1": {int64(0), int64(0), int64(1), int64(1), int64(2), int64(2)},
+		}},
+		{"constants repeat", `
+module "test"
+stub Count() (n: int)
+stub Collect1(v: int)
+stub Collect2(v: int)
+pipe main() {
+	Collect1(int("${Count()}${7}"))
+	Collect2(int("${1}${2}"))
+}
+`, map[string][]interface{}{
+			"Collect1": {int64(7), int64(17), int64(27)},
+			"Collect2": {int64(12)},
+		}},
+		{"destructure records", `
+module "test"
+stub Ball() (pos: {x: int, y: int}, size: int)
+stub Collect1(v: int)
+stub Collect2(v: int)
+pipe main() {
+	{pos: {x: px, y: _}}, size = Ball()
+	Collect1(px)
+	Collect2(size)
+}
+`, map[string][]interface{}{
+			"Collect1": {int64(1)},
+			"Collect2": {int64(3)},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			got := make(map[string][]interface{})
+			collect := func(name string) NativeProc {
+				return func(proc *Proc) error {
+					values := proc.In[0].All()
+					mu.Lock()
+					got[name] = append(got[name], values...)
+					mu.Unlock()
+					return nil
+				}
+			}
+
+			rt := New()
+			rt.RegisterProc("test", "Count", func(proc *Proc) error {
+				for i := 0; i < 3; i++ {
+					proc.Out[0].Send(int64(i))
+				}
+				return nil
+			})
+			rt.RegisterProc("test", "Map", func(proc *Proc) error {
+				f := proc.ArgPipe(1)
+				for _, v := range proc.In[0].All() {
+					results, err := f.Call(v)
+					if err != nil {
+						return err
+					}
+					for _, result := range results[0] {
+						proc.Out[0].Send(result)
+					}
+				}
+				return nil
+			})
+			rt.RegisterProc("test", "Ball", func(proc *Proc) error {
+				proc.Out[0].Send(map[string]interface{}{"x": int64(1), "y": int64(2)})
+				proc.Out[1].Send(int64(3))
+				return nil
+			})
+			rt.RegisterProc("test", "Collect1", collect("Collect1"))
+			rt.RegisterProc("test", "Collect2", collect("Collect2"))
+
+			if err := rt.RunProgram([]byte(tt.program)); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			for name, values := range got {
+				// merged streams have no defined order between producers
+				sort.Slice(values, func(i, j int) bool { return values[i].(int64) < values[j].(int64) })
+				got[name] = values
+			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("Run() called Pass() with %v, want %v", got, tt.want)
+				t.Errorf("Run() collected %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestState_UnboundedStreams(t *testing.T) {
+	// Concat receives all of a before b, so every value of n is buffered for b until a is closed, which would
+	// deadlock if streams blocked their producer once they held a number of values
+	const program = `
+module "test"
+stub Many() (n: int)
+stub Concat(a: int, b: int) (out: int)
+stub Collect1(v: int)
+pipe main() {
+	n = Many()
+	Collect1(Concat(n, n))
+}
+`
+	const many = 100000
+	rt := New()
+	rt.RegisterProc("test", "Many", func(proc *Proc) error {
+		for i := 0; i < many; i++ {
+			proc.Out[0].Send(int64(i))
+		}
+		return nil
+	})
+	rt.RegisterProc("test", "Concat", func(proc *Proc) error {
+		for _, in := range proc.In {
+			for v, ok := in.Recv(); ok; v, ok = in.Recv() {
+				proc.Out[0].Send(v)
+			}
+		}
+		return nil
+	})
+	var got int
+	rt.RegisterProc("test", "Collect1", func(proc *Proc) error {
+		got = len(proc.In[0].All())
+		return nil
+	})
+
+	if err := rt.RunProgram([]byte(program)); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got != 2*many {
+		t.Errorf("Run() collected %d values, want %d", got, 2*many)
+	}
+}
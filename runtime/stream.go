@@ -0,0 +1,132 @@
+package runtime
+
+import "sync"
+
+// Stream is the receiving end of an edge. Every consumer of a port has its own Stream that buffers
+// values until they are received, so a slow consumer never blocks the producer or the other consumers.
+//
+// The buffer is not bounded: every value a producer sends ahead of a consumer is kept in memory until it is
+// received, e.g. all of a large file read faster than the program handles its lines. Blocking the producer of a full
+// buffer instead could deadlock a program, since blocks receive their inputs in any order, like a stub that receives
+// all of one input before the next while both come from the same port, and Pipe.Call only receives the outputs of a
+// pipe once it has finished.
+type Stream struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	buf    []interface{}
+	closed bool
+
+	// constant is set if the stream has a single value that stands for every value of the streams it is combined
+	// with, e.g. the literal in "${stdin}-x" or a flag of a program.
+	constant bool
+}
+
+func NewStream() *Stream {
+	s := &Stream{}
+	s.ready = sync.NewCond(&s.mu)
+	return s
+}
+
+// ClosedStream returns a stream that has the given values and nothing more.
+func ClosedStream(values ...interface{}) *Stream {
+	s := NewStream()
+	for _, v := range values {
+		s.Send(v)
+	}
+	s.Close()
+	return s
+}
+
+// ConstStream returns a closed stream with the single value v that is constant, see Constant.
+func ConstStream(v interface{}) *Stream {
+	s := ClosedStream(v)
+	s.constant = true
+	return s
+}
+
+// Constant reports whether the only value of the stream is a constant, like a literal, rather than a stream with one
+// element. Blocks that combine one value of each input, like interpolations, receive the value of a constant input
+// once and reuse it for every value of their other inputs.
+func (s *Stream) Constant() bool {
+	return s.constant
+}
+
+// Send buffers v to be received later. Send never blocks, see Stream for why the buffer is not bounded.
+func (s *Stream) Send(v interface{}) {
+	s.mu.Lock()
+	if !s.closed {
+		s.buf = append(s.buf, v)
+	}
+	s.mu.Unlock()
+	s.ready.Signal()
+}
+
+// Close marks the end of the stream, Recv returns false after all buffered values are received.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.ready.Broadcast()
+}
+
+// Recv blocks until a value is available and returns it. ok is false if the stream is closed and empty.
+func (s *Stream) Recv() (v interface{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && !s.closed {
+		s.ready.Wait()
+	}
+	if len(s.buf) == 0 {
+		return nil, false
+	}
+	v = s.buf[0]
+	s.buf[0] = nil
+	s.buf = s.buf[1:]
+	return v, true
+}
+
+// All receives every remaining value until the stream is closed.
+func (s *Stream) All() (values []interface{}) {
+	for {
+		v, ok := s.Recv()
+		if !ok {
+			return
+		}
+		values = append(values, v)
+	}
+}
+
+// sink is anything an Output can forward values to.
+type sink interface {
+	Send(v interface{})
+	Close()
+}
+
+// Output is the sending end of a port. Values sent to an Output are broadcast to every consumer
+// connected to it (fan-out), and are dropped if there are none.
+type Output struct {
+	consumers []sink
+}
+
+// Connect adds a new consumer to the output and returns the stream it receives values on.
+func (o *Output) Connect() *Stream {
+	s := NewStream()
+	o.consumers = append(o.consumers, s)
+	return s
+}
+
+func (o *Output) forward(to sink) {
+	o.consumers = append(o.consumers, to)
+}
+
+func (o *Output) Send(v interface{}) {
+	for _, c := range o.consumers {
+		c.Send(v)
+	}
+}
+
+func (o *Output) Close() {
+	for _, c := range o.consumers {
+		c.Close()
+	}
+}
@@ -0,0 +1,209 @@
+package serialize
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/masp/hoser/ast"
+)
+
+// encoder converts traced modules to a Program. Blocks refer to the declarations they call by module and name.
+type encoder struct {
+	refs map[ast.BlockDecl]DeclRef
+}
+
+// Encode creates a program from the traced modules in set, which is run from the module main. Modules in set that
+// are only indexed and were never loaded are not part of the program.
+func Encode(set *ast.ModuleSet, main string) (*Program, error) {
+	if cached := set.Lookup(main); cached == nil || !cached.IsLoaded() {
+		return nil, fmt.Errorf("main module %q is not loaded", main)
+	}
+
+	e := newEncoder(set)
+	var names []string
+	for name, cached := range set.Modules {
+		if cached.IsLoaded() && cached.Mod != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	p := &Program{Version: Version, Main: main}
+	for _, name := range names {
+		mod, err := e.module(set.Modules[name])
+		if err != nil {
+			return nil, err
+		}
+		p.Modules = append(p.Modules, mod)
+	}
+	return p, nil
+}
+
+// EncodeModule saves only the module with the full name in set, which may refer to declarations in the other
+// loaded modules of set. It is loaded back with LoadModule.
+func EncodeModule(set *ast.ModuleSet, name string) (Module, error) {
+	cached := set.Lookup(name)
+	if cached == nil || !cached.IsLoaded() || cached.Mod == nil {
+		return Module{}, fmt.Errorf("module %q is not loaded", name)
+	}
+	return newEncoder(set).module(cached)
+}
+
+func newEncoder(set *ast.ModuleSet) *encoder {
+	e := &encoder{refs: make(map[ast.BlockDecl]DeclRef)}
+	for name, cached := range set.Modules {
+		if cached.IsLoaded() && cached.Mod != nil {
+			for _, decl := range cached.Mod.DefinedBlocks {
+				e.refs[decl] = DeclRef{Module: name, Name: decl.BlockName()}
+			}
+		}
+	}
+	return e
+}
+
+func (e *encoder) module(cached *ast.CachedModule) (Module, error) {
+	mod := Module{
+		Name:    cached.Mod.Name.Value,
+		Pos:     cached.Mod.ModulePos,
+		NamePos: cached.Mod.Name.Pos(),
+		File:    File{Name: cached.File.Name, Size: cached.File.Size, Lines: cached.File.Lines()},
+	}
+	for _, imp := range cached.Mod.Imports {
+		mod.Imports = append(mod.Imports, Import{Name: imp.ModuleName.Value, Pos: imp.Keyword})
+	}
+	for _, decl := range cached.Mod.DefinedBlocks {
+		d, err := e.decl(decl)
+		if err != nil {
+			return Module{}, fmt.Errorf("%v: %w", mod.Name, err)
+		}
+		mod.Decls = append(mod.Decls, d)
+	}
+	return mod, nil
+}
+
+func (e *encoder) decl(decl ast.BlockDecl) (Decl, error) {
+	var stub *ast.StubDecl
+	switch d := decl.(type) {
+	case *ast.StubDecl:
+		stub = d
+	case *ast.PipeDecl:
+		stub = &d.StubDecl
+	default:
+		return Decl{}, fmt.Errorf("invalid block declaration: %T", decl)
+	}
+	out := Decl{
+		Kind:    KindStub,
+		Name:    stub.Name.V,
+		NamePos: stub.Name.Pos(),
+		Pure:    stub.Pure,
+		Doc:     encodeDoc(stub.Doc),
+		Inputs:  encodePorts(&stub.Inputs),
+		Outputs: encodePorts(&stub.Outputs),
+	}
+
+	if pipe, ok := decl.(*ast.PipeDecl); ok {
+		if pipe.BodyDAG == nil {
+			return Decl{}, fmt.Errorf("pipe %v has not been traced", pipe.BlockName())
+		}
+		body, err := e.graph(pipe.BodyDAG)
+		if err != nil {
+			return Decl{}, fmt.Errorf("pipe %v: %w", pipe.BlockName(), err)
+		}
+		body.Open, body.Close = pipe.BegLBrack, pipe.EndRBrack
+		out.Kind, out.Body = KindPipe, &body
+	}
+	return out, nil
+}
+
+func encodePorts(fields *ast.FieldList) Ports {
+	ports := Ports{Opener: fields.Opener, Closer: fields.Closer, Fields: []Port{}}
+	for _, field := range fields.Fields {
+		port := Port{Name: field.Key.V, Pos: field.Key.Pos(), Type: field.Type(), Doc: encodeDoc(field.Doc)}
+		if field.Default != nil {
+			port.Default = encodeLiteral(field.Default)
+		}
+		ports.Fields = append(ports.Fields, port)
+	}
+	return ports
+}
+
+func encodeDoc(doc *ast.CommentGroup) []Comment {
+	if doc == nil {
+		return nil
+	}
+	comments := make([]Comment, len(doc.List))
+	for i, c := range doc.List {
+		comments[i] = Comment{Pos: c.Hash, Text: c.Text}
+	}
+	return comments
+}
+
+func encodeLiteral(lit *ast.LiteralExpr) *Literal {
+	return &Literal{Type: ast.LiteralType(lit), Value: lit.Value, Pos: lit.Pos()}
+}
+
+func (e *encoder) graph(graph *ast.Graph) (Body, error) {
+	body := Body{Blocks: []Block{}, Edges: []Edge{}}
+	for i, block := range graph.Blocks {
+		b, err := e.block(block)
+		if err != nil {
+			return Body{}, fmt.Errorf("block %d: %w", i, err)
+		}
+		body.Blocks = append(body.Blocks, b)
+	}
+	for _, edge := range graph.Edges {
+		body.Edges = append(body.Edges, Edge{
+			Src:  Loc{Block: int(edge.Src.Block), Port: int(edge.Src.Port)},
+			Dst:  Loc{Block: int(edge.Dst.Block), Port: int(edge.Dst.Port)},
+			Type: edge.Type,
+		})
+	}
+	return body, nil
+}
+
+func (e *encoder) block(block ast.Block) (Block, error) {
+	createdBy := block.CreatedBy()
+	b := Block{
+		Span: Span{From: createdBy.Pos(), To: createdBy.End()},
+		In:   block.InPorts(),
+		Out:  block.OutPorts(),
+	}
+	switch blk := block.(type) {
+	case *ast.LiteralBlock:
+		b.Kind, b.Literal = KindLiteral, encodeLiteral(blk.Lit)
+	case *ast.StubBlock:
+		return e.call(b, KindStub, blk.Decl)
+	case *ast.PipeBlock:
+		return e.call(b, KindPipe, blk.Decl)
+	case *ast.PipeRefBlock:
+		if _, ok := createdBy.(*ast.PipeLit); ok {
+			lit, err := e.decl(blk.Decl)
+			if err != nil {
+				return Block{}, err
+			}
+			b.Kind, b.Lit = KindRef, &lit
+			return b, nil
+		}
+		return e.call(b, KindRef, blk.Decl)
+	case *ast.ApplyBlock:
+		b.Kind, b.Type = KindApply, &PipeType{
+			Keyword: blk.Type.Keyword,
+			Inputs:  encodePorts(&blk.Type.Inputs),
+			Outputs: encodePorts(&blk.Type.Outputs),
+		}
+	case *ast.BuiltinBlock:
+		b.Kind, b.Op, b.Params = KindBuiltin, string(blk.Op), blk.Params
+	default:
+		return Block{}, fmt.Errorf("invalid block type: %T", block)
+	}
+	return b, nil
+}
+
+func (e *encoder) call(b Block, kind string, decl ast.BlockDecl) (Block, error) {
+	ref, ok := e.refs[decl]
+	if !ok {
+		return Block{}, fmt.Errorf("%v is not declared in a loaded module", decl.BlockName())
+	}
+	b.Kind, b.Decl = kind, &ref
+	return b, nil
+}
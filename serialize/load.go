@@ -0,0 +1,332 @@
+package serialize
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// loader rebuilds the modules of a program. Every declaration is created before any graph, since graphs refer to
+// declarations in any module.
+type loader struct {
+	decls map[DeclRef]ast.BlockDecl
+}
+
+// Load rebuilds the modules of p with their traced graphs, as if they were traced from source, and returns them
+// with the main module. Blocks are created by *ast.Span nodes, except pipe literals which are still created by an
+// *ast.PipeLit.
+func (p *Program) Load() (*ast.ModuleSet, *ast.Module, error) {
+	if err := checkVersion(p.Version); err != nil {
+		return nil, nil, err
+	}
+
+	set := ast.EmptyModuleSet()
+	l := loader{decls: make(map[DeclRef]ast.BlockDecl)}
+	mods := make([]*ast.Module, len(p.Modules))
+	files := make([]*token.File, len(p.Modules))
+	for i, m := range p.Modules {
+		var err error
+		if mods[i], files[i], err = l.module(m); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, m := range p.Modules {
+		if err := l.bodies(m, mods[i]); err != nil {
+			return nil, nil, err
+		}
+		addModule(&set, files[i], mods[i])
+	}
+
+	main := set.Lookup(p.Main)
+	if main == nil {
+		return nil, nil, fmt.Errorf("main module %q is not in the program", p.Main)
+	}
+	return &set, main.Mod, nil
+}
+
+// LoadModule rebuilds m like Load and adds it to set. The modules it refers to must already be loaded in set.
+func LoadModule(m Module, set *ast.ModuleSet) (*ast.Module, error) {
+	l := loader{decls: make(map[DeclRef]ast.BlockDecl)}
+	for name, cached := range set.Modules {
+		if cached.IsLoaded() && cached.Mod != nil {
+			for _, decl := range cached.Mod.DefinedBlocks {
+				l.decls[DeclRef{Module: name, Name: decl.BlockName()}] = decl
+			}
+		}
+	}
+	mod, file, err := l.module(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.bodies(m, mod); err != nil {
+		return nil, err
+	}
+	addModule(set, file, mod)
+	return mod, nil
+}
+
+// addModule adds a loaded module to set, replacing the header of the module if it was already indexed.
+func addModule(set *ast.ModuleSet, file *token.File, mod *ast.Module) {
+	set.IndexFile(file, mod).File = file
+	set.LoadModule(mod)
+}
+
+// module creates m and its declarations without their bodies.
+func (l *loader) module(m Module) (*ast.Module, *token.File, error) {
+	file := token.NewFile(m.File.Name, m.File.Size)
+	file.SetLines(m.File.Lines)
+	mod := &ast.Module{
+		ModulePos: m.Pos,
+		Name:      &ast.LiteralExpr{Start: m.NamePos, Type: token.String, Value: m.Name, ParsedVal: m.Name},
+	}
+	for _, imp := range m.Imports {
+		mod.Imports = append(mod.Imports, &ast.ImportDecl{
+			Keyword:    imp.Pos,
+			ModuleName: &ast.LiteralExpr{Start: imp.Pos, Type: token.String, Value: imp.Name, ParsedVal: imp.Name},
+		})
+	}
+	for _, d := range m.Decls {
+		decl, err := loadDecl(d)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v: %w", m.Name, err)
+		}
+		mod.DefinedBlocks = append(mod.DefinedBlocks, decl)
+		l.decls[DeclRef{Module: m.Name, Name: d.Name}] = decl
+	}
+	return mod, &file, nil
+}
+
+// bodies creates the graphs of the pipes of m in mod.
+func (l *loader) bodies(m Module, mod *ast.Module) error {
+	for i, d := range m.Decls {
+		if pipe, ok := mod.DefinedBlocks[i].(*ast.PipeDecl); ok {
+			if err := l.body(pipe, d.Body); err != nil {
+				return fmt.Errorf("%v: pipe %v: %w", m.Name, d.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadDecl creates a declaration without its body.
+func loadDecl(d Decl) (ast.BlockDecl, error) {
+	inputs, err := loadPorts(d.Inputs)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", d.Name, err)
+	}
+	outputs, err := loadPorts(d.Outputs)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", d.Name, err)
+	}
+	stub := ast.StubDecl{
+		Pure:    d.Pure,
+		Name:    &ast.Ident{V: d.Name, NamePos: d.NamePos},
+		Doc:     loadDoc(d.Doc),
+		Inputs:  inputs,
+		Outputs: outputs,
+	}
+	switch d.Kind {
+	case KindStub:
+		return &stub, nil
+	case KindPipe:
+		if d.Body == nil {
+			return nil, fmt.Errorf("pipe %v has no body", d.Name)
+		}
+		return &ast.PipeDecl{StubDecl: stub, BegLBrack: d.Body.Open, EndRBrack: d.Body.Close}, nil
+	default:
+		return nil, fmt.Errorf("invalid kind of declaration %q", d.Kind)
+	}
+}
+
+// loadPorts creates ports with their types in Inferred, like ports declared without a type.
+func loadPorts(ports Ports) (ast.FieldList, error) {
+	fields := ast.FieldList{Opener: ports.Opener, Closer: ports.Closer}
+	for _, port := range ports.Fields {
+		field := &ast.Field{
+			Key:      &ast.Ident{V: port.Name, NamePos: port.Pos},
+			Inferred: port.Type,
+			Doc:      loadDoc(port.Doc),
+		}
+		if port.Default != nil {
+			lit, err := loadLiteral(port.Default)
+			if err != nil {
+				return ast.FieldList{}, fmt.Errorf("default of %v: %w", port.Name, err)
+			}
+			field.Default = lit
+		}
+		fields.Fields = append(fields.Fields, field)
+	}
+	return fields, nil
+}
+
+func loadDoc(comments []Comment) *ast.CommentGroup {
+	if len(comments) == 0 {
+		return nil
+	}
+	doc := &ast.CommentGroup{}
+	for _, c := range comments {
+		doc.List = append(doc.List, &ast.Comment{Hash: c.Pos, Text: c.Text})
+	}
+	return doc
+}
+
+func (l *loader) body(pipe *ast.PipeDecl, body *Body) error {
+	graph := ast.NewGraph(pipe)
+	for i, b := range body.Blocks {
+		if err := l.block(&graph, b); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+	}
+	for _, e := range body.Edges {
+		src := ast.Loc{Block: ast.BlockIdx(e.Src.Block), Port: ast.PortIdx(e.Src.Port)}
+		dst := ast.Loc{Block: ast.BlockIdx(e.Dst.Block), Port: ast.PortIdx(e.Dst.Port)}
+		if !validLoc(&graph, src, false) || !validLoc(&graph, dst, true) {
+			return fmt.Errorf("invalid edge %v -> %v", e.Src, e.Dst)
+		}
+		graph.Connect(src, dst, e.Type)
+	}
+	pipe.BodyDAG = &graph
+	return nil
+}
+
+// validLoc reports whether loc is a port of graph. Values leave the root block through its inputs and arrive at
+// its outputs, unlike every other block.
+func validLoc(graph *ast.Graph, loc ast.Loc, dst bool) bool {
+	if loc.Block < ast.RootBlock || int(loc.Block) >= len(graph.Blocks) || loc.Port < 0 {
+		return false
+	}
+	block := graph.Block(loc.Block)
+	ports := block.OutPorts()
+	if dst == (loc.Block != ast.RootBlock) {
+		ports = block.InPorts()
+	}
+	return int(loc.Port) < len(ports)
+}
+
+func (l *loader) block(graph *ast.Graph, b Block) error {
+	createdBy := &ast.Span{From: b.Span.From, To: b.Span.To}
+	switch b.Kind {
+	case KindLiteral:
+		if b.Literal == nil {
+			return fmt.Errorf("literal has no value")
+		}
+		lit, err := loadLiteral(b.Literal)
+		if err != nil {
+			return err
+		}
+		if lit.Pos() == b.Span.From && lit.End() == b.Span.To {
+			graph.AddLiteralBlock(lit)
+		} else {
+			graph.AddLiteralBlockFrom(lit, createdBy)
+		}
+	case KindStub, KindPipe:
+		decl, err := l.lookup(b.Decl)
+		if err != nil {
+			return err
+		}
+		if _, isPipe := decl.(*ast.PipeDecl); isPipe != (b.Kind == KindPipe) {
+			return fmt.Errorf("%v is not a %v", decl.BlockName(), b.Kind)
+		}
+		graph.AddNamedBlock(decl, createdBy)
+	case KindRef:
+		if b.Lit != nil {
+			decl, err := loadDecl(*b.Lit)
+			if err != nil {
+				return err
+			}
+			pipe, ok := decl.(*ast.PipeDecl)
+			if !ok {
+				return fmt.Errorf("pipe literal is a %v", b.Lit.Kind)
+			}
+			if err := l.body(pipe, b.Lit.Body); err != nil {
+				return fmt.Errorf("pipe literal: %w", err)
+			}
+			graph.AddPipeRefBlock(pipe, &ast.PipeLit{Decl: pipe})
+			return nil
+		}
+		decl, err := l.lookup(b.Decl)
+		if err != nil {
+			return err
+		}
+		graph.AddPipeRefBlock(decl, createdBy)
+	case KindApply:
+		if b.Type == nil {
+			return fmt.Errorf("apply has no type")
+		}
+		inputs, err := loadPorts(b.Type.Inputs)
+		if err != nil {
+			return err
+		}
+		outputs, err := loadPorts(b.Type.Outputs)
+		if err != nil {
+			return err
+		}
+		graph.AddApplyBlock(&ast.PipeType{Keyword: b.Type.Keyword, Inputs: inputs, Outputs: outputs}, createdBy)
+	case KindBuiltin:
+		op := ast.Builtin(b.Op)
+		if err := checkBuiltin(op, b); err != nil {
+			return err
+		}
+		graph.AddBuiltinBlockWithParams(op, b.Params, b.In, b.Out, createdBy)
+	default:
+		return fmt.Errorf("invalid kind of block %q", b.Kind)
+	}
+	return nil
+}
+
+// checkBuiltin reports a built-in whose ports or parameters are not the ones the runtime expects of its op, which
+// would otherwise fail while the program runs.
+func checkBuiltin(op ast.Builtin, b Block) error {
+	in, out, params := len(b.In), len(b.Out), len(b.Params)
+	var ok bool
+	switch op {
+	case ast.MergeBuiltin:
+		ok = in >= 1 && out == 1
+	case ast.FieldBuiltin:
+		ok = in == 1 && out == 1 && params == 1
+	case ast.FormatBuiltin:
+		ok = params == in+1 && out == 1
+	case ast.IntBuiltin, ast.FloatBuiltin, ast.StringBuiltin:
+		ok = in == 1 && out == 1
+	default:
+		return fmt.Errorf("unknown built-in %q", b.Op)
+	}
+	if !ok {
+		return fmt.Errorf("built-in %v has %d inputs, %d outputs and %d parameters", op, in, out, params)
+	}
+	return nil
+}
+
+func (l *loader) lookup(ref *DeclRef) (ast.BlockDecl, error) {
+	if ref == nil {
+		return nil, fmt.Errorf("block has no declaration")
+	}
+	decl, ok := l.decls[*ref]
+	if !ok {
+		return nil, fmt.Errorf("%v.%v is not declared", ref.Module, ref.Name)
+	}
+	return decl, nil
+}
+
+func loadLiteral(lit *Literal) (*ast.LiteralExpr, error) {
+	expr := &ast.LiteralExpr{Start: lit.Pos, Value: lit.Value}
+	var err error
+	switch lit.Type {
+	case ast.IntEdge:
+		expr.Type = token.Integer
+		expr.ParsedVal, err = strconv.ParseInt(lit.Value, 10, 64)
+	case ast.FloatEdge:
+		expr.Type = token.Float
+		expr.ParsedVal, err = strconv.ParseFloat(lit.Value, 64)
+	case ast.StringEdge:
+		expr.Type, expr.ParsedVal = token.String, lit.Value
+	default:
+		return nil, fmt.Errorf("invalid type of literal %v", lit.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v literal %q", lit.Type, lit.Value)
+	}
+	return expr, nil
+}
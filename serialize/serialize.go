@@ -0,0 +1,223 @@
+// Package serialize saves traced modules to a stable format and loads them back into graphs that can be run
+// without parsing or tracing the source again.
+//
+// A Program holds every module a program uses. It is written as JSON for tools, or in a compact binary form for
+// caches and for shipping precompiled pipelines. Both forms hold the same data and carry the Version of the format.
+// Positions are offsets into the source file of their module, and the line table of each file is saved so they can
+// still be reported as lines and columns.
+package serialize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// Version is the version of the format written by this package. Programs written with another version cannot be
+// loaded.
+const Version = 1
+
+// magic starts every program in the binary form.
+var magic = []byte("hoser\x00")
+
+var ErrNotProgram = errors.New("not a hoser program")
+
+// Program is a set of traced modules, one of which is the module the program is run from.
+type Program struct {
+	Version int      `json:"version"`
+	Main    string   `json:"main"`    // full name of the module the program is run from
+	Modules []Module `json:"modules"` // sorted by name
+}
+
+// Module is a traced module and the file it was traced from.
+type Module struct {
+	Name    string    `json:"name"`
+	Pos     token.Pos `json:"pos"` // module keyword
+	NamePos token.Pos `json:"namePos"`
+	File    File      `json:"file"`
+	Imports []Import  `json:"imports,omitempty"`
+	Decls   []Decl    `json:"decls"`
+}
+
+// File is the name, size and line table of a source file.
+type File struct {
+	Name  string `json:"name"`
+	Size  int    `json:"size"`
+	Lines []int  `json:"lines"`
+}
+
+type Import struct {
+	Name string    `json:"name"`
+	Pos  token.Pos `json:"pos"` // import keyword
+}
+
+// Decl is a stub or a pipe. Pipes have a Body, including pipe literals which are saved where they are used.
+type Decl struct {
+	Kind    string    `json:"kind"` // "stub" or "pipe"
+	Name    string    `json:"name"`
+	NamePos token.Pos `json:"namePos"`
+	Pure    token.Pos `json:"pure,omitempty"` // pure keyword, 0 if the block is not pure
+	Doc     []Comment `json:"doc,omitempty"`
+	Inputs  Ports     `json:"inputs"`
+	Outputs Ports     `json:"outputs"`
+	Body    *Body     `json:"body,omitempty"`
+}
+
+// Comment is a line of a doc comment, including the #.
+type Comment struct {
+	Pos  token.Pos `json:"pos"`
+	Text string    `json:"text"`
+}
+
+// Ports is a list of ports between parentheses.
+type Ports struct {
+	Opener token.Pos `json:"opener"`
+	Fields []Port    `json:"fields"`
+	Closer token.Pos `json:"closer"`
+}
+
+// Port is a named input or output and its type, declared or inferred.
+type Port struct {
+	Name    string       `json:"name"`
+	Pos     token.Pos    `json:"pos"`
+	Type    ast.EdgeType `json:"type"`
+	Default *Literal     `json:"default,omitempty"`
+	Doc     []Comment    `json:"doc,omitempty"`
+}
+
+// Body is the traced graph of a pipe.
+type Body struct {
+	Open   token.Pos `json:"open"` // {
+	Close  token.Pos `json:"close"`
+	Blocks []Block   `json:"blocks"`
+	Edges  []Edge    `json:"edges"`
+}
+
+// Kinds of blocks.
+const (
+	KindLiteral = "literal"
+	KindStub    = "stub"
+	KindPipe    = "pipe"
+	KindRef     = "ref"
+	KindApply   = "apply"
+	KindBuiltin = "builtin"
+)
+
+// Block is a block of a graph. Which of the optional fields are set depends on the Kind:
+//
+//	literal: Literal
+//	stub, pipe: Decl
+//	ref: Decl for a declared stub or pipe, Lit for a pipe literal
+//	apply: Type
+//	builtin: Op and Params
+type Block struct {
+	Kind    string         `json:"kind"`
+	Span    Span           `json:"span"` // what created the block
+	In      []ast.EdgeType `json:"in,omitempty"`
+	Out     []ast.EdgeType `json:"out,omitempty"`
+	Literal *Literal       `json:"literal,omitempty"`
+	Decl    *DeclRef       `json:"decl,omitempty"`
+	Lit     *Decl          `json:"lit,omitempty"`
+	Type    *PipeType      `json:"type,omitempty"`
+	Op      string         `json:"op,omitempty"`
+	Params  []string       `json:"params,omitempty"`
+}
+
+// Span is the range of source that created a block.
+type Span struct {
+	From token.Pos `json:"from"`
+	To   token.Pos `json:"to"`
+}
+
+// Literal is a constant value, written as it would be in source without quotes for strings.
+type Literal struct {
+	Type  ast.EdgeType `json:"type"` // int, float or string
+	Value string       `json:"value"`
+	Pos   token.Pos    `json:"pos"`
+}
+
+// DeclRef names a stub or pipe declared in a module of the program.
+type DeclRef struct {
+	Module string `json:"module"`
+	Name   string `json:"name"`
+}
+
+// PipeType is the type of a pipe typed port that is called.
+type PipeType struct {
+	Keyword token.Pos `json:"keyword"`
+	Inputs  Ports     `json:"inputs"`
+	Outputs Ports     `json:"outputs"`
+}
+
+// Edge connects an output to an input, where block -1 is the pipe the graph describes.
+type Edge struct {
+	Src  Loc          `json:"src"`
+	Dst  Loc          `json:"dst"`
+	Type ast.EdgeType `json:"type"`
+}
+
+type Loc struct {
+	Block int `json:"block"`
+	Port  int `json:"port"`
+}
+
+// WriteJSON writes p as indented JSON.
+func (p *Program) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(p)
+}
+
+// ReadJSON reads a program written by WriteJSON.
+func ReadJSON(r io.Reader) (*Program, error) {
+	var p Program
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotProgram, err)
+	}
+	return &p, checkVersion(p.Version)
+}
+
+// WriteBinary writes p in the binary form.
+func (p *Program) WriteBinary(w io.Writer) error {
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(p)
+}
+
+// ReadBinary reads a program written by WriteBinary.
+func ReadBinary(r io.Reader) (*Program, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, header); err != nil || !bytes.Equal(header, magic) {
+		return nil, ErrNotProgram
+	}
+	var p Program
+	if err := gob.NewDecoder(br).Decode(&p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotProgram, err)
+	}
+	return &p, checkVersion(p.Version)
+}
+
+// Read reads a program in either form.
+func Read(r io.Reader) (*Program, error) {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(len(magic)); bytes.Equal(header, magic) {
+		return ReadBinary(br)
+	}
+	return ReadJSON(br)
+}
+
+func checkVersion(version int) error {
+	if version != Version {
+		return fmt.Errorf("program has format version %d, expected %d", version, Version)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package serialize
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/optimize"
+	"github.com/masp/hoser/token"
+	"github.com/masp/hoser/tracer"
+)
+
+const program = `module "a"
+pure stub Upper(s: string) (u: string)
+# Print prints s
+# followed by end.
+stub Print(s: string, end: string = "\n")
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+pipe Apply(v: int, f: pipe(x: int) (y: int)) (y) { y = f(v) }
+pipe Double(x: int) (y: int) { y = x }
+pipe main() {
+	n = Apply(int("2"), Double)
+	m = Map(n, pipe(x: int) (y: int) { y = x })
+	Print(Upper("${n}-${m}"))
+	Print(merge("a", string(1.5)))
+}
+`
+
+func encode(t *testing.T, src string) (*Program, *token.File) {
+	t.Helper()
+	file := token.NewFile("a.hos", len(src))
+	tr := tracer.NewTracer()
+	mod, err := tr.TraceModule(&file, []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimize.Module(mod, optimize.Fold)
+	p, err := Encode(tr.ModuleSet(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &file
+}
+
+func TestRoundTrip(t *testing.T) {
+	formats := []struct {
+		name  string
+		write func(p *Program, buf *bytes.Buffer) error
+		read  func(buf *bytes.Buffer) (*Program, error)
+	}{
+		{"JSON", func(p *Program, buf *bytes.Buffer) error { return p.WriteJSON(buf) }, func(buf *bytes.Buffer) (*Program, error) { return ReadJSON(buf) }},
+		{"Binary", func(p *Program, buf *bytes.Buffer) error { return p.WriteBinary(buf) }, func(buf *bytes.Buffer) (*Program, error) { return ReadBinary(buf) }},
+		{"Read JSON", func(p *Program, buf *bytes.Buffer) error { return p.WriteJSON(buf) }, func(buf *bytes.Buffer) (*Program, error) { return Read(buf) }},
+		{"Read binary", func(p *Program, buf *bytes.Buffer) error { return p.WriteBinary(buf) }, func(buf *bytes.Buffer) (*Program, error) { return Read(buf) }},
+	}
+	for _, tt := range formats {
+		t.Run(tt.name, func(t *testing.T) {
+			want, _ := encode(t, program)
+			var buf bytes.Buffer
+			if err := tt.write(want, &buf); err != nil {
+				t.Fatal(err)
+			}
+			read, err := tt.read(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			set, main, err := read.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if main.Name.Value != "a" {
+				t.Errorf("Load() main = %v, want a", main.Name.Value)
+			}
+
+			// the loaded modules are saved exactly as the traced ones
+			got, err := Encode(set, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Encode(Load()) = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadPositions(t *testing.T) {
+	p, file := encode(t, program)
+	set, main, err := p.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced := file.Position(token.Pos(strings.Index(program, "Print(Upper") + 1))
+
+	graph := main.Lookup("main").(*ast.PipeDecl).BodyDAG
+	for _, block := range graph.Blocks {
+		if stub, ok := block.(*ast.StubBlock); ok && stub.Decl.BlockName() == "Print" {
+			got := set.Lookup("a").File.Position(block.CreatedBy().Pos())
+			if got != traced {
+				t.Errorf("loaded position = %v, want %v", got, traced)
+			}
+			return
+		}
+	}
+	t.Fatal("Print block not found")
+}
+
+func TestJSON(t *testing.T) {
+	p, _ := encode(t, `module "a"
+stub B(a: int)
+pipe main() { B(1) }
+`)
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+	"version": 1,
+	"main": "a",
+	"modules": [
+		{
+			"name": "a",
+			"pos": 1,
+			"namePos": 8,
+			"file": {
+				"name": "a.hos",
+				"size": 48,
+				"lines": [
+					0,
+					11,
+					26,
+					47
+				]
+			},
+			"decls": [
+				{
+					"kind": "stub",
+					"name": "B",
+					"namePos": 17,
+					"inputs": {
+						"opener": 18,
+						"fields": [
+							{
+								"name": "a",
+								"pos": 19,
+								"type": "int"
+							}
+						],
+						"closer": 25
+					},
+					"outputs": {
+						"opener": 0,
+						"fields": [],
+						"closer": 0
+					}
+				},
+				{
+					"kind": "pipe",
+					"name": "main",
+					"namePos": 32,
+					"inputs": {
+						"opener": 36,
+						"fields": [],
+						"closer": 37
+					},
+					"outputs": {
+						"opener": 0,
+						"fields": [],
+						"closer": 0
+					},
+					"body": {
+						"open": 39,
+						"close": 46,
+						"blocks": [
+							{
+								"kind": "literal",
+								"span": {
+									"from": 43,
+									"to": 44
+								},
+								"out": [
+									"int"
+								],
+								"literal": {
+									"type": "int",
+									"value": "1",
+									"pos": 43
+								}
+							},
+							{
+								"kind": "stub",
+								"span": {
+									"from": 41,
+									"to": 44
+								},
+								"in": [
+									"int"
+								],
+								"decl": {
+									"module": "a",
+									"name": "B"
+								}
+							}
+						],
+						"edges": [
+							{
+								"src": {
+									"block": 0,
+									"port": 0
+								},
+								"dst": {
+									"block": 1,
+									"port": 0
+								},
+								"type": "int"
+							}
+						]
+					}
+				}
+			]
+		}
+	]
+}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteJSON() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(p *Program)
+		wantErr string
+	}{
+		{"Version", func(p *Program) { p.Version = 2 }, "program has format version 2, expected 1"},
+		{"Main", func(p *Program) { p.Main = "b" }, `main module "b" is not in the program`},
+		{"Decl", func(p *Program) {
+			p.Modules[0].Decls[1].Body.Blocks[1].Decl.Name = "D"
+		}, "a: pipe main: block 1: a.D is not declared"},
+		{"Edge", func(p *Program) {
+			p.Modules[0].Decls[1].Body.Edges[0].Dst.Port = 1
+		}, "a: pipe main: invalid edge {0 0} -> {1 1}"},
+		{"Literal", func(p *Program) {
+			p.Modules[0].Decls[1].Body.Blocks[0].Literal.Value = "x"
+		}, `a: pipe main: block 0: invalid int literal "x"`},
+		{"Builtin params", func(p *Program) {
+			format := &p.Modules[0].Decls[1].Body.Blocks[3]
+			format.Params = format.Params[:1]
+		}, "a: pipe main: block 3: built-in format has 1 inputs, 1 outputs and 1 parameters"},
+		{"Builtin ports", func(p *Program) {
+			p.Modules[0].Decls[1].Body.Blocks[3].Out = nil
+		}, "a: pipe main: block 3: built-in format has 1 inputs, 0 outputs and 2 parameters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := encode(t, `module "a"
+stub B(a: int)
+pipe main() { B(1); S("a${C()}") }
+stub C() (s: string)
+stub S(s: string)
+`)
+			tt.change(p)
+			if _, _, err := p.Load(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Load() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	if _, err := ReadBinary(strings.NewReader("{}")); err != ErrNotProgram {
+		t.Errorf("ReadBinary() error = %v, want %v", err, ErrNotProgram)
+	}
+	if _, err := Read(strings.NewReader("not json")); err == nil {
+		t.Errorf("Read() error = nil, want an error")
+	}
+}
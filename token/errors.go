@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 )
 
 // In an ErrorList, an error is represented by an *Error.
@@ -18,9 +19,99 @@ import (
 // the offending token, and the error condition is described
 // by Msg.
 //
+// Severity, Code, Related and Fixes are optional. Code is a
+// stable name for the kind of error (e.g. "type-mismatch") that
+// tools can rely on even if Msg changes.
+//
 type Error struct {
+	Pos      Position
+	Msg      error
+	Severity Severity
+	Code     string
+	Related  []Related // other positions that explain the error
+	Fixes    []Fix     // suggested changes that would fix the error
+}
+
+// Severity is how serious an Error is. The zero value is SeverityError.
+type Severity int
+
+const (
+	SeverityError   Severity = iota // the program cannot be run
+	SeverityWarning                 // the program can be run but is likely wrong
+	SeverityNote                    // information that is not a problem
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityNote:
+		return "note"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Related is another position that helps explain an Error, e.g.
+// where a port whose type does not match was declared.
+type Related struct {
 	Pos Position
-	Msg error
+	Msg string
+}
+
+// Fix is a change to the source that fixes an Error, described by
+// Msg and applied by replacing the text of every edit.
+type Fix struct {
+	Msg   string
+	Edits []TextEdit
+}
+
+// TextEdit replaces the source between Pos and End with NewText. If
+// Pos and End are the same, NewText is inserted at Pos.
+type TextEdit struct {
+	Pos, End Position
+	NewText  string
+}
+
+// Detail formats the error with everything attached to it, one
+// per line:
+//
+//	file:3:15: error[type-mismatch]: type mismatch: got float, expected int
+//		file:2:8: input a of B is declared here
+//		fix: convert to int with int()
+//			file:3:15: insert "int("
+//
+func (e *Error) Detail() string {
+	var sb strings.Builder
+	if e.Pos.Filename != "" || e.Pos.IsValid() {
+		sb.WriteString(e.Pos.String())
+		sb.WriteString(": ")
+	}
+	sb.WriteString(e.Severity.String())
+	if e.Code != "" {
+		fmt.Fprintf(&sb, "[%s]", e.Code)
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Msg.Error())
+	for _, rel := range e.Related {
+		fmt.Fprintf(&sb, "\n\t%s: %s", rel.Pos, rel.Msg)
+	}
+	for _, fix := range e.Fixes {
+		fmt.Fprintf(&sb, "\n\tfix: %s", fix.Msg)
+		for _, edit := range fix.Edits {
+			switch {
+			case edit.Pos.Offset == edit.End.Offset:
+				fmt.Fprintf(&sb, "\n\t\t%s: insert %q", edit.Pos, edit.NewText)
+			case edit.NewText == "":
+				fmt.Fprintf(&sb, "\n\t\t%s: delete to %s", edit.Pos, edit.End)
+			default:
+				fmt.Fprintf(&sb, "\n\t\t%s: replace to %s with %q", edit.Pos, edit.End, edit.NewText)
+			}
+		}
+	}
+	return sb.String()
 }
 
 // Error implements the error interface.
@@ -40,7 +131,7 @@ type ErrorList []*Error
 
 // Add adds an Error with given position and error message to an ErrorList.
 func (p *ErrorList) Add(pos Position, msg error) {
-	*p = append(*p, &Error{pos, msg})
+	*p = append(*p, &Error{Pos: pos, Msg: msg})
 }
 
 // Reset resets an ErrorList to no errors.
@@ -97,15 +188,25 @@ func (p ErrorList) Err() error {
 }
 
 // PrintError is a utility function that prints a list of errors to w,
-// one error per line, if the err parameter is an ErrorList. Otherwise
-// it prints the err string.
+// one error per line with its Detail, if the err parameter is an
+// ErrorList. Otherwise it prints the err string.
 //
 func PrintError(w io.Writer, err error) {
 	if list, ok := err.(ErrorList); ok {
 		for _, e := range list {
-			fmt.Fprintf(w, "%s\n", e)
+			fmt.Fprintf(w, "%s\n", e.Detail())
 		}
 	} else if err != nil {
 		fmt.Fprintf(w, "%s\n", err)
 	}
 }
+
+// HasErrors reports whether any Error in the list has SeverityError.
+func (p ErrorList) HasErrors() bool {
+	for _, e := range p {
+		if e.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
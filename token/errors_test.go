@@ -0,0 +1,66 @@
+package token
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorDetail(t *testing.T) {
+	pos := func(line, col int) Position { return Position{Filename: "a.hos", Line: line, Column: col} }
+	tests := []struct {
+		name string
+		err  Error
+		want string
+	}{
+		{
+			"Plain",
+			Error{Pos: pos(1, 2), Msg: errors.New("bad")},
+			"a.hos:1:2: error: bad",
+		},
+		{
+			"No position",
+			Error{Msg: errors.New("bad"), Severity: SeverityNote},
+			"note: bad",
+		},
+		{
+			"Related and fixes",
+			Error{
+				Pos:      pos(3, 5),
+				Msg:      errors.New("x is assigned but never used"),
+				Severity: SeverityWarning,
+				Code:     "unused-symbol",
+				Related:  []Related{{Pos: pos(2, 1), Msg: "first declared here"}},
+				Fixes: []Fix{{Msg: "discard", Edits: []TextEdit{
+					{Pos: Position{Filename: "a.hos", Offset: 10, Line: 3, Column: 5}, End: Position{Filename: "a.hos", Offset: 10, Line: 3, Column: 5}, NewText: "_"},
+					{Pos: Position{Filename: "a.hos", Offset: 10, Line: 3, Column: 5}, End: Position{Filename: "a.hos", Offset: 11, Line: 3, Column: 6}},
+					{Pos: Position{Filename: "a.hos", Offset: 10, Line: 3, Column: 5}, End: Position{Filename: "a.hos", Offset: 11, Line: 3, Column: 6}, NewText: "y"},
+				}}},
+			},
+			"a.hos:3:5: warning[unused-symbol]: x is assigned but never used\n" +
+				"\ta.hos:2:1: first declared here\n" +
+				"\tfix: discard\n" +
+				"\t\ta.hos:3:5: insert \"_\"\n" +
+				"\t\ta.hos:3:5: delete to a.hos:3:6\n" +
+				"\t\ta.hos:3:5: replace to a.hos:3:6 with \"y\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Detail(); got != tt.want {
+				t.Errorf("Detail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasErrors(t *testing.T) {
+	var list ErrorList
+	list = append(list, &Error{Msg: errors.New("w"), Severity: SeverityWarning})
+	if list.HasErrors() {
+		t.Errorf("HasErrors() = true for only warnings")
+	}
+	list.Add(Position{}, errors.New("e"))
+	if !list.HasErrors() {
+		t.Errorf("HasErrors() = false with an error")
+	}
+}
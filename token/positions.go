@@ -108,13 +108,29 @@ func (f *File) LineCount() int {
 	return n
 }
 
+// Lines returns the line offset table of f, which can be given to SetLines to restore the positions of a file
+// without scanning it again.
+func (f *File) Lines() []int {
+	f.lineMut.Lock()
+	lines := append([]int(nil), f.lines...)
+	f.lineMut.Unlock()
+	return lines
+}
+
+// SetLines replaces the line offset table of f with lines returned by Lines.
+func (f *File) SetLines(lines []int) {
+	f.lineMut.Lock()
+	f.lines = append([]int(nil), lines...)
+	f.lineMut.Unlock()
+}
+
 // AddLine adds the line offset for a new line.
 // The line offset must be larger than the offset for the previous line
 // and smaller than the file size; otherwise the line offset is ignored.
 //
 func (f *File) AddLine(offset int) {
 	f.lineMut.Lock()
-	if i := len(f.lines); (i == 0 || f.lines[i-1] < offset) && offset < f.Size {
+	if i := len(f.lines); (i == 0 || f.lines[i-1] <= offset) && offset < f.Size {
 		f.lines = append(f.lines, offset+1) // +1 since we want to put it at the start of the new line
 	}
 	f.lineMut.Unlock()
@@ -131,6 +147,17 @@ func (f *File) Pos(offset int) Pos {
 	return Pos(offset + 1)
 }
 
+// Offset returns the offset for the given file position p;
+// p must be a valid Pos value in that file.
+// f.Offset(f.Pos(offset)) == offset.
+//
+func (f *File) Offset(p Pos) int {
+	if int(p) <= 0 || int(p) > f.Size+1 {
+		panic(fmt.Sprintf("invalid Pos value %d (should be in [%d, %d])", p, 1, f.Size+1))
+	}
+	return int(p) - 1
+}
+
 // Line returns the line number for the given file position p;
 // p must be a Pos value in that file or NoPos.
 //
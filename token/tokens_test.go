@@ -43,3 +43,14 @@ func TestFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestFilesLeadingNewline(t *testing.T) {
+	src := []byte("\na")
+	file := NewFile("<test>", len(src))
+	file.AddLine(0)
+
+	want := Position{Filename: "<test>", Offset: Pos(2), Line: 2, Column: 1}
+	if got := file.Position(Pos(2)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
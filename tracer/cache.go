@@ -0,0 +1,163 @@
+package tracer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// ModuleCache keeps traced modules between runs of the tracer. Modules are stored by a key computed from their
+// source and the keys of the modules they import, so a module is only traced again when it or a module it depends
+// on (directly or not) has changed.
+//
+// Only modules that are traced without errors and whose ports all have declared types are stored. The types of
+// untyped ports are inferred for the whole program, so they may depend on the modules that import them.
+type ModuleCache interface {
+	// Contains reports whether a module is stored with key.
+	Contains(key string) bool
+	// Load adds the module stored with key to set and returns it with the warnings it was traced with. The modules
+	// it imports are already loaded in set.
+	Load(key string, set *ast.ModuleSet) (*ast.Module, token.ErrorList, error)
+	// Store saves the traced module with the full name in set, which may refer to other loaded modules in set.
+	Store(key string, set *ast.ModuleSet, name string, warnings token.ErrorList) error
+}
+
+// moduleKey is the cache key of the module with the full name, or "" if the module cannot be cached. Modules that
+// are part of an import cycle cannot be cached since their key would depend on itself.
+func (t *Tracer) moduleKey(name string) string {
+	if key, ok := t.keys[name]; ok {
+		return key
+	}
+	cached := t.modCache.Lookup(name)
+	if cached == nil || cached.Mod == nil {
+		return ""
+	}
+	t.keys[name] = "" // in progress, until the imports are hashed
+
+	src, err := t.source(cached.File.Name)
+	if err != nil {
+		return ""
+	}
+	var imports []string
+	for _, imp := range cached.Mod.Imports {
+		imports = append(imports, imp.ModuleName.Value)
+	}
+	sort.Strings(imports)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00shadow=%v\x00", name, cached.File.Name, len(src), t.WarnShadow)
+	h.Write(src)
+	for _, imp := range imports {
+		key := t.moduleKey(imp)
+		if key == "" {
+			return ""
+		}
+		fmt.Fprintf(h, "\x00%s=%s", imp, key)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	t.keys[name] = key
+	return key
+}
+
+// source reads the file of a module once.
+func (t *Tracer) source(filename string) ([]byte, error) {
+	if src, ok := t.sources[filename]; ok {
+		return src, nil
+	}
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	t.sources[filename] = src
+	return src, nil
+}
+
+// loadCached loads the module with the full name from the cache after loading the modules it imports, or returns
+// nil if it has to be traced.
+func (t *Tracer) loadCached(name string) *ast.Module {
+	if t.Cache == nil {
+		return nil
+	}
+	key := t.moduleKey(name)
+	if key == "" || !t.Cache.Contains(key) {
+		return nil
+	}
+
+	cached := t.modCache.Lookup(name)
+	mod, file := t.tracingMod, t.tracingFile
+	for _, imp := range cached.Mod.Imports {
+		if t.loadModule(imp.ModuleName.Value) == nil {
+			t.tracingMod, t.tracingFile = mod, file
+			return nil
+		}
+	}
+	t.tracingMod, t.tracingFile = mod, file
+
+	loaded, warnings, err := t.Cache.Load(key, &t.modCache)
+	if err != nil {
+		return nil
+	}
+	t.warnings = append(t.warnings, warnings...)
+	t.fromCache[name] = true
+	return loaded
+}
+
+// storeTraced stores every module traced since the tracer was created that can be cached. Errors from the cache
+// are ignored, the modules are traced again by the next tracer.
+func (t *Tracer) storeTraced() {
+	if t.Cache == nil {
+		return
+	}
+	for _, name := range t.traced {
+		if key := t.moduleKey(name); key != "" && t.cacheable(name) {
+			cached := t.modCache.Lookup(name)
+			_ = t.Cache.Store(key, &t.modCache, name, t.fileDiagnostics(t.warnings, cached.File.Name))
+		}
+	}
+}
+
+// cacheable reports whether a traced module can be stored, which is only the case if it and every module it imports
+// have no errors and no untyped ports.
+func (t *Tracer) cacheable(name string) bool {
+	if t.fromCache[name] {
+		return true
+	}
+	cached := t.modCache.Lookup(name)
+	if cached == nil || !cached.IsLoaded() || cached.Mod == nil {
+		return false
+	}
+	if len(t.fileDiagnostics(t.errors, cached.File.Name)) > 0 || hasUntypedPorts(cached.Mod) {
+		return false
+	}
+	for _, imp := range cached.Mod.Imports {
+		if !t.cacheable(imp.ModuleName.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileDiagnostics returns the errors or warnings of list reported in the file.
+func (t *Tracer) fileDiagnostics(list token.ErrorList, filename string) (found token.ErrorList) {
+	for _, e := range list {
+		if e.Pos.Filename == filename {
+			found = append(found, e)
+		}
+	}
+	return
+}
+
+func hasUntypedPorts(mod *ast.Module) (untyped bool) {
+	ast.Walk(mod, func(node ast.Node) bool {
+		if field, ok := node.(*ast.Field); ok && field.Value == nil {
+			untyped = true
+		}
+		return !untyped
+	})
+	return
+}
@@ -0,0 +1,33 @@
+package tracer
+
+// Codes are stable names for the kinds of errors and warnings reported by the tracer, set as the Code of each
+// token.Error. Tools can match on them rather than on the messages, which may change.
+const (
+	CodeAlreadyConnected = "already-connected" // a port is given values by more than one producer
+	CodeCannotInfer      = "cannot-infer"      // the type of a port or symbol is needed before it is known
+	CodeDuplicateImport  = "duplicate-import"  // two imports have the same qualifier
+	CodeDuplicateModule  = "duplicate-module"  // an imported module is declared by more than one file
+	CodeDuplicateName    = "duplicate-name"    // two ports or fields have the same name
+	CodeImportCycle      = "import-cycle"      // a module imports itself through other modules
+	CodeImpureCall       = "impure-call"       // a pure pipe calls a block that is not pure
+	CodeInvalidDefault   = "invalid-default"   // a port that is not an input of a pipe or stub has a default value
+	CodeIncludePath      = "include-path"      // the file of an imported module cannot be read
+	CodeInvalidArgument  = "invalid-argument"  // an argument does not match the inputs of the called block
+	CodeInvalidPattern   = "invalid-pattern"   // the left side of an assignment does not match the right side
+	CodeMissingArgument  = "missing-argument"  // an input of a block is not connected
+	CodeMissingType      = "missing-type"      // a port that cannot be inferred has no type
+	CodeNotCallable      = "not-callable"      // a symbol that is not a pipe is called
+	CodeNotImported      = "not-imported"      // a qualified name refers to a module that is not imported
+	CodeNotScalar        = "not-scalar"        // a value that is not a scalar is interpolated or converted
+	CodeRecursivePipe    = "recursive-pipe"    // a pipe calls itself through other pipes
+	CodeRedeclared       = "redeclared"        // two pipes or stubs have the same name
+	CodeRedefined        = "redefined"         // a symbol is defined twice in a pipe
+	CodeShadow           = "shadow"            // a symbol hides a pipe, stub or built-in
+	CodeTypeMismatch     = "type-mismatch"     // a value is connected to a port of another type
+	CodeUnassignedOutput = "unassigned-output" // an output of a pipe is never assigned
+	CodeUnknownModule    = "unknown-module"    // an imported module is not in the include path
+	CodeUnknownName      = "unknown-name"      // a name does not refer to a symbol, pipe, stub or built-in
+	CodeUnusedSymbol     = "unused-symbol"     // a symbol is assigned but never used
+	CodeUnusedValue      = "unused-value"      // the output of a block is never used
+	CodeWildcardValue    = "wildcard-value"    // _ is used as a value
+)
@@ -0,0 +1,137 @@
+package tracer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// A pipe can be inlined into the pipes that call it, and a module is loaded by the modules that import it. A pipe that
+// calls itself or a module that imports itself (directly or through others) would make either never end, so cycles are
+// reported as errors. Pipes passed as values are not part of the call graph since they are instantiated at runtime.
+
+// cycleStep is one edge in a cycle, e.g. pipe A calling pipe B at a position in A's file.
+type cycleStep struct {
+	desc string
+	pos  token.Position
+}
+
+func formatCycle(kind string, cycle []cycleStep) error {
+	var sb strings.Builder
+	sb.WriteString(kind)
+	sb.WriteString(": ")
+	for i, step := range cycle {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%s (%s)", step.desc, step.pos)
+	}
+	return fmt.Errorf("%s", sb.String())
+}
+
+// cycleNotes points at every step of a cycle after the first, which is where the error is reported.
+func cycleNotes(cycle []cycleStep) (notes []token.Related) {
+	for _, step := range cycle[1:] {
+		notes = append(notes, token.Related{Pos: step.pos, Msg: step.desc})
+	}
+	return
+}
+
+// checkImportCycles reports every cycle in the imports of the modules reachable from mod.
+func (t *Tracer) checkImportCycles(mod *ast.Module) {
+	var (
+		stack   []cycleStep
+		onStack = make(map[string]int) // index in stack of the first import made by a module being visited
+		visited = make(map[string]bool)
+	)
+	var visit func(name string)
+	visit = func(name string) {
+		cached := t.modCache.Lookup(name)
+		if cached == nil || cached.Mod == nil {
+			return // unknown modules are reported by checkImports
+		}
+		visited[name] = true
+		onStack[name] = len(stack)
+		for _, imp := range cached.Mod.Imports {
+			next := imp.ModuleName.Value
+			stack = append(stack, cycleStep{
+				desc: fmt.Sprintf("%v imports %v", name, next),
+				pos:  cached.File.Position(imp.Pos()),
+			})
+			if start, ok := onStack[next]; ok {
+				t.errorAt(stack[start].pos, CodeImportCycle, formatCycle("import cycle", stack[start:])).Related = cycleNotes(stack[start:])
+			} else if !visited[next] {
+				visit(next)
+			}
+			stack = stack[:len(stack)-1]
+		}
+		delete(onStack, name)
+	}
+	visit(mod.Name.Value)
+}
+
+// checkRecursion reports every cycle of pipes calling each other in the traced modules.
+func (t *Tracer) checkRecursion() {
+	var (
+		pipes []*ast.PipeDecl
+		files = make(map[*ast.PipeDecl]*token.File)
+	)
+	names := make([]string, 0, len(t.modCache.Modules))
+	for name := range t.modCache.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cached := t.modCache.Modules[name]
+		if !cached.IsLoaded() || cached.Mod == nil {
+			continue
+		}
+		for _, decl := range cached.Mod.DefinedBlocks {
+			if pipe, ok := decl.(*ast.PipeDecl); ok && pipe.BodyDAG != nil {
+				pipes = append(pipes, pipe)
+				files[pipe] = cached.File
+			}
+		}
+	}
+
+	var (
+		stack   []cycleStep
+		onStack = make(map[*ast.PipeDecl]int) // index in stack of the first call made by a pipe being visited
+		visited = make(map[*ast.PipeDecl]bool)
+	)
+	var visit func(pipe *ast.PipeDecl)
+	visit = func(pipe *ast.PipeDecl) {
+		visited[pipe] = true
+		onStack[pipe] = len(stack)
+		for _, block := range pipe.BodyDAG.Blocks {
+			called, ok := block.(*ast.PipeBlock)
+			if !ok || called.Decl.BodyDAG == nil {
+				continue
+			}
+			call := called.CreatedBy()
+			callName := called.Decl.BlockName()
+			if c, ok := call.(*ast.CallExpr); ok {
+				callName = c.Name.FullName()
+			}
+			stack = append(stack, cycleStep{
+				desc: fmt.Sprintf("%v calls %v", pipe.BlockName(), callName),
+				pos:  files[pipe].Position(call.Pos()),
+			})
+			if start, ok := onStack[called.Decl]; ok {
+				t.errorAt(stack[start].pos, CodeRecursivePipe, formatCycle("recursive pipe", stack[start:])).Related = cycleNotes(stack[start:])
+			} else if !visited[called.Decl] {
+				visit(called.Decl)
+			}
+			stack = stack[:len(stack)-1]
+		}
+		delete(onStack, pipe)
+	}
+	for _, pipe := range pipes {
+		if !visited[pipe] {
+			visit(pipe)
+		}
+	}
+}
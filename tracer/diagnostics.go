@@ -0,0 +1,266 @@
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// warn records a problem that does not stop the program from running, like a symbol that is never used.
+func (t *Tracer) warn(pos token.Pos, code string, err error) *token.Error {
+	w := &token.Error{Pos: t.tracingFile.Position(pos), Msg: err, Severity: token.SeverityWarning, Code: code}
+	t.warnings = append(t.warnings, w)
+	return w
+}
+
+// Warnings returns the warnings found by the last call to TraceModule, sorted by position.
+func (t *Tracer) Warnings() token.ErrorList {
+	t.warnings.Sort()
+	return t.warnings
+}
+
+// checkPipe reports the parts of a traced pipe body that are never used or never connected: symbols that are
+// assigned but never read, outputs of blocks that are never consumed (unless discarded with _) and outputs of the
+// pipe that are never assigned are warnings. Inputs of blocks that are not connected are errors, since the block
+// would never receive a value.
+func (t *Tracer) checkPipe(state *pipeTrace) {
+	for _, ident := range state.assigned {
+		if !state.used[ident.V] {
+			w := t.warn(ident.Pos(), CodeUnusedSymbol, fmt.Errorf("%v is assigned but never used", ident.V))
+			w.Fixes = append(w.Fixes, t.replaceFix("discard the value with _", ident, wildcard))
+			// the outputs assigned to the symbol are already reported by the symbol
+			for _, loc := range locsOf(state.symbolTable[ident.V]) {
+				state.discarded[loc] = true
+			}
+		}
+	}
+
+	graph := &state.Graph
+	for i, block := range graph.Blocks {
+		name, inputs, outputs := describeBlock(block)
+		for port := range inputs {
+			if _, ok := graph.Producer(ast.Loc{Block: ast.BlockIdx(i), Port: ast.PortIdx(port)}); !ok {
+				err := t.error(block.CreatedBy().Pos(), CodeMissingArgument, fmt.Errorf("missing argument for input %v of %v", inputs[port], name))
+				err.Related = t.portNote(block, ast.PortIdx(port), true)
+			}
+		}
+		for port := range block.OutPorts() {
+			loc := ast.Loc{Block: ast.BlockIdx(i), Port: ast.PortIdx(port)}
+			if state.discarded[loc] || len(graph.Consumers(loc)) > 0 {
+				continue
+			}
+			if outputs == nil {
+				t.warn(block.CreatedBy().Pos(), CodeUnusedValue, fmt.Errorf("value is never used"))
+			} else {
+				t.warn(block.CreatedBy().Pos(), CodeUnusedValue, fmt.Errorf("output %v of %v is never used", outputs[port], name))
+			}
+		}
+	}
+
+	if state.Decl.IsPure() {
+		t.checkPure(state)
+	}
+
+	for port, field := range state.Decl.Outputs.Fields {
+		if _, ok := graph.Producer(ast.Loc{Block: ast.RootBlock, Port: ast.PortIdx(port)}); !ok {
+			t.warn(field.Key.Pos(), CodeUnassignedOutput, fmt.Errorf("output %v of %v is never assigned", field.Key.V, state.Decl.BlockName()))
+		}
+	}
+}
+
+// checkPure reports the calls in a pure pipe of blocks that are not pure. Pipe values are never known to be pure,
+// since pipe types cannot be marked pure.
+func (t *Tracer) checkPure(state *pipeTrace) {
+	for _, block := range state.Graph.Blocks {
+		var decl ast.BlockDecl
+		switch b := block.(type) {
+		case *ast.StubBlock:
+			decl = b.Decl
+		case *ast.PipeBlock:
+			decl = b.Decl
+		case *ast.ApplyBlock:
+			t.error(b.CreatedBy().Pos(), CodeImpureCall, fmt.Errorf("pure pipe %v cannot call pipe value %v",
+				state.Decl.BlockName(), b.CreatedBy().(*ast.CallExpr).Name.V))
+			continue
+		default:
+			continue
+		}
+		if !decl.IsPure() {
+			err := t.error(block.CreatedBy().Pos(), CodeImpureCall, fmt.Errorf("pure pipe %v calls %v, which is not pure",
+				state.Decl.BlockName(), decl.BlockName()))
+			if pos, ok := t.declPosition(decl, decl.Pos()); ok {
+				err.Related = []token.Related{{Pos: pos, Msg: fmt.Sprintf("%v is declared here", decl.BlockName())}}
+			}
+		}
+	}
+}
+
+// describeBlock returns the names of a block and its ports to be used in messages. Blocks without named ports
+// (literals, built-ins, pipe values) have nil inputs and outputs. The inputs of built-ins are always connected
+// unless an error has already been reported for their arguments.
+func describeBlock(block ast.Block) (name string, inputs []string, outputs []string) {
+	switch b := block.(type) {
+	case *ast.PipeBlock:
+		return b.Decl.BlockName(), fieldNames(b.Decl.BlockInputs()), fieldNames(b.Decl.BlockOutputs())
+	case *ast.StubBlock:
+		return b.Decl.BlockName(), fieldNames(b.Decl.BlockInputs()), fieldNames(b.Decl.BlockOutputs())
+	case *ast.ApplyBlock:
+		// the first input is the pipe being called
+		inputs = append([]string{"pipe"}, fieldNames(&b.Type.Inputs)...)
+		return b.CreatedBy().(*ast.CallExpr).Name.V, inputs, fieldNames(&b.Type.Outputs)
+	case *ast.BuiltinBlock:
+		return string(b.Op), nil, nil
+	default:
+		return "", nil, nil
+	}
+}
+
+func fieldNames(fields *ast.FieldList) (names []string) {
+	if fields == nil {
+		return nil
+	}
+	for _, field := range fields.Fields {
+		names = append(names, field.Key.V)
+	}
+	return
+}
+
+// locsOf returns every source of values in out.
+func locsOf(out output) (locs []ast.Loc) {
+	switch o := out.(type) {
+	case oneOutput:
+		return []ast.Loc{o.From}
+	case outputBundle:
+		for _, name := range o.Names {
+			locs = append(locs, locsOf(o.Outputs[name])...)
+		}
+	}
+	return
+}
+
+// declPosition finds the position of pos in the file of the module that declares decl, which may not be the module
+// being traced.
+func (t *Tracer) declPosition(decl ast.BlockDecl, pos token.Pos) (token.Position, bool) {
+	for _, cached := range t.modCache.Modules {
+		if cached.Mod == nil {
+			continue
+		}
+		for _, other := range cached.Mod.DefinedBlocks {
+			if other == decl {
+				return cached.File.Position(pos), true
+			}
+		}
+	}
+	return token.Position{}, false
+}
+
+// portNote points at the declaration of a port of the stub or pipe called by block, if there is one.
+func (t *Tracer) portNote(block ast.Block, port ast.PortIdx, input bool) []token.Related {
+	var decl ast.BlockDecl
+	switch b := block.(type) {
+	case *ast.StubBlock:
+		decl = b.Decl
+	case *ast.PipeBlock:
+		decl = b.Decl
+	default:
+		return nil
+	}
+	fields, kind := decl.BlockOutputs(), "output"
+	if input {
+		fields, kind = decl.BlockInputs(), "input"
+	}
+	if int(port) >= len(fields.Fields) {
+		return nil
+	}
+	field := fields.Fields[port]
+	pos, ok := t.declPosition(decl, field.Pos())
+	if !ok {
+		return nil
+	}
+	return []token.Related{{Pos: pos, Msg: fmt.Sprintf("%v %v of %v is declared here", kind, field.Key.V, decl.BlockName())}}
+}
+
+// replaceFix is a fix replacing node in the file being traced with text.
+func (t *Tracer) replaceFix(msg string, node ast.Node, text string) token.Fix {
+	return token.Fix{Msg: msg, Edits: []token.TextEdit{{
+		Pos:     t.tracingFile.Position(node.Pos()),
+		End:     t.tracingFile.Position(node.End()),
+		NewText: text,
+	}}}
+}
+
+// suggest returns the candidate closest to name if it is close enough to be a likely typo, e.g. Filter for Fitler.
+func suggest(name string, candidates []string) (string, bool) {
+	best, bestDist := "", len(name)/3+1
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		if d := editDistance(name, c); d < bestDist || (d == bestDist && best != "" && c < best) {
+			best, bestDist = c, d
+		}
+	}
+	return best, best != ""
+}
+
+// editDistance is the number of single letter insertions, deletions, substitutions and swaps of adjacent letters
+// needed to turn a into b.
+func editDistance(a, b string) int {
+	dist := make([][]int, len(a)+1)
+	for i := range dist {
+		dist[i] = make([]int, len(b)+1)
+		dist[i][0] = i
+	}
+	for j := range dist[0] {
+		dist[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			dist[i][j] = min(dist[i-1][j]+1, dist[i][j-1]+1, dist[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				dist[i][j] = min(dist[i][j], dist[i-2][j-2]+1)
+			}
+		}
+	}
+	return dist[len(a)][len(b)]
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// suggestName adds a fix to err replacing ident with the candidate closest to it, if there is one.
+func (t *Tracer) suggestName(err *token.Error, ident *ast.Ident, candidates []string) {
+	if name, ok := suggest(ident.V, candidates); ok {
+		fix := t.replaceFix(fmt.Sprintf("did you mean %v?", name), ident, name)
+		fix.Edits[0].Pos = t.tracingFile.Position(ident.Pos()) // keep the qualifier of imported names
+		err.Fixes = append(err.Fixes, fix)
+	}
+}
+
+// localNames are the names that an unqualified identifier can refer to in the pipe being traced.
+func (t *Tracer) localNames(state *pipeTrace) []string {
+	names := []string{string(ast.MergeBuiltin), string(ast.IntBuiltin), string(ast.FloatBuiltin), string(ast.StringBuiltin)}
+	for name := range state.symbolTable {
+		names = append(names, name)
+	}
+	return append(names, declNames(t.tracingMod)...)
+}
+
+func declNames(mod *ast.Module) (names []string) {
+	for _, decl := range mod.DefinedBlocks {
+		names = append(names, decl.BlockName())
+	}
+	return
+}
@@ -0,0 +1,304 @@
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// Ports of pipes can be declared without a type:
+//
+//	pipe Double(x) (y) { y = Mul(x, 2) }
+//
+// Each of them is given a type variable when the module is traced, and the variable is unified with every type it
+// is connected to. Here x is unified with the first input of the stub Mul, so it becomes int. The types are inferred
+// for the whole program at once, so a variable can also be decided by the argument a pipe is called with.
+//
+// Once every module is traced, the inferred types replace the variables in the graphs and in the Inferred field of
+// the ports. A variable that is never connected to a known type is an error.
+type inference struct {
+	vars     []typeVar
+	bindings map[ast.EdgeType]typeBinding // type a variable has been unified with
+	scalars  []typeCheck                  // variables that are interpolated or converted, which must be scalars
+}
+
+// typeCheck is a variable that is checked once its type is inferred.
+type typeCheck struct {
+	Type ast.EdgeType
+	Pos  token.Position
+	What string // what is done with the value, e.g. "interpolate"
+}
+
+// typeVar is the type variable of a port declared without a type.
+type typeVar struct {
+	Type  ast.EdgeType
+	Field *ast.Field
+	Desc  string // e.g. "input x of Double"
+	Pos   token.Position
+}
+
+// typeBinding remembers why a variable was decided to be a type, so it can be explained if it conflicts later.
+type typeBinding struct {
+	Type ast.EdgeType
+	Why  string // the use that decided the type, e.g. "input a of B"
+	Pos  token.Position
+}
+
+// declareVars gives every port of decl declared without a type a new type variable.
+func (t *Tracer) declareVars(decl ast.BlockDecl) {
+	declare := func(fields *ast.FieldList, kind string) {
+		for _, field := range fields.Fields {
+			if field.Value != nil {
+				continue
+			}
+			v := ast.TypeVar(len(t.types.vars) + 1)
+			field.Inferred = v
+			t.types.vars = append(t.types.vars, typeVar{
+				Type:  v,
+				Field: field,
+				Desc:  fmt.Sprintf("%v %v of %v", kind, field.Key.V, decl.BlockName()),
+				Pos:   t.tracingFile.Position(field.Pos()),
+			})
+		}
+	}
+	declare(decl.BlockInputs(), "input")
+	declare(decl.BlockOutputs(), "output")
+}
+
+// checkPortTypes reports the ports of decl that have no type if untyped is false. The ports of pipe types must always
+// have types, since there is no body to infer them from.
+func (t *Tracer) checkPortTypes(decl ast.BlockDecl, untyped bool) {
+	t.checkTyped(decl.BlockInputs(), decl.BlockName(), untyped)
+	t.checkTyped(decl.BlockOutputs(), decl.BlockName(), untyped)
+}
+
+func (t *Tracer) checkTyped(fields *ast.FieldList, what string, untyped bool) {
+	for _, field := range fields.Fields {
+		if field.Value == nil {
+			if !untyped {
+				t.error(field.Pos(), CodeMissingType, fmt.Errorf("missing type for %v of %v", field.Key.V, what))
+			}
+			continue
+		}
+		ast.Walk(field.Value, func(n ast.Node) bool {
+			if typ, ok := n.(*ast.PipeType); ok {
+				t.checkTyped(&typ.Inputs, "pipe type", false)
+				t.checkTyped(&typ.Outputs, "pipe type", false)
+				t.checkDefaults(&typ.Inputs, false)
+				t.checkDefaults(&typ.Outputs, false)
+				return false
+			}
+			return true
+		})
+	}
+}
+
+// checkDefaults reports default values that are not allowed on fields or cannot be connected to their port. Only
+// the inputs of declared pipes and stubs may have defaults, which are given to the input when a call leaves it out.
+func (t *Tracer) checkDefaults(fields *ast.FieldList, allowed bool) {
+	for _, field := range fields.Fields {
+		if field.Default == nil {
+			continue
+		}
+		if !allowed {
+			t.error(field.Assign, CodeInvalidDefault, fmt.Errorf("%v cannot have a default value, only inputs of pipes and stubs can", field.Key.V))
+			continue
+		}
+		typ := ast.TypeOf(field.Value)
+		if lit := ast.LiteralType(field.Default); !lit.Widens(typ) {
+			t.error(field.Default.Pos(), CodeTypeMismatch, fmt.Errorf("cannot use %v value as default of %v: %v", lit, field.Key.V, typ))
+		}
+	}
+}
+
+// resolve replaces the variables in typ with the types they have been unified with so far.
+func (t *Tracer) resolve(typ ast.EdgeType) ast.EdgeType {
+	return typ.Subst(func(v ast.EdgeType) ast.EdgeType {
+		if b, ok := t.types.bindings[v]; ok {
+			return t.resolve(b.Type)
+		}
+		return v
+	})
+}
+
+// typeConflict is the error returned by unify, with a note for every use that decided the type of a variable
+// involved.
+type typeConflict struct {
+	Msg     string
+	Related []token.Related
+}
+
+func (c *typeConflict) Error() string { return c.Msg }
+
+// unify makes src and dst the same type by binding the variables in them. If they cannot be the same, the error
+// explains which earlier use decided the type of the variables involved.
+func (t *Tracer) unify(src, dst ast.EdgeType, srcWhy, dstWhy string, pos token.Pos) *typeConflict {
+	resolvedSrc, resolvedDst := t.resolve(src), t.resolve(dst)
+	if t.unifyResolved(resolvedSrc, resolvedDst, srcWhy, dstWhy, t.tracingFile.Position(pos)) {
+		return nil
+	}
+
+	conflict := &typeConflict{Msg: fmt.Sprintf("type mismatch: got %v, expected %v", t.resolve(src), t.resolve(dst))}
+	for _, v := range t.types.vars {
+		if !containsVar(src, v.Type) && !containsVar(dst, v.Type) {
+			continue
+		}
+		if b, ok := t.origin(v.Type); ok {
+			conflict.Msg += fmt.Sprintf(", %v is %v because of %v (%v)", v.Desc, t.resolve(v.Type), b.Why, b.Pos)
+			conflict.Related = append(conflict.Related, token.Related{
+				Pos: b.Pos,
+				Msg: fmt.Sprintf("%v is %v because of %v", v.Desc, t.resolve(v.Type), b.Why),
+			})
+		}
+	}
+	return conflict
+}
+
+// origin finds the binding that decided the type of v, skipping the bindings of v to other variables.
+func (t *Tracer) origin(v ast.EdgeType) (b typeBinding, ok bool) {
+	for {
+		next, found := t.types.bindings[v]
+		if !found {
+			return b, ok
+		}
+		b, ok = next, true
+		if !next.Type.IsVar() {
+			return b, ok
+		}
+		v = next.Type
+	}
+}
+
+func (t *Tracer) unifyResolved(src, dst ast.EdgeType, srcWhy, dstWhy string, pos token.Position) bool {
+	switch {
+	case src == dst:
+		return true
+	case src.IsVar():
+		return t.bind(src, dst, dstWhy, pos)
+	case dst.IsVar():
+		return t.bind(dst, src, srcWhy, pos)
+	case src.IsPipe() && dst.IsPipe():
+		srcIn, srcOut := src.PipePorts()
+		dstIn, dstOut := dst.PipePorts()
+		if len(srcIn) != len(dstIn) || len(srcOut) != len(dstOut) {
+			return false
+		}
+		for i := range srcIn {
+			if !t.unifyResolved(t.resolve(srcIn[i]), t.resolve(dstIn[i]), srcWhy, dstWhy, pos) {
+				return false
+			}
+		}
+		for i := range srcOut {
+			if !t.unifyResolved(t.resolve(srcOut[i]), t.resolve(dstOut[i]), srcWhy, dstWhy, pos) {
+				return false
+			}
+		}
+		return true
+	case src.IsRecord() && dst.IsRecord():
+		srcFields, dstFields := src.RecordFields(), dst.RecordFields()
+		if len(srcFields) != len(dstFields) {
+			return false
+		}
+		for name, typ := range srcFields {
+			other, ok := dstFields[name]
+			if !ok || !t.unifyResolved(t.resolve(typ), t.resolve(other), srcWhy, dstWhy, pos) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Tracer) bind(v, typ ast.EdgeType, why string, pos token.Position) bool {
+	if containsVar(typ, v) {
+		return false // a type cannot contain itself, e.g. ?1 = pipe(?1) ()
+	}
+	t.types.bindings[v] = typeBinding{Type: typ, Why: why, Pos: pos}
+	return true
+}
+
+func containsVar(typ, v ast.EdgeType) (found bool) {
+	typ.Subst(func(other ast.EdgeType) ast.EdgeType {
+		found = found || other == v
+		return other
+	})
+	return
+}
+
+// finishInference replaces the type variables in every traced graph with the types inferred for them, and reports
+// the ports whose types could not be inferred.
+func (t *Tracer) finishInference() {
+	if len(t.types.vars) == 0 {
+		return
+	}
+	for _, v := range t.types.vars {
+		typ := t.resolve(v.Type)
+		if typ.HasVars() {
+			t.errorAt(v.Pos, CodeCannotInfer, fmt.Errorf("cannot infer type of %v, add a type annotation", v.Desc))
+		}
+		v.Field.Inferred = typ
+	}
+	for _, check := range t.types.scalars {
+		if typ := t.resolve(check.Type); !typ.HasVars() && !typ.IsScalar() {
+			t.errorAt(check.Pos, CodeNotScalar, fmt.Errorf("cannot %v value of type %v, expected string, int or float", check.What, typ))
+		}
+	}
+
+	var substGraph func(graph *ast.Graph)
+	substGraph = func(graph *ast.Graph) {
+		graph.SubstTypes(t.resolve)
+		for _, block := range graph.Blocks {
+			if ref, ok := block.(*ast.PipeRefBlock); ok {
+				if lit, ok := ref.CreatedBy().(*ast.PipeLit); ok && lit.Decl.BodyDAG != nil {
+					substGraph(lit.Decl.BodyDAG)
+				}
+			}
+		}
+	}
+	for _, cached := range t.modCache.Modules {
+		if !cached.IsLoaded() || cached.Mod == nil {
+			continue
+		}
+		for _, decl := range cached.Mod.DefinedBlocks {
+			if pipe, ok := decl.(*ast.PipeDecl); ok && pipe.BodyDAG != nil {
+				substGraph(pipe.BodyDAG)
+			}
+		}
+	}
+}
+
+// describeSrc and describeDst name the two ends of an edge for type errors.
+func describeSrc(graph *ast.Graph, src ast.Loc) string {
+	if src.Block == ast.RootBlock {
+		return fmt.Sprintf("input %v", graph.Root.(*ast.PipeBlock).Decl.Inputs.Fields[src.Port].Key.V)
+	}
+	block := graph.Block(src.Block)
+	switch b := block.(type) {
+	case *ast.LiteralBlock:
+		if b.Lit.Type == token.String {
+			return fmt.Sprintf("literal %q", b.Lit.Value)
+		}
+		return fmt.Sprintf("literal %v", b.Lit.Value)
+	case *ast.PipeRefBlock:
+		return fmt.Sprintf("pipe %v", b.Decl.BlockName())
+	}
+	name, _, outputs := describeBlock(block)
+	if outputs == nil {
+		return fmt.Sprintf("output of %v", name)
+	}
+	return fmt.Sprintf("output %v of %v", outputs[src.Port], name)
+}
+
+func describeDst(graph *ast.Graph, dst ast.Loc) string {
+	if dst.Block == ast.RootBlock {
+		return fmt.Sprintf("output %v", graph.Root.(*ast.PipeBlock).Decl.Outputs.Fields[dst.Port].Key.V)
+	}
+	name, inputs, _ := describeBlock(graph.Block(dst.Block))
+	if inputs == nil {
+		return fmt.Sprintf("input of %v", name)
+	}
+	return fmt.Sprintf("input %v of %v", inputs[dst.Port], name)
+}
@@ -0,0 +1,182 @@
+package tracer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/parser"
+	"github.com/masp/hoser/token"
+)
+
+// SourceExt is the extension of hoser source files that are indexed in the include path.
+const SourceExt = ".hos"
+
+// Index is the module headers of the source files in an include path. It can be given to the tracers of any number of
+// programs with the same include path, which then do not search the include path again. Files changed after the
+// index is made are read as they are when a module is imported, but new and removed modules are not found.
+type Index struct {
+	modules ast.ModuleSet
+}
+
+// NewIndex searches the directories of includePath for modules.
+func NewIndex(includePath ...string) *Index {
+	index := &Index{modules: ast.EmptyModuleSet()}
+	indexDirs(&index.modules, includePath)
+	return index
+}
+
+// indexIncludePath finds every module in the include path, or copies the modules of Index if it is set.
+func (t *Tracer) indexIncludePath() {
+	if t.indexed {
+		return
+	}
+	t.indexed = true
+
+	if t.Index == nil {
+		indexDirs(&t.modCache, t.IncludePath)
+		return
+	}
+	for name, cached := range t.Index.modules.Modules {
+		copied := *cached // the tracer loads modules into its own copy
+		copied.Duplicates = copied.Duplicates[:len(copied.Duplicates):len(copied.Duplicates)]
+		t.modCache.Modules[name] = &copied
+	}
+}
+
+// indexDirs adds every module in dirs to set by parsing only the module header of each source file. The rest of the
+// file is parsed when the module is first imported. Directories and files that cannot be read are skipped like files
+// that are not modules, so they only cause an error if a module that cannot be found is imported.
+func indexDirs(set *ast.ModuleSet, dirs []string) {
+	for _, dir := range dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // the entry or the directory cannot be read, the walk goes on with the next
+			}
+			if d.IsDir() || filepath.Ext(path) != SourceExt {
+				return nil
+			}
+
+			src, err := os.ReadFile(path)
+			if err != nil || len(src) == 0 {
+				return nil
+			}
+			file := token.NewFile(path, len(src))
+			header, err := parser.ParseModuleHeader(&file, src)
+			if err != nil {
+				// files that aren't modules are not indexed, the error is reported if the module is imported
+				return nil
+			}
+			set.IndexFile(&file, header)
+			return nil
+		})
+	}
+}
+
+// checkImports reports every import of mod that cannot be found in the include path, or that is declared by more
+// than one file of it.
+func (t *Tracer) checkImports(mod *ast.Module) {
+	for _, imp := range mod.Imports {
+		cached := t.modCache.Lookup(imp.ModuleName.Value)
+		if cached == nil {
+			t.error(imp.ModuleName.Pos(), CodeUnknownModule, fmt.Errorf("unknown module %q, not found in include path", imp.ModuleName.Value))
+			continue
+		}
+		if len(cached.Duplicates) > 0 {
+			notes := []token.Related{{Pos: declaredAt(cached), Msg: fmt.Sprintf("module %q is declared here", imp.ModuleName.Value)}}
+			for _, dup := range cached.Duplicates {
+				notes = append(notes, token.Related{Pos: declaredAt(dup), Msg: fmt.Sprintf("module %q is declared again here", imp.ModuleName.Value)})
+			}
+			files := make([]string, len(notes))
+			for i, note := range notes {
+				files[i] = note.Pos.String()
+			}
+			t.error(imp.ModuleName.Pos(), CodeDuplicateModule, fmt.Errorf("module %q is declared by more than one file: %s",
+				imp.ModuleName.Value, strings.Join(files, ", "))).Related = notes
+		}
+	}
+}
+
+// declaredAt is the position of the name in the header of a module.
+func declaredAt(cached *ast.CachedModule) token.Position {
+	return cached.File.Position(cached.Mod.Name.Pos())
+}
+
+// loadModule parses and traces the module with the full name if it has not been already.
+func (t *Tracer) loadModule(fullName string) *ast.Module {
+	cached := t.modCache.Lookup(fullName)
+	if cached == nil {
+		return nil
+	}
+	if cached.IsLoaded() {
+		return cached.Mod // nil if the module failed to parse
+	}
+
+	if mod := t.loadCached(fullName); mod != nil {
+		return mod
+	}
+	src, err := t.source(cached.File.Name)
+	if err != nil {
+		t.errorAt(token.Position{Filename: cached.File.Name}, CodeIncludePath, err)
+		return nil
+	}
+	file := token.NewFile(cached.File.Name, len(src))
+	mod, err := parser.ParseModule(&file, src)
+	if err != nil {
+		if list, ok := err.(token.ErrorList); ok {
+			t.errors = append(t.errors, list...)
+		} else {
+			t.errors.Add(token.Position{Filename: file.Name}, err)
+		}
+		// don't parse again and report the same errors for every import
+		cached.Loaded, cached.Mod = true, nil
+		return nil
+	}
+	cached.File = &file
+	t.modCache.LoadModule(mod)
+	t.traced = append(t.traced, fullName)
+	t.traceModule(&file, mod)
+	return mod
+}
+
+// lookupImported resolves a qualified name like grep.Filter to the declaration in the imported module. Errors are
+// reported if the module is not imported or the declaration cannot be found.
+func (t *Tracer) lookupImported(name *ast.Ident) ast.BlockDecl {
+	imp := t.tracingMod.Import(name.Module)
+	if imp == nil {
+		t.error(name.ModulePos, CodeNotImported, fmt.Errorf("module %v is not imported", name.Module))
+		return nil
+	}
+
+	// the imported module is traced with its own file, so the current one is restored after
+	mod, file := t.tracingMod, t.tracingFile
+	imported := t.loadModule(imp.ModuleName.Value)
+	t.tracingMod, t.tracingFile = mod, file
+	if imported == nil {
+		// the error is reported for the import by checkImports
+		return nil
+	}
+
+	decl := imported.Lookup(name.V)
+	if decl == nil {
+		err := t.error(name.Pos(), CodeUnknownName, fmt.Errorf("module %v has no pipe or stub named %v", name.Module, name.V))
+		t.suggestName(err, name, declNames(imported))
+	}
+	return decl
+}
+
+// lookupDecl finds the pipe or stub called name in the module being traced or in the modules it imports.
+func (t *Tracer) lookupDecl(name *ast.Ident) ast.BlockDecl {
+	if name.Local() {
+		return t.tracingMod.Lookup(name.V)
+	}
+	return t.lookupImported(name)
+}
+
+// ModuleSet is every module that has been found in the include path and the modules that have been traced.
+func (t *Tracer) ModuleSet() *ast.ModuleSet {
+	return &t.modCache
+}
@@ -6,9 +6,16 @@ import (
 	"github.com/masp/hoser/token"
 )
 
-func NewTracer() *Tracer {
+// NewTracer creates a tracer that finds imported modules in the directories of includePath.
+func NewTracer(includePath ...string) *Tracer {
 	return &Tracer{
-		modCache: ast.EmptyModuleSet(),
+		IncludePath: includePath,
+		modCache:    ast.EmptyModuleSet(),
+		keys:        make(map[string]string),
+		sources:     make(map[string][]byte),
+		fromCache:   make(map[string]bool),
+		refs:        make(map[*ast.Ident]ast.Node),
+		types:       inference{bindings: make(map[ast.EdgeType]typeBinding)},
 	}
 }
 
@@ -17,14 +24,36 @@ func NewTracer() *Tracer {
 // expanding it into a single graph which is done by the runtime.
 //
 // If an external module is referenced, it wil lbe found under includeDir (recursively), parsed, and traced recursively
-// until only stubs and literal blocks remain.
+// until only stubs and literal blocks remain. The include path is only searched if main imports a module.
 func (t *Tracer) TraceModule(file *token.File, src []byte) (module *ast.Module, err error) {
 	module, err = parser.ParseModule(file, src)
 	if err != nil {
 		return
 	}
+	return t.TraceParsed(file, module, src)
+}
+
+// TraceParsed traces a module like TraceModule, for a module that has already been parsed from src without errors.
+func (t *Tracer) TraceParsed(file *token.File, parsed *ast.Module, src []byte) (module *ast.Module, err error) {
+	module = parsed
 	defer t.handleErrors(&err)
-	t.traceModule(file, module)
+	if len(module.Imports) > 0 {
+		t.indexIncludePath()
+	}
+	t.sources[file.Name] = src
+	// the main module may also be in the include path, where only its header was scanned
+	t.modCache.IndexFile(file, module).File = file
+	if cached := t.loadCached(module.Name.Value); cached != nil {
+		module = cached
+	} else {
+		t.modCache.LoadModule(module)
+		t.traced = append(t.traced, module.Name.Value)
+		t.traceModule(file, module)
+	}
+	t.finishInference()
+	t.checkImportCycles(module)
+	t.checkRecursion()
+	t.storeTraced()
 	return
 }
 
@@ -42,19 +71,27 @@ func (t *Tracer) handleErrors(err *error) {
 
 type bailout struct{}
 
-func (t *Tracer) error(pos token.Pos, err error) {
+// error reports an error at pos in the file being traced. The returned Error can be given related positions and
+// fixes, even if it is discarded.
+func (t *Tracer) error(pos token.Pos, code string, err error) *token.Error {
 	epos := t.tracingFile.Position(pos)
 
 	// If AllErrors is not set, discard errors reported on the same line
 	// as the last recorded error and stop parsing if there are more than
 	// 10 errors.
 	n := len(t.errors)
-	if n > 0 && t.errors[n-1].Pos.Line == epos.Line {
-		return // discard - likely a spurious error
+	if n > 0 && t.errors[n-1].Pos.Filename == epos.Filename && t.errors[n-1].Pos.Line == epos.Line {
+		return &token.Error{Pos: epos, Msg: err, Code: code} // discard - likely a spurious error
 	}
 	if n > 10 {
 		panic(bailout{})
 	}
+	return t.errorAt(epos, code, err)
+}
 
-	t.errors.Add(epos, err)
+// errorAt reports an error at a position that may be in another file than the one being traced.
+func (t *Tracer) errorAt(pos token.Position, code string, err error) *token.Error {
+	e := &token.Error{Pos: pos, Msg: err, Code: code}
+	t.errors = append(t.errors, e)
+	return e
 }
@@ -0,0 +1,33 @@
+package tracer
+
+import (
+	"github.com/masp/hoser/ast"
+)
+
+// Refs maps every identifier traced from source to what it refers to:
+//
+//   - the *ast.PipeDecl or *ast.StubDecl of a call, a pipe passed by name or the name of a declaration
+//   - the *ast.Field of a port, for the ports of a signature, the inputs used in a body, the outputs assigned in a
+//     body and the names of named arguments
+//   - the *ast.Ident where a symbol is first assigned, for the symbol and every use of it
+//
+// Built-ins, the wildcard _ and identifiers that could not be resolved have no entry. Modules loaded from a
+// ModuleCache are not traced again, so their identifiers have no entries either.
+func (t *Tracer) Refs() map[*ast.Ident]ast.Node {
+	return t.refs
+}
+
+func (t *Tracer) refer(ident *ast.Ident, to ast.Node) {
+	if to != nil {
+		t.refs[ident] = to
+	}
+}
+
+// referPorts records the ports of a signature as referring to themselves.
+func (t *Tracer) referPorts(decl ast.BlockDecl) {
+	for _, fields := range []*ast.FieldList{decl.BlockInputs(), decl.BlockOutputs()} {
+		for _, field := range fields.Fields {
+			t.refer(field.Key, field)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/masp/hoser/ast"
+	"github.com/masp/hoser/token"
+)
+
+// checkDecls reports the names that are declared more than once in a module: imports with the same qualifier,
+// pipes and stubs with the same name, and ports with the same name in a signature or type.
+func (t *Tracer) checkDecls(mod *ast.Module) {
+	imports := make(map[string]*ast.ImportDecl)
+	for _, imp := range mod.Imports {
+		if first, ok := imports[imp.Qualifier()]; ok {
+			err := t.error(imp.ModuleName.Pos(), CodeDuplicateImport, fmt.Errorf("%v is already imported at %v", imp.Qualifier(), t.tracingFile.Position(first.ModuleName.Pos())))
+			err.Related = t.firstNote(first.ModuleName.Pos())
+			continue
+		}
+		imports[imp.Qualifier()] = imp
+	}
+
+	decls := make(map[string]ast.BlockDecl)
+	for _, decl := range mod.DefinedBlocks {
+		name := decl.BlockName()
+		if first, ok := decls[name]; ok {
+			err := t.error(decl.Pos(), CodeRedeclared, fmt.Errorf("%v redeclared in this module, first declared at %v", name, t.tracingFile.Position(first.Pos())))
+			err.Related = t.firstNote(first.Pos())
+		} else {
+			decls[name] = decl
+		}
+		t.checkPorts(decl.BlockInputs(), decl.BlockOutputs())
+	}
+}
+
+// checkPorts reports ports with the same name in the inputs and outputs of a signature, and fields with the same
+// name in the types of the ports.
+func (t *Tracer) checkPorts(inputs, outputs *ast.FieldList) {
+	t.checkFieldNames(inputs, outputs)
+	for _, fields := range []*ast.FieldList{inputs, outputs} {
+		for _, field := range fields.Fields {
+			if field.Value == nil {
+				continue
+			}
+			ast.Walk(field.Value, func(n ast.Node) bool {
+				switch typ := n.(type) {
+				case *ast.PipeType:
+					t.checkPorts(&typ.Inputs, &typ.Outputs)
+					return false
+				case *ast.FieldList:
+					t.checkFieldNames(typ)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// checkFieldNames reports the keys that are repeated across all of lists.
+func (t *Tracer) checkFieldNames(lists ...*ast.FieldList) {
+	seen := make(map[string]*ast.Field)
+	for _, fields := range lists {
+		for _, field := range fields.Fields {
+			if first, ok := seen[field.Key.V]; ok {
+				err := t.error(field.Key.Pos(), CodeDuplicateName, fmt.Errorf("duplicate name %v, first declared at %v", field.Key.V, t.tracingFile.Position(first.Key.Pos())))
+				err.Related = t.firstNote(first.Key.Pos())
+				continue
+			}
+			seen[field.Key.V] = field
+		}
+	}
+}
+
+// define records that a symbol is defined at pos in the pipe being traced. A symbol can only be defined once in a
+// pipe, since every use of it must refer to the same stream of values. Defining a symbol with the name of a pipe,
+// stub or built-in hides it in the rest of the pipe, which is reported as a warning if WarnShadow is set.
+func (t *Tracer) define(name string, pos token.Pos, state *pipeTrace) bool {
+	if first, ok := state.defined[name]; ok {
+		err := t.error(pos, CodeRedefined, fmt.Errorf("%v is already defined at %v", name, t.tracingFile.Position(first)))
+		err.Related = t.firstNote(first)
+		return false
+	}
+	state.defined[name] = pos
+
+	if !t.WarnShadow {
+		return true
+	}
+	if decl := t.tracingMod.Lookup(name); decl != nil {
+		w := t.warn(pos, CodeShadow, fmt.Errorf("%v shadows %v declared at %v", name, name, t.tracingFile.Position(decl.Pos())))
+		w.Related = t.firstNote(decl.Pos())
+	} else if _, ok := ast.LookupBuiltin(name); ok {
+		t.warn(pos, CodeShadow, fmt.Errorf("%v shadows the built-in %v", name, name))
+	}
+	return true
+}
+
+// firstNote points at the first declaration of a name that is declared again.
+func (t *Tracer) firstNote(pos token.Pos) []token.Related {
+	return []token.Related{{Pos: t.tracingFile.Position(pos), Msg: "first declared here"}}
+}
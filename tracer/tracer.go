@@ -24,38 +24,47 @@ var NilOutput output = nil
 // Given a block like `A() (v: int)` called like `v = A()`, v would have a `portOutput` value.
 type oneOutput struct {
 	From ast.Loc
+	Name string // name of the port or field the output comes from, empty if it has none (e.g. a literal)
 }
 
 // outputBundle is a bundle of outputs, usually when a block returns multiple values.
 //  Given a block like `A() (v1: int, v2: int)` called like `v = A()`, v would be `manyOutput` with {v1, v2}.
 type outputBundle struct {
 	Outputs map[string]output
+	Names   []string // names of Outputs in the order they are declared
 }
 
-func (o oneOutput) output()    {}
-func (o outputBundle) output() {}
+// invalidOutput is the output of an expression whose error has already been reported, e.g. the names of a tuple
+// pattern that does not match its right side. Using it reports nothing more, so that one mistake is one error.
+type invalidOutput struct{}
 
-func makeOutputBundle(block ast.BlockIdx, decl ast.BlockDecl) output {
-	if decl.BlockOutputs() == nil {
+func (o oneOutput) output()     {}
+func (o outputBundle) output()  {}
+func (o invalidOutput) output() {}
+
+func makeOutputBundle(block ast.BlockIdx, outputs *ast.FieldList) output {
+	if outputs == nil {
 		return NilOutput
 	}
 
-	switch len(decl.BlockOutputs().Fields) {
+	switch len(outputs.Fields) {
 	case 0:
 		return NilOutput
 	case 1:
-		return oneOutput{From: ast.Loc{Block: block, Port: 0}}
+		return oneOutput{From: ast.Loc{Block: block, Port: 0}, Name: outputs.Fields[0].Key.V}
 	default:
-		bundle := make(map[string]output)
-		for port, field := range decl.BlockOutputs().Fields {
-			bundle[field.Key.V] = oneOutput{
+		bundle := outputBundle{Outputs: make(map[string]output)}
+		for port, field := range outputs.Fields {
+			bundle.Outputs[field.Key.V] = oneOutput{
 				From: ast.Loc{
 					Block: block,
 					Port:  ast.PortIdx(port),
 				},
+				Name: field.Key.V,
 			}
+			bundle.Names = append(bundle.Names, field.Key.V)
 		}
-		return outputBundle{Outputs: bundle}
+		return bundle
 	}
 }
 
@@ -74,34 +83,126 @@ func makeOutputBundle(block ast.BlockIdx, decl ast.BlockDecl) output {
 //
 // The end product is a fully connected set of DAGs with the only terminal blocks being stubs (defined in Go) and literal blocks.
 type Tracer struct {
+	IncludePath []string    // directories searched recursively for imported modules
+	Index       *Index      // modules of IncludePath found before, nil to search it when a module is imported
+	WarnShadow  bool        // warn when a symbol hides a pipe, stub or built-in with the same name
+	Cache       ModuleCache // traced modules kept between runs, nil to always trace every module
+
 	modCache ast.ModuleSet
+	indexed  bool // true once the include path has been indexed
+
+	keys      map[string]string // cache key of each module, "" if it cannot be cached
+	sources   map[string][]byte // source of each file that has been read
+	fromCache map[string]bool   // modules loaded from the cache instead of traced
+	traced    []string          // modules traced by this tracer, in the order they are traced
+	refs      map[*ast.Ident]ast.Node
 
 	tracingMod  *ast.Module
 	tracingFile *token.File
 
-	errors token.ErrorList
+	types    inference
+	errors   token.ErrorList
+	warnings token.ErrorList
 }
 
 func (t *Tracer) expectedError(node ast.Node, msg string) {
-	t.error(node.Pos(), fmt.Errorf("expected %v, got %T", msg, node))
+	t.error(node.Pos(), CodeInvalidPattern, fmt.Errorf("expected %v, got %T", msg, node))
 }
 
 func (t *Tracer) connect(src ast.Loc, dst ast.Loc, graph *ast.Graph) {
-	var srcType, dstType ast.EdgeType
-	srcBlock := graph.Blocks[src.Block]
-	dstBlock := graph.Blocks[dst.Block]
-	srcType = srcBlock.OutPorts()[src.Port]
-	dstType = dstBlock.InPorts()[dst.Port]
-	if srcType != dstType {
-		t.error(dstBlock.CreatedBy().Pos(), fmt.Errorf("type mismatch: got %v, expected %v", srcType, dstType))
+	srcType := graph.SrcType(src)
+	dstType := graph.DstType(dst)
+	if rs, rd := t.resolve(srcType), t.resolve(dstType); rs != rd && !rs.HasVars() && !rd.HasVars() && rs.Widens(rd) {
+		t.convert(src, dst, rs, rd, graph)
+		return
+	}
+	if srcType.HasVars() || dstType.HasVars() {
+		// the edge keeps the variable, it is replaced once the types of the whole program are inferred
+		pos := graph.Block(dst.Block).CreatedBy().Pos()
+		if dst.Block == ast.RootBlock && src.Block != ast.RootBlock {
+			pos = graph.Block(src.Block).CreatedBy().Pos()
+		}
+		if conflict := t.unify(srcType, dstType, describeSrc(graph, src), describeDst(graph, dst), pos); conflict != nil {
+			t.error(pos, CodeTypeMismatch, conflict).Related = conflict.Related
+			return
+		}
+	} else if srcType != dstType {
+		err := t.error(graph.Block(dst.Block).CreatedBy().Pos(), CodeTypeMismatch, fmt.Errorf("type mismatch: got %v, expected %v", srcType, dstType))
+		if dst.Block != ast.RootBlock {
+			err.Related = t.portNote(graph.Block(dst.Block), dst.Port, true)
+		}
+		if fix, ok := t.convertFix(graph, src, srcType, dstType); ok {
+			err.Fixes = append(err.Fixes, fix)
+		}
+		return
+	}
+	if _, ok := graph.Producer(dst); ok {
+		t.error(graph.Block(dst.Block).CreatedBy().Pos(), CodeAlreadyConnected, fmt.Errorf("port is already connected, use merge() to combine multiple outputs"))
 		return
 	}
 	graph.Connect(src, dst, srcType)
 }
 
+// convertFix suggests converting src explicitly to the type to, if both are scalars and src is a value that can be
+// wrapped in a call, e.g. `Sleep(int(1.5))`.
+func (t *Tracer) convertFix(graph *ast.Graph, src ast.Loc, from, to ast.EdgeType) (token.Fix, bool) {
+	op, ok := ast.ConvertBuiltin(to)
+	if !ok || !from.IsScalar() || src.Block == ast.RootBlock {
+		return token.Fix{}, false
+	}
+	var start, end token.Pos
+	switch n := graph.Block(src.Block).CreatedBy().(type) {
+	case *ast.LiteralExpr:
+		start, end = n.Pos(), n.End()
+	case *ast.CallExpr:
+		start, end = n.Pos(), n.Rparen+1
+	default:
+		return token.Fix{}, false
+	}
+	return token.Fix{Msg: fmt.Sprintf("convert to %v with %v()", to, op), Edits: []token.TextEdit{
+		{Pos: t.tracingFile.Position(start), End: t.tracingFile.Position(start), NewText: string(op) + "("},
+		{Pos: t.tracingFile.Position(end), End: t.tracingFile.Position(end), NewText: ")"},
+	}}, true
+}
+
+// convert connects src to dst through a block converting from to the type to, which from widens to.
+func (t *Tracer) convert(src ast.Loc, dst ast.Loc, from, to ast.EdgeType, graph *ast.Graph) {
+	if _, ok := graph.Producer(dst); ok {
+		t.error(graph.Block(dst.Block).CreatedBy().Pos(), CodeAlreadyConnected, fmt.Errorf("port is already connected, use merge() to combine multiple outputs"))
+		return
+	}
+	createdBy := graph.Block(dst.Block).CreatedBy()
+	if dst.Block == ast.RootBlock && src.Block != ast.RootBlock {
+		createdBy = graph.Block(src.Block).CreatedBy()
+	}
+	op, _ := ast.ConvertBuiltin(to)
+	conv := graph.AddBuiltinBlock(op, []ast.EdgeType{from}, []ast.EdgeType{to}, createdBy)
+	graph.Connect(src, ast.Loc{Block: conv, Port: 0}, from)
+	graph.Connect(ast.Loc{Block: conv, Port: 0}, dst, to)
+}
+
 func (t *Tracer) traceModule(file *token.File, mod *ast.Module) {
 	t.tracingMod = mod
 	t.tracingFile = file
+	t.checkDecls(mod)
+	t.checkImports(mod)
+	for _, decl := range mod.DefinedBlocks {
+		// every signature must be known before the bodies are traced, since bodies may call any pipe
+		switch d := decl.(type) {
+		case *ast.StubDecl:
+			t.checkPortTypes(d, false)
+			t.checkDefaults(&d.Inputs, true)
+			t.checkDefaults(&d.Outputs, false)
+			t.refer(d.Name, d)
+			t.referPorts(d)
+		case *ast.PipeDecl:
+			t.refer(d.Name, d)
+			t.checkPortTypes(d, true)
+			t.checkDefaults(&d.Inputs, true)
+			t.checkDefaults(&d.Outputs, false)
+			t.declareVars(d)
+		}
+	}
 	for _, decl := range mod.DefinedBlocks {
 		if pipe, ok := decl.(*ast.PipeDecl); ok {
 			pipe.BodyDAG = t.tracePipe(pipe)
@@ -110,15 +211,38 @@ func (t *Tracer) traceModule(file *token.File, mod *ast.Module) {
 }
 
 type pipeTrace struct {
+	Decl        *ast.PipeDecl
 	Graph       ast.Graph
 	symbolTable map[string]output
+	symbols     map[string]ast.Node // port or assignment each symbol refers to
+
+	defined   map[string]token.Pos // where each symbol is defined
+	assigned  []*ast.Ident         // symbols bound by assignments, in the order they are bound
+	used      map[string]bool      // symbols that have been read
+	discarded map[ast.Loc]bool     // outputs explicitly discarded with _
 }
 
 func (t *Tracer) tracePipe(pipe *ast.PipeDecl) *ast.Graph {
-	trace := pipeTrace{Graph: ast.Graph{}, symbolTable: make(map[string]output)}
+	trace := pipeTrace{
+		Decl:        pipe,
+		Graph:       ast.NewGraph(pipe),
+		symbolTable: make(map[string]output),
+		symbols:     make(map[string]ast.Node),
+		defined:     make(map[string]token.Pos),
+		used:        make(map[string]bool),
+		discarded:   make(map[ast.Loc]bool),
+	}
+	for port, field := range pipe.Inputs.Fields {
+		// inputs of the pipe leave the root block to be used in the body
+		trace.symbolTable[field.Key.V] = oneOutput{From: ast.Loc{Block: ast.RootBlock, Port: ast.PortIdx(port)}, Name: field.Key.V}
+		trace.symbols[field.Key.V] = field
+		t.define(field.Key.V, field.Key.Pos(), &trace)
+	}
+	t.referPorts(pipe)
 	for _, stmt := range pipe.Body {
 		t.traceStmt(stmt, &trace)
 	}
+	t.checkPipe(&trace)
 	return &trace.Graph
 }
 
@@ -139,6 +263,10 @@ func (t *Tracer) traceExpr(expr ast.Expr, state *pipeTrace) output {
 		return t.traceIdent(x, state)
 	case *ast.LiteralExpr:
 		return t.traceLit(x, state)
+	case *ast.PipeLit:
+		return t.tracePipeLit(x, state)
+	case *ast.InterpExpr:
+		return t.traceInterp(x, state)
 	default:
 		return NilOutput
 	}
@@ -146,54 +274,246 @@ func (t *Tracer) traceExpr(expr ast.Expr, state *pipeTrace) output {
 
 func (t *Tracer) traceCall(call *ast.CallExpr, state *pipeTrace) (out output) {
 	if call.Name.Local() {
-		decl := t.tracingMod.Lookup(call.Name.V)
-		if decl == nil {
-			t.error(call.Pos(), fmt.Errorf("unable to find local pipe or stub with name %v", call.Name.V))
+		if fn, ok := state.symbolTable[call.Name.V]; ok {
+			state.used[call.Name.V] = true
+			t.refer(call.Name, state.symbols[call.Name.V])
+			return t.traceApply(call, fn, state)
+		}
+	}
+
+	decl := t.lookupDecl(call.Name)
+	if decl == nil {
+		if !call.Name.Local() {
+			// error already reported when resolving the module
 			return NilOutput
 		}
+		if op, ok := ast.LookupBuiltin(call.Name.V); ok {
+			return t.traceBuiltin(call, op, state)
+		}
+		err := t.error(call.Pos(), CodeUnknownName, fmt.Errorf("unable to find local pipe or stub with name %v", call.Name.V))
+		t.suggestName(err, call.Name, t.localNames(state))
+		return NilOutput
+	}
 
-		if len(call.Args) != len(decl.BlockInputs().Fields) {
-			t.error(call.Pos(), fmt.Errorf("wrong number of args for call to %v, expected %d, got %d",
-				call.Name.V,
-				len(decl.BlockInputs().Fields),
-				len(call.Args)))
+	t.refer(call.Name, decl)
+	incomingEdges, ok := t.traceArgs(call, decl.BlockInputs(), state)
+	if !ok {
+		return invalidOutput{}
+	}
+	for port, field := range decl.BlockInputs().Fields {
+		if incomingEdges[port] == nil && field.Default != nil {
+			idx := state.Graph.AddLiteralBlockFrom(field.Default, call)
+			incomingEdges[port] = &ast.Loc{Block: idx, Port: 0}
 		}
+	}
 
-		var (
-			usedPorts []int
-			argval    ast.Expr
-		)
-		incomingEdges := make([]ast.Loc, len(decl.BlockInputs().Fields))
-		for _, arg := range call.Args {
-			usedPorts, argval = t.matchArgToInput(arg, decl.BlockInputs(), usedPorts)
-			if argval == nil {
-				// error returned by matchArgToField
-				return NilOutput
-			}
+	// Add the block and edges now after all the args have added their input blocks to the graph
+	thisBlock := state.Graph.AddNamedBlock(decl, call)
+	t.connectArgs(incomingEdges, thisBlock, 0, state)
+	return makeOutputBundle(thisBlock, decl.BlockOutputs())
+}
 
-			foundPort := ast.PortIdx(usedPorts[len(usedPorts)-1])
-			tracedarg := t.traceExpr(argval, state)
-			if inarg, ok := tracedarg.(oneOutput); ok {
-				incomingEdges[foundPort] = inarg.From
-			} else {
-				t.error(argval.Pos(), fmt.Errorf("expected single output, got %v", tracedarg))
+// traceBuiltin traces a call to a block implemented by the runtime. Built-ins only take positional arguments and
+// their port types are decided by the arguments they are called with.
+func (t *Tracer) traceBuiltin(call *ast.CallExpr, op ast.Builtin, state *pipeTrace) output {
+	var incomingEdges []*ast.Loc
+	for _, arg := range call.Args {
+		if _, ok := arg.(*ast.Field); ok {
+			t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("%v does not take named arguments", op))
+			return NilOutput
+		}
+		tracedarg := t.traceExpr(arg, state)
+		switch inarg := tracedarg.(type) {
+		case oneOutput:
+			incomingEdges = append(incomingEdges, &inarg.From)
+		case invalidOutput:
+			return inarg
+		default:
+			t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("expected single output, got %v", tracedarg))
+			return NilOutput
+		}
+	}
+
+	switch op {
+	case ast.MergeBuiltin:
+		if len(incomingEdges) == 0 {
+			t.error(call.Pos(), CodeInvalidArgument, fmt.Errorf("merge needs at least one argument"))
+			return NilOutput
+		}
+		// every input of merge has the same type as the first one, so mismatched inputs are caught by connect
+		typ := state.Graph.SrcType(*incomingEdges[0])
+		inPorts := make([]ast.EdgeType, len(incomingEdges))
+		for i := range inPorts {
+			inPorts[i] = typ
+		}
+		thisBlock := state.Graph.AddBuiltinBlock(op, inPorts, []ast.EdgeType{typ}, call)
+		t.connectArgs(incomingEdges, thisBlock, 0, state)
+		return oneOutput{From: ast.Loc{Block: thisBlock, Port: 0}}
+	case ast.IntBuiltin, ast.FloatBuiltin, ast.StringBuiltin:
+		if len(incomingEdges) != 1 {
+			t.error(call.Pos(), CodeInvalidArgument, fmt.Errorf("%v takes exactly one argument, got %d", op, len(incomingEdges)))
+			return NilOutput
+		}
+		// any scalar can be converted explicitly, even if information is lost
+		from := t.resolve(state.Graph.SrcType(*incomingEdges[0]))
+		if from.IsVar() {
+			t.types.scalars = append(t.types.scalars, typeCheck{Type: from, Pos: t.tracingFile.Position(call.Args[0].Pos()), What: "convert"})
+		} else if !from.IsScalar() {
+			t.error(call.Args[0].Pos(), CodeNotScalar, fmt.Errorf("cannot convert value of type %v to %v", from, op))
+			return NilOutput
+		}
+		thisBlock := state.Graph.AddBuiltinBlock(op, []ast.EdgeType{from}, []ast.EdgeType{ast.EdgeType(op)}, call)
+		t.connectArgs(incomingEdges, thisBlock, 0, state)
+		return oneOutput{From: ast.Loc{Block: thisBlock, Port: 0}}
+	default:
+		panic(fmt.Errorf("unknown builtin %v", op))
+	}
+}
+
+// traceApply traces a call to a symbol holding a pipe, e.g. f(x) where f is a pipe typed port. The called pipe
+// is not known until runtime, so an ApplyBlock is added that receives the pipe on its first port.
+func (t *Tracer) traceApply(call *ast.CallExpr, fn output, state *pipeTrace) output {
+	if _, ok := fn.(invalidOutput); ok {
+		return fn
+	}
+	from, ok := fn.(oneOutput)
+	if !ok {
+		t.error(call.Pos(), CodeNotCallable, fmt.Errorf("cannot call %v, it is not a pipe", call.Name.V))
+		return NilOutput
+	}
+	if fnType := t.resolve(state.Graph.SrcType(from.From)); !fnType.IsPipe() {
+		if fnType.IsVar() {
+			t.error(call.Pos(), CodeCannotInfer, fmt.Errorf("cannot call %v before its type is known, add a type annotation", call.Name.V))
+		} else {
+			t.error(call.Pos(), CodeNotCallable, fmt.Errorf("cannot call %v, it is not a pipe", call.Name.V))
+		}
+		return NilOutput
+	}
+
+	typ := t.pipeTypeOf(from.From, state)
+	if typ == nil {
+		t.error(call.Pos(), CodeCannotInfer, fmt.Errorf("cannot call %v, the names of its ports are not known, add a type annotation", call.Name.V))
+		return NilOutput
+	}
+	incomingEdges, ok := t.traceArgs(call, &typ.Inputs, state)
+	if !ok {
+		return invalidOutput{}
+	}
+
+	thisBlock := state.Graph.AddApplyBlock(typ, call)
+	t.connect(from.From, ast.Loc{Block: thisBlock, Port: 0}, &state.Graph)
+	t.connectArgs(incomingEdges, thisBlock, 1, state)
+	return makeOutputBundle(thisBlock, &typ.Outputs)
+}
+
+// pipeTypeOf finds the signature of the pipe that leaves from, which is needed to match arguments by name. It is nil
+// if the port the pipe leaves from has an inferred type, since the inferred type has no port names.
+func (t *Tracer) pipeTypeOf(from ast.Loc, state *pipeTrace) *ast.PipeType {
+	typ, _ := t.typeExprOf(from, state).(*ast.PipeType)
+	return typ
+}
+
+// typeExprOf finds the type expression declaring the values that leave from, or nil if it is not declared, e.g.
+// because the port has an inferred type or the block is a built-in whose output is not typed by a declaration.
+func (t *Tracer) typeExprOf(from ast.Loc, state *pipeTrace) ast.Expr {
+	var field *ast.Field
+	if from.Block == ast.RootBlock {
+		field = state.Decl.Inputs.Fields[from.Port]
+	} else {
+		switch b := state.Graph.Block(from.Block).(type) {
+		case *ast.PipeRefBlock:
+			return &ast.PipeType{Keyword: b.Decl.Pos(), Inputs: *b.Decl.BlockInputs(), Outputs: *b.Decl.BlockOutputs()}
+		case *ast.ApplyBlock:
+			field = b.Type.Outputs.Fields[from.Port]
+		case *ast.StubBlock:
+			field = b.Decl.Outputs.Fields[from.Port]
+		case *ast.PipeBlock:
+			field = b.Decl.Outputs.Fields[from.Port]
+		case *ast.BuiltinBlock:
+			switch b.Op {
+			case ast.MergeBuiltin:
+				// every input of merge has the type of the first one
+				if src, ok := incomingEdge(&state.Graph, ast.Loc{Block: from.Block, Port: 0}); ok {
+					return t.typeExprOf(src, state)
+				}
+			case ast.FieldBuiltin:
+				// the field is declared in the type of the record it is taken from
+				src, ok := incomingEdge(&state.Graph, ast.Loc{Block: from.Block, Port: 0})
+				if !ok {
+					return nil
+				}
+				record, ok := t.typeExprOf(src, state).(*ast.FieldList)
+				if !ok {
+					return nil
+				}
+				for _, f := range record.Fields {
+					if f.Key.V == b.Params[0] {
+						return f.Value
+					}
+				}
 			}
+			return nil
+		default:
+			return nil
 		}
+	}
+	return field.Value
+}
 
-		// Add the block and edges now after all the args have added their input blocks to the graph
-		thisBlock := state.Graph.AddNamedBlock(decl, call)
-		for port, from := range incomingEdges {
-			t.connect(
-				from,
-				ast.Loc{Block: thisBlock, Port: ast.PortIdx(port)},
-				&state.Graph,
-			)
+// incomingEdge finds the source of the edge connected to the input dst, ok is false if it is not connected.
+func incomingEdge(graph *ast.Graph, dst ast.Loc) (src ast.Loc, ok bool) {
+	for _, edge := range graph.Edges {
+		if edge.Dst == dst {
+			return edge.Src, true
 		}
+	}
+	return ast.Loc{}, false
+}
 
-		out = makeOutputBundle(thisBlock, decl)
-		return
+// traceArgs traces each argument of call and matches it to one of inputs. The returned slice has the source
+// of each input port or nil if the port was not given an argument. ok is false if an argument is invalid, which has
+// been reported.
+func (t *Tracer) traceArgs(call *ast.CallExpr, inputs *ast.FieldList, state *pipeTrace) (incomingEdges []*ast.Loc, ok bool) {
+	// missing arguments are reported as unconnected inputs once the whole pipe has been traced
+	var (
+		usedPorts []int
+		argval    ast.Expr
+		invalid   bool
+	)
+	incomingEdges = make([]*ast.Loc, len(inputs.Fields))
+	for _, arg := range call.Args {
+		usedPorts, argval = t.matchArgToInput(arg, inputs, usedPorts)
+		if argval == nil {
+			// error returned by matchArgToField
+			return nil, false
+		}
+
+		foundPort := ast.PortIdx(usedPorts[len(usedPorts)-1])
+		tracedarg := t.traceExpr(argval, state)
+		switch inarg := tracedarg.(type) {
+		case oneOutput:
+			incomingEdges[foundPort] = &inarg.From
+		case invalidOutput:
+			invalid = true // the other arguments are still traced to report their errors
+		default:
+			t.error(argval.Pos(), CodeInvalidArgument, fmt.Errorf("expected single output, got %v", tracedarg))
+		}
+	}
+	return incomingEdges, !invalid
+}
+
+// connectArgs connects the traced arguments to the input ports of block, starting from firstPort.
+func (t *Tracer) connectArgs(incomingEdges []*ast.Loc, block ast.BlockIdx, firstPort int, state *pipeTrace) {
+	for port, from := range incomingEdges {
+		if from == nil {
+			continue
+		}
+		t.connect(
+			*from,
+			ast.Loc{Block: block, Port: ast.PortIdx(firstPort + port)},
+			&state.Graph,
+		)
 	}
-	panic("unsupported global name")
 }
 
 const namedArgUsedPort = 999 // namedArgUsedPort is in usedArgs it means a named arg was used and a positional cannot be used anymore
@@ -206,47 +526,119 @@ func (t *Tracer) matchArgToInput(argExpr ast.Expr, inputs *ast.FieldList, usedPo
 			if field.Key.V == arg.Key.V {
 				for _, used := range usedPorts {
 					if used == i {
-						t.error(arg.Pos(), fmt.Errorf("already used argument with name %s", field.Key.V))
+						t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("already used argument with name %s", field.Key.V))
 						return
 					}
 				}
-				ports = append(ports, namedArgUsedPort, i)
+				ports = append(usedPorts, namedArgUsedPort, i)
 				value = arg.Value
+				t.refer(arg.Key, field)
 				return
 			}
 		}
-		t.error(arg.Pos(), fmt.Errorf("no input found with name %s", arg.Key.V))
+		t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("no input found with name %s", arg.Key.V))
 	default:
 		// the arg is a positional argument, the field is based on the position
 		nextPort := len(usedPorts)
 		for _, port := range usedPorts {
 			if port == namedArgUsedPort {
-				t.error(arg.Pos(), fmt.Errorf("positional arg cannot be after named arg"))
+				t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("positional arg cannot be after named arg"))
 				return
 			}
 		}
 
 		if len(inputs.Fields) <= nextPort {
-			t.error(arg.Pos(), fmt.Errorf("too many arguments, expected %d got %d", len(inputs.Fields), nextPort))
+			t.error(arg.Pos(), CodeInvalidArgument, fmt.Errorf("too many arguments, expected %d got %d", len(inputs.Fields), nextPort))
 			return
 		}
-		ports = append(ports, nextPort)
+		ports = append(usedPorts, nextPort)
 		value = arg
 	}
 	return
 }
 
 func (t *Tracer) traceIdent(ident *ast.Ident, state *pipeTrace) (out output) {
+	if ident.V == wildcard {
+		t.error(ident.Pos(), CodeWildcardValue, fmt.Errorf("cannot use %v as a value", wildcard))
+		return NilOutput
+	}
+
 	var ok bool
-	if out, ok = state.symbolTable[ident.V]; !ok {
-		t.error(ident.Pos(), fmt.Errorf("no symbol found with name %v", ident.V))
+	if ident.Local() {
+		if out, ok = state.symbolTable[ident.V]; ok {
+			state.used[ident.V] = true
+			t.refer(ident, state.symbols[ident.V])
+			return
+		}
 	}
-	return
+	if decl := t.lookupDecl(ident); decl != nil {
+		t.refer(ident, decl)
+		// a pipe or stub referenced by name is passed as a value
+		idx := state.Graph.AddPipeRefBlock(decl, ident)
+		return oneOutput{From: ast.Loc{Block: idx, Port: 0}}
+	}
+	if ident.Local() {
+		err := t.error(ident.Pos(), CodeUnknownName, fmt.Errorf("no symbol found with name %v", ident.V))
+		t.suggestName(err, ident, t.localNames(state))
+	}
+	return NilOutput
+}
+
+// traceInterp lowers a string with embedded expressions to a format block. The string parts are parameters of the
+// block and the values of the embedded expressions are its inputs.
+func (t *Tracer) traceInterp(interp *ast.InterpExpr, state *pipeTrace) output {
+	var (
+		segments      []string
+		inPorts       []ast.EdgeType
+		incomingEdges []*ast.Loc
+	)
+	for _, part := range interp.Parts {
+		if lit, ok := part.(*ast.LiteralExpr); ok && lit.Type == token.String {
+			segments = append(segments, lit.Value)
+			continue
+		}
+
+		out := t.traceExpr(part, state)
+		if _, ok := out.(invalidOutput); ok {
+			return out
+		}
+		traced, ok := out.(oneOutput)
+		if !ok {
+			t.error(part.Pos(), CodeInvalidArgument, fmt.Errorf("expected single output to interpolate"))
+			return NilOutput
+		}
+		typ := t.resolve(state.Graph.SrcType(traced.From))
+		if typ.IsVar() {
+			// checked once the type is inferred
+			t.types.scalars = append(t.types.scalars, typeCheck{Type: typ, Pos: t.tracingFile.Position(part.Pos()), What: "interpolate"})
+		} else if !typ.IsScalar() {
+			t.error(part.Pos(), CodeNotScalar, fmt.Errorf("cannot interpolate value of type %v, expected string, int or float", typ))
+			return NilOutput
+		}
+		inPorts = append(inPorts, typ)
+		incomingEdges = append(incomingEdges, &traced.From)
+	}
+
+	thisBlock := state.Graph.AddBuiltinBlockWithParams(ast.FormatBuiltin, segments, inPorts, []ast.EdgeType{ast.StringEdge}, interp)
+	t.connectArgs(incomingEdges, thisBlock, 0, state)
+	return oneOutput{From: ast.Loc{Block: thisBlock, Port: 0}}
+}
+
+func (t *Tracer) tracePipeLit(lit *ast.PipeLit, state *pipeTrace) oneOutput {
+	// pipe literals cannot see the symbols of the pipe they are defined in, they only have their own ports
+	t.checkPortTypes(lit.Decl, true)
+	t.checkDefaults(&lit.Decl.Inputs, false)
+	t.checkDefaults(&lit.Decl.Outputs, false)
+	t.checkPorts(&lit.Decl.Inputs, &lit.Decl.Outputs)
+	t.declareVars(lit.Decl)
+	lit.Decl.BodyDAG = t.tracePipe(lit.Decl)
+	idx := state.Graph.AddPipeRefBlock(lit.Decl, lit)
+	return oneOutput{From: ast.Loc{Block: idx, Port: 0}}
 }
 
 func (t *Tracer) traceLit(lit *ast.LiteralExpr, state *pipeTrace) oneOutput {
 	idx := state.Graph.AddLiteralBlock(lit)
-	return oneOutput{ast.Loc{Block: idx, Port: 0}}
+	return oneOutput{From: ast.Loc{Block: idx, Port: 0}}
 }
 
 func (t *Tracer) traceAssign(assign *ast.AssignExpr, state *pipeTrace) output {
@@ -257,36 +649,144 @@ func (t *Tracer) traceAssign(assign *ast.AssignExpr, state *pipeTrace) output {
 	return rhs
 }
 
+// wildcard is the pattern that discards whatever it is matched with, e.g. `{a: _, b: b} = C()`
+const wildcard = "_"
+
 func (t *Tracer) unifyExpr(pattern ast.Expr, rhs output, state *pipeTrace) {
 	switch p := pattern.(type) {
 	case *ast.Ident:
 		// 1. An identifier a = b()
 		t.unifyOne(p, rhs, state)
 	case *ast.FieldList:
-		// 2. A map a: b, c: d = v()
+		// 2. A map {a: b, c: d} = v()
 		t.unifyBundle(p, rhs, state)
+	case *ast.TupleExpr:
+		// 3. A tuple a, b = v()
+		t.unifyTuple(p, rhs, state)
 	default:
-		t.expectedError(pattern, "variable name or map of variables")
+		t.expectedError(pattern, "variable name, map or list of variables")
 	}
 }
 
 func (t *Tracer) unifyOne(pattern *ast.Ident, rhs output, state *pipeTrace) {
 	varName := pattern.V
+	if varName == wildcard {
+		for _, loc := range locsOf(rhs) {
+			state.discarded[loc] = true
+		}
+		return
+	}
+	if !t.define(varName, pattern.Pos(), state) {
+		return
+	}
+	isOutput := false
+	state.symbols[varName] = pattern
+	for port, field := range state.Decl.Outputs.Fields {
+		if field.Key.V == varName {
+			isOutput = true
+			state.symbols[varName] = field
+			// outputs of the pipe arrive at the root block
+			if from, ok := rhs.(oneOutput); ok {
+				t.connect(from.From, ast.Loc{Block: ast.RootBlock, Port: ast.PortIdx(port)}, &state.Graph)
+			} else if _, ok := rhs.(invalidOutput); !ok {
+				t.error(pattern.Pos(), CodeInvalidPattern, fmt.Errorf("expected single output to assign to %v, got %v", varName, rhs))
+			}
+		}
+	}
+	if !isOutput {
+		state.assigned = append(state.assigned, pattern)
+	}
+	t.refer(pattern, state.symbols[varName])
 	state.symbolTable[varName] = rhs
 }
 
-func (t *Tracer) unifyBundle(pattern *ast.FieldList, rhs output, state *pipeTrace) error {
-	if rBundle, ok := rhs.(outputBundle); ok {
+// unifyBundle matches each field of the pattern by name with either an output of a block with many outputs, or
+// with a field of a record. Patterns can be nested to destructure records inside records, e.g.
+// 	{pos: {x: px}} = Ball()
+func (t *Tracer) unifyBundle(pattern *ast.FieldList, rhs output, state *pipeTrace) {
+	t.checkFieldNames(pattern)
+	switch r := rhs.(type) {
+	case outputBundle:
 		for _, field := range pattern.Fields {
-			if foundOutput, ok := rBundle.Outputs[field.Key.V]; ok {
-				t.unifyOne(field.Key, foundOutput, state)
+			if foundOutput, ok := r.Outputs[field.Key.V]; ok {
+				t.unifyExpr(field.Value, foundOutput, state)
 			} else {
-				t.error(field.Key.Pos(), fmt.Errorf("name does not match any output on right side of assignment"))
+				t.error(field.Key.Pos(), CodeInvalidPattern, fmt.Errorf("name does not match any output on right side of assignment"))
 			}
 		}
-	} else {
+	case oneOutput:
+		if len(pattern.Fields) == 1 && pattern.Fields[0].Key.V == r.Name {
+			// the pattern names the only output of the block
+			t.unifyExpr(pattern.Fields[0].Value, r, state)
+			return
+		}
+
+		recordType := t.resolve(state.Graph.SrcType(r.From))
+		if recordType.HasVars() {
+			t.error(pattern.Pos(), CodeCannotInfer, fmt.Errorf("cannot destructure %v before its type is known, add a type annotation", r.Name))
+			return
+		}
+		if !recordType.IsRecord() {
+			t.error(pattern.Pos(), CodeInvalidPattern, fmt.Errorf("cannot destructure %v, it is not a record", recordType))
+			return
+		}
+		for _, field := range pattern.Fields {
+			fieldType, ok := recordType.Field(field.Key.V)
+			if !ok {
+				t.error(field.Key.Pos(), CodeInvalidPattern, fmt.Errorf("%v has no field %v", recordType, field.Key.V))
+				continue
+			}
+			fieldBlock := state.Graph.AddBuiltinBlockWithParams(ast.FieldBuiltin, []string{field.Key.V},
+				[]ast.EdgeType{recordType}, []ast.EdgeType{fieldType}, field)
+			t.connect(r.From, ast.Loc{Block: fieldBlock, Port: 0}, &state.Graph)
+			t.unifyExpr(field.Value, oneOutput{From: ast.Loc{Block: fieldBlock, Port: 0}, Name: field.Key.V}, state)
+		}
+	case invalidOutput:
+		for _, field := range pattern.Fields {
+			t.unifyExpr(field.Value, r, state)
+		}
+	default:
 		// a: b = 10 not okay
 		t.expectedError(pattern, "more than one output on right side of assignment")
 	}
-	return nil
+}
+
+// unifyTuple matches each pattern with the outputs of a block in the order they are declared.
+// The names of a pattern that does not match are defined as invalid and the outputs of the right side are discarded,
+// so neither reports anything more.
+func (t *Tracer) unifyTuple(pattern *ast.TupleExpr, rhs output, state *pipeTrace) {
+	bundle, ok := rhs.(outputBundle)
+	if !ok || len(bundle.Names) != len(pattern.Elts) {
+		if _, invalid := rhs.(invalidOutput); !invalid {
+			n := outputCount(rhs)
+			outputs := "outputs"
+			if n == 1 {
+				outputs = "output"
+			}
+			t.error(pattern.Pos(), CodeInvalidPattern, fmt.Errorf("assignment mismatch: %d patterns but right side has %d %s",
+				len(pattern.Elts), n, outputs))
+		}
+		for _, elt := range pattern.Elts {
+			t.unifyExpr(elt, invalidOutput{}, state)
+		}
+		// the outputs of the right side are already reported by the mismatch
+		for _, loc := range locsOf(rhs) {
+			state.discarded[loc] = true
+		}
+		return
+	}
+	for i, elt := range pattern.Elts {
+		t.unifyExpr(elt, bundle.Outputs[bundle.Names[i]], state)
+	}
+}
+
+// outputCount is the number of outputs of a block that rhs is the output of.
+func outputCount(rhs output) int {
+	switch r := rhs.(type) {
+	case oneOutput:
+		return 1
+	case outputBundle:
+		return len(r.Names)
+	}
+	return 0
 }
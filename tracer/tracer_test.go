@@ -2,7 +2,10 @@ package tracer
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/masp/hoser/ast"
@@ -17,6 +20,15 @@ func encodeBlock(block ast.Block) (value string) {
 		value = b.Lit.Value
 	case *ast.StubBlock:
 		value = b.Decl.BlockName() + "*"
+	case *ast.PipeRefBlock:
+		value = "&" + b.Decl.BlockName()
+	case *ast.BuiltinBlock:
+		value = string(b.Op)
+		if len(b.Params) > 0 {
+			value += "(" + strings.Join(b.Params, ", ") + ")"
+		}
+	case *ast.ApplyBlock:
+		value = b.CreatedBy().(*ast.CallExpr).Name.V + "()"
 	default:
 		panic(fmt.Errorf("invalid block type: %T", block))
 	}
@@ -32,8 +44,8 @@ func encodeBlocks(blocks []ast.Block) (result []string) {
 
 func encodeEdge(edge ast.Edge, graph *ast.Graph) (value string) {
 	return fmt.Sprintf("%s[%d]->%s[%d]",
-		encodeBlock(graph.Blocks[edge.Src.Block]), edge.Src.Port,
-		encodeBlock(graph.Blocks[edge.Dst.Block]), edge.Dst.Port)
+		encodeBlock(graph.Block(edge.Src.Block)), edge.Src.Port,
+		encodeBlock(graph.Block(edge.Dst.Block)), edge.Dst.Port)
 }
 
 func encodeEdges(graph *ast.Graph) (result []string) {
@@ -54,8 +66,8 @@ func Test_TracePipe(t *testing.T) {
 			"Single call",
 			`
 module "a"
-B(a: int) {}
-main() {
+pipe B(a: int) {}
+pipe main() {
 	B(a: 10)
 }
 `,
@@ -66,8 +78,8 @@ main() {
 			"Single call with single arg",
 			`
 module "a"
-B(a: int) {}
-main() {
+pipe B(a: int) {}
+pipe main() {
 	B(10)
 }
 `,
@@ -78,21 +90,33 @@ main() {
 			"Multiarg",
 			`
 module "a"
-B(a: int, b: int) {}
-main() {
+pipe B(a: int, b: int) {}
+pipe main() {
 	B(10, 12)
 }
 `,
 			[]string{"10", "12", "B"},
 			[]string{"10[0]->B[0]", "12[0]->B[1]"},
 		},
+		{
+			"Three positional args",
+			`
+module "a"
+pipe B(a: int, b: int, c: int) {}
+pipe main() {
+	B(10, 12, 14)
+}
+`,
+			[]string{"10", "12", "14", "B"},
+			[]string{"10[0]->B[0]", "12[0]->B[1]", "14[0]->B[2]"},
+		},
 		{
 			"Nested",
 			`
 module "a"
-B(a: int, b: int) {}
-C() (c: int) {}
-main() {
+pipe B(a: int, b: int) {}
+pipe C() (c: int) {}
+pipe main() {
 	B(10, C())
 }
 `,
@@ -103,9 +127,9 @@ main() {
 			"Symbols",
 			`
 module "a"
-B(a: int, b: int) {}
-C() (c: int) {}
-main() {
+pipe B(a: int, b: int) {}
+pipe C() (c: int) {}
+pipe main() {
 	c = C()
 	B(10, c)
 }
@@ -117,9 +141,9 @@ main() {
 			"Unify multiresult",
 			`
 module "a"
-B(a: int, b: int) {}
-C() (c1: int, c2: int) {}
-main() {
+pipe B(a: int, b: int) {}
+pipe C() (c1: int, c2: int) {}
+pipe main() {
 	{c1: c1, c2: c2} = C()
 	B(a: c2, b: c2)
 }
@@ -127,6 +151,168 @@ main() {
 			[]string{"C", "B"},
 			[]string{"C[1]->B[0]", "C[1]->B[1]"},
 		},
+		{
+			"Wildcard",
+			`
+module "a"
+stub B(a: int)
+stub C() (c1: int, c2: int)
+pipe main() {
+	{c1: _, c2: x} = C()
+	B(x)
+}
+`,
+			[]string{"C*", "B*"},
+			[]string{"C*[1]->B*[0]"},
+		},
+		{
+			"Tuple",
+			`
+module "a"
+stub B(a: int, b: int)
+stub C() (c1: int, c2: int)
+pipe main() {
+	x, y = C()
+	B(y, x)
+}
+`,
+			[]string{"C*", "B*"},
+			[]string{"C*[1]->B*[0]", "C*[0]->B*[1]"},
+		},
+		{
+			"Nested record",
+			`
+module "a"
+stub B(a: int, b: int)
+stub Ball() (pos: {x: int, y: int}, size: int)
+pipe main() {
+	{pos: {x: px}, size: _} = Ball()
+	B(px, 10)
+}
+`,
+			[]string{"Ball*", "field(x)", "10", "B*"},
+			[]string{"Ball*[0]->field(x)[0]", "field(x)[0]->B*[0]", "10[0]->B*[1]"},
+		},
+		{
+			"Record single output",
+			`
+module "a"
+stub B(a: int, b: int)
+stub Pos() (pos: {x: int, y: int})
+pipe main() {
+	{pos: {x: px}} = Pos()
+	{y: py} = Pos()
+	B(px, py)
+}
+`,
+			[]string{"Pos*", "field(x)", "Pos*", "field(y)", "B*"},
+			[]string{"Pos*[0]->field(x)[0]", "Pos*[0]->field(y)[0]", "field(x)[0]->B*[0]", "field(y)[0]->B*[1]"},
+		},
+		{
+			"String interpolation",
+			`
+module "a"
+stub B(a: string)
+pipe main(name: string, n: int) {
+	B("out/${name}-${n}.txt")
+	B("plain")
+}
+`,
+			[]string{"format(out/, -, .txt)", "B*", "plain", "B*"},
+			[]string{"main[0]->format(out/, -, .txt)[0]", "main[1]->format(out/, -, .txt)[1]", "format(out/, -, .txt)[0]->B*[0]", "plain[0]->B*[0]"},
+		},
+		{
+			"Fan-out",
+			`
+module "a"
+stub B(a: int)
+stub C() (c: int)
+pipe main() {
+	c = C()
+	B(c)
+	B(c)
+}
+`,
+			[]string{"C*", "B*", "B*"},
+			[]string{"C*[0]->B*[0]", "C*[0]->B*[0]"},
+		},
+		{
+			"Merge",
+			`
+module "a"
+stub B(a: int)
+stub C() (c: int)
+pipe main() {
+	B(merge(C(), 10, C()))
+}
+`,
+			[]string{"C*", "10", "C*", "merge", "B*"},
+			[]string{"C*[0]->merge[0]", "10[0]->merge[1]", "C*[0]->merge[2]", "merge[0]->B*[0]"},
+		},
+		{
+			"Pipe literal argument",
+			`
+module "a"
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+stub Double(x: int) (y: int)
+pipe main() {
+	Map(1, pipe(a: int) (b: int) { b = Double(a) })
+}
+`,
+			[]string{"1", "&pipe", "Map*"},
+			[]string{"1[0]->Map*[0]", "&pipe[0]->Map*[1]"},
+		},
+		{
+			"Named pipe argument",
+			`
+module "a"
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+pipe Double(x: int) (y: int) {}
+pipe main() {
+	Map(f: Double, in: 1)
+}
+`,
+			[]string{"&Double", "1", "Map*"},
+			[]string{"1[0]->Map*[0]", "&Double[0]->Map*[1]"},
+		},
+		{
+			"Call pipe typed port",
+			`
+module "a"
+pipe main(v: int, f: pipe(x: int) (y: int)) (r: int) {
+	r = f(x: v)
+}
+`,
+			[]string{"f()"},
+			[]string{"main[1]->f()[0]", "main[0]->f()[1]", "f()[0]->main[0]"},
+		},
+		{
+			"Call merged pipes",
+			`
+module "a"
+pipe A(x: int) (y: int) { y = x }
+pipe B(x: int) (y: int) { y = x }
+pipe main() (o: int) {
+	f = merge(A, B)
+	o = f(x: 1)
+}
+`,
+			[]string{"&A", "&B", "merge", "1", "f()"},
+			[]string{"&A[0]->merge[0]", "&B[0]->merge[1]", "merge[0]->f()[0]", "1[0]->f()[1]", "f()[0]->main[0]"},
+		},
+		{
+			"Call pipe in record",
+			`
+module "a"
+stub R() (r: {f: pipe(x: int) (y: int)})
+pipe main() (o: int) {
+	{f: g} = R()
+	o = g(1)
+}
+`,
+			[]string{"R*", "field(f)", "1", "g()"},
+			[]string{"R*[0]->field(f)[0]", "field(f)[0]->g()[0]", "1[0]->g()[1]", "g()[0]->main[0]"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -167,15 +353,121 @@ func Test_TracePipeFail(t *testing.T) {
 			"Mismatch type",
 			`
 module "a"
-B(a: int) {}
-main() { B(a: "test") }
+pipe B(a: int) {}
+pipe main() { B(a: "test") }
+`,
+		},
+		{
+			"Mismatch pipe signature",
+			`
+module "a"
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+pipe main() { Map(1, pipe(x: string) (y: int) {}) }
+`,
+		},
+		{
+			"Call non-pipe",
+			`
+module "a"
+pipe main(v: int) { v(1) }
+`,
+		},
+		{
+			"Tuple mismatch",
+			`
+module "a"
+stub C() (c1: int, c2: int)
+pipe main() { a, b, c = C() }
+`,
+		},
+		{
+			"Wildcard as value",
+			`
+module "a"
+stub B(a: int)
+pipe main() { B(_) }
+`,
+		},
+		{
+			"Missing record field",
+			`
+module "a"
+stub Pos() (pos: {x: int, y: int})
+pipe main() { {z: pz} = Pos() }
+`,
+		},
+		{
+			"Interpolate pipe",
+			`
+module "a"
+stub B(a: string)
+pipe main(f: pipe() ()) { B("${f}") }
+`,
+		},
+		{
+			"Merge mismatched types",
+			`
+module "a"
+stub B(a: int)
+pipe main() { B(merge(10, "a")) }
+`,
+		},
+		{
+			"Pure pipe calls impure stub",
+			`
+module "a"
+stub B(a: int) (b: int)
+pure pipe P(a: int) (b: int) { b = B(a) }
+pipe main() { P(1) }
+`,
+		},
+		{
+			"Pure pipe calls pipe value",
+			`
+module "a"
+pure pipe P(a: int, f: pipe(x: int) (y: int)) (b: int) { b = f(a) }
+pipe main() {}
+`,
+		},
+		{
+			"Output assigned twice",
+			`
+module "a"
+pipe main() (v: int) {
+	v = 10
+	v = 12
+}
+`,
+		},
+		{
+			"Too many arguments",
+			`
+module "a"
+stub B(a: int, b: int)
+pipe main() { B(1, 2, 3) }
+`,
+		},
+		{
+			"Argument named twice",
+			`
+module "a"
+stub B(a: int, b: int)
+pipe main() { B(a: 1, b: 2, a: 3) }
+`,
+		},
+		{
+			"Missing argument",
+			`
+module "a"
+stub B(a: int, b: int)
+pipe main() { B(b: 1) }
 `,
 		},
 		{
 			"Missing declaration",
 			`
 module "a"
-main() { B() }
+pipe main() { B() }
 `,
 		},
 	}
@@ -190,3 +482,1040 @@ main() { B() }
 		})
 	}
 }
+
+func Test_TracePatternMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{
+			"No outputs",
+			`module "a"
+stub P(n: int)
+stub Q(a: int, b: int) (m: int)
+stub R(m: int)
+pipe main() {
+	a, b = P(1)
+	R(Q(a, b))
+}
+`,
+			"6:2: assignment mismatch: 2 patterns but right side has 0 outputs",
+		},
+		{
+			"One output",
+			`module "a"
+stub P() (n: int)
+stub R(m: string)
+pipe main() {
+	a, b = P()
+	R("${a}")
+	R("${b}")
+}
+`,
+			"5:2: assignment mismatch: 2 patterns but right side has 1 output",
+		},
+		{
+			"Nested pattern",
+			`module "a"
+stub P() (a: int, b: int, c: int)
+stub R(m: int)
+pipe main() {
+	{a: a}, b = P()
+	R(a)
+	R(b)
+}
+`,
+			"5:2: assignment mismatch: 2 patterns but right side has 3 outputs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer()
+			_, err := tr.TraceModule(&file, []byte(tt.src))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("TraceModule() err = %v, want %s", err, tt.wantErr)
+			}
+			if w := tr.Warnings(); len(w) > 0 {
+				t.Errorf("Warnings() = %v, want none", w)
+			}
+		})
+	}
+}
+
+func Test_TraceImports(t *testing.T) {
+	includeDir := t.TempDir()
+	modules := map[string]string{
+		"grep.hos": `
+module "text/grep"
+stub Filter(in: string, pattern: string) (out: string)
+pipe Match(in: string) (out: string) { out = Filter(in, "a") }
+`,
+		"nested/wc.hos": `
+module "wc"
+import "text/grep"
+pipe Count(in: string) (n: string) { n = grep.Match(in) }
+`,
+		"broken.hos": `
+module "broken"
+pipe Broken( {}
+`,
+		"notes.txt": `not a module`,
+		"sort.hos": `module "sort"
+stub Sort(in: string) (out: string)
+`,
+		"nested/sort.hos": `module "sort"
+stub Sort(in: string) (out: string)
+`,
+	}
+	for name, src := range modules {
+		path := filepath.Join(includeDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files and directories that cannot be read are skipped
+	if err := os.Symlink(filepath.Join(includeDir, "missing.hos"), filepath.Join(includeDir, "dangling.hos")); err != nil {
+		t.Fatal(err)
+	}
+	missingDir := filepath.Join(includeDir, "missing")
+
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantErr    string
+	}{
+		{
+			"Qualified call",
+			`
+module "main"
+import "text/grep"
+stub B(a: string)
+pipe main() { B(grep.Filter("a", "b")) }
+`,
+			[]string{"a", "b", "Filter*", "B*"},
+			"",
+		},
+		{
+			"Transitive import",
+			`
+module "main"
+import "wc"
+stub B(a: string)
+pipe main() { B(wc.Count("a")) }
+`,
+			[]string{"a", "Count", "B*"},
+			"",
+		},
+		{
+			"Qualified pipe value",
+			`
+module "main"
+import "text/grep"
+stub Map(in: string, f: pipe(in: string) (out: string))
+pipe main() { Map("a", grep.Match) }
+`,
+			[]string{"a", "&Match", "Map*"},
+			"",
+		},
+		{
+			"Not imported",
+			`
+module "main"
+pipe main() { grep.Filter("a", "b") }
+`,
+			nil,
+			"3:15: module grep is not imported",
+		},
+		{
+			"Unknown module",
+			`
+module "main"
+import "sed"
+pipe main() {}
+`,
+			nil,
+			`3:8: unknown module "sed", not found in include path`,
+		},
+		{
+			"Unknown name in module",
+			`
+module "main"
+import "text/grep"
+pipe main() { grep.Replace("a") }
+`,
+			nil,
+			"4:20: module grep has no pipe or stub named Replace",
+		},
+		{
+			"Broken module",
+			`
+module "main"
+import "broken"
+pipe main() { broken.Broken() }
+`,
+			nil,
+			"broken.hos:3:",
+		},
+		{
+			"Duplicate module",
+			`
+module "main"
+import "sort"
+pipe main() { sort.Sort("a") }
+`,
+			nil,
+			`3:8: module "sort" is declared by more than one file: ` + filepath.Join(includeDir, "nested/sort.hos") + ":1:8, " + filepath.Join(includeDir, "sort.hos") + ":1:8",
+		},
+	}
+	// every case is traced by its own tracer, then by tracers sharing an index of the include path
+	shared := NewIndex(includeDir, missingDir)
+	for _, index := range []*Index{nil, shared} {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				file := token.NewFile("", len(tt.src))
+				tr := NewTracer(includeDir, missingDir)
+				tr.Index = index
+				module, err := tr.TraceModule(&file, []byte(tt.src))
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := module.Lookup("main").(*ast.PipeDecl)
+				gotBlocks := encodeBlocks(got.BodyDAG.Blocks)
+				if !reflect.DeepEqual(gotBlocks, tt.wantBlocks) {
+					t.Errorf("got blocks %v, want %v", gotBlocks, tt.wantBlocks)
+				}
+			})
+		}
+	}
+	for _, cached := range shared.modules.Modules {
+		if cached.Loaded {
+			t.Errorf("module %s was loaded into the shared index", cached.Mod.Name.Value)
+		}
+	}
+}
+
+func Test_TraceWithoutImports(t *testing.T) {
+	includeDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(includeDir, "grep.hos"), []byte(`module "grep"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `
+module "main"
+pipe main() {}
+`
+	file := token.NewFile(filepath.Join(includeDir, "main.hos"), len(src))
+	tr := NewTracer(includeDir)
+	if _, err := tr.TraceModule(&file, []byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	// a program without imports does not search the include path, which may be a large directory like $HOME
+	if got := tr.ModuleSet().Lookup("grep"); got != nil {
+		t.Errorf("module grep was indexed from %s, want the include path not to be searched", got.File.Name)
+	}
+}
+
+func Test_TraceCycles(t *testing.T) {
+	includeDir := t.TempDir()
+	modules := map[string]string{
+		"a.hos": `module "a"
+import "b"
+pipe A(in: int) (out: int) { out = b.B(in) }
+`,
+		"b.hos": `module "b"
+import "a"
+pipe B(in: int) (out: int) { out = a.A(in) }
+`,
+		"ping.hos": `module "ping"
+import "main"
+pipe Ping(in: int) (out: int) { out = main.Pong(in) }
+`,
+	}
+	for name, src := range modules {
+		if err := os.WriteFile(filepath.Join(includeDir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{
+			"Direct recursion",
+			`module "main"
+pipe A(in: int) (out: int) { out = A(in) }
+pipe main() {}
+`,
+			"2:36: recursive pipe: A calls A (2:36)",
+		},
+		{
+			"Mutual recursion",
+			`module "main"
+pipe A(in: int) (out: int) { out = B(in) }
+pipe B(in: int) (out: int) { out = C(in) }
+pipe C(in: int) (out: int) { out = A(in) }
+pipe main() { A(1) }
+`,
+			"2:36: recursive pipe: A calls B (2:36), B calls C (3:36), C calls A (4:36)",
+		},
+		{
+			"Recursion through module",
+			`module "main"
+import "ping"
+pipe Pong(in: int) (out: int) { out = ping.Ping(in) }
+pipe main() { Pong(1) }
+`,
+			"3:44: recursive pipe: Pong calls ping.Ping (3:44), Ping calls main.Pong (" + filepath.Join(includeDir, "ping.hos") + ":3:44)",
+		},
+		{
+			"Import cycle",
+			`module "main"
+import "a"
+pipe main() {}
+`,
+			"import cycle: a imports b (" + filepath.Join(includeDir, "a.hos") + ":2:1), b imports a (" + filepath.Join(includeDir, "b.hos") + ":2:1)",
+		},
+		{
+			"Pipe value is not a call",
+			`module "main"
+stub Map(in: int, f: pipe(in: int) (out: int)) (out: int)
+pipe A(in: int) (out: int) { out = Map(in, A) }
+pipe main() {}
+`,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer(includeDir)
+			_, err := tr.TraceModule(&file, []byte(tt.src))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			list, _ := err.(token.ErrorList)
+			for _, e := range list {
+				if strings.Contains(e.Error(), tt.wantErr) {
+					return
+				}
+			}
+			t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+		})
+	}
+}
+
+func Test_TraceWarnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		wantWarnings []string
+	}{
+		{
+			"Unused symbol",
+			`module "a"
+stub B(a: int) (b: int)
+pipe main() {
+	x = 10
+	y = B(x)
+}
+`,
+			[]string{"5:2: y is assigned but never used"},
+		},
+		{
+			"Unused output",
+			`module "a"
+stub B(a: int) (b: int, c: int)
+stub C(a: int)
+pipe main() {
+	{b: b} = B(1)
+	C(b)
+}
+`,
+			[]string{"5:11: output c of B is never used"},
+		},
+		{
+			"Discarded output",
+			`module "a"
+stub B(a: int) (b: int, c: int)
+stub C(a: int)
+pipe main() {
+	{b: b, c: _} = B(1)
+	C(b)
+	_ = 5
+}
+`,
+			nil,
+		},
+		{
+			"Unused value",
+			`module "a"
+pipe main() {
+	10
+}
+`,
+			[]string{"3:2: value is never used"},
+		},
+		{
+			"Unassigned pipe output",
+			`module "a"
+pipe main() (out: int, err: string) {
+	out = 1
+}
+`,
+			[]string{"2:24: output err of main is never assigned"},
+		},
+		{
+			"Used through pipe call",
+			`module "a"
+stub C(a: int)
+pipe main(f: pipe(x: int) (y: int)) {
+	g = f
+	C(g(1))
+}
+`,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer()
+			if _, err := tr.TraceModule(&file, []byte(tt.src)); err != nil {
+				t.Fatal(err)
+			}
+			var gotWarnings []string
+			for _, w := range tr.Warnings() {
+				gotWarnings = append(gotWarnings, w.Error())
+			}
+			if !reflect.DeepEqual(gotWarnings, tt.wantWarnings) {
+				t.Errorf("Warnings() = %q, want %q", gotWarnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func Test_TraceInference(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		pipe      string
+		wantPorts []string // inferred types of the inputs then outputs of pipe
+		wantErr   string
+	}{
+		{
+			"From stub signature",
+			`module "a"
+stub Mul(a: int, b: int) (c: int)
+pipe Double(x) (y) { y = Mul(x, 2) }
+pipe main() {}
+`,
+			"Double",
+			[]string{"int", "int"},
+			"",
+		},
+		{
+			"From call site",
+			`module "a"
+stub Print(s: string)
+pipe Id(x) (y) { y = x }
+pipe main() { Print(Id("a")) }
+`,
+			"Id",
+			[]string{"string", "string"},
+			"",
+		},
+		{
+			"Through merge",
+			`module "a"
+stub Print(s: float)
+pipe Both(a, b) (c) { c = merge(a, b) }
+pipe main() { Print(Both(1.5, 2.5)) }
+`,
+			"Both",
+			[]string{"float", "float", "float"},
+			"",
+		},
+		{
+			"Pipe literal",
+			`module "a"
+stub Map(in: int, f: pipe(x: int) (y: int)) (out: int)
+stub Print(s: int)
+pipe main() { Print(Map(1, pipe(x) (y) { y = x })) }
+`,
+			"main",
+			nil,
+			"",
+		},
+		{
+			"Conflicting uses",
+			`module "a"
+stub B(a: string)
+stub C(a: int)
+pipe P(x) { B(x); C(x) }
+pipe main() {}
+`,
+			"",
+			nil,
+			"4:19: type mismatch: got string, expected int, input x of P is string because of input a of B (4:13)",
+		},
+		{
+			"Conflicting call sites",
+			`module "a"
+stub Print(s: int)
+pipe Id(x) (y) { y = x }
+pipe main() { Print(Id(1)); Print(Id(1.5)) }
+`,
+			"",
+			nil,
+			"4:35: type mismatch: got float, expected int, input x of Id is int because of literal 1 (4:21)",
+		},
+		{
+			"Cannot infer",
+			`module "a"
+pipe Id(x) (y) { y = x }
+pipe main() {}
+`,
+			"",
+			nil,
+			"2:9: cannot infer type of input x of Id, add a type annotation",
+		},
+		{
+			"Untyped pipe type",
+			`module "a"
+stub Map(in: int, f: pipe(x) (y: int)) (out: int)
+pipe main() {}
+`,
+			"",
+			nil,
+			"2:27: missing type for x of pipe type",
+		},
+		{
+			"Interpolated",
+			`module "a"
+stub Print(s: string)
+pipe Show(x) { Print("${x}") }
+pipe main() { Show(2) }
+`,
+			"Show",
+			[]string{"int"},
+			"",
+		},
+		{
+			"Interpolated pipe",
+			`module "a"
+stub Print(s: string)
+pipe Show(x) { Print("${x}") }
+pipe main() { Show(main) }
+`,
+			"",
+			nil,
+			"3:25: cannot interpolate value of type pipe() (), expected string, int or float",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer()
+			module, err := tr.TraceModule(&file, []byte(tt.src))
+			if tt.wantErr != "" {
+				list, _ := err.(token.ErrorList)
+				for _, e := range list {
+					if e.Error() == tt.wantErr {
+						return
+					}
+				}
+				t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.pipe == "" {
+				return
+			}
+
+			pipe := module.Lookup(tt.pipe).(*ast.PipeDecl)
+			var gotPorts []string
+			for _, typ := range append(pipe.BodyDAG.Root.InPorts(), pipe.BodyDAG.Root.OutPorts()...) {
+				gotPorts = append(gotPorts, string(typ))
+			}
+			if !reflect.DeepEqual(gotPorts, tt.wantPorts) {
+				t.Errorf("inferred ports = %v, want %v", gotPorts, tt.wantPorts)
+			}
+			for _, edge := range pipe.BodyDAG.Edges {
+				if edge.Type.HasVars() {
+					t.Errorf("edge %v has uninferred type %v", encodeEdge(edge, pipe.BodyDAG), edge.Type)
+				}
+			}
+		})
+	}
+}
+
+func Test_TraceConversions(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantEdges  []string
+		wantErr    string
+	}{
+		{
+			"Int widens to float",
+			`module "a"
+stub B(a: float)
+pipe main() { B(1) }
+`,
+			[]string{"1", "B*", "float"},
+			[]string{"1[0]->float[0]", "float[0]->B*[0]"},
+			"",
+		},
+		{
+			"Scalar widens to string",
+			`module "a"
+pipe main() (out: string) { out = 2.5 }
+`,
+			[]string{"2.5", "string"},
+			[]string{"2.5[0]->string[0]", "string[0]->main[0]"},
+			"",
+		},
+		{
+			"Explicit conversion",
+			`module "a"
+stub B(a: int)
+pipe main() { B(int("12")) }
+`,
+			[]string{"12", "int", "B*"},
+			[]string{"12[0]->int[0]", "int[0]->B*[0]"},
+			"",
+		},
+		{
+			"Float does not narrow to int",
+			`module "a"
+stub B(a: int)
+pipe main() { B(1.5) }
+`,
+			nil,
+			nil,
+			"3:15: type mismatch: got float, expected int",
+		},
+		{
+			"String does not widen to float",
+			`module "a"
+stub B(a: float)
+pipe main() { B("1") }
+`,
+			nil,
+			nil,
+			"3:15: type mismatch: got string, expected float",
+		},
+		{
+			"Convert pipe",
+			`module "a"
+stub B(a: string)
+pipe main() { B(string(main)) }
+`,
+			nil,
+			nil,
+			"3:24: cannot convert value of type pipe() () to string",
+		},
+		{
+			"Convert many",
+			`module "a"
+stub B(a: int)
+pipe main() { B(int(1, 2)) }
+`,
+			nil,
+			nil,
+			"3:17: int takes exactly one argument, got 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			module, err := NewTracer().TraceModule(&file, []byte(tt.src))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			graph := module.Lookup("main").(*ast.PipeDecl).BodyDAG
+			if got := encodeBlocks(graph.Blocks); !reflect.DeepEqual(got, tt.wantBlocks) {
+				t.Errorf("got blocks %v, want %v", got, tt.wantBlocks)
+			}
+			if got := encodeEdges(graph); !reflect.DeepEqual(got, tt.wantEdges) {
+				t.Errorf("got edges %v, want %v", got, tt.wantEdges)
+			}
+		})
+	}
+}
+
+func Test_TraceDefaults(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantBlocks []string
+		wantEdges  []string
+		wantErr    string
+	}{
+		{
+			"Left out input",
+			`module "a"
+stub B(a: int, b: int = 10)
+pipe main() { B(1) }
+`,
+			[]string{"1", "10", "B*"},
+			[]string{"1[0]->B*[0]", "10[0]->B*[1]"},
+			"",
+		},
+		{
+			"Given input",
+			`module "a"
+stub B(a: int, b: int = 10)
+pipe main() { B(b: 2, a: 1) }
+`,
+			[]string{"2", "1", "B*"},
+			[]string{"1[0]->B*[0]", "2[0]->B*[1]"},
+			"",
+		},
+		{
+			"Widened default",
+			`module "a"
+stub B(a: float = 1)
+pipe main() { B() }
+`,
+			[]string{"1", "B*", "float"},
+			[]string{"1[0]->float[0]", "float[0]->B*[0]"},
+			"",
+		},
+		{
+			"Mismatched default",
+			`module "a"
+stub B(a: int = "x")
+pipe main() { B() }
+`,
+			nil,
+			nil,
+			"2:17: cannot use string value as default of a: int",
+		},
+		{
+			"Default on output",
+			`module "a"
+stub B() (a: int = 1)
+pipe main() { B() }
+`,
+			nil,
+			nil,
+			"2:18: a cannot have a default value, only inputs of pipes and stubs can",
+		},
+		{
+			"Default in pipe type",
+			`module "a"
+stub B(f: pipe(x: int = 1))
+pipe main() { B(main) }
+`,
+			nil,
+			nil,
+			"2:23: x cannot have a default value, only inputs of pipes and stubs can",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			module, err := NewTracer().TraceModule(&file, []byte(tt.src))
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			graph := module.Lookup("main").(*ast.PipeDecl).BodyDAG
+			if got := encodeBlocks(graph.Blocks); !reflect.DeepEqual(got, tt.wantBlocks) {
+				t.Errorf("got blocks %v, want %v", got, tt.wantBlocks)
+			}
+			if got := encodeEdges(graph); !reflect.DeepEqual(got, tt.wantEdges) {
+				t.Errorf("got edges %v, want %v", got, tt.wantEdges)
+			}
+		})
+	}
+}
+
+func Test_TraceRedefinitions(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		wantErr      string
+		wantWarnings []string
+	}{
+		{
+			"Duplicate pipe",
+			`module "a"
+pipe A() {}
+stub A(x: int)
+pipe main() {}
+`,
+			"3:6: A redeclared in this module, first declared at 2:6",
+			nil,
+		},
+		{
+			"Duplicate port",
+			`module "a"
+pipe A(x: int, y: int) (x: int) { x = y }
+pipe main() {}
+`,
+			"2:25: duplicate name x, first declared at 2:8",
+			nil,
+		},
+		{
+			"Duplicate pipe type port",
+			`module "a"
+stub Map(f: pipe(x: int, x: int) (y: int))
+pipe main() {}
+`,
+			"2:26: duplicate name x, first declared at 2:18",
+			nil,
+		},
+		{
+			"Duplicate record field",
+			`module "a"
+stub Pos() (pos: {x: int, x: float})
+pipe main() {}
+`,
+			"2:27: duplicate name x, first declared at 2:19",
+			nil,
+		},
+		{
+			"Duplicate import",
+			`module "a"
+import "b/x"
+import "x"
+pipe main() {}
+`,
+			"3:8: x is already imported at 2:8",
+			nil,
+		},
+		{
+			"Rebinding",
+			`module "a"
+stub B(a: int)
+pipe main() {
+	x = 1
+	x = 2
+	B(x)
+}
+`,
+			"5:2: x is already defined at 4:2",
+			nil,
+		},
+		{
+			"Rebinding input",
+			`module "a"
+stub B(a: int)
+pipe P(x: int) {
+	x = 2
+	B(x)
+}
+pipe main() {}
+`,
+			"4:2: x is already defined at 3:8",
+			nil,
+		},
+		{
+			"Rebinding in tuple",
+			`module "a"
+stub C() (c1: int, c2: int)
+stub B(a: int)
+pipe main() { a, a = C(); B(a) }
+`,
+			"4:18: a is already defined at 4:15",
+			nil,
+		},
+		{
+			"Shadowing",
+			`module "a"
+stub B(a: int)
+stub C(a: int, b: int)
+pipe main() {
+	B = 1
+	merge = 2
+	C(B, merge)
+}
+`,
+			"",
+			[]string{"5:2: B shadows B declared at 2:6", "6:2: merge shadows the built-in merge"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer()
+			tr.WarnShadow = true
+			_, err := tr.TraceModule(&file, []byte(tt.src))
+			if tt.wantErr != "" {
+				list, _ := err.(token.ErrorList)
+				for _, e := range list {
+					if e.Error() == tt.wantErr {
+						return
+					}
+				}
+				t.Fatalf("TraceModule() err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotWarnings []string
+			for _, w := range tr.Warnings() {
+				gotWarnings = append(gotWarnings, w.Error())
+			}
+			if !reflect.DeepEqual(gotWarnings, tt.wantWarnings) {
+				t.Errorf("Warnings() = %q, want %q", gotWarnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func Test_TraceDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // Detail of the first error, or of the first warning if there are no errors
+	}{
+		{
+			"Unknown pipe",
+			`module "a"
+stub Filter(x: int)
+pipe main() {
+	Fitler(1)
+}
+`,
+			"4:2: error[unknown-name]: unable to find local pipe or stub with name Fitler\n" +
+				"\tfix: did you mean Filter?\n" +
+				"\t\t4:2: replace to 4:8 with \"Filter\"",
+		},
+		{
+			"Unknown symbol",
+			`module "a"
+stub B(x: int)
+pipe main() {
+	count = 1
+	B(cuont)
+}
+`,
+			"5:4: error[unknown-name]: no symbol found with name cuont\n" +
+				"\tfix: did you mean count?\n" +
+				"\t\t5:4: replace to 5:9 with \"count\"",
+		},
+		{
+			"Type mismatch",
+			`module "a"
+stub B(a: int)
+pipe main() {
+	B(1.5)
+}
+`,
+			"4:2: error[type-mismatch]: type mismatch: got float, expected int\n" +
+				"\t2:8: input a of B is declared here\n" +
+				"\tfix: convert to int with int()\n" +
+				"\t\t4:4: insert \"int(\"\n" +
+				"\t\t4:7: insert \")\"",
+		},
+		{
+			"Inference conflict",
+			`module "a"
+stub B(a: string)
+stub C(a: float)
+pipe P(x) { B(x) C(x) }
+pipe main() { P("a") }
+`,
+			"4:18: error[type-mismatch]: type mismatch: got string, expected float, input x of P is string because of input a of B (4:13)\n" +
+				"\t4:13: input x of P is string because of input a of B",
+		},
+		{
+			"Missing argument",
+			`module "a"
+stub B(a: int, b: int)
+pipe main() {
+	B(a: 1)
+}
+`,
+			"4:2: error[missing-argument]: missing argument for input b of B\n" +
+				"\t2:16: input b of B is declared here",
+		},
+		{
+			"Redefined",
+			`module "a"
+stub B(a: int)
+pipe main() {
+	x = 1
+	x = 2
+	B(x)
+}
+`,
+			"5:2: error[redefined]: x is already defined at 4:2\n" +
+				"\t4:2: first declared here",
+		},
+		{
+			"Impure call",
+			`module "a"
+stub B(a: int) (b: int)
+pure pipe P(a: int) (b: int) { b = B(a) }
+pure stub C(a: int)
+pipe main() { C(P(1)) }
+`,
+			"3:36: error[impure-call]: pure pipe P calls B, which is not pure\n" +
+				"\t2:6: B is declared here",
+		},
+		{
+			"Unused symbol",
+			`module "a"
+pipe main() {
+	x = 1
+}
+`,
+			"3:2: warning[unused-symbol]: x is assigned but never used\n" +
+				"\tfix: discard the value with _\n" +
+				"\t\t3:2: replace to 3:3 with \"_\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := token.NewFile("", len(tt.src))
+			tr := NewTracer()
+			_, err := tr.TraceModule(&file, []byte(tt.src))
+			list, _ := err.(token.ErrorList)
+			if len(list) == 0 {
+				list = tr.Warnings()
+			}
+			if len(list) == 0 {
+				t.Fatalf("TraceModule() reported nothing, want %v", tt.want)
+			}
+			if got := list[0].Detail(); got != tt.want {
+				t.Errorf("Detail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}